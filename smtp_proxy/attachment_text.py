@@ -0,0 +1,278 @@
+"""Text extraction from attachments for search, run in a background pool."""
+
+from concurrent.futures import ThreadPoolExecutor
+import logging
+import re
+import time
+import zlib
+
+from .config import AttachmentIndexConfig
+from .database.email_repository import EmailRepository
+from .extract import attachment_payloads
+from .models import AttachmentText
+
+logger = logging.getLogger(__name__)
+
+STATUS_INDEXED = "indexed"
+STATUS_SKIPPED = "skipped"  # Type not supported or not enabled
+STATUS_TOO_LARGE = "too_large"
+STATUS_FAILED = "failed"
+STATUS_TIMEOUT = "timeout"
+
+PDF_STREAM = re.compile(rb"<<((?:(?!>>\s*stream).)*?)>>\s*stream\r?\n", re.DOTALL)
+PDF_TOKEN = re.compile(
+    rb"\((?:\\.|[^\\()]|\((?:\\.|[^\\()])*\))*\)"  # String, one level of nested parens
+    rb"|<[0-9A-Fa-f\s]*>"  # Hex string
+    rb"|\[|\]"
+    rb"|/[^\s/\[\]()<>]+"  # Name
+    rb"|[^\s/\[\]()<>]+",  # Number or operator
+    re.DOTALL,
+)
+PDF_ESCAPES = {b"n": b"\n", b"r": b"\r", b"t": b"\t", b"b": b"\b", b"f": b"\f"}
+# Operators that move to a new line of text
+PDF_LINE_OPERATORS = {b"Td", b"TD", b"T*", b"ET", b"'", b'"'}
+# TJ adjustments wider than this (thousandths of an em) are gaps between words
+PDF_WORD_GAP = 200
+
+
+class ExtractionTimeout(Exception):
+    """Raised when extraction runs past its deadline."""
+
+
+def attachment_kind(content_type: str, filename: str) -> str | None:
+    """Classify an attachment as "text", "csv" or "pdf", or None if unsupported."""
+    name = filename.lower()
+    if content_type in ("text/csv", "application/csv") or name.endswith(".csv"):
+        return "csv"
+    if content_type == "application/pdf" or name.endswith(".pdf"):
+        return "pdf"
+    if content_type.startswith("text/"):
+        return "text"
+    return None
+
+
+def extract_text(
+    attachment: dict, payload: bytes, charset: str, config: AttachmentIndexConfig, index: int = 0
+) -> AttachmentText:
+    """Extract searchable text from one attachment within the configured limits."""
+    result = AttachmentText(
+        index=index,
+        filename=attachment.get("filename", ""),
+        content_type=attachment.get("content_type", ""),
+        status=STATUS_SKIPPED,
+    )
+    kind = attachment_kind(result.content_type, result.filename)
+    if kind not in config.types:
+        return result
+    if len(payload) > config.max_bytes:
+        result.status = STATUS_TOO_LARGE
+        return result
+
+    deadline = time.monotonic() + config.timeout_seconds
+    try:
+        if kind == "pdf":
+            text = pdf_text(payload, deadline, config.max_bytes * 10)
+        else:
+            text = _decode(payload, charset)
+    except ExtractionTimeout:
+        result.status = STATUS_TIMEOUT
+        return result
+    except Exception as e:
+        result.status = STATUS_FAILED
+        result.error = str(e) or type(e).__name__
+        return result
+
+    result.status = STATUS_INDEXED
+    result.text = text[: config.max_chars]
+    return result
+
+
+def _decode(payload: bytes, charset: str) -> str:
+    """Decode text content in its declared charset, falling back to UTF-8."""
+    try:
+        return payload.decode(charset or "utf-8", errors="replace")
+    except LookupError:
+        return payload.decode("utf-8", errors="replace")
+
+
+def pdf_text(data: bytes, deadline: float, max_stream_bytes: int) -> str:
+    """Extract the text layer of a PDF's Flate or uncompressed content streams.
+
+    This covers PDFs whose fonts use single-byte encodings, as most
+    generated reports and invoices do. Text in fonts that need a ToUnicode
+    map is skipped, and a PDF with no extractable text is an error.
+    """
+    if not data.startswith(b"%PDF"):
+        raise ValueError("not a PDF file")
+    if b"/Encrypt" in data:
+        raise ValueError("encrypted PDF")
+
+    lines: list[str] = []
+    for match in PDF_STREAM.finditer(data):
+        if time.monotonic() > deadline:
+            raise ExtractionTimeout()
+        header = match.group(1)
+        if b"/Subtype/Image" in header.replace(b" ", b""):
+            continue
+        end = data.find(b"endstream", match.end())
+        if end < 0:
+            break
+        stream = data[match.end() : end]
+        if b"/FlateDecode" in header:
+            try:
+                stream = zlib.decompressobj().decompress(stream, max_stream_bytes)
+            except zlib.error:
+                continue
+        elif b"/Filter" in header:
+            continue
+        if b"BT" in stream:
+            lines.extend(_content_text(stream, deadline))
+
+    text = "\n".join(line for line in (line.strip() for line in lines) if line)
+    if not text:
+        raise ValueError("no text layer")
+    return text
+
+
+def _content_text(stream: bytes, deadline: float) -> list[str]:
+    """Collect the text shown by a content stream's text operators, one line per move."""
+    lines: list[str] = []
+    line: list[str] = []
+    operands: list[bytes] = []
+    in_array = False
+    for count, match in enumerate(PDF_TOKEN.finditer(stream)):
+        if count % 10000 == 0 and time.monotonic() > deadline:
+            raise ExtractionTimeout()
+        token = match.group()
+        if token == b"[":
+            in_array = True
+            operands = []
+        elif token == b"]":
+            in_array = False
+        elif token[:1] in (b"(", b"<") or in_array or token[:1] == b"/" or _is_number(token):
+            operands.append(token)
+        else:
+            if token in (b"Tj", b"TJ", b"'", b'"'):
+                if token in (b"'", b'"'):
+                    lines.append("".join(line))
+                    line = []
+                for operand in operands:
+                    if operand[:1] == b"(":
+                        line.append(_pdf_string(operand))
+                    elif operand[:1] == b"<":
+                        line.append(_pdf_hex_string(operand))
+                    elif token == b"TJ" and _is_number(operand) and -float(operand) > PDF_WORD_GAP:
+                        line.append(" ")
+            elif token in PDF_LINE_OPERATORS:
+                lines.append("".join(line))
+                line = []
+            operands = []
+    lines.append("".join(line))
+    return lines
+
+
+def _is_number(token: bytes) -> bool:
+    """Check whether a content stream token is a numeric operand."""
+    try:
+        float(token)
+    except ValueError:
+        return False
+    return True
+
+
+def _pdf_string(token: bytes) -> str:
+    """Decode a literal (...) string, resolving escapes."""
+    raw = token[1:-1]
+    out = bytearray()
+    i = 0
+    while i < len(raw):
+        char = raw[i : i + 1]
+        if char != b"\\":
+            out += char
+            i += 1
+            continue
+        following = raw[i + 1 : i + 2]
+        if following in PDF_ESCAPES:
+            out += PDF_ESCAPES[following]
+            i += 2
+        elif following.isdigit():
+            octal = re.match(rb"[0-7]{1,3}", raw[i + 1 : i + 4])
+            if octal:
+                out.append(int(octal.group(), 8) & 0xFF)
+                i += 1 + len(octal.group())
+            else:
+                i += 2
+        elif following in (b"\r", b"\n"):
+            # Line continuation
+            i += 2
+            if following == b"\r" and raw[i : i + 1] == b"\n":
+                i += 1
+        else:
+            out += following
+            i += 2
+    return _pdf_bytes_text(bytes(out))
+
+
+def _pdf_hex_string(token: bytes) -> str:
+    """Decode a <...> string if it holds single-byte text; CID text is skipped."""
+    digits = re.sub(rb"\s", b"", token[1:-1])
+    if len(digits) % 2:
+        digits += b"0"
+    try:
+        data = bytes.fromhex(digits.decode())
+    except ValueError:
+        return ""
+    text = _pdf_bytes_text(data)
+    return text if text.isprintable() else ""
+
+
+def _pdf_bytes_text(data: bytes) -> str:
+    """Decode PDF string bytes, which are UTF-16 with a BOM or a Latin-1 superset."""
+    if data.startswith(b"\xfe\xff"):
+        return data[2:].decode("utf-16-be", errors="replace")
+    return data.decode("latin-1")
+
+
+class AttachmentIndexer:
+    """Extracts attachment text for new emails on a pool of worker threads.
+
+    Extraction happens after the SMTP reply has been sent, so it never
+    delays the client. Each attachment's outcome is stored, including
+    skipped and failed ones, so the UI can show what was not searched.
+    """
+
+    def __init__(self, config: AttachmentIndexConfig, email_repo: EmailRepository):
+        self.config = config
+        self.email_repo = email_repo
+        self._executor = ThreadPoolExecutor(
+            max_workers=config.workers, thread_name_prefix="attachment-index"
+        )
+
+    def submit(self, email_id: int, raw_message: bytes) -> None:
+        """Queue an email's attachments for extraction."""
+        self._executor.submit(self._index, email_id, raw_message)
+
+    def _index(self, email_id: int, raw_message: bytes) -> None:
+        """Extract and store the text of every attachment of one email."""
+        try:
+            results = [
+                extract_text(attachment, payload, charset, self.config, index)
+                for index, (attachment, payload, charset) in enumerate(
+                    attachment_payloads(raw_message)
+                )
+            ]
+            if results:
+                self.email_repo.add_attachment_texts(email_id, results)
+        except Exception as e:
+            logger.error(f"Failed to index attachments of email {email_id}: {e}")
+            return
+        for result in results:
+            if result.status in (STATUS_FAILED, STATUS_TIMEOUT):
+                logger.warning(
+                    f"Could not extract text from {result.filename or 'attachment'} "
+                    f"of email {email_id}: {result.error or result.status}"
+                )
+
+    def shutdown(self) -> None:
+        """Stop the workers, dropping queued emails."""
+        self._executor.shutdown(wait=False, cancel_futures=True)
@@ -2,7 +2,15 @@
 
 from dataclasses import dataclass, field
 from pathlib import Path
+import hmac
+import ipaddress
 import json
+import re
+import socket
+
+import bcrypt
+
+from .senders import sender_pattern_error
 
 
 @dataclass
@@ -11,14 +19,140 @@ class TLSConfig:
     enabled: bool = False
     cert_file: str = "certs/server.crt"
     key_file: str = "certs/server.key"
+    min_version: str = "1.2"  # Lowest TLS version STARTTLS negotiates: "1.0" to "1.3"
+    require: str = "off"  # Refuse MAIL before STARTTLS: "off", "all" or "unauthenticated" sessions
+
+
+TLS_VERSIONS = ("1.0", "1.1", "1.2", "1.3")
+TLS_REQUIREMENTS = ("off", "all", "unauthenticated")
+
+
+@dataclass
+class SMTPCredential:
+    """One username and password accepted by SMTP AUTH.
+
+    The password is given either in plaintext or as a bcrypt hash.
+    """
+    username: str = ""
+    password: str = ""
+    password_hash: str = ""  # bcrypt, from `hash-password`
+    allowed_senders: list[str] = field(default_factory=list)  # MAIL FROM allowlist; empty: any
+    max_messages_per_day: int = 0  # Counted per UTC day; 0 is unlimited
+
+    def matches(self, password: str) -> bool:
+        """Check a password against this credential."""
+        if self.password_hash:
+            try:
+                return bcrypt.checkpw(password.encode(), self.password_hash.encode())
+            except ValueError:
+                return False
+        return hmac.compare_digest(self.password.encode(), password.encode())
 
 
 @dataclass
 class AuthConfig:
-    """SMTP authentication configuration."""
+    """SMTP authentication configuration.
+
+    username and password are the original single credential and are
+    checked alongside the users list, so either form works on its own.
+    """
     required: bool = True
     username: str = "mailuser"
     password: str = "mailpass"
+    password_hash: str = ""  # bcrypt alternative to password
+    allowed_senders: list[str] = field(default_factory=list)  # Of username; empty allows any
+    max_messages_per_day: int = 0  # Of username; 0 is unlimited
+    users: list[SMTPCredential] = field(default_factory=list)
+    mechanisms: list[str] = field(default_factory=lambda: ["PLAIN", "LOGIN"])
+    use_web_users: bool = False  # Check PLAIN and LOGIN against web UI users instead of the above
+
+    def credentials(self) -> list[SMTPCredential]:
+        """Return every accepted credential, the single pair first.
+
+        None are accepted while use_web_users is set, which replaces them.
+        """
+        if self.use_web_users:
+            return []
+        single = (
+            [
+                SMTPCredential(
+                    self.username,
+                    self.password,
+                    self.password_hash,
+                    self.allowed_senders,
+                    self.max_messages_per_day,
+                )
+            ]
+            if self.username
+            else []
+        )
+        return single + self.users
+
+    def credential_for(self, username: str) -> SMTPCredential | None:
+        """Return the credential of a username, or None if it is unknown."""
+        for credential in self.credentials():
+            if credential.username == username:
+                return credential
+        return None
+
+    def offered_mechanisms(self) -> list[str]:
+        """Return the AUTH mechanisms to offer, upper-cased.
+
+        CRAM-MD5 is left out when no configured credential has a plaintext
+        password, as it has no other secret to check a response against.
+        """
+        mechanisms = [m.upper() for m in self.mechanisms]
+        if not any(credential.password for credential in self.credentials()):
+            mechanisms = [m for m in mechanisms if m != "CRAM-MD5"]
+        return mechanisms
+
+    def password_for(self, username: str) -> str | None:
+        """Return the plaintext password of a username, or None if it is unknown or hashed."""
+        credential = self.credential_for(username)
+        return credential.password if credential and credential.password else None
+
+    def check(self, username: str, password: str) -> bool:
+        """Check a username and password against the configured credentials."""
+        credential = self.credential_for(username)
+        return credential is not None and credential.matches(password)
+
+
+@dataclass
+class UpstreamConfig:
+    """Upstream SMTP server that received mail is relayed to."""
+    host: str = ""
+    port: int = 25
+    starttls: bool = False  # Upgrade a plain connection with STARTTLS
+    implicit_tls: bool = False  # Connect with TLS from the start, usually port 465
+    username: str = ""  # Empty skips AUTH
+    password: str = ""
+    timeout_seconds: int = 30
+    local_address: str = ""  # Source IP to connect from; "" uses smtp.relay.local_address
+
+
+@dataclass
+class RelayRoute(UpstreamConfig):
+    """Upstream server for recipients in matching domains."""
+    domain: str = ""  # Exact domain, or "*.example.com" for any subdomain
+
+
+@dataclass
+class RelayConfig:
+    """Relay of received mail to the upstream server."""
+    enabled: bool = False  # False only stores mail
+    local_address: str = ""  # Source IP of upstream connections; "" lets the OS choose
+    routes: list[RelayRoute] = field(default_factory=list)  # Checked in order before the default upstream
+
+
+@dataclass
+class TrustedNetwork:
+    """Network whose clients are treated as authenticated without SMTP AUTH."""
+    network: str = ""
+    name: str = ""
+
+    def __post_init__(self):
+        if not self.name:
+            self.name = self.network
 
 
 @dataclass
@@ -27,19 +161,78 @@ class SMTPConfig:
     host: str = "0.0.0.0"
     port: int = 2525
     domain: str = "localhost"
-    read_timeout_seconds: int = 10
+    read_timeout_seconds: int = 10  # For each AUTH response and DATA line
     write_timeout_seconds: int = 10
+    idle_timeout_seconds: int = 0  # For each command; 0 uses read_timeout_seconds
+    max_session_seconds: int = 1800  # Sessions are closed with a 421 after this; 0 disables
+    min_data_rate_bytes_per_second: int = 0  # Slower DATA is closed with a 421; 0 disables
+    data_rate_grace_seconds: int = 10  # DATA time before the rate is checked
     max_message_bytes: int = 10485760  # 10MB
     max_recipients: int = 50
     allow_insecure_auth: bool = True
+    shutdown_drain_seconds: int = 10
+    announce_shutdown: bool = True
+    shutdown_message: str = "Service shutting down, try again later"  # Text of the draining 421
+    duplicate_mail: str = "reset"  # "reset" or "reject" a second MAIL FROM
+    skip_duplicates_within_seconds: int = 0  # 0 stores every copy
+    normalize_line_endings: bool = True  # False stores the raw bytes exactly as received
+    early_talker_action: str = "off"  # "off", "log", "delay" or "reject" clients that talk before the banner
+    early_talker_wait_ms: int = 500  # How long to watch for input before sending the banner
+    early_talker_delay_seconds: int = 10  # Extra banner delay for the "delay" action
+    smuggling_protection: str = "normalize"  # "off", "normalize" or "reject" end-of-data without CRLF.CRLF
+    subaddress_separators: str = "+"  # Each character starts a recipient tag; "" disables sub-addressing
     tls: TLSConfig = field(default_factory=TLSConfig)
     auth: AuthConfig = field(default_factory=AuthConfig)
+    trusted_networks: list[TrustedNetwork] = field(default_factory=list)
+    upstream: UpstreamConfig = field(default_factory=UpstreamConfig)
+    relay: RelayConfig = field(default_factory=RelayConfig)
 
     @property
     def address(self) -> str:
         return f"{self.host}:{self.port}"
 
 
+@dataclass
+class AuthProviderConfig:
+    """Source of web users, tried in list order at login."""
+    type: str = "database"  # "database" or "htpasswd"
+    path: str = ""  # htpasswd file of username:bcrypt-hash lines
+    role: str = "admin"  # Role of htpasswd users; database users each have their own
+
+
+AUTH_PROVIDER_TYPES = ("database", "htpasswd")
+
+# Admins can change and delete things; viewers can only read emails
+USER_ROLES = ("admin", "viewer")
+
+PASSWORD_HASH_ALGORITHMS = ("bcrypt", "argon2id")
+
+# bcrypt's log2 work factor: each step doubles the time a hash takes
+BCRYPT_MIN_COST = 4
+BCRYPT_MAX_COST = 31
+
+SMTP_AUTH_MECHANISMS = ("PLAIN", "LOGIN", "CRAM-MD5")
+
+ACCESS_LOG_FORMATS = ("text", "json", "off")
+
+# What web.base_path may look like once normalized: /mailproxy or
+# /tools/mailproxy, with characters that need no escaping in URLs, HTML
+# or JavaScript strings
+BASE_PATH_PATTERN = re.compile(r"(/[A-Za-z0-9._~-]+)+")
+
+# Largest page of the email list, whether configured or asked for
+MAX_PAGE_SIZE = 500
+
+
+@dataclass
+class WebTLSConfig:
+    """HTTPS for the web UI."""
+    enabled: bool = False
+    cert_file: str = "certs/server.crt"
+    key_file: str = "certs/server.key"
+    redirect_port: int = 0  # Plain HTTP port that redirects to HTTPS; 0 disables
+
+
 @dataclass
 class WebConfig:
     """Web server configuration."""
@@ -47,16 +240,78 @@ class WebConfig:
     port: int = 8080
     session_secret: str = "change-this-to-32-byte-secret!!"
     session_name: str = "smtp_proxy_session"
+    session_max_age_seconds: int = 86400  # Sessions end this long after sign-in
+    session_idle_timeout_seconds: int = 0  # End sessions idle this long; 0 disables
+    magic_login: bool = False  # Development only: log a one-time login link at startup
+    magic_login_allow_remote: bool = False  # Permit magic_login on a non-loopback host
+    preview_marks_read: bool = True  # Opening an email in the list's preview pane marks it read
+    request_timeout_seconds: float = 15.0  # 0 disables; streaming downloads are exempt
+    max_body_bytes: int = 1024 * 1024
+    max_upload_bytes: int = 10 * 1024 * 1024  # Settings imports
+    access_log: str = "text"  # Request log lines: "text", "json" or "off"
+    base_path: str = ""  # URL prefix the UI is served under behind a proxy, such as /mailproxy
+    templates_dir: str = ""  # Templates here replace the built-in ones of the same name
+    page_size: int = 50  # Emails per page of the list, unless ?per_page= asks for another
+    login_max_failures: int = 5  # Failed sign-ins per client or username in the window; 0 disables
+    login_window_seconds: int = 60
+    trusted_proxies: list[str] = field(default_factory=list)  # CIDRs trusted for X-Forwarded-For
+    behind_proxy: bool = False  # Take the request scheme from X-Forwarded-Proto
+    cookie_secure: bool = False  # Always mark session cookies Secure, not only on HTTPS requests
+    lockout_failures: int = 10  # Consecutive failed sign-ins that lock a username; 0 disables
+    lockout_minutes: int = 15
+    login_attempt_retention_days: int = 90  # 0 keeps failed sign-ins forever
+    tls: WebTLSConfig = field(default_factory=WebTLSConfig)
+    password_hash: str = "bcrypt"  # Algorithm for new web user passwords: "bcrypt" or "argon2id"
+    bcrypt_cost: int = 12  # Lower speeds up test runs, higher suits internet-facing deployments
+    argon2_memory_kib: int = 65536
+    argon2_iterations: int = 3
+    auth_providers: list[AuthProviderConfig] = field(
+        default_factory=lambda: [AuthProviderConfig()]
+    )
 
     @property
     def address(self) -> str:
         return f"{self.host}:{self.port}"
 
+    @property
+    def scheme(self) -> str:
+        return "https" if self.tls.enabled else "http"
+
+    @property
+    def is_loopback(self) -> bool:
+        """Check whether the web listener is bound to a loopback address."""
+        if self.host == "localhost":
+            return True
+        try:
+            return ipaddress.ip_address(self.host).is_loopback
+        except ValueError:
+            return False
+
 
 @dataclass
 class DatabaseConfig:
     """Database configuration."""
     path: str = "./data/smtp_proxy.db"
+    aggregate_cache: bool = True
+    aggregate_cache_ttl_seconds: int = 30
+    probe_interval_seconds: int = 5  # How often to retry storage while it is unavailable
+    journal_retention_days: int = 30  # 0 keeps the change journal forever
+    replica_path: str = ""  # Directory for warm standby snapshots; "" disables replication
+    replica_interval_seconds: int = 60
+    replica_keep: int = 3  # Snapshots retained in replica_path
+    max_total_bytes: int = 0  # Stored size above which SMTP answers 452; 0 is unlimited
+    max_emails: int = 0  # Stored emails above which SMTP answers 452; 0 is unlimited
+    compress_raw: bool = False  # Gzip new raw messages before storing them
+
+
+@dataclass
+class StorageConfig:
+    """Where raw messages are kept."""
+    mode: str = "blob"  # "blob" stores raw messages in the database, "files" under dir
+    dir: str = "./data/messages"  # Content-addressed raw message files
+
+
+STORAGE_MODES = ("blob", "files")
 
 
 @dataclass
@@ -64,6 +319,109 @@ class AdminConfig:
     """Admin user configuration."""
     username: str = "admin"
     password: str = "changeme"
+    disabled: bool = False
+    force_password: bool = False
+
+
+@dataclass
+class ResponderConfig:
+    """Synthesized reply to mail for matching recipients."""
+    name: str = ""
+    recipient_pattern: str = ""  # Regex matched against each envelope recipient
+    action: str = "accept"  # "hard_bounce", "soft_bounce", "out_of_office" or "accept"
+    status: str = ""  # Enhanced status code for bounces; defaults to 5.1.1 (hard) or 4.2.2 (soft)
+    delay_seconds: int = 0  # Wait before generating the response
+    subject: str = ""  # Out-of-office subject; defaults to "Out of Office: <subject>"
+    message: str = ""  # Out-of-office body or bounce diagnostic text
+    max_per_minute: int = 10  # Responses generated per minute before the rest are dropped
+
+
+RESPONDER_ACTIONS = ("hard_bounce", "soft_bounce", "out_of_office", "accept")
+
+
+@dataclass
+class AttachmentIndexConfig:
+    """Background text extraction from attachments for search."""
+    types: list[str] = field(default_factory=list)  # Any of "text", "csv" and "pdf"; empty disables
+    max_bytes: int = 5242880  # Larger attachments are skipped
+    max_chars: int = 200000  # Extracted text beyond this is dropped
+    timeout_seconds: int = 10  # Per attachment
+    workers: int = 2
+
+
+ATTACHMENT_INDEX_TYPES = ("text", "csv", "pdf")
+
+
+@dataclass
+class CryptoConfig:
+    """Keys for verifying and decrypting S/MIME and PGP/MIME mail."""
+    smime_ca_file: str = ""  # PEM bundle of trusted S/MIME issuers
+    smime_key_file: str = ""  # PEM private key; empty leaves S/MIME mail encrypted
+    pgp_public_keys: str = ""  # Public keys of trusted PGP signers
+    pgp_secret_key: str = ""  # Secret key; empty leaves PGP mail encrypted
+    passphrase_file: str = ""  # File holding the passphrase of the private keys
+    persist_decrypted: bool = False  # Store decrypted bodies instead of keeping them in memory
+    timeout_seconds: int = 10
+
+
+@dataclass
+class PrivacyConfig:
+    """How much of each message's content is stored."""
+    store_body: bool = True  # False stores metadata only; requires store_raw false
+    store_raw: bool = True
+    hash_subject: bool = False  # Store a SHA-256 of the subject instead of its text
+    scrub_patterns: list[str] = field(default_factory=list)  # Regexes masked in stored content
+    scrub_replacement: str = "[redacted]"
+
+
+@dataclass
+class SIEMConfig:
+    """Export of audit events to an external collector."""
+    enabled: bool = False
+    transport: str = "udp"  # "udp" or "tcp" syslog (RFC 5424), or "https"
+    host: str = ""  # Syslog collector
+    port: int = 514
+    url: str = ""  # HTTPS bulk endpoint, sent newline-delimited JSON
+    token: str = ""  # Bearer token for the HTTPS endpoint
+    ca_file: str = ""  # CA bundle for the collector's certificate; empty uses the system store
+    app_name: str = "smtp-proxy"
+    batch_size: int = 100
+    interval_seconds: int = 10
+    timeout_seconds: int = 10
+    max_backoff_seconds: int = 300  # Longest wait between retries while the collector is down
+
+
+SIEM_TRANSPORTS = ("udp", "tcp", "https")
+
+# Hosts of common email open and click trackers
+DEFAULT_TRACKER_DOMAINS = [
+    "list-manage.com",
+    "sendgrid.net",
+    "mandrillapp.com",
+    "mailchimp.com",
+    "hubspotemail.net",
+    "hs-analytics.net",
+    "exct.net",
+    "rs6.net",
+    "mailtrack.io",
+    "yesware.com",
+    "mixmax.com",
+    "sparkpostmail.com",
+    "mailgun.org",
+    "pstmrk.it",
+    "google-analytics.com",
+]
+
+
+@dataclass
+class TrackingConfig:
+    """Detection of open-tracking and read receipt requests in received mail."""
+    enabled: bool = True
+    # Remote content from these domains or their subdomains is flagged
+    tracker_domains: list[str] = field(default_factory=lambda: list(DEFAULT_TRACKER_DOMAINS))
+
+
+COMPONENTS = ("all", "smtp", "web")
 
 
 @dataclass
@@ -72,7 +430,19 @@ class Config:
     smtp: SMTPConfig = field(default_factory=SMTPConfig)
     web: WebConfig = field(default_factory=WebConfig)
     database: DatabaseConfig = field(default_factory=DatabaseConfig)
-    admin: AdminConfig = field(default_factory=AdminConfig)
+    admin: AdminConfig | None = field(default_factory=AdminConfig)
+    instance_id: str = field(default_factory=socket.gethostname)
+    read_only: bool = False
+    dev: bool = False  # Set by --dev: reload templates and log verbosely
+    responders: list[ResponderConfig] = field(default_factory=list)
+    attachment_index: AttachmentIndexConfig = field(default_factory=AttachmentIndexConfig)
+    crypto: CryptoConfig = field(default_factory=CryptoConfig)
+    components: str = "all"  # Servers this process runs: "all", "smtp" or "web"
+    background_jobs: bool = True  # Run backfills, journal purge, replication and SIEM export here
+    siem: SIEMConfig = field(default_factory=SIEMConfig)
+    privacy: PrivacyConfig = field(default_factory=PrivacyConfig)
+    tracking: TrackingConfig = field(default_factory=TrackingConfig)
+    storage: StorageConfig = field(default_factory=StorageConfig)
 
     @classmethod
     def load(cls, path: str) -> "Config":
@@ -92,22 +462,60 @@ class Config:
         smtp_data = data.get("smtp", {})
         tls_data = smtp_data.pop("tls", {})
         auth_data = smtp_data.pop("auth", {})
+        users_data = auth_data.pop("users", [])
+        if users_data and "username" not in auth_data:
+            # A users list replaces the default single credential
+            auth_data.update(username="", password="")
+        elif "password_hash" in auth_data and "password" not in auth_data:
+            # A hash replaces the default plaintext password
+            auth_data["password"] = ""
+        trusted_data = smtp_data.pop("trusted_networks", [])
+        upstream_data = smtp_data.pop("upstream", {})
+        relay_data = smtp_data.pop("relay", {})
+        route_data = relay_data.pop("routes", [])
 
         smtp_config = SMTPConfig(
             **smtp_data,
             tls=TLSConfig(**tls_data),
-            auth=AuthConfig(**auth_data),
+            auth=AuthConfig(**auth_data, users=[SMTPCredential(**u) for u in users_data]),
+            trusted_networks=[
+                TrustedNetwork(network=n) if isinstance(n, str) else TrustedNetwork(**n)
+                for n in trusted_data
+            ],
+            upstream=UpstreamConfig(**upstream_data),
+            relay=RelayConfig(**relay_data, routes=[RelayRoute(**r) for r in route_data]),
         )
 
-        web_config = WebConfig(**data.get("web", {}))
+        web_data = data.get("web", {})
+        provider_data = web_data.pop("auth_providers", None)
+        web_tls_data = web_data.pop("tls", {})
+        web_config = WebConfig(**web_data, tls=WebTLSConfig(**web_tls_data))
+        # One leading and no trailing slash, or "" for the root
+        base_path = web_config.base_path.strip().strip("/")
+        web_config.base_path = f"/{base_path}" if base_path else ""
+        if provider_data is not None:
+            web_config.auth_providers = [AuthProviderConfig(**p) for p in provider_data]
         database_config = DatabaseConfig(**data.get("database", {}))
-        admin_config = AdminConfig(**data.get("admin", {}))
+        # Without an admin block no bootstrap user is managed; startup then
+        # requires at least one user to exist in the database
+        admin_config = AdminConfig(**data["admin"]) if "admin" in data else None
 
         config = cls(
             smtp=smtp_config,
             web=web_config,
             database=database_config,
             admin=admin_config,
+            instance_id=data.get("instance_id") or socket.gethostname(),
+            read_only=data.get("read_only", False),
+            responders=[ResponderConfig(**r) for r in data.get("responders", [])],
+            attachment_index=AttachmentIndexConfig(**data.get("attachment_index", {})),
+            crypto=CryptoConfig(**data.get("crypto", {})),
+            components=data.get("components", "all"),
+            background_jobs=data.get("background_jobs", True),
+            siem=SIEMConfig(**data.get("siem", {})),
+            privacy=PrivacyConfig(**data.get("privacy", {})),
+            tracking=TrackingConfig(**data.get("tracking", {})),
+            storage=StorageConfig(**data.get("storage", {})),
         )
 
         config.validate()
@@ -117,20 +525,333 @@ class Config:
         """Validate the configuration."""
         errors = []
 
+        if self.components not in COMPONENTS:
+            errors.append(f"Components must be one of {', '.join(COMPONENTS)}: {self.components!r}")
+
         if self.smtp.port <= 0 or self.smtp.port > 65535:
             errors.append("SMTP port must be between 1 and 65535")
 
+        if self.smtp.shutdown_drain_seconds < 0:
+            errors.append("SMTP shutdown drain seconds must not be negative")
+
+        message = self.smtp.shutdown_message
+        if not (message.strip() and message.isascii() and message.isprintable()):
+            errors.append("SMTP shutdown message must be one line of printable ASCII text")
+
+        if self.smtp.read_timeout_seconds <= 0 or self.smtp.write_timeout_seconds <= 0:
+            errors.append("SMTP read and write timeouts must be positive")
+
+        for name in (
+            "idle_timeout_seconds",
+            "max_session_seconds",
+            "min_data_rate_bytes_per_second",
+            "data_rate_grace_seconds",
+        ):
+            if getattr(self.smtp, name) < 0:
+                errors.append(f"SMTP {name} must not be negative")
+
+        if self.smtp.duplicate_mail not in ("reset", "reject"):
+            errors.append("SMTP duplicate_mail must be 'reset' or 'reject'")
+
+        if self.smtp.early_talker_action not in ("off", "log", "delay", "reject"):
+            errors.append("SMTP early_talker_action must be 'off', 'log', 'delay' or 'reject'")
+
+        if self.smtp.smuggling_protection not in ("off", "normalize", "reject"):
+            errors.append("SMTP smuggling_protection must be 'off', 'normalize' or 'reject'")
+
+        if any(c in '@"\\<>' or c.isspace() for c in self.smtp.subaddress_separators):
+            errors.append(
+                "SMTP subaddress_separators cannot contain @, quotes, backslashes, "
+                "angle brackets or spaces"
+            )
+
+        for mechanism in self.smtp.auth.mechanisms:
+            if mechanism.upper() not in SMTP_AUTH_MECHANISMS:
+                errors.append(
+                    f"SMTP auth mechanism must be one of {', '.join(SMTP_AUTH_MECHANISMS)}: "
+                    f"{mechanism!r}"
+                )
+        # Every mechanism looks a username up in the SMTP users from the web
+        # UI first; only usernames not stored there fall back to the web UI's
+        # own users with use_web_users, or to the configured credentials
+        # otherwise. PLAIN and LOGIN receive the password and only need a
+        # hash to check it against, but CRAM-MD5 computes an HMAC keyed with
+        # the secret itself, so it can only check configured plaintext
+        # passwords: SMTP users from the web UI are refused it, and it is not
+        # offered at all when no configured credential has a password
+        uses_cram_md5 = "CRAM-MD5" in (m.upper() for m in self.smtp.auth.mechanisms)
+        if uses_cram_md5 and self.smtp.auth.use_web_users:
+            errors.append(
+                "SMTP auth mechanism CRAM-MD5 cannot be used with use_web_users, "
+                "as web user passwords are stored hashed"
+            )
+        elif uses_cram_md5 and any(
+            not credential.password for credential in self.smtp.auth.credentials()
+        ):
+            errors.append(
+                "SMTP auth mechanism CRAM-MD5 requires a plaintext password for every user"
+            )
+
+        seen_usernames = set()
+        for credential in self.smtp.auth.credentials():
+            if not credential.username:
+                errors.append("SMTP auth users require a username")
+            elif credential.username in seen_usernames:
+                errors.append(f"Duplicate SMTP auth username: {credential.username}")
+            seen_usernames.add(credential.username)
+            label = credential.username or "(unnamed)"
+            if credential.password and credential.password_hash:
+                errors.append(f"SMTP auth user {label} must set password or password_hash, not both")
+            elif not credential.password and not credential.password_hash:
+                errors.append(f"SMTP auth user {label} requires a password or password_hash")
+            elif credential.password_hash and not credential.password_hash.startswith("$2"):
+                errors.append(f"SMTP auth user {label} password_hash is not a bcrypt hash")
+            for pattern in credential.allowed_senders:
+                error = sender_pattern_error(pattern)
+                if error:
+                    errors.append(f"SMTP auth user {label}: {error}")
+            if credential.max_messages_per_day < 0:
+                errors.append(f"SMTP auth user {label} max_messages_per_day cannot be negative")
+
+        for trusted in self.smtp.trusted_networks:
+            try:
+                ipaddress.ip_network(trusted.network, strict=False)
+            except ValueError:
+                errors.append(f"Invalid SMTP trusted network: {trusted.network}")
+
+        if self.smtp.relay.enabled:
+            if not self.smtp.upstream.host and not self.smtp.relay.routes:
+                errors.append("SMTP upstream host or relay routes are required when relay is enabled")
+            upstreams = [("SMTP upstream", self.smtp.upstream)] + [
+                (f"SMTP relay route {route.domain}", route) for route in self.smtp.relay.routes
+            ]
+            for label, upstream in upstreams:
+                if upstream.port <= 0 or upstream.port > 65535:
+                    errors.append(f"{label} port must be between 1 and 65535")
+                if upstream.starttls and upstream.implicit_tls:
+                    errors.append(f"{label} cannot use both starttls and implicit_tls")
+                if upstream.timeout_seconds <= 0:
+                    errors.append(f"{label} timeout must be positive")
+            for route in self.smtp.relay.routes:
+                if not route.host:
+                    errors.append(f"SMTP relay route {route.domain} requires a host")
+                if not re.match(r"^(\*\.)?[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*$", route.domain):
+                    errors.append(
+                        f"SMTP relay route domain must be a domain or *.domain: {route.domain!r}"
+                    )
+
+        local_addresses = [
+            ("SMTP relay", self.smtp.relay.local_address),
+            ("SMTP upstream", self.smtp.upstream.local_address),
+        ] + [
+            (f"SMTP relay route {route.domain}", route.local_address)
+            for route in self.smtp.relay.routes
+        ]
+        for label, address in local_addresses:
+            if not address:
+                continue
+            try:
+                ipaddress.ip_address(address)
+            except ValueError:
+                errors.append(f"{label} local_address must be an IP address: {address!r}")
+
         if self.web.port <= 0 or self.web.port > 65535:
             errors.append("Web port must be between 1 and 65535")
 
+        if self.web.request_timeout_seconds < 0:
+            errors.append("Web request_timeout_seconds must not be negative")
+
+        if self.web.max_body_bytes <= 0 or self.web.max_upload_bytes <= 0:
+            errors.append("Web max_body_bytes and max_upload_bytes must be positive")
+        if not 1 <= self.web.page_size <= MAX_PAGE_SIZE:
+            errors.append(f"Web page_size must be between 1 and {MAX_PAGE_SIZE}")
+        if self.web.access_log not in ACCESS_LOG_FORMATS:
+            errors.append(f"Web access_log must be one of {', '.join(ACCESS_LOG_FORMATS)}")
+        if self.web.base_path and not BASE_PATH_PATTERN.fullmatch(self.web.base_path):
+            errors.append(
+                f"Invalid web base_path: {self.web.base_path}; use a path such as /mailproxy"
+            )
+        if self.web.templates_dir and not Path(self.web.templates_dir).is_dir():
+            errors.append(f"Web templates_dir is not a directory: {self.web.templates_dir}")
+        if self.web.session_max_age_seconds <= 0:
+            errors.append("Web session_max_age_seconds must be positive")
+        if self.web.session_idle_timeout_seconds < 0:
+            errors.append("Web session_idle_timeout_seconds must not be negative")
+        # Browsers never send a Secure cookie back over plain HTTP, so
+        # nobody could stay signed in
+        if self.web.cookie_secure and not self.web.behind_proxy and not self.web.tls.enabled:
+            errors.append(
+                "Web cookie_secure requires HTTPS, but the web server serves plain HTTP; "
+                "enable web.tls, or set behind_proxy if a TLS reverse proxy is in front of it"
+            )
+        if self.web.login_max_failures < 0:
+            errors.append("Web login_max_failures must not be negative")
+        if self.web.login_window_seconds <= 0:
+            errors.append("Web login_window_seconds must be positive")
+        if self.web.lockout_failures < 0:
+            errors.append("Web lockout_failures must not be negative")
+        if self.web.lockout_minutes <= 0:
+            errors.append("Web lockout_minutes must be positive")
+        if self.web.password_hash not in PASSWORD_HASH_ALGORITHMS:
+            errors.append(
+                f"Web password_hash must be one of {', '.join(PASSWORD_HASH_ALGORITHMS)}"
+            )
+        if not BCRYPT_MIN_COST <= self.web.bcrypt_cost <= BCRYPT_MAX_COST:
+            errors.append(
+                f"Web bcrypt_cost must be between {BCRYPT_MIN_COST} and {BCRYPT_MAX_COST}"
+            )
+        # Argon2 needs at least 8 KiB per lane, and uses 4 lanes
+        if self.web.argon2_memory_kib < 32 or self.web.argon2_iterations < 1:
+            errors.append(
+                "Web argon2_memory_kib must be at least 32 and argon2_iterations at least 1"
+            )
+        for proxy in self.web.trusted_proxies:
+            try:
+                ipaddress.ip_network(proxy, strict=False)
+            except ValueError:
+                errors.append(f"Invalid web trusted proxy: {proxy}")
+
+        if self.web.magic_login and not self.web.is_loopback and not self.web.magic_login_allow_remote:
+            errors.append(
+                "Web magic_login requires a loopback web host "
+                "(set magic_login_allow_remote to override)"
+            )
+
+        if not self.web.auth_providers:
+            errors.append("At least one web auth provider is required")
+
+        for provider in self.web.auth_providers:
+            if provider.type not in AUTH_PROVIDER_TYPES:
+                errors.append(f"Unknown web auth provider type: {provider.type}")
+            elif provider.type == "htpasswd" and not provider.path:
+                errors.append("Web htpasswd auth provider requires a path")
+            if provider.role not in USER_ROLES:
+                errors.append(f"Unknown web auth provider role: {provider.role}")
+
         if not self.database.path:
             errors.append("Database path is required")
 
-        if not self.admin.username:
-            errors.append("Admin username is required")
-
-        if not self.admin.password:
-            errors.append("Admin password is required")
+        if self.database.probe_interval_seconds <= 0:
+            errors.append("Database probe interval must be positive")
+
+        if self.database.journal_retention_days < 0:
+            errors.append("Database journal retention days must not be negative")
+
+        if self.database.replica_path:
+            if self.database.replica_interval_seconds <= 0:
+                errors.append("Database replica interval must be positive")
+            if self.database.replica_keep < 1:
+                errors.append("Database replica_keep must be at least 1")
+
+        if self.storage.mode not in STORAGE_MODES:
+            errors.append(
+                f"Storage mode must be one of {', '.join(STORAGE_MODES)}: {self.storage.mode!r}"
+            )
+        if not self.storage.dir:
+            errors.append("Storage dir must be set")
+
+        if self.database.max_total_bytes < 0 or self.database.max_emails < 0:
+            errors.append("Database max_total_bytes and max_emails must not be negative")
+
+        if self.admin and not self.admin.disabled:
+            if not self.admin.username:
+                errors.append("Admin username is required")
+
+            if not self.admin.password:
+                errors.append("Admin password is required")
+
+        for responder in self.responders:
+            label = responder.name or responder.recipient_pattern
+            try:
+                re.compile(responder.recipient_pattern)
+            except re.error as e:
+                errors.append(f"Responder {label}: invalid recipient pattern: {e}")
+            if responder.action not in RESPONDER_ACTIONS:
+                errors.append(f"Responder {label}: unknown action {responder.action}")
+            status_class = {"hard_bounce": "5", "soft_bounce": "4"}.get(responder.action)
+            if responder.status and status_class and not re.match(
+                rf"^{status_class}\.\d{{1,3}}\.\d{{1,3}}$", responder.status
+            ):
+                errors.append(
+                    f"Responder {label}: status must be an enhanced status code "
+                    f"starting with {status_class}, e.g. {status_class}.1.1"
+                )
+            if responder.delay_seconds < 0 or responder.max_per_minute < 0:
+                errors.append(f"Responder {label}: delay and rate cap must not be negative")
+
+        for kind in self.attachment_index.types:
+            if kind not in ATTACHMENT_INDEX_TYPES:
+                errors.append(
+                    f"Attachment index type must be one of {', '.join(ATTACHMENT_INDEX_TYPES)}: {kind!r}"
+                )
+        if self.attachment_index.types and (
+            self.attachment_index.max_bytes <= 0
+            or self.attachment_index.max_chars <= 0
+            or self.attachment_index.timeout_seconds <= 0
+            or self.attachment_index.workers <= 0
+        ):
+            errors.append("Attachment index limits and worker count must be positive")
+
+        for label, path in (
+            ("S/MIME CA", self.crypto.smime_ca_file),
+            ("S/MIME key", self.crypto.smime_key_file),
+            ("PGP public keys", self.crypto.pgp_public_keys),
+            ("PGP secret key", self.crypto.pgp_secret_key),
+            ("Crypto passphrase", self.crypto.passphrase_file),
+        ):
+            if path and not Path(path).exists():
+                errors.append(f"{label} file not found: {path}")
+        if self.crypto.timeout_seconds <= 0:
+            errors.append("Crypto timeout must be positive")
+
+        # The raw message holds the body, so it cannot be kept without it
+        if not self.privacy.store_body and self.privacy.store_raw:
+            errors.append("Privacy store_raw must be false when store_body is false")
+        if not self.privacy.store_body and self.attachment_index.types:
+            errors.append("Attachment indexing stores attachment text, so it needs privacy.store_body")
+        for pattern in self.privacy.scrub_patterns:
+            try:
+                re.compile(pattern)
+            except re.error as e:
+                errors.append(f"Invalid privacy scrub pattern {pattern!r}: {e}")
+
+        for domain in self.tracking.tracker_domains:
+            if not domain or any(c.isspace() or c in "/@*" for c in domain):
+                errors.append(f"Invalid tracker domain {domain!r}: must be a bare domain name")
+
+        if self.siem.enabled:
+            if self.siem.transport not in SIEM_TRANSPORTS:
+                errors.append(
+                    f"SIEM transport must be one of {', '.join(SIEM_TRANSPORTS)}: "
+                    f"{self.siem.transport!r}"
+                )
+            elif self.siem.transport == "https":
+                if not self.siem.url.startswith("https://"):
+                    errors.append("SIEM url must be an https:// URL")
+            elif not self.siem.host or not 0 < self.siem.port <= 65535:
+                errors.append("SIEM syslog transport requires a host and a port from 1 to 65535")
+            if self.siem.ca_file and not Path(self.siem.ca_file).exists():
+                errors.append(f"SIEM CA file not found: {self.siem.ca_file}")
+            if (
+                self.siem.batch_size <= 0
+                or self.siem.interval_seconds <= 0
+                or self.siem.timeout_seconds <= 0
+                or self.siem.max_backoff_seconds <= 0
+            ):
+                errors.append("SIEM batch size, interval, timeout and backoff must be positive")
+
+        if self.smtp.tls.min_version not in TLS_VERSIONS:
+            errors.append(
+                f"SMTP TLS min_version must be one of {', '.join(TLS_VERSIONS)}: "
+                f"{self.smtp.tls.min_version!r}"
+            )
+        if self.smtp.tls.require not in TLS_REQUIREMENTS:
+            errors.append(
+                f"SMTP TLS require must be one of {', '.join(TLS_REQUIREMENTS)}: "
+                f"{self.smtp.tls.require!r}"
+            )
+        elif self.smtp.tls.require != "off" and not self.smtp.tls.enabled:
+            errors.append("SMTP TLS require needs smtp.tls.enabled, or no client could send mail")
 
         if self.smtp.tls.enabled:
             if not Path(self.smtp.tls.cert_file).exists():
@@ -138,5 +859,15 @@ class Config:
             if not Path(self.smtp.tls.key_file).exists():
                 errors.append(f"TLS key file not found: {self.smtp.tls.key_file}")
 
+        if self.web.tls.enabled:
+            if not Path(self.web.tls.cert_file).exists():
+                errors.append(f"Web TLS certificate file not found: {self.web.tls.cert_file}")
+            if not Path(self.web.tls.key_file).exists():
+                errors.append(f"Web TLS key file not found: {self.web.tls.key_file}")
+            if self.web.tls.redirect_port and not 1 <= self.web.tls.redirect_port <= 65535:
+                errors.append("Web TLS redirect_port must be between 1 and 65535")
+            elif self.web.tls.redirect_port == self.web.port:
+                errors.append("Web TLS redirect_port must differ from web.port")
+
         if errors:
             raise ValueError("Configuration validation failed:\n" + "\n".join(f"  - {e}" for e in errors))
@@ -0,0 +1,112 @@
+"""S/MIME and PGP/MIME detection, signature verification and decryption."""
+
+import logging
+
+from ..config import CryptoConfig
+from ..extract import extract_content
+from . import pgp, smime
+from .detect import (
+    PGP,
+    SIGNATURE_ERROR,
+    SIGNATURE_EXPIRED,
+    SIGNATURE_INVALID,
+    SIGNATURE_UNKNOWN_KEY,
+    SIGNATURE_UNTRUSTED,
+    SIGNATURE_VALID,
+    SMIME,
+    SecurityReport,
+    detect,
+    summarize,
+)
+from .tools import CryptoError
+
+logger = logging.getLogger(__name__)
+
+__all__ = [
+    "CryptoError",
+    "CryptoInspector",
+    "PGP",
+    "SIGNATURE_ERROR",
+    "SIGNATURE_EXPIRED",
+    "SIGNATURE_INVALID",
+    "SIGNATURE_UNKNOWN_KEY",
+    "SIGNATURE_UNTRUSTED",
+    "SIGNATURE_VALID",
+    "SMIME",
+    "SecurityReport",
+    "detect",
+    "summarize",
+]
+
+
+class CryptoInspector:
+    """Verifies and decrypts signed or encrypted messages with the configured keys.
+
+    Nothing here raises: a message that cannot be verified or decrypted
+    gets a report with the error, so its metadata still renders.
+    """
+
+    def __init__(self, config: CryptoConfig):
+        self.config = config
+
+    def can_decrypt(self, scheme: str) -> bool:
+        if scheme == SMIME:
+            return bool(self.config.smime_key_file)
+        return bool(self.config.pgp_secret_key)
+
+    def inspect(self, raw_message: bytes) -> SecurityReport | None:
+        """Detect, verify and decrypt a message, or return None if it is neither."""
+        report = detect(raw_message)
+        if report is None:
+            return None
+        try:
+            if report.encrypted:
+                self._decrypt(report, raw_message)
+            elif report.signed:
+                content = self._verify(report, raw_message)
+                if content:
+                    report.body = extract_content(content).body
+        except CryptoError as e:
+            report.error = str(e)
+            if report.signed and not report.signature:
+                report.signature = SIGNATURE_ERROR
+        except Exception as e:
+            logger.warning(f"Failed to inspect {report.label} message: {e}")
+            report.error = str(e) or type(e).__name__
+        return report
+
+    def _verify(self, report: SecurityReport, raw_message: bytes) -> bytes:
+        """Check the signature, filling in the report, and return the signed content."""
+        timeout = self.config.timeout_seconds
+        if report.scheme == SMIME:
+            report.signature, report.signer, report.signer_expires, content = smime.verify(
+                raw_message, self.config.smime_ca_file, timeout
+            )
+            return content
+        report.signature, report.signer, report.signer_expires = pgp.verify(
+            raw_message, self.config.pgp_public_keys, timeout
+        )
+        return b""
+
+    def _decrypt(self, report: SecurityReport, raw_message: bytes) -> None:
+        """Decrypt the message, then check a signature found inside it."""
+        if not self.can_decrypt(report.scheme):
+            return
+        timeout = self.config.timeout_seconds
+        if report.scheme == SMIME:
+            inner = smime.decrypt(
+                raw_message, self.config.smime_key_file, self.config.passphrase_file, timeout
+            )
+        else:
+            inner = pgp.decrypt(
+                raw_message, self.config.pgp_secret_key, self.config.passphrase_file, timeout
+            )
+        report.decrypted = True
+        report.body = extract_content(inner).body
+
+        nested = detect(inner)
+        if nested and nested.signed and nested.scheme == report.scheme:
+            report.signed = True
+            content = self._verify(report, inner)
+            if content:
+                report.body = extract_content(content).body
@@ -0,0 +1,95 @@
+"""Detection of S/MIME and PGP/MIME signed or encrypted messages."""
+
+from dataclasses import dataclass
+from email import policy
+from email.parser import BytesHeaderParser
+
+SMIME = "smime"
+PGP = "pgp"
+
+SIGNATURE_VALID = "valid"
+SIGNATURE_INVALID = "invalid"  # The content does not match the signature
+SIGNATURE_UNTRUSTED = "untrusted"  # Intact, but the signer is not a trust anchor
+SIGNATURE_EXPIRED = "expired"  # Intact, but the signing key or certificate expired
+SIGNATURE_UNKNOWN_KEY = "unknown_key"  # No public key to check it with
+SIGNATURE_ERROR = "error"  # Could not be checked at all
+
+SMIME_SIGNATURE_TYPES = ("application/pkcs7-signature", "application/x-pkcs7-signature")
+SMIME_MIME_TYPES = ("application/pkcs7-mime", "application/x-pkcs7-mime")
+
+
+@dataclass
+class SecurityReport:
+    """What is known about a message's signature and encryption.
+
+    signature and signer are empty until the signature has been checked,
+    and body holds the text of a decrypted message. It is only kept in
+    memory unless crypto.persist_decrypted is set.
+    """
+    scheme: str
+    signed: bool = False
+    encrypted: bool = False
+    signature: str = ""
+    signer: str = ""
+    signer_expires: str = ""
+    decrypted: bool = False
+    body: str = ""
+    error: str = ""
+
+    @property
+    def label(self) -> str:
+        name = "S/MIME" if self.scheme == SMIME else "PGP"
+        if self.encrypted and self.signed:
+            return f"{name} signed and encrypted"
+        return f"{name} {'encrypted' if self.encrypted else 'signed'}"
+
+    @property
+    def summary(self) -> str:
+        """What detect() found, in the form stored with each email, like "pgp:signed"."""
+        flags = ["signed"] if self.signed else []
+        if self.encrypted:
+            flags.append("encrypted")
+        return f"{self.scheme}:{','.join(flags)}"
+
+    @classmethod
+    def from_summary(cls, summary: str | None) -> "SecurityReport | None":
+        """Rebuild a detected report from its stored summary, or None if there is none."""
+        if not summary:
+            return None
+        scheme, _, flags = summary.partition(":")
+        flags = flags.split(",")
+        return cls(scheme=scheme, signed="signed" in flags, encrypted="encrypted" in flags)
+
+
+def detect(raw_message: bytes) -> SecurityReport | None:
+    """Classify a message by its top-level content type, or None if it is neither.
+
+    Only the headers are parsed. Whether an encrypted message is also
+    signed is only known once it has been decrypted.
+    """
+    try:
+        headers = BytesHeaderParser(policy=policy.default).parsebytes(raw_message)
+        content_type = headers.get_content_type()
+        protocol = (headers.get_param("protocol") or "").lower()
+        smime_type = (headers.get_param("smime-type") or "").lower()
+    except Exception:
+        return None
+
+    if content_type == "multipart/signed":
+        if protocol in SMIME_SIGNATURE_TYPES:
+            return SecurityReport(scheme=SMIME, signed=True)
+        if protocol == "application/pgp-signature":
+            return SecurityReport(scheme=PGP, signed=True)
+    elif content_type in SMIME_MIME_TYPES:
+        if smime_type == "signed-data":
+            return SecurityReport(scheme=SMIME, signed=True)
+        return SecurityReport(scheme=SMIME, encrypted=True)
+    elif content_type == "multipart/encrypted" and protocol == "application/pgp-encrypted":
+        return SecurityReport(scheme=PGP, encrypted=True)
+    return None
+
+
+def summarize(raw_message: bytes) -> str:
+    """Return the stored summary of a message's signing and encryption, or "" if neither."""
+    report = detect(raw_message)
+    return report.summary if report else ""
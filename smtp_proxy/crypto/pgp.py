@@ -0,0 +1,140 @@
+"""PGP/MIME (RFC 3156) signature verification and decryption with gpg."""
+
+from email import message_from_bytes, policy
+from pathlib import Path
+import re
+import tempfile
+
+from ..extract import normalize_line_endings
+from .detect import (
+    SIGNATURE_ERROR,
+    SIGNATURE_EXPIRED,
+    SIGNATURE_INVALID,
+    SIGNATURE_UNKNOWN_KEY,
+    SIGNATURE_VALID,
+)
+from .tools import CryptoError, last_error, run_tool
+
+
+def signed_parts(raw_message: bytes) -> tuple[bytes, bytes]:
+    """Split a multipart/signed message into the signed bytes and the signature.
+
+    The signed part is cut from the raw message, not re-serialized, since
+    any change to it invalidates the signature. RFC 3156 signs it with
+    CRLF line endings and without the CRLF before the next boundary.
+    """
+    msg = message_from_bytes(raw_message, policy=policy.default)
+    boundary = msg.get_boundary()
+    if not boundary:
+        raise CryptoError("multipart/signed message has no boundary")
+    raw = normalize_line_endings(raw_message)
+    delimiter = re.compile(
+        rb"(?:^|\r\n)--" + re.escape(boundary.encode()) + rb"(--)?[ \t]*(?:\r\n|$)"
+    )
+    marks = list(delimiter.finditer(raw))
+    if len(marks) < 3:
+        raise CryptoError("multipart/signed message does not have two parts")
+    signed = raw[marks[0].end() : marks[1].start()]
+    signature_part = message_from_bytes(
+        raw[marks[1].end() : marks[2].start()], policy=policy.default
+    )
+    signature = signature_part.get_payload(decode=True) or b""
+    return signed, signature
+
+
+def encrypted_payload(raw_message: bytes) -> bytes:
+    """Return the armored data of a multipart/encrypted message's second part."""
+    msg = message_from_bytes(raw_message, policy=policy.default)
+    parts = msg.get_payload() if msg.is_multipart() else []
+    if len(parts) < 2:
+        raise CryptoError("multipart/encrypted message does not have two parts")
+    return parts[1].get_payload(decode=True) or b""
+
+
+class Keyring:
+    """A throwaway gpg home holding only the configured keys."""
+
+    def __init__(self, timeout: float):
+        self.timeout = timeout
+        self._directory = tempfile.TemporaryDirectory(prefix="smtp-proxy-gpg-")
+        self.home = self._directory.name
+
+    def __enter__(self) -> "Keyring":
+        return self
+
+    def __exit__(self, *exc) -> None:
+        # Stop the agent a secret key import starts before removing its home
+        run_tool(["gpgconf", "--homedir", self.home, "--kill", "gpg-agent"], self.timeout)
+        self._directory.cleanup()
+
+    def gpg(self, *args: str, input: bytes | None = None, passphrase_file: str = ""):
+        command = ["gpg", "--homedir", self.home, "--batch", "--no-tty", "--status-fd", "2"]
+        if passphrase_file:
+            command += ["--pinentry-mode", "loopback", "--passphrase-file", passphrase_file]
+        return run_tool(command + list(args), self.timeout, input=input)
+
+    def import_keys(self, path: str, passphrase_file: str = "") -> None:
+        process = self.gpg("--import", path, passphrase_file=passphrase_file)
+        if process.returncode != 0:
+            raise CryptoError(f"Could not import PGP keys from {path}: {last_error(process)}")
+
+
+def _status(process) -> dict[str, str]:
+    """Collect gpg's machine-readable [GNUPG:] status lines by keyword."""
+    status = {}
+    for line in process.stderr.decode("utf-8", errors="replace").splitlines():
+        if line.startswith("[GNUPG:] "):
+            keyword, _, rest = line[9:].partition(" ")
+            status.setdefault(keyword, rest)
+    return status
+
+
+def verify(raw_message: bytes, public_keys: str, timeout: float) -> tuple[str, str, str]:
+    """Check a PGP/MIME signature and return (status, signer, expires).
+
+    Every key in public_keys is a trust anchor, so a good signature from
+    one of them is valid.
+    """
+    signed, signature = signed_parts(raw_message)
+    with Keyring(timeout) as keyring:
+        if public_keys:
+            keyring.import_keys(public_keys)
+        sig_file = Path(keyring.home) / "signature.asc"
+        data_file = Path(keyring.home) / "signed.eml"
+        sig_file.write_bytes(signature)
+        data_file.write_bytes(signed)
+        status = _status(keyring.gpg("--verify", str(sig_file), str(data_file)))
+
+    signer = ""
+    for keyword in ("GOODSIG", "EXPKEYSIG", "EXPSIG", "BADSIG"):
+        if keyword in status:
+            signer = status[keyword].partition(" ")[2]
+            break
+    expires = ""
+    if "VALIDSIG" in status:
+        fields = status["VALIDSIG"].split()
+        if len(fields) > 3 and fields[3] != "0":
+            expires = fields[3]
+
+    if "BADSIG" in status:
+        return SIGNATURE_INVALID, signer, expires
+    if "EXPKEYSIG" in status or "EXPSIG" in status:
+        return SIGNATURE_EXPIRED, signer, expires
+    if "GOODSIG" in status:
+        return SIGNATURE_VALID, signer, expires
+    if "NO_PUBKEY" in status:
+        return SIGNATURE_UNKNOWN_KEY, "", ""
+    return SIGNATURE_ERROR, "", ""
+
+
+def decrypt(
+    raw_message: bytes, secret_key: str, passphrase_file: str, timeout: float
+) -> bytes:
+    """Decrypt a PGP/MIME message and return the inner MIME entity."""
+    payload = encrypted_payload(raw_message)
+    with Keyring(timeout) as keyring:
+        keyring.import_keys(secret_key, passphrase_file)
+        process = keyring.gpg("--decrypt", input=payload, passphrase_file=passphrase_file)
+    if process.returncode != 0:
+        raise CryptoError(f"PGP decryption failed: {last_error(process)}")
+    return process.stdout
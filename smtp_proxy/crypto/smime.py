@@ -0,0 +1,81 @@
+"""S/MIME signature verification and decryption with openssl."""
+
+from pathlib import Path
+import tempfile
+
+from .detect import (
+    SIGNATURE_EXPIRED,
+    SIGNATURE_INVALID,
+    SIGNATURE_UNTRUSTED,
+    SIGNATURE_VALID,
+)
+from .tools import CryptoError, last_error, run_tool
+
+
+def verify(
+    raw_message: bytes, ca_file: str, timeout: float
+) -> tuple[str, str, str, bytes]:
+    """Check an S/MIME signature and return (status, signer, expires, content).
+
+    The signature is first checked against the trust anchors in ca_file;
+    when that fails it is checked on its own to tell a tampered message
+    from one signed by an unknown or expired certificate. content is the
+    signed entity, which for opaque signed-data is only available here.
+    """
+    with tempfile.TemporaryDirectory(prefix="smtp-proxy-smime-") as work:
+        message = Path(work) / "message.eml"
+        signer = Path(work) / "signer.pem"
+        content = Path(work) / "content.eml"
+        message.write_bytes(raw_message)
+        command = [
+            "openssl", "smime", "-verify", "-in", str(message),
+            "-signer", str(signer), "-out", str(content),
+        ]
+
+        status = SIGNATURE_VALID
+        process = None
+        if ca_file:
+            process = run_tool(command + ["-CAfile", ca_file], timeout)
+        if process is None or process.returncode != 0:
+            unchecked = run_tool(command + ["-noverify"], timeout)
+            if unchecked.returncode != 0:
+                return SIGNATURE_INVALID, "", "", b""
+            status = SIGNATURE_UNTRUSTED
+
+        subject, expires, expired = _certificate(signer, timeout)
+        if status == SIGNATURE_UNTRUSTED and expired:
+            status = SIGNATURE_EXPIRED
+        return status, subject, expires, content.read_bytes()
+
+
+def _certificate(path: Path, timeout: float) -> tuple[str, str, bool]:
+    """Return the subject, expiry date and whether a PEM certificate has expired."""
+    process = run_tool(
+        [
+            "openssl", "x509", "-in", str(path), "-noout",
+            "-subject", "-enddate", "-nameopt", "RFC2253",
+        ],
+        timeout,
+    )
+    fields = {}
+    for line in process.stdout.decode("utf-8", errors="replace").splitlines():
+        key, _, value = line.partition("=")
+        fields[key.strip()] = value.strip()
+    expired = run_tool(
+        ["openssl", "x509", "-in", str(path), "-noout", "-checkend", "0"], timeout
+    ).returncode != 0
+    return fields.get("subject", ""), fields.get("notAfter", ""), expired
+
+
+def decrypt(raw_message: bytes, key_file: str, passphrase_file: str, timeout: float) -> bytes:
+    """Decrypt an S/MIME enveloped message and return the inner MIME entity."""
+    with tempfile.TemporaryDirectory(prefix="smtp-proxy-smime-") as work:
+        message = Path(work) / "message.eml"
+        message.write_bytes(raw_message)
+        command = ["openssl", "smime", "-decrypt", "-in", str(message), "-inkey", key_file]
+        if passphrase_file:
+            command += ["-passin", f"file:{passphrase_file}"]
+        process = run_tool(command, timeout)
+        if process.returncode != 0:
+            raise CryptoError(f"S/MIME decryption failed: {last_error(process)}")
+        return process.stdout
@@ -0,0 +1,29 @@
+"""Running the openssl and gpg command line tools."""
+
+import subprocess
+
+
+class CryptoError(Exception):
+    """Raised when a message cannot be verified or decrypted."""
+
+
+def run_tool(
+    args: list[str], timeout: float, input: bytes | None = None
+) -> subprocess.CompletedProcess:
+    """Run a crypto tool and return the completed process.
+
+    A missing binary or a run past the timeout is a CryptoError; a
+    non-zero exit status is left to the caller to interpret.
+    """
+    try:
+        return subprocess.run(args, input=input, capture_output=True, timeout=timeout)
+    except FileNotFoundError:
+        raise CryptoError(f"{args[0]} is not installed")
+    except subprocess.TimeoutExpired:
+        raise CryptoError(f"{args[0]} did not finish within {timeout:g}s")
+
+
+def last_error(process: subprocess.CompletedProcess) -> str:
+    """Return the last line a tool wrote to stderr, for error messages."""
+    lines = process.stderr.decode("utf-8", errors="replace").strip().splitlines()
+    return lines[-1] if lines else f"exit status {process.returncode}"
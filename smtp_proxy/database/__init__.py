@@ -1,7 +1,33 @@
 """Database module for SMTP Proxy."""
 
+from .address_repository import AddressRepository
+from .api_token_repository import ApiTokenRepository
+from .audit_repository import AuditRepository
+from .cache import AggregateCache
 from .connection import Database
 from .email_repository import EmailRepository
+from .journal_repository import JournalRepository
+from .lease_repository import LeaseRepository
+from .login_attempt_repository import LoginAttemptRepository
+from .quota_repository import QuotaRepository
+from .raw_store import RawMessageStore
+from .rule_repository import RuleRepository
+from .smtp_credential_repository import SMTPCredentialRepository
 from .user_repository import UserRepository
 
-__all__ = ["Database", "EmailRepository", "UserRepository"]
+__all__ = [
+    "AddressRepository",
+    "ApiTokenRepository",
+    "AuditRepository",
+    "AggregateCache",
+    "Database",
+    "EmailRepository",
+    "JournalRepository",
+    "LeaseRepository",
+    "LoginAttemptRepository",
+    "QuotaRepository",
+    "RawMessageStore",
+    "RuleRepository",
+    "SMTPCredentialRepository",
+    "UserRepository",
+]
@@ -0,0 +1,129 @@
+"""Address book repository for database operations."""
+
+from datetime import datetime
+
+from ..extract import header_addresses
+from ..models import Address, Email
+from .connection import Database
+from .email_repository import escape_like, normalize_address
+from .raw_store import decompress_raw
+
+
+class AddressRepository:
+    """Repository for the address book built from received mail."""
+
+    def __init__(self, db: Database):
+        self.db = db
+
+    def record(self, email: Email) -> None:
+        """Count the sender and recipients of a received email.
+
+        Each distinct address is upserted once per message. Display names
+        are kept oldest first, with the latest one seen moved to the end.
+        """
+        headers = header_addresses(email.raw_message)
+        names = {
+            normalize_address(addr): name
+            for kind in ("from", "to", "cc")
+            for name, addr in headers[kind]
+            if name
+        }
+
+        seen: dict[str, list[int]] = {}
+        sender_addresses = [email.sender] + [addr for _, addr in headers["from"]]
+        for addr in sender_addresses:
+            if addr:
+                seen.setdefault(normalize_address(addr), [0, 0])[0] = 1
+        recipient_addresses = email.recipients + [
+            addr for kind in ("to", "cc") for _, addr in headers[kind]
+        ]
+        for addr in recipient_addresses:
+            if addr:
+                seen.setdefault(normalize_address(addr), [0, 0])[1] = 1
+
+        received_at = email.received_at.isoformat()
+        query = """
+            INSERT INTO addresses (address, display_names, first_seen, last_seen,
+                                   sent_count, received_count)
+            VALUES (?, ?, ?, ?, ?, ?)
+            ON CONFLICT(address) DO UPDATE SET
+                last_seen = MAX(last_seen, excluded.last_seen),
+                sent_count = sent_count + excluded.sent_count,
+                received_count = received_count + excluded.received_count,
+                display_names = CASE
+                    WHEN excluded.display_names = '' THEN display_names
+                    ELSE ltrim(
+                        trim(replace(char(10) || display_names || char(10),
+                                     char(10) || excluded.display_names || char(10),
+                                     char(10)), char(10))
+                        || char(10) || excluded.display_names,
+                        char(10))
+                END
+        """
+        self.db.executemany(
+            query,
+            [
+                (addr, names.get(addr, "").replace("\n", " "), received_at, received_at, sent, received)
+                for addr, (sent, received) in seen.items()
+            ],
+        )
+
+    def search_prefix(self, prefix: str, limit: int = 10) -> list[Address]:
+        """Find addresses or display names starting with a prefix, most active first."""
+        escaped = escape_like(prefix)
+        query = """
+            SELECT * FROM addresses
+            WHERE address LIKE ? ESCAPE '\\'
+               OR (char(10) || display_names) LIKE ? ESCAPE '\\'
+            ORDER BY sent_count + received_count DESC, address LIMIT ?
+        """
+        rows = self.db.fetchall(query, (f"{escaped}%", f"%\n{escaped}%", limit))
+        return [self._row_to_address(row) for row in rows]
+
+    def most_active(self, limit: int = 200) -> list[Address]:
+        """Get the addresses seen in the most emails."""
+        query = """
+            SELECT * FROM addresses
+            ORDER BY sent_count + received_count DESC, address LIMIT ?
+        """
+        return [self._row_to_address(row) for row in self.db.fetchall(query, (limit,))]
+
+    def count(self) -> int:
+        """Get the number of known addresses."""
+        row = self.db.fetchone("SELECT COUNT(*) as count FROM addresses")
+        return row["count"] if row else 0
+
+    def rebuild(self, batch_size: int = 500) -> int:
+        """Rebuild the address book from every stored email."""
+        self.db.execute("DELETE FROM addresses")
+        recorded = 0
+        last_id = 0
+        query = """
+            SELECT id, sender, recipients, raw_message, received_at FROM emails
+            WHERE id > ? ORDER BY id LIMIT ?
+        """
+        while True:
+            rows = self.db.fetchall(query, (last_id, batch_size))
+            if not rows:
+                break
+            for row in rows:
+                self.record(Email(
+                    sender=row["sender"],
+                    recipients=Email.parse_recipients_json(row["recipients"]),
+                    raw_message=decompress_raw(row["raw_message"]),
+                    received_at=datetime.fromisoformat(row["received_at"]),
+                ))
+            last_id = rows[-1]["id"]
+            recorded += len(rows)
+        return recorded
+
+    def _row_to_address(self, row) -> Address:
+        """Convert a database row to an Address object."""
+        return Address(
+            address=row["address"],
+            display_names=[n for n in row["display_names"].split("\n") if n],
+            first_seen=datetime.fromisoformat(row["first_seen"]),
+            last_seen=datetime.fromisoformat(row["last_seen"]),
+            sent_count=row["sent_count"],
+            received_count=row["received_count"],
+        )
@@ -0,0 +1,101 @@
+"""API token repository for database operations."""
+
+import hashlib
+import hmac
+import secrets
+from datetime import datetime
+
+from ..models import ApiToken
+from .connection import Database
+
+# Marks tokens as this application's, for people and secret scanners
+TOKEN_PREFIX = "smtpp_"
+GENERATED_TOKEN_BYTES = 32
+
+
+def hash_token(token: str) -> str:
+    """Return the SHA-256 hex digest a token is stored as."""
+    return hashlib.sha256(token.encode()).hexdigest()
+
+
+class ApiTokenRepository:
+    """Repository for the bearer tokens API clients authenticate with.
+
+    Tokens are generated, shown once and stored as SHA-256 hashes; they
+    are random, so unlike passwords they need no salt or slow hash.
+    Revoking a token deletes it, and every request looks its token up
+    again, so a revoked token stops working at once.
+    """
+
+    def __init__(self, db: Database):
+        self.db = db
+
+    def get_all(self) -> list[ApiToken]:
+        """Get all API tokens ordered by name."""
+        rows = self.db.fetchall("SELECT * FROM api_tokens ORDER BY name")
+        return [self._row_to_token(row) for row in rows]
+
+    def get_by_id(self, token_id: int) -> ApiToken | None:
+        """Get an API token by ID."""
+        row = self.db.fetchone("SELECT * FROM api_tokens WHERE id = ?", (token_id,))
+        return self._row_to_token(row) if row else None
+
+    def exists(self, name: str) -> bool:
+        """Check if an API token with the given name exists."""
+        row = self.db.fetchone("SELECT 1 FROM api_tokens WHERE name = ?", (name,))
+        return row is not None
+
+    def create(self, name: str, created_by: str = "") -> tuple[int, str]:
+        """Create an API token, returning its ID and the token itself."""
+        token = TOKEN_PREFIX + secrets.token_urlsafe(GENERATED_TOKEN_BYTES)
+        query = """
+            INSERT INTO api_tokens (name, token_hash, created_by, created_at)
+            VALUES (?, ?, ?, ?)
+        """
+        cursor = self.db.execute(
+            query, (name, hash_token(token), created_by, datetime.now().isoformat())
+        )
+        return cursor.lastrowid, token
+
+    def revoke(self, token_id: int) -> bool:
+        """Delete an API token so it is refused from the next request on."""
+        cursor = self.db.execute("DELETE FROM api_tokens WHERE id = ?", (token_id,))
+        return cursor.rowcount > 0
+
+    def verify(self, token: str) -> ApiToken | None:
+        """Return the API token a bearer token matches, or None.
+
+        The hash is compared with every stored one in constant time, and
+        without stopping at a match, so response times do not reveal how
+        close a guess came. A match records when the token was last used,
+        unless the database is read-only.
+        """
+        digest = hash_token(token)
+        matched = None
+        for api_token in self.get_all():
+            if hmac.compare_digest(api_token.token_hash, digest) and matched is None:
+                matched = api_token
+        if matched and not self.db.read_only:
+            self.db.execute(
+                "UPDATE api_tokens SET last_used_at = ? WHERE id = ?",
+                (datetime.now().isoformat(), matched.id),
+            )
+        return matched
+
+    def _row_to_token(self, row) -> ApiToken:
+        """Convert a database row to an ApiToken object."""
+        created_at = row["created_at"]
+        if isinstance(created_at, str):
+            created_at = datetime.fromisoformat(created_at)
+        last_used_at = row["last_used_at"]
+        if isinstance(last_used_at, str):
+            last_used_at = datetime.fromisoformat(last_used_at)
+
+        return ApiToken(
+            id=row["id"],
+            name=row["name"],
+            token_hash=row["token_hash"],
+            created_by=row["created_by"] or "",
+            created_at=created_at,
+            last_used_at=last_used_at,
+        )
@@ -0,0 +1,163 @@
+"""Hash-chained audit log of security-relevant events."""
+
+from datetime import datetime, timezone
+import json
+import logging
+import sqlite3
+from typing import Iterator
+
+from ..models import AUDIT_GENESIS_HASH, AuditEvent
+from .connection import Database
+
+logger = logging.getLogger(__name__)
+
+VERIFY_BATCH_SIZE = 1000
+
+
+class AuditRepository:
+    """Repository for the audit log, which is also the SIEM export spool.
+
+    Events are appended with the hash of the event before them. Events
+    not yet accepted by the collector have no shipped_at, so they
+    survive restarts while the collector is down.
+    """
+
+    def __init__(self, db: Database, instance_id: str = ""):
+        self.db = db
+        self.instance_id = instance_id
+
+    def record(
+        self,
+        event: str,
+        outcome: str = "success",
+        actor: str = "",
+        source: str = "",
+        **data,
+    ) -> AuditEvent | None:
+        """Append an event to the chain.
+
+        Failures are logged rather than raised, so an unavailable audit
+        log never blocks the sign-in or change being recorded. Nothing is
+        recorded on a read-only database.
+        """
+        if self.db.read_only:
+            return None
+        entry = AuditEvent(
+            event=event,
+            outcome=outcome,
+            actor=actor or "",
+            source=source or "",
+            instance_id=self.instance_id,
+            data=data,
+        )
+        try:
+            with self.db.transaction() as conn:
+                # Take the write lock before reading the tail, so processes
+                # sharing the database cannot both extend the same event
+                conn.execute("BEGIN IMMEDIATE")
+                last = conn.execute(
+                    "SELECT id, hash FROM audit_events ORDER BY id DESC LIMIT 1"
+                ).fetchone()
+                if last:
+                    entry.id, entry.prev_hash = last["id"] + 1, last["hash"]
+                else:
+                    entry.id, entry.prev_hash = 1, AUDIT_GENESIS_HASH
+                entry.hash = entry.compute_hash()
+                conn.execute(
+                    """
+                    INSERT INTO audit_events (id, occurred_at, event, outcome, actor, source,
+                                              instance_id, data, prev_hash, hash)
+                    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+                    """,
+                    (
+                        entry.id, entry.occurred_at.isoformat(timespec="microseconds"),
+                        entry.event, entry.outcome, entry.actor, entry.source,
+                        entry.instance_id, json.dumps(entry.data, sort_keys=True),
+                        entry.prev_hash, entry.hash,
+                    ),
+                )
+        except sqlite3.Error as e:
+            logger.warning(f"Failed to record audit event {event}: {e}")
+            return None
+        return entry
+
+    def pending(self, limit: int) -> list[AuditEvent]:
+        """Get the oldest events not yet shipped to the collector."""
+        rows = self.db.fetchall(
+            "SELECT * FROM audit_events WHERE shipped_at IS NULL ORDER BY id LIMIT ?",
+            (limit,),
+        )
+        return [self._row_to_event(row) for row in rows]
+
+    def pending_count(self) -> int:
+        """Count the events waiting to be shipped."""
+        row = self.db.fetchone("SELECT COUNT(*) FROM audit_events WHERE shipped_at IS NULL")
+        return row[0] if row else 0
+
+    def mark_shipped(self, event_ids: list[int]) -> None:
+        """Record that the collector accepted events."""
+        if not event_ids:
+            return
+        placeholders = ",".join("?" * len(event_ids))
+        self.db.execute(
+            f"UPDATE audit_events SET shipped_at = ? WHERE id IN ({placeholders})",
+            (datetime.now(timezone.utc).isoformat(),) + tuple(event_ids),
+        )
+
+    def recent(self, limit: int = 200, event: str = "") -> list[AuditEvent]:
+        """Get the most recent events, newest first, optionally of one kind."""
+        if event:
+            rows = self.db.fetchall(
+                "SELECT * FROM audit_events WHERE event = ? ORDER BY id DESC LIMIT ?",
+                (event, limit),
+            )
+        else:
+            rows = self.db.fetchall(
+                "SELECT * FROM audit_events ORDER BY id DESC LIMIT ?", (limit,)
+            )
+        return [self._row_to_event(row) for row in rows]
+
+    def iter_all(self) -> Iterator[AuditEvent]:
+        """Yield every event in chain order, reading in batches."""
+        after = 0
+        while True:
+            rows = self.db.fetchall(
+                "SELECT * FROM audit_events WHERE id > ? ORDER BY id LIMIT ?",
+                (after, VERIFY_BATCH_SIZE),
+            )
+            if not rows:
+                return
+            for row in rows:
+                yield self._row_to_event(row)
+            after = rows[-1]["id"]
+
+    def verify(self) -> tuple[int, str | None]:
+        """Check the whole chain, returning the events checked and the first problem."""
+        checked = 0
+        expected_id, expected_prev = 1, AUDIT_GENESIS_HASH
+        for entry in self.iter_all():
+            if entry.id != expected_id:
+                return checked, f"event {expected_id} is missing (next is {entry.id})"
+            if entry.prev_hash != expected_prev:
+                return checked, f"event {entry.id} does not follow event {entry.id - 1}"
+            if entry.compute_hash() != entry.hash:
+                return checked, f"event {entry.id} was modified after it was recorded"
+            checked += 1
+            expected_id, expected_prev = entry.id + 1, entry.hash
+        return checked, None
+
+    def _row_to_event(self, row: sqlite3.Row) -> AuditEvent:
+        """Convert a database row to an AuditEvent."""
+        return AuditEvent(
+            id=row["id"],
+            occurred_at=datetime.fromisoformat(row["occurred_at"]),
+            event=row["event"],
+            outcome=row["outcome"],
+            actor=row["actor"] or "",
+            source=row["source"] or "",
+            instance_id=row["instance_id"] or "",
+            data=json.loads(row["data"] or "{}"),
+            prev_hash=row["prev_hash"],
+            hash=row["hash"],
+            shipped_at=datetime.fromisoformat(row["shipped_at"]) if row["shipped_at"] else None,
+        )
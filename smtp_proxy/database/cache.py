@@ -0,0 +1,61 @@
+"""In-process cache for aggregate query results."""
+
+import threading
+import time
+from typing import Any, Callable
+
+
+class AggregateCache:
+    """Caches aggregate query results until the next write or TTL expiry.
+
+    Repository write methods call invalidate(), which bumps a generation
+    counter so every cached value becomes stale at once. The TTL is a
+    safety net for writes that bypass the repository.
+    """
+
+    def __init__(self, ttl_seconds: float = 30.0, enabled: bool = True):
+        self.ttl_seconds = ttl_seconds
+        self.enabled = enabled
+        self.hits = 0
+        self.misses = 0
+        self._generation = 0
+        self._entries: dict[str, tuple[int, float, Any]] = {}
+        self._lock = threading.Lock()
+
+    def get_or_compute(self, key: str, compute: Callable[[], Any]) -> Any:
+        """Return the cached value for key, computing it on a miss."""
+        if not self.enabled:
+            return compute()
+
+        now = time.monotonic()
+        with self._lock:
+            generation = self._generation
+            entry = self._entries.get(key)
+            if entry and entry[0] == generation and entry[1] > now:
+                self.hits += 1
+                return entry[2]
+            self.misses += 1
+
+        value = compute()
+
+        with self._lock:
+            # A write during compute bumps the generation, so the value is
+            # stored as already stale rather than masking that write
+            self._entries[key] = (generation, now + self.ttl_seconds, value)
+        return value
+
+    def invalidate(self) -> None:
+        """Mark all cached values as stale."""
+        with self._lock:
+            self._generation += 1
+            self._entries.clear()
+
+    def stats(self) -> dict:
+        """Return hit/miss counters."""
+        with self._lock:
+            return {
+                "enabled": self.enabled,
+                "hits": self.hits,
+                "misses": self.misses,
+                "entries": len(self._entries),
+            }
@@ -1,16 +1,61 @@
 """Database connection and schema initialization."""
 
+from contextlib import contextmanager
+from datetime import datetime
+import logging
 import sqlite3
 from pathlib import Path
 import threading
+from typing import Iterator
+
+from .health import StorageBreaker
+
+logger = logging.getLogger(__name__)
+
+# Keep emails_fts in step with the subject and body of emails
+FTS_TRIGGERS = """
+CREATE TRIGGER IF NOT EXISTS emails_fts_insert AFTER INSERT ON emails
+BEGIN
+    INSERT INTO emails_fts (rowid, subject, body) VALUES (NEW.id, NEW.subject, NEW.body);
+END;
+
+CREATE TRIGGER IF NOT EXISTS emails_fts_delete AFTER DELETE ON emails
+BEGIN
+    INSERT INTO emails_fts (emails_fts, rowid, subject, body)
+    VALUES ('delete', OLD.id, OLD.subject, OLD.body);
+END;
+
+CREATE TRIGGER IF NOT EXISTS emails_fts_update AFTER UPDATE OF subject, body ON emails
+BEGIN
+    INSERT INTO emails_fts (emails_fts, rowid, subject, body)
+    VALUES ('delete', OLD.id, OLD.subject, OLD.body);
+    INSERT INTO emails_fts (rowid, subject, body) VALUES (NEW.id, NEW.subject, NEW.body);
+END;
+"""
 
 
 class Database:
-    """SQLite database connection manager."""
+    """SQLite database connection manager.
 
-    def __init__(self, path: str):
+    fts5 tells whether the SQLite build has FTS5, and so whether the
+    emails_fts full-text index of subjects and bodies is kept.
+
+    A read-only database is opened as it is, without creating or
+    migrating the schema, so it works on a read-only filesystem; it must
+    exist and have been opened for writing by this version before.
+    """
+
+    def __init__(self, path: str, read_only: bool = False):
         self.path = path
+        self.read_only = read_only
         self._lock = threading.Lock()
+        self.breaker = StorageBreaker()
+        self.fts5 = False
+        if read_only:
+            self.conn = sqlite3.connect(f"file:{path}?mode=ro", uri=True, check_same_thread=False)
+            self.conn.row_factory = sqlite3.Row
+            self.fts5 = self._has_full_text_index()
+            return
         self._ensure_directory()
         self.conn = sqlite3.connect(path, check_same_thread=False)
         self.conn.row_factory = sqlite3.Row
@@ -31,6 +76,49 @@ class Database:
             created_at DATETIME DEFAULT CURRENT_TIMESTAMP
         );
 
+        CREATE TABLE IF NOT EXISTS smtp_credentials (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            username TEXT NOT NULL UNIQUE,
+            password_hash TEXT NOT NULL,
+            disabled INTEGER DEFAULT 0,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            last_used_at DATETIME,
+            allowed_senders TEXT DEFAULT '',
+            max_messages_per_day INTEGER DEFAULT 0
+        );
+
+        CREATE TABLE IF NOT EXISTS api_tokens (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL UNIQUE,
+            token_hash TEXT NOT NULL UNIQUE,
+            created_by TEXT DEFAULT '',
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            last_used_at DATETIME
+        );
+
+        CREATE TABLE IF NOT EXISTS login_attempts (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            username TEXT NOT NULL,
+            source TEXT DEFAULT '',
+            attempted_at DATETIME NOT NULL
+        );
+
+        -- Consecutive failed sign-ins per attempted username, whether or
+        -- not such a user exists
+        CREATE TABLE IF NOT EXISTS login_lockouts (
+            username TEXT PRIMARY KEY,
+            failures INTEGER NOT NULL DEFAULT 0,
+            last_failed_at DATETIME,
+            locked_until DATETIME
+        );
+
+        CREATE TABLE IF NOT EXISTS smtp_quota_usage (
+            username TEXT NOT NULL,
+            day TEXT NOT NULL,
+            messages INTEGER NOT NULL DEFAULT 0,
+            PRIMARY KEY (username, day)
+        );
+
         CREATE TABLE IF NOT EXISTS emails (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
             sender TEXT NOT NULL,
@@ -42,42 +130,360 @@ class Database:
             received_at DATETIME DEFAULT CURRENT_TIMESTAMP,
             status TEXT DEFAULT 'received',
             smtp_auth_user TEXT DEFAULT '',
-            client_ip TEXT DEFAULT ''
+            client_ip TEXT DEFAULT '',
+            instance_id TEXT DEFAULT '',
+            timing TEXT DEFAULT '',
+            content_hash TEXT DEFAULT '',
+            parse_error TEXT DEFAULT '',
+            anomalies TEXT DEFAULT '',
+            attachments TEXT DEFAULT '',
+            attachment_names TEXT DEFAULT '',
+            relay_routes TEXT DEFAULT ''
+        );
+
+        CREATE TABLE IF NOT EXISTS rules (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL,
+            priority INTEGER NOT NULL DEFAULT 100,
+            enabled INTEGER NOT NULL DEFAULT 1,
+            sender_pattern TEXT DEFAULT '',
+            recipient_pattern TEXT DEFAULT '',
+            subject_pattern TEXT DEFAULT '',
+            auth_user TEXT DEFAULT '',
+            min_size_bytes INTEGER DEFAULT 0,
+            action TEXT NOT NULL,
+            action_value TEXT DEFAULT '',
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS email_recipients (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            email_id INTEGER NOT NULL,
+            address TEXT NOT NULL,
+            normalized_address TEXT NOT NULL,
+            type TEXT NOT NULL
+        );
+
+        CREATE TABLE IF NOT EXISTS addresses (
+            address TEXT PRIMARY KEY,
+            display_names TEXT DEFAULT '',
+            first_seen DATETIME NOT NULL,
+            last_seen DATETIME NOT NULL,
+            sent_count INTEGER NOT NULL DEFAULT 0,
+            received_count INTEGER NOT NULL DEFAULT 0
+        );
+
+        CREATE TABLE IF NOT EXISTS delivery_attempts (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            email_id INTEGER NOT NULL,
+            attempted_at DATETIME NOT NULL,
+            upstream TEXT NOT NULL,
+            smtp_code INTEGER NOT NULL,
+            response TEXT DEFAULT '',
+            duration_ms INTEGER DEFAULT 0
+        );
+
+        CREATE TABLE IF NOT EXISTS email_journal (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            occurred_at DATETIME NOT NULL,
+            action TEXT NOT NULL,
+            email_id INTEGER,
+            actor TEXT DEFAULT '',
+            old_status TEXT DEFAULT '',
+            new_status TEXT DEFAULT '',
+            sender TEXT DEFAULT '',
+            subject TEXT DEFAULT '',
+            size_bytes INTEGER DEFAULT 0,
+            received_at DATETIME,
+            count INTEGER DEFAULT 0
+        );
+
+        CREATE TABLE IF NOT EXISTS attachment_texts (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            email_id INTEGER NOT NULL,
+            attachment_index INTEGER NOT NULL,
+            filename TEXT DEFAULT '',
+            content_type TEXT DEFAULT '',
+            status TEXT NOT NULL,
+            text TEXT DEFAULT '',
+            error TEXT DEFAULT ''
+        );
+
+        CREATE TABLE IF NOT EXISTS audit_events (
+            id INTEGER PRIMARY KEY,
+            occurred_at DATETIME NOT NULL,
+            event TEXT NOT NULL,
+            outcome TEXT NOT NULL,
+            actor TEXT DEFAULT '',
+            source TEXT DEFAULT '',
+            instance_id TEXT DEFAULT '',
+            data TEXT DEFAULT '{}',
+            prev_hash TEXT NOT NULL,
+            hash TEXT NOT NULL,
+            shipped_at DATETIME
+        );
+
+        -- One row with the running totals of the emails table, kept by the
+        -- triggers below so quota checks need not sum size_bytes
+        CREATE TABLE IF NOT EXISTS storage_usage (
+            id INTEGER PRIMARY KEY CHECK (id = 1),
+            emails INTEGER NOT NULL DEFAULT 0,
+            bytes INTEGER NOT NULL DEFAULT 0
+        );
+
+        CREATE TRIGGER IF NOT EXISTS storage_usage_insert AFTER INSERT ON emails
+        BEGIN
+            UPDATE storage_usage SET emails = emails + 1, bytes = bytes + NEW.size_bytes
+            WHERE id = 1;
+        END;
+
+        CREATE TRIGGER IF NOT EXISTS storage_usage_delete AFTER DELETE ON emails
+        BEGIN
+            UPDATE storage_usage SET emails = emails - 1, bytes = bytes - OLD.size_bytes
+            WHERE id = 1;
+        END;
+
+        -- Which instance runs each background job, for instances sharing
+        -- the database
+        CREATE TABLE IF NOT EXISTS job_leases (
+            name TEXT PRIMARY KEY,
+            holder TEXT NOT NULL,
+            expires_at DATETIME NOT NULL
+        );
+
+        CREATE TABLE IF NOT EXISTS health_probe (
+            id INTEGER PRIMARY KEY,
+            checked_at DATETIME NOT NULL
         );
 
         CREATE INDEX IF NOT EXISTS idx_emails_received_at ON emails(received_at DESC);
         CREATE INDEX IF NOT EXISTS idx_emails_sender ON emails(sender);
         CREATE INDEX IF NOT EXISTS idx_emails_status ON emails(status);
+        CREATE INDEX IF NOT EXISTS idx_emails_smtp_auth_user ON emails(smtp_auth_user);
+        CREATE INDEX IF NOT EXISTS idx_emails_size_bytes ON emails(size_bytes DESC);
+        CREATE INDEX IF NOT EXISTS idx_emails_sender_size ON emails(sender, size_bytes);
+        CREATE INDEX IF NOT EXISTS idx_email_recipients_email_id ON email_recipients(email_id);
+        CREATE INDEX IF NOT EXISTS idx_email_recipients_address
+            ON email_recipients(normalized_address, email_id);
+        CREATE INDEX IF NOT EXISTS idx_delivery_attempts_email_id
+            ON delivery_attempts(email_id, attempted_at);
+        CREATE INDEX IF NOT EXISTS idx_attachment_texts_email_id
+            ON attachment_texts(email_id, attachment_index);
+        CREATE INDEX IF NOT EXISTS idx_email_journal_email_id ON email_journal(email_id);
+        CREATE INDEX IF NOT EXISTS idx_email_journal_occurred_at ON email_journal(occurred_at);
+        CREATE INDEX IF NOT EXISTS idx_login_attempts_attempted_at
+            ON login_attempts(attempted_at);
+        CREATE INDEX IF NOT EXISTS idx_audit_events_unshipped ON audit_events(id)
+            WHERE shipped_at IS NULL;
         """
         with self._lock:
             self.conn.executescript(schema)
+            self._migrate_schema()
+            self._init_full_text_search()
             self.conn.commit()
 
+    def _migrate_schema(self) -> None:
+        """Add columns introduced after the initial schema to existing databases."""
+        self._ensure_column("emails", "instance_id", "TEXT DEFAULT ''")
+        self._ensure_column("emails", "timing", "TEXT DEFAULT ''")
+        self._ensure_column("emails", "content_hash", "TEXT DEFAULT ''")
+        self._ensure_column("emails", "parse_error", "TEXT DEFAULT ''")
+        self._ensure_column("emails", "anomalies", "TEXT DEFAULT ''")
+        self._ensure_column("emails", "attachments", "TEXT DEFAULT ''")
+        self._ensure_column("emails", "attachment_names", "TEXT DEFAULT ''")
+        self._ensure_column("emails", "relay_routes", "TEXT DEFAULT ''")
+        self._ensure_column("email_recipients", "canonical_address", "TEXT DEFAULT ''")
+        self._ensure_column("email_journal", "detail", "TEXT DEFAULT ''")
+        self._ensure_column("emails", "redactions", "TEXT DEFAULT ''")
+        self._ensure_column("smtp_credentials", "allowed_senders", "TEXT DEFAULT ''")
+        self._ensure_column("smtp_credentials", "max_messages_per_day", "INTEGER DEFAULT 0")
+        self._ensure_column("emails", "tracking", "TEXT DEFAULT ''")
+        # NULL marks emails stored before TLS details were recorded
+        self._ensure_column("emails", "tls_version", "TEXT")
+        self._ensure_column("emails", "tls_cipher", "TEXT DEFAULT ''")
+        self._ensure_column("emails", "raw_path", "TEXT DEFAULT ''")
+        self._ensure_column("emails", "body_type", "TEXT DEFAULT ''")
+        # NULL marks emails stored before previews were computed
+        self._ensure_column("emails", "preview", "TEXT")
+        # NULL marks emails stored before signing and encryption were detected
+        self._ensure_column("emails", "security", "TEXT")
+        self._ensure_column("emails", "labels", "TEXT DEFAULT ''")
+        self._ensure_column("emails", "mailbox", "TEXT DEFAULT ''")
+        self._ensure_column("users", "active", "INTEGER DEFAULT 1")
+        # Users from before roles stay admins, as everyone was one
+        self._ensure_column("users", "role", "TEXT DEFAULT 'admin'")
+        if self._ensure_column("emails", "stored_bytes", "INTEGER DEFAULT 0"):
+            # Raw messages stored until now are uncompressed, so a file is
+            # as large as the message itself
+            self.conn.execute(
+                "UPDATE emails SET stored_bytes = "
+                "CASE WHEN raw_path != '' THEN size_bytes ELSE length(raw_message) END"
+            )
+        # Databases from before storage_usage start from a one-off sum
+        self.conn.execute(
+            "INSERT OR IGNORE INTO storage_usage (id, emails, bytes) "
+            "SELECT 1, COUNT(*), COALESCE(SUM(size_bytes), 0) FROM emails"
+        )
+        self.conn.execute(
+            "CREATE INDEX IF NOT EXISTS idx_emails_content_hash "
+            "ON emails(content_hash, received_at)"
+        )
+        self.conn.execute("CREATE INDEX IF NOT EXISTS idx_emails_mailbox ON emails(mailbox)")
+        self.conn.execute(
+            "CREATE INDEX IF NOT EXISTS idx_email_recipients_canonical "
+            "ON email_recipients(canonical_address, email_id)"
+        )
+
+    def _init_full_text_search(self) -> None:
+        """Create the full-text index of emails, or drop its triggers without FTS5.
+
+        The index is rebuilt whenever its triggers are created, which
+        covers databases from before it existed and ones written by a
+        build without FTS5 meanwhile.
+        """
+        try:
+            self.conn.execute(
+                "CREATE VIRTUAL TABLE IF NOT EXISTS emails_fts USING fts5("
+                "subject, body, content='emails', content_rowid='id')"
+            )
+            # An index made by another build exists even where FTS5 does not
+            self.conn.execute("SELECT 1 FROM emails_fts LIMIT 1").fetchone()
+        except sqlite3.OperationalError as e:
+            logger.warning(f"Full-text search is unavailable, searching bodies with LIKE: {e}")
+            # Triggers left by a build with FTS5 would make every insert fail
+            for trigger in ("insert", "delete", "update"):
+                self.conn.execute(f"DROP TRIGGER IF EXISTS emails_fts_{trigger}")
+            return
+        self.fts5 = True
+        row = self.conn.execute(
+            "SELECT 1 FROM sqlite_master WHERE type = 'trigger' AND name = 'emails_fts_insert'"
+        ).fetchone()
+        if row is None:
+            self.conn.executescript(FTS_TRIGGERS)
+            self.conn.execute("INSERT INTO emails_fts (emails_fts) VALUES ('rebuild')")
+
+    def _has_full_text_index(self) -> bool:
+        """Check whether the full-text index exists and this SQLite build can read it."""
+        try:
+            self.conn.execute("SELECT 1 FROM emails_fts LIMIT 1").fetchone()
+        except sqlite3.OperationalError:
+            return False
+        return True
+
+    def _ensure_column(self, table: str, column: str, definition: str) -> bool:
+        """Add a column to a table if it does not already exist, and report whether it did."""
+        columns = {row["name"] for row in self.conn.execute(f"PRAGMA table_info({table})")}
+        if column in columns:
+            return False
+        self.conn.execute(f"ALTER TABLE {table} ADD COLUMN {column} {definition}")
+        return True
+
     def execute(self, query: str, params: tuple = ()) -> sqlite3.Cursor:
         """Execute a query with thread safety."""
         with self._lock:
-            cursor = self.conn.execute(query, params)
-            self.conn.commit()
-            return cursor
+            try:
+                cursor = self.conn.execute(query, params)
+                self.conn.commit()
+            except sqlite3.Error as e:
+                self._write_failed(e)
+                raise
+        self.breaker.record_success()
+        return cursor
 
     def executemany(self, query: str, params_list: list[tuple]) -> sqlite3.Cursor:
         """Execute many queries with thread safety."""
         with self._lock:
-            cursor = self.conn.executemany(query, params_list)
-            self.conn.commit()
-            return cursor
+            try:
+                cursor = self.conn.executemany(query, params_list)
+                self.conn.commit()
+            except sqlite3.Error as e:
+                self._write_failed(e)
+                raise
+        self.breaker.record_success()
+        return cursor
+
+    @contextmanager
+    def transaction(self) -> Iterator[sqlite3.Connection]:
+        """Run several writes atomically with thread safety.
+
+        Commits when the block exits and rolls back if it raises.
+        """
+        with self._lock:
+            try:
+                yield self.conn
+                self.conn.commit()
+            except sqlite3.Error as e:
+                self._write_failed(e)
+                raise
+            except BaseException:
+                self.conn.rollback()
+                raise
+        self.breaker.record_success()
 
     def fetchone(self, query: str, params: tuple = ()) -> sqlite3.Row | None:
         """Fetch one row."""
         with self._lock:
-            cursor = self.conn.execute(query, params)
-            return cursor.fetchone()
+            try:
+                cursor = self.conn.execute(query, params)
+                return cursor.fetchone()
+            except sqlite3.Error as e:
+                self.breaker.record_failure(e)
+                raise
 
     def fetchall(self, query: str, params: tuple = ()) -> list[sqlite3.Row]:
         """Fetch all rows."""
         with self._lock:
-            cursor = self.conn.execute(query, params)
-            return cursor.fetchall()
+            try:
+                cursor = self.conn.execute(query, params)
+                return cursor.fetchall()
+            except sqlite3.Error as e:
+                self.breaker.record_failure(e)
+                raise
+
+    def probe(self) -> bool:
+        """Attempt a small write to check whether storage has recovered.
+
+        A read-only database is probed with a read instead.
+        """
+        try:
+            if self.read_only:
+                self.fetchone("SELECT 1 FROM health_probe LIMIT 1")
+                self.breaker.record_success()
+                return True
+            self.execute(
+                "INSERT OR REPLACE INTO health_probe (id, checked_at) VALUES (1, ?)",
+                (datetime.now().isoformat(),),
+            )
+        except sqlite3.Error:
+            return False
+        return True
+
+    def total_changes(self) -> int:
+        """Return the number of rows changed through this connection so far."""
+        with self._lock:
+            return self.conn.total_changes
+
+    def backup_to(self, path: str) -> int:
+        """Copy a consistent snapshot of the database to path.
+
+        Writes wait until the copy is done. Returns total_changes as of
+        the snapshot.
+        """
+        with self._lock:
+            target = sqlite3.connect(path)
+            try:
+                self.conn.backup(target)
+            finally:
+                target.close()
+            return self.conn.total_changes
+
+    def _write_failed(self, error: sqlite3.Error) -> None:
+        """Roll back a failed write and report it to the breaker."""
+        try:
+            self.conn.rollback()
+        except sqlite3.Error:
+            pass
+        self.breaker.record_failure(error)
 
     def close(self) -> None:
         """Close the database connection."""
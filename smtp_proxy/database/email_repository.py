@@ -1,40 +1,237 @@
 """Email repository for database operations."""
 
 from datetime import datetime
+from functools import partial
+import hashlib
+import io
+import json
+import logging
+import re
+import threading
+from typing import BinaryIO, Iterator
 
-from ..models import Email
+from ..crypto import summarize
+from ..extract import body_preview, extract_attachments, extract_subject, header_addresses
+from ..models import AttachmentText, DeliveryAttempt, Email
+from ..privacy import Redactor
+from ..subaddress import split_subaddress
+from ..tracking import TrackingAnalyzer
+from .cache import AggregateCache
 from .connection import Database
+from .journal_repository import journal_deletions, journal_receive, journal_status, journal_wipe
+from .quota_repository import QuotaExceededError, consume_quota
+from .raw_store import GZIP_MAGIC, RawMessageStore, compress_raw, decompress_raw
+
+logger = logging.getLogger(__name__)
+
+# Kinds of rows in email_recipients: envelope RCPT TO, and To/Cc headers
+RECIPIENT_TYPES = ("envelope", "to", "cc")
+
+# Emails read from the database at a time by iter_search and iter_by_ids
+EXPORT_BATCH_SIZE = 100
+
+# Columns of emails as they are listed: all but the body and raw message,
+# which are only read for a single email or a download
+LIST_COLUMNS = (
+    "id, sender, recipients, subject, preview, body_type, size_bytes, received_at, status, "
+    "smtp_auth_user, client_ip, instance_id, timing, content_hash, parse_error, anomalies, "
+    "attachments, relay_routes, redactions, tracking, tls_version, tls_cipher, raw_path, "
+    "stored_bytes, security, labels, mailbox"
+)
+
+INSERT_RECIPIENT = (
+    "INSERT INTO email_recipients (email_id, address, normalized_address, canonical_address, type) "
+    "VALUES (?, ?, ?, ?, ?)"
+)
+
+# Upper bounds (exclusive) and labels for the message size histogram
+SIZE_BUCKETS = [
+    (1024, "< 1 KB"),
+    (10 * 1024, "1-10 KB"),
+    (100 * 1024, "10-100 KB"),
+    (1024 * 1024, "100 KB-1 MB"),
+    (10 * 1024 * 1024, "1-10 MB"),
+    (None, "> 10 MB"),
+]
+
+
+# Bracket the matched words in FTS5 snippets; control characters never
+# occur in stored bodies
+SNIPPET_START = "\x02"
+SNIPPET_END = "\x03"
+SNIPPET_TOKENS = 16
+
+
+def content_hash(raw_message: bytes) -> str:
+    """Return the SHA-256 hex digest identifying a raw message."""
+    return hashlib.sha256(raw_message).hexdigest()
+
+
+def normalize_address(address: str) -> str:
+    """Normalize an email address for indexed lookups."""
+    return address.strip().strip("<>").lower()
+
+
+def escape_like(term: str) -> str:
+    """Lowercase a search term and escape LIKE wildcards with a backslash."""
+    return term.lower().replace("\\", "\\\\").replace("%", "\\%").replace("_", "\\_")
+
+
+def _like_pattern(term: str) -> str:
+    """Build a case-insensitive substring LIKE pattern for a search term."""
+    return f"%{escape_like(term)}%"
+
+
+def fts_query(text: str) -> str:
+    """Build an FTS5 query matching every word of a search, each as a prefix.
+
+    Words are quoted, so FTS5 operators and punctuation in them are
+    taken literally.
+    """
+    return " ".join('"' + word.replace('"', '""') + '"*' for word in text.split())
+
+
+def snippet_parts(snippet: str) -> list[tuple[str, bool]]:
+    """Split an FTS5 snippet into its text and whether each piece matched."""
+    parts = []
+    highlighted = False
+    for piece in re.split(f"([{SNIPPET_START}{SNIPPET_END}])", snippet):
+        if piece in (SNIPPET_START, SNIPPET_END):
+            highlighted = piece == SNIPPET_START
+        elif piece:
+            parts.append((piece, highlighted))
+    return parts
 
 
 class EmailRepository:
-    """Repository for email CRUD operations."""
+    """Repository for email CRUD operations.
 
-    def __init__(self, db: Database):
+    Recipients are indexed both as received and in canonical form, with
+    any sub-address tag after one of subaddress_separators removed. New
+    emails pass through redactor, when given, before anything about them
+    is written, so content it withholds never reaches the database file.
+    max_total_bytes and max_emails bound what SMTP may store; 0 is unlimited.
+    With raw_files, new raw messages are written to raw_store and only
+    their path is kept in the row; emails already stored either way stay
+    readable, as long as raw_store is given. With compress_raw, new raw
+    messages are gzipped first; reads tell compressed ones apart by their
+    header, so rows stored either way can be mixed.
+    """
+
+    def __init__(
+        self,
+        db: Database,
+        cache: AggregateCache | None = None,
+        subaddress_separators: str = "+",
+        redactor: Redactor | None = None,
+        max_total_bytes: int = 0,
+        max_emails: int = 0,
+        raw_store: RawMessageStore | None = None,
+        raw_files: bool = False,
+        compress_raw: bool = False,
+    ):
         self.db = db
+        self.cache = cache or AggregateCache(enabled=False)
+        self.subaddress_separators = subaddress_separators
+        self.redactor = redactor
+        self.max_total_bytes = max_total_bytes
+        self.max_emails = max_emails
+        self.raw_store = raw_store
+        self.raw_files = raw_files and raw_store is not None
+        self.compress_raw = compress_raw
+        # Held from checking whether a raw file is still referenced until
+        # it is removed, so an identical message stored meanwhile keeps it
+        self._raw_lock = threading.Lock()
+
+    def canonical_address(self, address: str) -> str:
+        """Normalize an address and strip its sub-address tag."""
+        canonical, _ = split_subaddress(address, self.subaddress_separators)
+        return normalize_address(canonical)
+
+    def create(self, email: Email, actor: str = "", quota: tuple[str, int] | None = None) -> int:
+        """Create a new email with its recipients and journal entry, and return its ID.
 
-    def create(self, email: Email) -> int:
-        """Create a new email and return its ID."""
+        With quota, a (username, limit) pair, the email is counted against
+        that user's daily quota in the same transaction. If the quota is
+        used up, nothing is stored and QuotaExceededError is raised.
+        """
+        if not email.content_hash:
+            email.content_hash = content_hash(email.raw_message)
+        if email.security is None:
+            # Detected before redaction, as only the top-level headers are read
+            email.security = summarize(email.raw_message)
+        stored = self.redactor.redact(email) if self.redactor else email
         query = """
             INSERT INTO emails (sender, recipients, subject, body, raw_message,
-                              size_bytes, received_at, status, smtp_auth_user, client_ip)
-            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+                              size_bytes, received_at, status, smtp_auth_user, client_ip,
+                              instance_id, timing, content_hash, parse_error,
+                              anomalies, attachments, attachment_names, redactions,
+                              tracking, tls_version, tls_cipher, raw_path, stored_bytes,
+                              body_type, preview, security, labels, mailbox)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+                    ?, ?)
         """
-        cursor = self.db.execute(
-            query,
-            (
-                email.sender,
-                email.recipients_json(),
-                email.subject,
-                email.body,
-                email.raw_message,
-                email.size_bytes,
-                email.received_at.isoformat(),
-                email.status,
-                email.auth_user,
-                email.client_ip,
-            ),
-        )
-        return cursor.lastrowid
+        with self._raw_lock:
+            raw_message, raw_path = stored.raw_message, ""
+            if self.compress_raw and raw_message:
+                raw_message = compress_raw(raw_message)
+            stored_bytes = len(raw_message)
+            if self.raw_files and raw_message:
+                # Written first so no row refers to a missing file; a failed
+                # insert leaves an orphan for reconcile_raw_files to report
+                raw_path = self.raw_store.write(raw_message)
+                raw_message = b""
+            try:
+                with self.db.transaction() as conn:
+                    if quota and not consume_quota(conn, *quota):
+                        raise QuotaExceededError(quota[0])
+                    cursor = conn.execute(
+                        query,
+                        (
+                            stored.sender,
+                            stored.recipients_json(),
+                            stored.subject,
+                            stored.body,
+                            raw_message,
+                            stored.size_bytes,
+                            stored.received_at.isoformat(),
+                            stored.status,
+                            stored.auth_user,
+                            stored.client_ip,
+                            stored.instance_id,
+                            stored.timing_json(),
+                            stored.content_hash,
+                            stored.parse_error,
+                            stored.anomalies,
+                            stored.attachments_json(),
+                            stored.attachment_names(),
+                            ",".join(stored.redactions),
+                            stored.tracking_json(),
+                            stored.tls_version,
+                            stored.tls_cipher,
+                            raw_path,
+                            stored_bytes,
+                            stored.body_type,
+                            # Taken from the stored body, so it never shows what was redacted
+                            body_preview(stored.body),
+                            stored.security,
+                            ",".join(stored.labels),
+                            stored.mailbox,
+                        ),
+                    )
+                    email_id = cursor.lastrowid
+                    # Recipients come from the envelope and the To/Cc headers only
+                    rows = self._recipient_rows(email_id, email.recipients, email.raw_message)
+                    if rows:
+                        conn.executemany(INSERT_RECIPIENT, rows)
+                    journal_receive(conn, email_id, stored, actor)
+            except QuotaExceededError:
+                # Unless an identical stored email shares the file
+                if raw_path:
+                    self._delete_raw_files({raw_path})
+                raise
+        self.cache.invalidate()
+        return email_id
 
     def get_by_id(self, email_id: int) -> Email | None:
         """Get an email by its ID."""
@@ -44,46 +241,938 @@ class EmailRepository:
             return None
         return self._row_to_email(row)
 
+    def open_raw(self, email: Email) -> BinaryIO:
+        """Open the raw message of an email as received, to be read in chunks.
+
+        Messages kept as files are streamed from disk, decompressed as they
+        are read, instead of being loaded whole first.
+        """
+        if email.raw_path and self.raw_store is not None:
+            return self.raw_store.open(email.raw_path)
+        return io.BytesIO(email.raw_message)
+
+    def get_latest_by_subject(self, subject: str) -> Email | None:
+        """Get the most recently stored email with exactly this subject."""
+        row = self.db.fetchone(
+            "SELECT * FROM emails WHERE subject = ? ORDER BY id DESC LIMIT 1", (subject,)
+        )
+        return self._row_to_email(row) if row else None
+
     def get_all(self) -> list[Email]:
         """Get all emails ordered by received_at descending."""
         query = "SELECT * FROM emails ORDER BY received_at DESC"
         rows = self.db.fetchall(query)
         return [self._row_to_email(row) for row in rows]
 
-    def update_status(self, email_id: int, status: str) -> bool:
-        """Update the status of an email."""
-        query = "UPDATE emails SET status = ? WHERE id = ?"
-        cursor = self.db.execute(query, (status, email_id))
+    def get_page(self, limit: int, offset: int = 0) -> list[Email]:
+        """Get one page of emails ordered by received_at descending.
+
+        The emails are listed without their body or raw message.
+        """
+        query = (
+            f"SELECT {LIST_COLUMNS} FROM emails "
+            "ORDER BY received_at DESC, id DESC LIMIT ? OFFSET ?"
+        )
+        rows = self.db.fetchall(query, (limit, offset))
+        return [self._row_to_email(row) for row in rows]
+
+    def get_recent(self, limit: int) -> list[Email]:
+        """Get the most recently received emails."""
+        query = "SELECT * FROM emails ORDER BY received_at DESC LIMIT ?"
+        rows = self.db.fetchall(query, (limit,))
+        return [self._row_to_email(row) for row in rows]
+
+    def update_status(self, email_id: int, status: str, actor: str = "") -> bool:
+        """Update the status of an email, journaling the change."""
+        with self.db.transaction() as conn:
+            journal_status(conn, email_id, status, actor)
+            cursor = conn.execute("UPDATE emails SET status = ? WHERE id = ?", (status, email_id))
+        self.cache.invalidate()
+        return cursor.rowcount > 0
+
+    def update_status_all(self, from_status: str, to_status: str, actor: str = "") -> int:
+        """Move every email in one status to another, journaling each change.
+
+        Returns how many emails were updated.
+        """
+        with self.db.transaction() as conn:
+            rows = conn.execute("SELECT id FROM emails WHERE status = ?", (from_status,))
+            for row in rows.fetchall():
+                journal_status(conn, row["id"], to_status, actor)
+            cursor = conn.execute(
+                "UPDATE emails SET status = ? WHERE status = ?", (to_status, from_status)
+            )
+        self.cache.invalidate()
+        return cursor.rowcount
+
+    def update_body(self, email_id: int, body: str) -> bool:
+        """Replace the stored text body of an email, e.g. with its decrypted text."""
+        cursor = self.db.execute(
+            "UPDATE emails SET body = ?, preview = ? WHERE id = ?",
+            (body, body_preview(body), email_id),
+        )
+        return cursor.rowcount > 0
+
+    def update_timing(self, email_id: int, timing: dict) -> bool:
+        """Update the timing breakdown of an email."""
+        query = "UPDATE emails SET timing = ? WHERE id = ?"
+        cursor = self.db.execute(query, (json.dumps(timing), email_id))
+        return cursor.rowcount > 0
+
+    def update_relay_routes(self, email_id: int, routes: list[dict]) -> bool:
+        """Record which relay route handled each recipient of an email."""
+        query = "UPDATE emails SET relay_routes = ? WHERE id = ?"
+        cursor = self.db.execute(query, (json.dumps(routes), email_id))
         return cursor.rowcount > 0
 
-    def delete_all(self) -> int:
-        """Delete all emails and return the count of deleted rows."""
-        query = "DELETE FROM emails"
-        cursor = self.db.execute(query)
+    def add_delivery_attempt(
+        self, email_id: int, upstream: str, smtp_code: int, response: str, duration_ms: int
+    ) -> int:
+        """Record one relay attempt for an email and return its ID."""
+        query = """
+            INSERT INTO delivery_attempts (email_id, attempted_at, upstream, smtp_code,
+                                           response, duration_ms)
+            VALUES (?, ?, ?, ?, ?, ?)
+        """
+        cursor = self.db.execute(
+            query,
+            (email_id, datetime.now().isoformat(), upstream, smtp_code, response, duration_ms),
+        )
+        return cursor.lastrowid
+
+    def get_delivery_attempts(self, email_id: int) -> list[DeliveryAttempt]:
+        """Get the relay attempts for an email, oldest first."""
+        query = "SELECT * FROM delivery_attempts WHERE email_id = ? ORDER BY attempted_at, id"
+        return [self._row_to_attempt(row) for row in self.db.fetchall(query, (email_id,))]
+
+    def last_delivery_attempts(self, email_ids: list[int]) -> dict[int, DeliveryAttempt]:
+        """Get the most recent relay attempt of each email that has one."""
+        if not email_ids:
+            return {}
+        placeholders = ", ".join("?" for _ in email_ids)
+        query = f"""
+            SELECT * FROM delivery_attempts WHERE id IN (
+                SELECT MAX(id) FROM delivery_attempts
+                WHERE email_id IN ({placeholders}) GROUP BY email_id
+            )
+        """
+        return {
+            row["email_id"]: self._row_to_attempt(row)
+            for row in self.db.fetchall(query, tuple(email_ids))
+        }
+
+    def _row_to_attempt(self, row) -> DeliveryAttempt:
+        """Convert a database row to a DeliveryAttempt."""
+        return DeliveryAttempt(
+            id=row["id"],
+            email_id=row["email_id"],
+            attempted_at=datetime.fromisoformat(row["attempted_at"]),
+            upstream=row["upstream"],
+            smtp_code=row["smtp_code"],
+            response=row["response"],
+            duration_ms=row["duration_ms"],
+        )
+
+    def get_by_status(
+        self, statuses: tuple[str, ...], limit: int = 100, offset: int = 0
+    ) -> list[Email]:
+        """Get emails with any of the given statuses, newest first."""
+        placeholders = ", ".join("?" for _ in statuses)
+        query = f"""
+            SELECT * FROM emails WHERE status IN ({placeholders})
+            ORDER BY received_at DESC LIMIT ? OFFSET ?
+        """
+        rows = self.db.fetchall(query, (*statuses, limit, offset))
+        return [self._row_to_email(row) for row in rows]
+
+    def count_by_status(self, statuses: tuple[str, ...]) -> int:
+        """Count the emails with any of the given statuses."""
+        placeholders = ", ".join("?" for _ in statuses)
+        row = self.db.fetchone(
+            f"SELECT COUNT(*) AS count FROM emails WHERE status IN ({placeholders})",
+            tuple(statuses),
+        )
+        return row["count"] if row else 0
+
+    def add_attachment_texts(self, email_id: int, texts: list[AttachmentText]) -> None:
+        """Store the extraction outcome of an email's attachments.
+
+        Nothing is stored if the email was deleted in the meantime.
+        """
+        self.db.executemany(
+            """
+            INSERT INTO attachment_texts (email_id, attachment_index, filename,
+                                          content_type, status, text, error)
+            SELECT ?, ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM emails WHERE id = ?)
+            """,
+            [
+                (email_id, t.index, t.filename, t.content_type, t.status, t.text, t.error, email_id)
+                for t in texts
+            ],
+        )
+
+    def get_attachment_texts(self, email_id: int) -> list[AttachmentText]:
+        """Get the extraction outcome of an email's attachments, in attachment order."""
+        query = "SELECT * FROM attachment_texts WHERE email_id = ? ORDER BY attachment_index"
+        return [
+            AttachmentText(
+                index=row["attachment_index"],
+                filename=row["filename"],
+                content_type=row["content_type"],
+                status=row["status"],
+                text=row["text"],
+                error=row["error"],
+            )
+            for row in self.db.fetchall(query, (email_id,))
+        ]
+
+    def body_snippets(
+        self, email_ids: list[int], text: str
+    ) -> dict[int, list[tuple[str, bool]]]:
+        """Get the passage of each email's body that best matches a search.
+
+        Each passage is split into pieces flagged when they matched. Only
+        available with FTS5; otherwise no email has a snippet.
+        """
+        if not email_ids or not text or not self.db.fts5:
+            return {}
+        placeholders = ", ".join("?" for _ in email_ids)
+        rows = self.db.fetchall(
+            f"""
+            SELECT rowid, snippet(emails_fts, 1, ?, ?, '…', ?) AS snippet FROM emails_fts
+            WHERE emails_fts MATCH ? AND rowid IN ({placeholders})
+            """,
+            (SNIPPET_START, SNIPPET_END, SNIPPET_TOKENS, fts_query(text), *email_ids),
+        )
+        # Emails that only matched in the subject have nothing to highlight
+        return {
+            row["rowid"]: snippet_parts(row["snippet"])
+            for row in rows
+            if SNIPPET_START in row["snippet"]
+        }
+
+    def attachment_text_matches(self, email_ids: list[int], term: str) -> dict[int, list[str]]:
+        """Name the attachments of each email whose extracted text contains term."""
+        if not email_ids or not term:
+            return {}
+        placeholders = ", ".join("?" for _ in email_ids)
+        rows = self.db.fetchall(
+            f"""
+            SELECT email_id, filename FROM attachment_texts
+            WHERE email_id IN ({placeholders}) AND text LIKE ? ESCAPE '\\'
+            ORDER BY email_id, attachment_index
+            """,
+            (*email_ids, _like_pattern(term)),
+        )
+        matches: dict[int, list[str]] = {}
+        for row in rows:
+            matches.setdefault(row["email_id"], []).append(row["filename"] or "(unnamed)")
+        return matches
+
+    def delete_all(self, actor: str = "") -> int:
+        """Delete all emails, journaling a tombstone for each, and return the count."""
+        with self._raw_lock:
+            with self.db.transaction() as conn:
+                raw_paths = self._raw_paths(conn, "1", ())
+                journal_deletions(conn, "1", (), actor)
+                cursor = conn.execute("DELETE FROM emails")
+                conn.execute("DELETE FROM email_recipients")
+                conn.execute("DELETE FROM delivery_attempts")
+                conn.execute("DELETE FROM attachment_texts")
+                journal_wipe(conn, cursor.rowcount, actor)
+            self._delete_raw_files(raw_paths)
+        self.cache.invalidate()
+        return cursor.rowcount
+
+    def delete_by_ids(self, email_ids: list[int], actor: str = "") -> int:
+        """Delete the emails with the given IDs, journaling tombstones, and return the count."""
+        if not email_ids:
+            return 0
+        placeholders = ", ".join("?" for _ in email_ids)
+        where = f"id IN ({placeholders})"
+        with self._raw_lock:
+            with self.db.transaction() as conn:
+                raw_paths = self._raw_paths(conn, where, tuple(email_ids))
+                journal_deletions(conn, where, tuple(email_ids), actor)
+                cursor = conn.execute(f"DELETE FROM emails WHERE {where}", tuple(email_ids))
+                for table in ("email_recipients", "delivery_attempts", "attachment_texts"):
+                    conn.execute(
+                        f"DELETE FROM {table} WHERE email_id IN ({placeholders})",
+                        tuple(email_ids),
+                    )
+            self._delete_raw_files(raw_paths)
+        self.cache.invalidate()
         return cursor.rowcount
 
+    def delete(self, email_id: int, actor: str = "") -> bool:
+        """Delete one email and its recipients, delivery attempts and attachment text."""
+        return self.delete_by_ids([email_id], actor=actor) > 0
+
+    def _raw_paths(self, conn, where: str, params: tuple) -> set[str]:
+        """Return the raw message files of the emails matching a condition."""
+        rows = conn.execute(
+            f"SELECT DISTINCT raw_path FROM emails WHERE ({where}) AND raw_path != ''", params
+        ).fetchall()
+        return {row["raw_path"] for row in rows}
+
+    def _delete_raw_files(self, raw_paths: set[str]) -> None:
+        """Remove raw message files that no remaining email refers to.
+
+        Duplicates share a file, so one still referenced is kept. Failures
+        are logged; the file is then reported by reconcile_raw_files.
+        """
+        if not raw_paths or self.raw_store is None:
+            return
+        placeholders = ", ".join("?" for _ in raw_paths)
+        rows = self.db.fetchall(
+            f"SELECT DISTINCT raw_path FROM emails WHERE raw_path IN ({placeholders})",
+            tuple(raw_paths),
+        )
+        try:
+            self.raw_store.delete(raw_paths - {row["raw_path"] for row in rows})
+        except OSError as e:
+            logger.error(f"Failed to remove raw message files: {e}")
+
+    def reconcile_raw_files(self) -> tuple[set[str], set[str]]:
+        """Compare the raw message files with the emails that refer to them.
+
+        Returns the orphaned files no email refers to, and the missing
+        files that emails refer to but raw_store lacks.
+        """
+        if self.raw_store is None:
+            return set(), set()
+        rows = self.db.fetchall("SELECT DISTINCT raw_path FROM emails WHERE raw_path != ''")
+        referenced = {row["raw_path"] for row in rows}
+        with self._raw_lock:
+            stored = self.raw_store.files()
+        return stored - referenced, referenced - stored
+
+    def total_size(self) -> int:
+        """Get the total stored size of all emails in bytes."""
+        return self.cache.get_or_compute("total_size", self._total_size)
+
+    def _total_size(self) -> int:
+        """Sum size_bytes over all emails."""
+        query = "SELECT COALESCE(SUM(size_bytes), 0) as total FROM emails"
+        row = self.db.fetchone(query)
+        return row["total"] if row else 0
+
+    def stored_size(self) -> int:
+        """Get the bytes raw messages take in storage, after any compression."""
+        return self.cache.get_or_compute("stored_size", self._stored_size)
+
+    def _stored_size(self) -> int:
+        """Sum stored_bytes over all emails."""
+        row = self.db.fetchone("SELECT COALESCE(SUM(stored_bytes), 0) as total FROM emails")
+        return row["total"] if row else 0
+
+    def storage_usage(self) -> dict:
+        """Get the email count and total size_bytes from the running totals."""
+        row = self.db.fetchone("SELECT emails, bytes FROM storage_usage WHERE id = 1")
+        if not row:
+            return {"emails": 0, "bytes": 0}
+        return {"emails": row["emails"], "bytes": row["bytes"]}
+
+    def storage_quota_exceeded(self) -> str:
+        """Return which storage quota is used up, or an empty string if none is."""
+        if not self.max_total_bytes and not self.max_emails:
+            return ""
+        usage = self.storage_usage()
+        if self.max_total_bytes and usage["bytes"] >= self.max_total_bytes:
+            return f"{usage['bytes']} of {self.max_total_bytes} bytes stored"
+        if self.max_emails and usage["emails"] >= self.max_emails:
+            return f"{usage['emails']} of {self.max_emails} emails stored"
+        return ""
+
+    def size_histogram(self) -> list[dict]:
+        """Get email counts and total bytes grouped into size buckets."""
+        return self.cache.get_or_compute("size_histogram", self._size_histogram)
+
+    def _size_histogram(self) -> list[dict]:
+        """Query the size histogram."""
+        cases = " ".join(
+            f"WHEN size_bytes < {limit} THEN {i}"
+            for i, (limit, _) in enumerate(SIZE_BUCKETS)
+            if limit is not None
+        )
+        query = f"""
+            SELECT CASE {cases} ELSE {len(SIZE_BUCKETS) - 1} END as bucket,
+                   COUNT(*) as count, SUM(size_bytes) as bytes
+            FROM emails GROUP BY bucket
+        """
+        rows = {row["bucket"]: row for row in self.db.fetchall(query)}
+        return [
+            {
+                "label": label,
+                "count": rows[i]["count"] if i in rows else 0,
+                "bytes": rows[i]["bytes"] if i in rows else 0,
+            }
+            for i, (_, label) in enumerate(SIZE_BUCKETS)
+        ]
+
+    def get_largest(self, limit: int = 50) -> list[dict]:
+        """Get summary rows for the largest emails, without message content."""
+        return self.cache.get_or_compute(
+            f"largest:{limit}", lambda: self._get_largest(limit)
+        )
+
+    def _get_largest(self, limit: int) -> list[dict]:
+        """Query the largest emails."""
+        query = """
+            SELECT id, sender, subject, size_bytes, received_at FROM emails
+            ORDER BY size_bytes DESC LIMIT ?
+        """
+        return [dict(row) for row in self.db.fetchall(query, (limit,))]
+
+    def size_by_sender(self, limit: int = 20) -> list[dict]:
+        """Get email counts and total bytes per sender, largest first."""
+        return self.cache.get_or_compute(
+            f"size_by_sender:{limit}", lambda: self._size_by_sender(limit)
+        )
+
+    def _size_by_sender(self, limit: int) -> list[dict]:
+        """Query byte totals per sender."""
+        query = """
+            SELECT sender, COUNT(*) as count, SUM(size_bytes) as bytes FROM emails
+            GROUP BY sender ORDER BY bytes DESC LIMIT ?
+        """
+        return [dict(row) for row in self.db.fetchall(query, (limit,))]
+
+    def tls_usage(self, since: datetime) -> list[dict]:
+        """Count the emails received since a time per auth user, client, TLS version and cipher.
+
+        The version is "" for plaintext. Emails from before TLS details
+        were recorded, and ones not received over SMTP, are left out.
+        """
+        query = """
+            SELECT smtp_auth_user, client_ip, tls_version, tls_cipher,
+                   COUNT(*) AS messages, MAX(received_at) AS last_seen
+            FROM emails
+            WHERE tls_version IS NOT NULL AND received_at >= ?
+            GROUP BY smtp_auth_user, client_ip, tls_version, tls_cipher
+            ORDER BY smtp_auth_user, client_ip, messages DESC
+        """
+        return [
+            {
+                "auth_user": row["smtp_auth_user"],
+                "client_ip": row["client_ip"],
+                "version": row["tls_version"],
+                "cipher": row["tls_cipher"],
+                "messages": row["messages"],
+                "last_seen": row["last_seen"],
+            }
+            for row in self.db.fetchall(query, (since.isoformat(),))
+        ]
+
+    def has_duplicate_since(self, content_hash: str, since: datetime) -> bool:
+        """Check whether an identical message was received since a time."""
+        query = """
+            SELECT 1 FROM emails WHERE content_hash = ? AND received_at >= ? LIMIT 1
+        """
+        row = self.db.fetchone(query, (content_hash, since.isoformat()))
+        return row is not None
+
+    def duplicate_groups(self, limit: int = 100) -> list[dict]:
+        """Get groups of byte-identical emails, most wasted bytes first."""
+        query = """
+            SELECT content_hash, COUNT(*) as count,
+                   SUM(size_bytes) - MIN(size_bytes) as wasted_bytes,
+                   MIN(id) as first_id, MAX(id) as last_id,
+                   MIN(received_at) as first_received_at,
+                   MAX(received_at) as last_received_at,
+                   MAX(sender) as sender, MAX(subject) as subject
+            FROM emails WHERE content_hash != ''
+            GROUP BY content_hash HAVING COUNT(*) > 1
+            ORDER BY wasted_bytes DESC LIMIT ?
+        """
+        return [dict(row) for row in self.db.fetchall(query, (limit,))]
+
+    def duplicate_cleanup_plan(self, keep: str = "oldest") -> dict[str, list[int]]:
+        """Map each duplicate content hash to the IDs that cleanup would delete.
+
+        keep is "oldest" or "newest"; that email survives in each group.
+        """
+        query = """
+            SELECT id, content_hash FROM emails
+            WHERE content_hash IN (
+                SELECT content_hash FROM emails WHERE content_hash != ''
+                GROUP BY content_hash HAVING COUNT(*) > 1
+            )
+            ORDER BY content_hash, received_at, id
+        """
+        groups: dict[str, list[int]] = {}
+        for row in self.db.fetchall(query):
+            groups.setdefault(row["content_hash"], []).append(row["id"])
+        if keep == "newest":
+            return {h: ids[:-1] for h, ids in groups.items()}
+        return {h: ids[1:] for h, ids in groups.items()}
+
+    def backfill_content_hashes(self, batch_size: int = 500) -> int:
+        """Compute content hashes for emails stored before hashing existed."""
+        updated = 0
+        query = "SELECT id, raw_message, raw_path FROM emails WHERE content_hash = '' LIMIT ?"
+        while True:
+            rows = self.db.fetchall(query, (batch_size,))
+            if not rows:
+                break
+            params = []
+            for row in rows:
+                raw_message = self._stored_raw(row["raw_path"], row["raw_message"])
+                params.append((content_hash(raw_message), row["id"]))
+            self.db.executemany("UPDATE emails SET content_hash = ? WHERE id = ?", params)
+            updated += len(rows)
+        return updated
+
+    def search(
+        self,
+        text: str = "",
+        filename: str = "",
+        recipient: str = "",
+        sender: str = "",
+        canonical: str = "",
+        auth_user: str = "",
+        has_tracking: bool = False,
+        status: str = "",
+        since: datetime | None = None,
+        until: datetime | None = None,
+        label: str = "",
+        mailbox: str = "",
+        limit: int = 0,
+        offset: int = 0,
+    ) -> list[Email]:
+        """Find emails by free text, attachment filename, recipient, sender or auth user.
+
+        Free text matches sender, recipients, subject, body, attachment
+        filenames and text extracted from attachments. With FTS5, subject
+        and body are matched word by word through emails_fts, and emails
+        matching there come first, best match first; filename matches
+        attachment filenames only; recipient matches an envelope, To or Cc
+        address and sender the envelope sender, both exactly but ignoring
+        case. canonical matches a recipient with any sub-address tag, so
+        signup@qa.test finds mail to signup+run-1@qa.test. auth_user
+        matches the SMTP user the email was sent as exactly. has_tracking
+        keeps only emails where tracking analysis found something, status
+        only emails with that status, and since and until only emails
+        received from since and before until. label and mailbox keep only
+        emails a rule gave that label or routed to that mailbox. With
+        limit, only that many are returned, starting at offset. The emails
+        are listed without their body or raw message.
+        """
+        where, params = self._search_where(
+            text, filename, recipient, sender, canonical, auth_user, has_tracking,
+            status, since, until, label, mailbox,
+        )
+        query = (
+            f"SELECT {LIST_COLUMNS} FROM emails WHERE {where} "
+            "ORDER BY received_at DESC, id DESC"
+        )
+        if text and self.db.fts5:
+            query = f"""
+                SELECT {LIST_COLUMNS} FROM emails
+                LEFT JOIN (SELECT rowid, rank FROM emails_fts WHERE emails_fts MATCH ?) hits
+                ON hits.rowid = emails.id
+                WHERE {where}
+                ORDER BY hits.rank IS NULL, hits.rank, received_at DESC, id DESC
+            """
+            params = [fts_query(text), *params]
+        if limit:
+            query += " LIMIT ? OFFSET ?"
+            params += [limit, offset]
+        return [self._row_to_email(row) for row in self.db.fetchall(query, tuple(params))]
+
+    def iter_search(self, batch_size: int = EXPORT_BATCH_SIZE, **filters) -> Iterator[Email]:
+        """Yield the emails search() finds with the same filters, oldest first.
+
+        Only their IDs are fetched up front and the emails are read a batch
+        at a time, so an export of any size holds at most one batch of raw
+        messages in memory.
+        """
+        where, params = self._search_where(**filters)
+        rows = self.db.fetchall(
+            f"SELECT id FROM emails WHERE {where} ORDER BY received_at, id", tuple(params)
+        )
+        return self.iter_by_ids([row["id"] for row in rows], batch_size)
+
+    def iter_by_ids(
+        self, email_ids: list[int], batch_size: int = EXPORT_BATCH_SIZE
+    ) -> Iterator[Email]:
+        """Yield the emails with these IDs in the order given, a batch at a time.
+
+        IDs of emails that no longer exist are skipped.
+        """
+        for start in range(0, len(email_ids), batch_size):
+            batch = email_ids[start:start + batch_size]
+            placeholders = ", ".join("?" for _ in batch)
+            rows = self.db.fetchall(
+                f"SELECT * FROM emails WHERE id IN ({placeholders})", tuple(batch)
+            )
+            by_id = {row["id"]: row for row in rows}
+            for email_id in batch:
+                if email_id in by_id:
+                    yield self._row_to_email(by_id[email_id])
+
+    def raw_stored(self, email_ids: list[int]) -> dict[int, bool]:
+        """Map each of these IDs that exists to whether its email's raw message was stored."""
+        if not email_ids:
+            return {}
+        placeholders = ", ".join("?" for _ in email_ids)
+        rows = self.db.fetchall(
+            f"SELECT id, redactions FROM emails WHERE id IN ({placeholders})", tuple(email_ids)
+        )
+        return {row["id"]: "raw" not in (row["redactions"] or "").split(",") for row in rows}
+
+    def search_count(self, **filters) -> int:
+        """Count the emails search() finds with the same filters."""
+        where, params = self._search_where(**filters)
+        row = self.db.fetchone(f"SELECT COUNT(*) as count FROM emails WHERE {where}", tuple(params))
+        return row["count"] if row else 0
+
+    def _search_where(
+        self,
+        text: str = "",
+        filename: str = "",
+        recipient: str = "",
+        sender: str = "",
+        canonical: str = "",
+        auth_user: str = "",
+        has_tracking: bool = False,
+        status: str = "",
+        since: datetime | None = None,
+        until: datetime | None = None,
+        label: str = "",
+        mailbox: str = "",
+    ) -> tuple[str, list]:
+        """Build the WHERE clause and parameters of a search."""
+        conditions = []
+        params: list = []
+        if text:
+            pattern = _like_pattern(text)
+            if self.db.fts5:
+                body = "id IN (SELECT rowid FROM emails_fts WHERE emails_fts MATCH ?)"
+                body_param = fts_query(text)
+            else:
+                body, body_param = "body LIKE ? ESCAPE '\\'", pattern
+            conditions.append(
+                "(sender LIKE ? ESCAPE '\\' OR subject LIKE ? ESCAPE '\\'"
+                " OR attachment_names LIKE ? ESCAPE '\\'"
+                " OR id IN (SELECT email_id FROM email_recipients"
+                " WHERE normalized_address LIKE ? ESCAPE '\\')"
+                " OR id IN (SELECT email_id FROM attachment_texts"
+                f" WHERE text LIKE ? ESCAPE '\\') OR {body})"
+            )
+            params.extend([pattern] * 5 + [body_param])
+        if filename:
+            conditions.append("attachment_names LIKE ? ESCAPE '\\'")
+            params.append(_like_pattern(filename))
+        if recipient:
+            conditions.append(
+                "id IN (SELECT email_id FROM email_recipients WHERE normalized_address = ?)"
+            )
+            params.append(normalize_address(recipient))
+        if canonical:
+            conditions.append(
+                "id IN (SELECT email_id FROM email_recipients WHERE canonical_address = ?)"
+            )
+            params.append(self.canonical_address(canonical))
+        if sender:
+            conditions.append("sender = ? COLLATE NOCASE")
+            params.append(sender.strip().strip("<>"))
+        if auth_user:
+            conditions.append("smtp_auth_user = ?")
+            params.append(auth_user)
+        if has_tracking:
+            conditions.append("tracking NOT IN ('', '[]')")
+        if status:
+            conditions.append("status = ?")
+            params.append(status)
+        if since:
+            conditions.append("received_at >= ?")
+            params.append(since.isoformat())
+        if until:
+            conditions.append("received_at < ?")
+            params.append(until.isoformat())
+        if label:
+            # Labels are stored comma-separated and never contain a comma
+            conditions.append("',' || labels || ',' LIKE ? ESCAPE '\\'")
+            params.append(f"%,{escape_like(label)},%")
+        if mailbox:
+            conditions.append("mailbox = ?")
+            params.append(mailbox)
+        return " AND ".join(conditions) or "1", params
+
+    def auth_users(self) -> list[str]:
+        """Return the distinct SMTP users that stored emails were sent as."""
+        query = """
+            SELECT DISTINCT smtp_auth_user FROM emails
+            WHERE smtp_auth_user != '' ORDER BY smtp_auth_user
+        """
+        return [row["smtp_auth_user"] for row in self.db.fetchall(query)]
+
+    def statuses(self) -> list[str]:
+        """Return the distinct statuses of stored emails."""
+        query = "SELECT DISTINCT status FROM emails ORDER BY status"
+        return [row["status"] for row in self.db.fetchall(query)]
+
+    def labels(self) -> list[str]:
+        """Return the distinct labels of stored emails."""
+        rows = self.db.fetchall("SELECT DISTINCT labels FROM emails WHERE labels != ''")
+        return sorted({label for row in rows for label in row["labels"].split(",") if label})
+
+    def mailboxes(self) -> list[str]:
+        """Return the distinct mailboxes stored emails were routed to."""
+        query = "SELECT DISTINCT mailbox FROM emails WHERE mailbox != '' ORDER BY mailbox"
+        return [row["mailbox"] for row in self.db.fetchall(query)]
+
+    def backfill_recipients(self, batch_size: int = 500) -> int:
+        """Populate email_recipients for emails stored before the table existed."""
+        updated = 0
+        last_id = 0
+        query = """
+            SELECT id, recipients, raw_message, raw_path FROM emails
+            WHERE id > ? AND id NOT IN (SELECT email_id FROM email_recipients)
+            ORDER BY id LIMIT ?
+        """
+        while True:
+            rows = self.db.fetchall(query, (last_id, batch_size))
+            if not rows:
+                break
+            for row in rows:
+                recipients = Email.parse_recipients_json(row["recipients"])
+                raw_message = self._stored_raw(row["raw_path"], row["raw_message"])
+                if self._insert_recipients(row["id"], recipients, raw_message):
+                    updated += 1
+            last_id = rows[-1]["id"]
+        return updated
+
+    def backfill_canonical_recipients(self, batch_size: int = 500) -> int:
+        """Fill in canonical addresses for recipients indexed before sub-addressing."""
+        updated = 0
+        last_id = 0
+        query = """
+            SELECT id, address FROM email_recipients
+            WHERE id > ? AND canonical_address = '' ORDER BY id LIMIT ?
+        """
+        while True:
+            rows = self.db.fetchall(query, (last_id, batch_size))
+            if not rows:
+                break
+            self.db.executemany(
+                "UPDATE email_recipients SET canonical_address = ? WHERE id = ?",
+                [(self.canonical_address(row["address"]), row["id"]) for row in rows],
+            )
+            updated += len(rows)
+            last_id = rows[-1]["id"]
+        return updated
+
+    def _insert_recipients(self, email_id: int, envelope: list[str], raw_message: bytes) -> int:
+        """Write the envelope and header recipients of an email and return the row count."""
+        params = self._recipient_rows(email_id, envelope, raw_message)
+        if params:
+            self.db.executemany(INSERT_RECIPIENT, params)
+        return len(params)
+
+    def _recipient_rows(
+        self, email_id: int, envelope: list[str], raw_message: bytes
+    ) -> list[tuple]:
+        """Build email_recipients rows for the envelope and header recipients of an email."""
+        headers = header_addresses(raw_message)
+        addresses = {
+            "envelope": envelope,
+            "to": [addr for _, addr in headers["to"]],
+            "cc": [addr for _, addr in headers["cc"]],
+        }
+        return [
+            (email_id, address, normalize_address(address), self.canonical_address(address), kind)
+            for kind in RECIPIENT_TYPES
+            for address in addresses.get(kind, [])
+        ]
+
+    def backfill_attachments(self, batch_size: int = 500) -> int:
+        """Index attachment filenames for emails stored before indexing existed."""
+        updated = 0
+        query = "SELECT id, raw_message, raw_path FROM emails WHERE attachments = '' LIMIT ?"
+        while True:
+            rows = self.db.fetchall(query, (batch_size,))
+            if not rows:
+                break
+            params = []
+            for row in rows:
+                raw_message = self._stored_raw(row["raw_path"], row["raw_message"])
+                email = Email(attachments=extract_attachments(raw_message))
+                params.append((email.attachments_json(), email.attachment_names(), row["id"]))
+            self.db.executemany(
+                "UPDATE emails SET attachments = ?, attachment_names = ? WHERE id = ?",
+                params,
+            )
+            updated += len(rows)
+        return updated
+
+    def backfill_previews(self, batch_size: int = 500) -> int:
+        """Compute list previews for emails stored before previews existed."""
+        updated = 0
+        query = "SELECT id, body FROM emails WHERE preview IS NULL LIMIT ?"
+        while True:
+            rows = self.db.fetchall(query, (batch_size,))
+            if not rows:
+                break
+            self.db.executemany(
+                "UPDATE emails SET preview = ? WHERE id = ?",
+                [(body_preview(row["body"]), row["id"]) for row in rows],
+            )
+            updated += len(rows)
+        return updated
+
+    def backfill_security(self, batch_size: int = 500) -> int:
+        """Detect signing and encryption for emails stored before it was recorded.
+
+        Emails whose raw message was not stored are recorded as neither.
+        """
+        updated = 0
+        query = "SELECT id, raw_message, raw_path FROM emails WHERE security IS NULL LIMIT ?"
+        while True:
+            rows = self.db.fetchall(query, (batch_size,))
+            if not rows:
+                break
+            self.db.executemany(
+                "UPDATE emails SET security = ? WHERE id = ?",
+                [
+                    (summarize(self._stored_raw(row["raw_path"], row["raw_message"])), row["id"])
+                    for row in rows
+                ],
+            )
+            updated += len(rows)
+        return updated
+
+    def backfill_subjects(self, batch_size: int = 500) -> int:
+        """Decode subjects that older versions stored encoded or lost.
+
+        Encoded-words in a charset the parser did not know were kept as
+        sent, and a broken one could leave the subject empty. Those are
+        decoded again from the raw message where it was kept. Hashed
+        subjects cannot be compared, so nothing is done while
+        privacy.hash_subject is on.
+        """
+        if self.redactor and self.redactor.config.hash_subject:
+            return 0
+        updated = 0
+        last_id = 0
+        query = """
+            SELECT id, subject, raw_message, raw_path FROM emails
+            WHERE id > ? AND (subject = '' OR subject LIKE '%=?%?=%')
+            AND (length(raw_message) > 0 OR raw_path != '')
+            ORDER BY id LIMIT ?
+        """
+        while True:
+            rows = self.db.fetchall(query, (last_id, batch_size))
+            if not rows:
+                break
+            params = []
+            for row in rows:
+                subject = extract_subject(self._stored_raw(row["raw_path"], row["raw_message"]))
+                if subject != row["subject"]:
+                    params.append((subject, row["id"]))
+            self.db.executemany("UPDATE emails SET subject = ? WHERE id = ?", params)
+            updated += len(params)
+            last_id = rows[-1]["id"]
+        return updated
+
+    def backfill_tracking(self, analyzer: TrackingAnalyzer, batch_size: int = 500) -> int:
+        """Analyze emails stored before tracking detection existed.
+
+        Emails whose raw message was not stored, or that fail to parse,
+        stay unanalyzed.
+        """
+        updated = 0
+        last_id = 0
+        query = """
+            SELECT id, raw_message, raw_path FROM emails
+            WHERE id > ? AND tracking = '' AND (length(raw_message) > 0 OR raw_path != '')
+            ORDER BY id LIMIT ?
+        """
+        while True:
+            rows = self.db.fetchall(query, (last_id, batch_size))
+            if not rows:
+                break
+            params = []
+            for row in rows:
+                raw_message = self._stored_raw(row["raw_path"], row["raw_message"])
+                email = Email(tracking=analyzer.analyze(raw_message))
+                if email.tracking is not None:
+                    params.append((email.tracking_json(), row["id"]))
+            self.db.executemany("UPDATE emails SET tracking = ? WHERE id = ?", params)
+            updated += len(params)
+            last_id = rows[-1]["id"]
+        return updated
+
     def count(self) -> int:
         """Get the total count of emails."""
+        return self.cache.get_or_compute("count", self._count)
+
+    def _count(self) -> int:
+        """Count all emails."""
         query = "SELECT COUNT(*) as count FROM emails"
         row = self.db.fetchone(query)
         return row["count"] if row else 0
 
     def _row_to_email(self, row) -> Email:
-        """Convert a database row to an Email object."""
+        """Convert a database row to an Email object.
+
+        Rows of LIST_COLUMNS give an email with an empty body and raw message.
+        """
         received_at = row["received_at"]
         if isinstance(received_at, str):
             received_at = datetime.fromisoformat(received_at)
+        listed = "raw_message" not in row.keys()
 
         return Email(
             id=row["id"],
             sender=row["sender"],
             recipients=Email.parse_recipients_json(row["recipients"]),
             subject=row["subject"],
-            body=row["body"],
-            raw_message=row["raw_message"],
+            body="" if listed else row["body"],
+            body_type=row["body_type"] or "",
+            preview=row["preview"] or "",
+            raw_message=(
+                b"" if listed else self._stored_raw(row["raw_path"], row["raw_message"], lazy=True)
+            ),
             size_bytes=row["size_bytes"],
             received_at=received_at,
             status=row["status"],
             auth_user=row["smtp_auth_user"],
             client_ip=row["client_ip"],
+            instance_id=row["instance_id"],
+            timing=Email.parse_timing_json(row["timing"]),
+            content_hash=row["content_hash"],
+            parse_error=row["parse_error"],
+            anomalies=row["anomalies"],
+            attachments=Email.parse_attachments_json(row["attachments"]),
+            relay_routes=Email.parse_relay_routes_json(row["relay_routes"]),
+            redactions=[r for r in (row["redactions"] or "").split(",") if r],
+            tracking=Email.parse_tracking_json(row["tracking"]),
+            tls_version=row["tls_version"],
+            tls_cipher=row["tls_cipher"] or "",
+            raw_path=row["raw_path"] or "",
+            stored_bytes=row["stored_bytes"] or 0,
+            security=row["security"],
+            labels=[label for label in (row["labels"] or "").split(",") if label],
+            mailbox=row["mailbox"] or "",
         )
+
+    def _stored_raw(self, raw_path: str, inline: bytes, lazy: bool = False):
+        """Return a row's raw message as received.
+
+        With lazy, messages kept in a file or compressed are returned as a
+        function that reads them, so listing emails does neither.
+        """
+        if not raw_path:
+            if lazy and inline.startswith(GZIP_MAGIC):
+                return partial(decompress_raw, inline)
+            return decompress_raw(inline)
+        if self.raw_store is None:
+            logger.error(f"Raw message file {raw_path} cannot be read without storage.dir")
+            return b""
+
+        def read() -> bytes:
+            return decompress_raw(self.raw_store.read(raw_path))
+
+        return read if lazy else read()
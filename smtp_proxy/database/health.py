@@ -0,0 +1,88 @@
+"""Storage error classification and circuit breaker."""
+
+import logging
+import sqlite3
+import threading
+import time
+
+logger = logging.getLogger(__name__)
+
+STORAGE_DISK_FULL = "disk_full"
+STORAGE_LOCKED = "locked"
+STORAGE_READ_ONLY = "read_only"
+STORAGE_IO = "io"
+
+# Substrings of SQLite error messages and the storage problem they indicate
+STORAGE_ERROR_PATTERNS = [
+    ("database or disk is full", STORAGE_DISK_FULL),
+    ("database is locked", STORAGE_LOCKED),
+    ("database table is locked", STORAGE_LOCKED),
+    ("readonly database", STORAGE_READ_ONLY),
+    ("disk i/o error", STORAGE_IO),
+    ("unable to open database file", STORAGE_IO),
+]
+
+
+def classify_storage_error(error: Exception) -> str | None:
+    """Return the kind of storage problem behind an error.
+
+    None means the error is not a storage problem, e.g. a bad query.
+    """
+    if not isinstance(error, sqlite3.Error):
+        return None
+    message = str(error).lower()
+    for pattern, kind in STORAGE_ERROR_PATTERNS:
+        if pattern in message:
+            return kind
+    return None
+
+
+class StorageBreaker:
+    """Tracks whether storage is usable.
+
+    The breaker opens on the first storage error and closes again on the
+    next successful write, whether from normal traffic or a probe.
+    """
+
+    def __init__(self):
+        self.kind: str | None = None
+        self.error = ""
+        self.opened_at: float | None = None
+        self._lock = threading.Lock()
+
+    @property
+    def is_open(self) -> bool:
+        """Check whether storage is currently considered unavailable."""
+        return self.opened_at is not None
+
+    def record_failure(self, error: Exception) -> None:
+        """Open the breaker if an error is a storage problem."""
+        kind = classify_storage_error(error)
+        if kind is None:
+            return
+        with self._lock:
+            if not self.is_open:
+                logger.error(f"Storage unavailable ({kind}): {error}")
+                self.opened_at = time.monotonic()
+            self.kind = kind
+            self.error = str(error)
+
+    def record_success(self) -> None:
+        """Close the breaker after a successful write."""
+        if not self.is_open:
+            return
+        with self._lock:
+            if self.opened_at is not None:
+                down_seconds = time.monotonic() - self.opened_at
+                logger.info(f"Storage available again after {down_seconds:.0f}s")
+            self.kind = None
+            self.error = ""
+            self.opened_at = None
+
+    def stats(self) -> dict:
+        """Return the breaker state for health reporting."""
+        return {
+            "state": "open" if self.is_open else "closed",
+            "kind": self.kind,
+            "error": self.error,
+        }
@@ -0,0 +1,180 @@
+"""Email change journal for database operations."""
+
+from datetime import datetime, timedelta
+import sqlite3
+
+from ..models import Email, JournalEntry
+from .connection import Database
+
+
+def journal_receive(conn: sqlite3.Connection, email_id: int, email: Email, actor: str) -> None:
+    """Record a newly stored email inside the caller's transaction."""
+    conn.execute(
+        """
+        INSERT INTO email_journal (occurred_at, action, email_id, actor, new_status,
+                                   sender, subject, size_bytes, received_at)
+        VALUES (?, 'receive', ?, ?, ?, ?, ?, ?, ?)
+        """,
+        (
+            datetime.now().isoformat(), email_id, actor, email.status,
+            email.sender, email.subject, email.size_bytes, email.received_at.isoformat(),
+        ),
+    )
+
+
+def journal_status(
+    conn: sqlite3.Connection, email_id: int, new_status: str, actor: str
+) -> None:
+    """Record a status change inside the caller's transaction, before it is applied."""
+    conn.execute(
+        """
+        INSERT INTO email_journal (occurred_at, action, email_id, actor, old_status,
+                                   new_status, sender, subject, size_bytes, received_at)
+        SELECT ?, 'status', id, ?, status, ?, sender, subject, size_bytes, received_at
+        FROM emails WHERE id = ? AND status != ?
+        """,
+        (datetime.now().isoformat(), actor, new_status, email_id, new_status),
+    )
+
+
+def journal_deletions(
+    conn: sqlite3.Connection, where: str, params: tuple, actor: str
+) -> None:
+    """Record tombstones for the emails matching where, before they are deleted."""
+    conn.execute(
+        f"""
+        INSERT INTO email_journal (occurred_at, action, email_id, actor, old_status,
+                                   sender, subject, size_bytes, received_at)
+        SELECT ?, 'delete', id, ?, status, sender, subject, size_bytes, received_at
+        FROM emails WHERE {where}
+        """,
+        (datetime.now().isoformat(), actor) + params,
+    )
+
+
+def journal_wipe(conn: sqlite3.Connection, count: int, actor: str) -> None:
+    """Record a wipe of all emails inside the caller's transaction."""
+    conn.execute(
+        "INSERT INTO email_journal (occurred_at, action, actor, count) VALUES (?, 'wipe', ?, ?)",
+        (datetime.now().isoformat(), actor, count),
+    )
+
+
+class JournalRepository:
+    """Repository for reading and pruning the email change journal.
+
+    Entries are written by EmailRepository in the same transaction as the
+    change they describe.
+    """
+
+    def __init__(self, db: Database):
+        self.db = db
+
+    def record(self, email_id: int, action: str, actor: str, detail: str) -> None:
+        """Record an event that does not change the email, such as a release."""
+        self.db.execute(
+            """
+            INSERT INTO email_journal (occurred_at, action, email_id, actor, old_status,
+                                       new_status, sender, subject, size_bytes,
+                                       received_at, detail)
+            SELECT ?, ?, id, ?, status, status, sender, subject, size_bytes, received_at, ?
+            FROM emails WHERE id = ?
+            """,
+            (datetime.now().isoformat(), action, actor, detail, email_id),
+        )
+
+    def for_email(self, email_id: int) -> list[JournalEntry]:
+        """Get the history of one email, oldest first."""
+        rows = self.db.fetchall(
+            "SELECT * FROM email_journal WHERE email_id = ? ORDER BY occurred_at, id",
+            (email_id,),
+        )
+        return [self._row_to_entry(row) for row in rows]
+
+    def recent(self, limit: int = 200) -> list[JournalEntry]:
+        """Get the most recent journal entries across all emails, newest first."""
+        rows = self.db.fetchall(
+            "SELECT * FROM email_journal ORDER BY occurred_at DESC, id DESC LIMIT ?",
+            (limit,),
+        )
+        return [self._row_to_entry(row) for row in rows]
+
+    def as_of(self, when: datetime, limit: int = 500) -> list[dict]:
+        """Reconstruct the email list as it was at a point in time.
+
+        Emails deleted since then come from their tombstones, and statuses
+        are rolled back through later status changes. The result is only
+        complete for times within the journal's retention.
+        """
+        when_iso = when.isoformat()
+        current = self.db.fetchall(
+            """
+            SELECT id, sender, subject, size_bytes, received_at, status FROM emails
+            WHERE received_at <= ? ORDER BY received_at DESC LIMIT ?
+            """,
+            (when_iso, limit),
+        )
+        deleted = self.db.fetchall(
+            """
+            SELECT email_id AS id, sender, subject, size_bytes, received_at,
+                   old_status AS status
+            FROM email_journal
+            WHERE action = 'delete' AND occurred_at > ? AND received_at <= ?
+            ORDER BY received_at DESC LIMIT ?
+            """,
+            (when_iso, when_iso, limit),
+        )
+        # The earliest change after the moment holds the status it had then
+        later_changes = self.db.fetchall(
+            """
+            SELECT email_id, old_status FROM email_journal
+            WHERE action = 'status' AND occurred_at > ?
+            ORDER BY occurred_at DESC, id DESC
+            """,
+            (when_iso,),
+        )
+        status_then = {row["email_id"]: row["old_status"] for row in later_changes}
+
+        snapshot = [
+            {
+                "id": row["id"],
+                "sender": row["sender"],
+                "subject": row["subject"],
+                "size_bytes": row["size_bytes"],
+                "received_at": datetime.fromisoformat(row["received_at"]),
+                "status": status_then.get(row["id"], row["status"]),
+                "deleted": is_deleted,
+            }
+            for rows, is_deleted in ((current, False), (deleted, True))
+            for row in rows
+        ]
+        snapshot.sort(key=lambda entry: entry["received_at"], reverse=True)
+        return snapshot[:limit]
+
+    def purge(self, retention_days: int) -> int:
+        """Delete entries older than the retention period and return the count."""
+        if retention_days <= 0:
+            return 0
+        cutoff = datetime.now() - timedelta(days=retention_days)
+        cursor = self.db.execute(
+            "DELETE FROM email_journal WHERE occurred_at < ?", (cutoff.isoformat(),)
+        )
+        return cursor.rowcount
+
+    def _row_to_entry(self, row) -> JournalEntry:
+        """Convert a database row to a JournalEntry."""
+        return JournalEntry(
+            id=row["id"],
+            occurred_at=datetime.fromisoformat(row["occurred_at"]),
+            action=row["action"],
+            email_id=row["email_id"],
+            actor=row["actor"],
+            old_status=row["old_status"],
+            new_status=row["new_status"],
+            sender=row["sender"],
+            subject=row["subject"],
+            size_bytes=row["size_bytes"],
+            received_at=datetime.fromisoformat(row["received_at"]) if row["received_at"] else None,
+            count=row["count"],
+            detail=row["detail"],
+        )
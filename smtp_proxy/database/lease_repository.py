@@ -0,0 +1,58 @@
+"""Background job lease repository for database operations."""
+
+from datetime import datetime, timedelta
+
+from .connection import Database
+
+
+class LeaseRepository:
+    """Repository for the leases that let one instance at a time run a job.
+
+    Instances sharing a database each run every background job loop, but
+    only the one holding a job's lease does the work. The holder renews
+    the lease each time it runs the job; once it stops, the lease expires
+    and another instance takes the job over. holder must be unique per
+    instance, which the instance ID is.
+    """
+
+    def __init__(self, db: Database, holder: str):
+        self.db = db
+        self.holder = holder
+
+    def acquire(self, name: str, seconds: float) -> bool:
+        """Take or renew the lease on a job, returning whether this instance holds it.
+
+        The check and update are one statement, so two instances racing
+        for an expired lease cannot both get it. Nothing is leased on a
+        read-only database.
+        """
+        if self.db.read_only:
+            return False
+        now = datetime.now()
+        query = """
+            INSERT INTO job_leases (name, holder, expires_at) VALUES (?, ?, ?)
+            ON CONFLICT(name) DO UPDATE
+            SET holder = excluded.holder, expires_at = excluded.expires_at
+            WHERE job_leases.holder = excluded.holder OR job_leases.expires_at <= ?
+        """
+        expires_at = now + timedelta(seconds=seconds)
+        cursor = self.db.execute(
+            query, (name, self.holder, expires_at.isoformat(), now.isoformat())
+        )
+        return cursor.rowcount > 0
+
+    def release(self, name: str) -> None:
+        """Give up the lease on a job if this instance holds it."""
+        if self.db.read_only:
+            return
+        self.db.execute(
+            "DELETE FROM job_leases WHERE name = ? AND holder = ?", (name, self.holder)
+        )
+
+    def holder_of(self, name: str) -> str | None:
+        """Return the instance holding an unexpired lease on a job, or None."""
+        row = self.db.fetchone(
+            "SELECT holder FROM job_leases WHERE name = ? AND expires_at > ?",
+            (name, datetime.now().isoformat()),
+        )
+        return row["holder"] if row else None
@@ -0,0 +1,124 @@
+"""Failed web sign-in and account lockout repository for database operations."""
+
+from datetime import datetime, timedelta
+
+from ..models import LoginAttempt, LoginLockout
+from .connection import Database
+
+
+def _datetime(value) -> datetime | None:
+    return datetime.fromisoformat(value) if isinstance(value, str) else value
+
+
+class LoginAttemptRepository:
+    """Repository for failed web sign-ins and the lockouts they cause.
+
+    Every failure is appended to login_attempts. Consecutive failures are
+    counted per attempted username in login_lockouts, for names that do
+    not exist too, so a lock says nothing about whether an account does.
+    """
+
+    def __init__(self, db: Database):
+        self.db = db
+
+    def get(self, username: str) -> LoginLockout | None:
+        """Get the failure count and lock of a username."""
+        row = self.db.fetchone("SELECT * FROM login_lockouts WHERE username = ?", (username,))
+        return self._row_to_lockout(row) if row else None
+
+    def locked_until(self, username: str) -> datetime | None:
+        """Return when a username's lock ends, or None if it is not locked."""
+        lockout = self.get(username)
+        return lockout.locked_until if lockout and lockout.locked else None
+
+    def record_failure(
+        self, username: str, source: str, max_failures: int, lock_minutes: int
+    ) -> datetime | None:
+        """Record a failed sign-in, returning when the lock ends if this one locked it.
+
+        A failure while locked is recorded without extending the lock.
+        Once a lock has expired the count starts over, so the user gets
+        max_failures more attempts. max_failures of 0 never locks. Nothing
+        is recorded on a read-only database.
+        """
+        if self.db.read_only:
+            return None
+        now = datetime.now()
+        with self.db.transaction() as conn:
+            conn.execute(
+                "INSERT INTO login_attempts (username, source, attempted_at) VALUES (?, ?, ?)",
+                (username, source, now.isoformat()),
+            )
+            row = conn.execute(
+                "SELECT * FROM login_lockouts WHERE username = ?", (username,)
+            ).fetchone()
+            lockout = self._row_to_lockout(row) if row else LoginLockout(username=username)
+            if lockout.locked:
+                return None
+            failures = 1 if lockout.locked_until else lockout.failures + 1
+            locked_until = None
+            if max_failures and failures >= max_failures:
+                locked_until = now + timedelta(minutes=lock_minutes)
+            conn.execute(
+                """
+                INSERT INTO login_lockouts (username, failures, last_failed_at, locked_until)
+                VALUES (?, ?, ?, ?)
+                ON CONFLICT(username) DO UPDATE SET failures = excluded.failures,
+                    last_failed_at = excluded.last_failed_at,
+                    locked_until = excluded.locked_until
+                """,
+                (
+                    username, failures, now.isoformat(),
+                    locked_until.isoformat() if locked_until else None,
+                ),
+            )
+        return locked_until
+
+    def reset(self, username: str) -> bool:
+        """Clear a username's failures and lock, returning whether it had any."""
+        if self.db.read_only:
+            return False
+        cursor = self.db.execute("DELETE FROM login_lockouts WHERE username = ?", (username,))
+        return cursor.rowcount > 0
+
+    def lockouts(self) -> list[LoginLockout]:
+        """Get every username with failures since its last sign-in, locked ones first."""
+        rows = self.db.fetchall(
+            "SELECT * FROM login_lockouts "
+            "ORDER BY locked_until IS NULL, locked_until DESC, last_failed_at DESC"
+        )
+        return [self._row_to_lockout(row) for row in rows]
+
+    def recent(self, limit: int = 100) -> list[LoginAttempt]:
+        """Get the most recent failed sign-ins, newest first."""
+        rows = self.db.fetchall(
+            "SELECT * FROM login_attempts ORDER BY attempted_at DESC, id DESC LIMIT ?", (limit,)
+        )
+        return [
+            LoginAttempt(
+                id=row["id"],
+                username=row["username"],
+                source=row["source"] or "",
+                attempted_at=_datetime(row["attempted_at"]),
+            )
+            for row in rows
+        ]
+
+    def purge(self, retention_days: int) -> int:
+        """Delete failed sign-ins older than the retention period and return the count."""
+        if retention_days <= 0:
+            return 0
+        cutoff = datetime.now() - timedelta(days=retention_days)
+        cursor = self.db.execute(
+            "DELETE FROM login_attempts WHERE attempted_at < ?", (cutoff.isoformat(),)
+        )
+        return cursor.rowcount
+
+    def _row_to_lockout(self, row) -> LoginLockout:
+        """Convert a database row to a LoginLockout."""
+        return LoginLockout(
+            username=row["username"],
+            failures=row["failures"],
+            last_failed_at=_datetime(row["last_failed_at"]),
+            locked_until=_datetime(row["locked_until"]),
+        )
@@ -0,0 +1,63 @@
+"""Daily SMTP message quota repository for database operations."""
+
+from datetime import datetime, timezone
+import sqlite3
+
+from .connection import Database
+
+
+class QuotaExceededError(Exception):
+    """Raised instead of storing an email from a user who has used up their quota."""
+
+
+def quota_day() -> str:
+    """Return the day quotas are currently counted against, in UTC."""
+    return datetime.now(timezone.utc).date().isoformat()
+
+
+def consume_quota(conn: sqlite3.Connection, username: str, limit: int) -> bool:
+    """Count one message against a user's quota inside the caller's transaction.
+
+    Returns False, counting nothing, if the quota is used up. The check and
+    increment are one statement, so concurrent sessions of the same user
+    cannot go over the limit together.
+    """
+    query = """
+        INSERT INTO smtp_quota_usage (username, day, messages)
+        VALUES (?, ?, 1)
+        ON CONFLICT(username, day) DO UPDATE SET messages = messages + 1
+        WHERE messages < ?
+    """
+    cursor = conn.execute(query, (username, quota_day(), limit))
+    return cursor.rowcount > 0
+
+
+class QuotaRepository:
+    """Repository for the messages each SMTP credential has sent per day.
+
+    Counts are kept per UTC day, so they survive restarts and roll over
+    at midnight UTC without any reset job.
+    """
+
+    def __init__(self, db: Database):
+        self.db = db
+
+    def used(self, username: str) -> int:
+        """Get how many messages a user has sent today."""
+        row = self.db.fetchone(
+            "SELECT messages FROM smtp_quota_usage WHERE username = ? AND day = ?",
+            (username, quota_day()),
+        )
+        return row["messages"] if row else 0
+
+    def usage_today(self) -> dict[str, int]:
+        """Get today's message count for every user that has sent one."""
+        rows = self.db.fetchall(
+            "SELECT username, messages FROM smtp_quota_usage WHERE day = ?", (quota_day(),)
+        )
+        return {row["username"]: row["messages"] for row in rows}
+
+    def prune(self) -> int:
+        """Delete the counts of earlier days, returning how many were removed."""
+        cursor = self.db.execute("DELETE FROM smtp_quota_usage WHERE day < ?", (quota_day(),))
+        return cursor.rowcount
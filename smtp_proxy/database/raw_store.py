@@ -0,0 +1,123 @@
+"""Raw message compression, and content-addressed files outside the SQLite store."""
+
+import gzip
+import hashlib
+import io
+import logging
+import os
+from pathlib import Path
+import tempfile
+from typing import BinaryIO
+import zlib
+
+logger = logging.getLogger(__name__)
+
+# Compressed raw messages are recognized by the gzip header, which no
+# RFC 5322 message starts with, so uncompressed ones need no flag
+GZIP_MAGIC = b"\x1f\x8b"
+# Most of the ratio of level 9 at a fraction of the CPU
+COMPRESS_LEVEL = 6
+
+# Prefix of files being written, which reconciliation ignores
+TEMP_PREFIX = ".tmp-"
+
+
+def compress_raw(raw_message: bytes) -> bytes:
+    """Gzip a raw message, or return it unchanged when that would not save space.
+
+    The gzip header carries no timestamp, so identical messages compress
+    to identical bytes and still share a content-addressed file.
+    """
+    compressed = gzip.compress(raw_message, compresslevel=COMPRESS_LEVEL, mtime=0)
+    return compressed if len(compressed) < len(raw_message) else raw_message
+
+
+def decompress_raw(stored: bytes) -> bytes:
+    """Return a stored raw message as received, whether or not it was compressed."""
+    if not stored.startswith(GZIP_MAGIC):
+        return stored
+    try:
+        return gzip.decompress(stored)
+    except (OSError, EOFError, zlib.error) as e:
+        logger.error(f"Compressed raw message cannot be read: {e}")
+        return stored
+
+
+class RawMessageStore:
+    """Stores raw messages as files named by the SHA-256 of their bytes.
+
+    Files are spread over subdirectories named by the first two hex
+    digits, and emails refer to them by that relative path. Identical
+    messages share one file, so a file may only be removed once no email
+    refers to it.
+    """
+
+    def __init__(self, directory: str):
+        self.directory = Path(directory)
+
+    def write(self, raw_message: bytes) -> str:
+        """Store a raw message unless it already is, and return its relative path.
+
+        The file is written under a temporary name and renamed, so a
+        crash never leaves a partial message under a content name.
+        """
+        digest = hashlib.sha256(raw_message).hexdigest()
+        relative = f"{digest[:2]}/{digest}"
+        target = self.directory / relative
+        if target.exists():
+            return relative
+        target.parent.mkdir(parents=True, exist_ok=True)
+        fd, temp_path = tempfile.mkstemp(prefix=TEMP_PREFIX, dir=target.parent)
+        try:
+            with os.fdopen(fd, "wb") as f:
+                f.write(raw_message)
+                f.flush()
+                os.fsync(f.fileno())
+            os.replace(temp_path, target)
+        except BaseException:
+            Path(temp_path).unlink(missing_ok=True)
+            raise
+        return relative
+
+    def read(self, relative: str) -> bytes:
+        """Read a stored raw message, or return nothing if its file is gone."""
+        try:
+            return (self.directory / relative).read_bytes()
+        except FileNotFoundError:
+            logger.error(f"Raw message file {self.directory / relative} is missing")
+            return b""
+
+    def open(self, relative: str) -> BinaryIO:
+        """Open a stored raw message for reading as received, decompressing as it is read.
+
+        A missing file is logged and read as empty, like read.
+        """
+        path = self.directory / relative
+        try:
+            with path.open("rb") as f:
+                compressed = f.read(len(GZIP_MAGIC)) == GZIP_MAGIC
+            return gzip.open(path, "rb") if compressed else path.open("rb")
+        except FileNotFoundError:
+            logger.error(f"Raw message file {path} is missing")
+            return io.BytesIO()
+
+    def delete(self, paths: set[str]) -> int:
+        """Remove stored raw messages and return how many files were removed."""
+        removed = 0
+        for relative in paths:
+            try:
+                (self.directory / relative).unlink()
+                removed += 1
+            except FileNotFoundError:
+                pass
+        return removed
+
+    def files(self) -> set[str]:
+        """Return the relative paths of every stored raw message."""
+        if not self.directory.is_dir():
+            return set()
+        return {
+            f"{path.parent.name}/{path.name}"
+            for path in self.directory.glob("??/*")
+            if path.is_file() and not path.name.startswith(TEMP_PREFIX)
+        }
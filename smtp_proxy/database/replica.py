@@ -0,0 +1,146 @@
+"""Warm standby snapshots of the SQLite store in a secondary directory."""
+
+from datetime import datetime
+import logging
+import os
+from pathlib import Path
+import shutil
+import sqlite3
+import threading
+
+from .connection import Database
+
+logger = logging.getLogger(__name__)
+
+SNAPSHOT_PREFIX = "snapshot-"
+SNAPSHOT_SUFFIX = ".db"
+
+
+class ReplicaError(Exception):
+    """Raised when no usable snapshot can be restored."""
+
+
+def list_snapshots(directory: str) -> list[Path]:
+    """Return the complete snapshots in a replica directory, newest first."""
+    path = Path(directory)
+    if not path.is_dir():
+        return []
+    snapshots = [
+        p for p in path.iterdir()
+        if p.name.startswith(SNAPSHOT_PREFIX) and p.suffix == SNAPSHOT_SUFFIX
+    ]
+    return sorted(snapshots, key=lambda p: p.name, reverse=True)
+
+
+def check_integrity(path: Path) -> str:
+    """Run SQLite's integrity check on a snapshot and return its verdict."""
+    conn = sqlite3.connect(f"file:{path}?mode=ro", uri=True)
+    try:
+        return conn.execute("PRAGMA integrity_check").fetchone()[0]
+    finally:
+        conn.close()
+
+
+def restore_replica(directory: str, target: str, force: bool = False) -> tuple[Path, int]:
+    """Copy the newest snapshot that passes an integrity check to target.
+
+    Returns the snapshot used and the number of emails it holds. Refuses
+    to overwrite an existing database unless force is set.
+    """
+    if Path(target).exists() and not force:
+        raise ReplicaError(f"{target} already exists; pass --force to overwrite it")
+    snapshots = list_snapshots(directory)
+    if not snapshots:
+        raise ReplicaError(f"No snapshots found in {directory}")
+
+    for snapshot in snapshots:
+        try:
+            verdict = check_integrity(snapshot)
+        except sqlite3.Error as e:
+            verdict = str(e)
+        if verdict != "ok":
+            logger.warning(f"Skipping snapshot {snapshot.name}: {verdict}")
+            continue
+        Path(target).parent.mkdir(parents=True, exist_ok=True)
+        partial = f"{target}.restoring"
+        shutil.copyfile(snapshot, partial)
+        os.replace(partial, target)
+        conn = sqlite3.connect(target)
+        try:
+            count = conn.execute("SELECT COUNT(*) FROM emails").fetchone()[0]
+        finally:
+            conn.close()
+        return snapshot, count
+    raise ReplicaError(f"No snapshot in {directory} passed the integrity check")
+
+
+class Replicator:
+    """Writes consistent snapshots of the database to a replica directory.
+
+    Snapshots use SQLite's online backup API, so each one is a complete
+    database as of a committed transaction. A snapshot is only taken when
+    something was written since the last one, and the newest keep
+    snapshots are retained.
+    """
+
+    def __init__(self, db: Database, directory: str, keep: int = 3):
+        self.db = db
+        self.directory = directory
+        self.keep = keep
+        self.last_success: datetime | None = None
+        self.last_error = ""
+        self.snapshots_taken = 0
+        self._replicated_changes: int | None = None
+        self._lock = threading.Lock()
+
+    def replicate(self) -> Path | None:
+        """Take a snapshot if the database changed, returning its path."""
+        with self._lock:
+            if self.db.total_changes() == self._replicated_changes:
+                self.last_success = datetime.now()
+                return None
+            Path(self.directory).mkdir(parents=True, exist_ok=True)
+            taken_at = datetime.now()
+            name = f"{SNAPSHOT_PREFIX}{taken_at.strftime('%Y%m%dT%H%M%S%f')}{SNAPSHOT_SUFFIX}"
+            final = Path(self.directory) / name
+            partial = final.with_suffix(".partial")
+            try:
+                changes = self.db.backup_to(str(partial))
+                with open(partial, "rb") as f:
+                    os.fsync(f.fileno())
+                os.replace(partial, final)
+            except (OSError, sqlite3.Error) as e:
+                self.last_error = str(e)
+                partial.unlink(missing_ok=True)
+                raise
+            self._replicated_changes = changes
+            self.last_success = taken_at
+            self.last_error = ""
+            self.snapshots_taken += 1
+            self._prune()
+            return final
+
+    def _prune(self) -> None:
+        """Delete snapshots beyond the retention count."""
+        for old in list_snapshots(self.directory)[self.keep :]:
+            try:
+                old.unlink()
+            except OSError as e:
+                logger.warning(f"Failed to remove old snapshot {old}: {e}")
+
+    def stats(self) -> dict:
+        """Return replication state for health reporting.
+
+        lag_seconds is the time since the replica was last known to match
+        the database, or None before the first snapshot.
+        """
+        lag = None
+        if self.last_success:
+            lag = round((datetime.now() - self.last_success).total_seconds())
+        return {
+            "path": self.directory,
+            "last_success": self.last_success.isoformat() if self.last_success else None,
+            "lag_seconds": lag,
+            "last_error": self.last_error,
+            "snapshots_taken": self.snapshots_taken,
+        }
@@ -0,0 +1,112 @@
+"""Rule repository for database operations."""
+
+from datetime import datetime
+
+from ..models import Rule
+from .connection import Database
+
+
+class RuleRepository:
+    """Repository for rule CRUD operations."""
+
+    def __init__(self, db: Database):
+        self.db = db
+
+    def create(self, rule: Rule) -> int:
+        """Create a new rule and return its ID."""
+        query = """
+            INSERT INTO rules (name, priority, enabled, sender_pattern, recipient_pattern,
+                               subject_pattern, auth_user, min_size_bytes, action,
+                               action_value, created_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        """
+        cursor = self.db.execute(
+            query,
+            (
+                rule.name,
+                rule.priority,
+                int(rule.enabled),
+                rule.sender_pattern,
+                rule.recipient_pattern,
+                rule.subject_pattern,
+                rule.auth_user,
+                rule.min_size_bytes,
+                rule.action,
+                rule.action_value,
+                datetime.now().isoformat(),
+            ),
+        )
+        return cursor.lastrowid
+
+    def update(self, rule: Rule) -> bool:
+        """Update an existing rule."""
+        query = """
+            UPDATE rules SET name = ?, priority = ?, enabled = ?, sender_pattern = ?,
+                             recipient_pattern = ?, subject_pattern = ?, auth_user = ?,
+                             min_size_bytes = ?, action = ?, action_value = ?
+            WHERE id = ?
+        """
+        cursor = self.db.execute(
+            query,
+            (
+                rule.name,
+                rule.priority,
+                int(rule.enabled),
+                rule.sender_pattern,
+                rule.recipient_pattern,
+                rule.subject_pattern,
+                rule.auth_user,
+                rule.min_size_bytes,
+                rule.action,
+                rule.action_value,
+                rule.id,
+            ),
+        )
+        return cursor.rowcount > 0
+
+    def get_by_id(self, rule_id: int) -> Rule | None:
+        """Get a rule by its ID."""
+        query = "SELECT * FROM rules WHERE id = ?"
+        row = self.db.fetchone(query, (rule_id,))
+        if row is None:
+            return None
+        return self._row_to_rule(row)
+
+    def get_all(self) -> list[Rule]:
+        """Get all rules in evaluation order."""
+        query = "SELECT * FROM rules ORDER BY priority ASC, id ASC"
+        rows = self.db.fetchall(query)
+        return [self._row_to_rule(row) for row in rows]
+
+    def get_enabled(self) -> list[Rule]:
+        """Get enabled rules in evaluation order."""
+        query = "SELECT * FROM rules WHERE enabled = 1 ORDER BY priority ASC, id ASC"
+        rows = self.db.fetchall(query)
+        return [self._row_to_rule(row) for row in rows]
+
+    def delete(self, rule_id: int) -> bool:
+        """Delete a rule."""
+        query = "DELETE FROM rules WHERE id = ?"
+        cursor = self.db.execute(query, (rule_id,))
+        return cursor.rowcount > 0
+
+    def _row_to_rule(self, row) -> Rule:
+        """Convert a database row to a Rule object."""
+        created_at = row["created_at"]
+        if isinstance(created_at, str):
+            created_at = datetime.fromisoformat(created_at)
+
+        return Rule(
+            id=row["id"],
+            name=row["name"],
+            priority=row["priority"],
+            enabled=bool(row["enabled"]),
+            sender_pattern=row["sender_pattern"],
+            recipient_pattern=row["recipient_pattern"],
+            subject_pattern=row["subject_pattern"],
+            auth_user=row["auth_user"],
+            min_size_bytes=row["min_size_bytes"],
+            action=row["action"],
+            action_value=row["action_value"],
+            created_at=created_at,
+        )
@@ -0,0 +1,131 @@
+"""SMTP credential repository for database operations."""
+
+import secrets
+from datetime import datetime
+
+import bcrypt
+
+from ..models import SMTPUser
+from .connection import Database
+
+GENERATED_PASSWORD_BYTES = 18
+
+
+class SMTPCredentialRepository:
+    """Repository for SMTP AUTH users managed in the web UI.
+
+    Passwords are generated, shown once and stored as bcrypt hashes.
+    """
+
+    def __init__(self, db: Database):
+        self.db = db
+
+    def get_all(self) -> list[SMTPUser]:
+        """Get all SMTP users ordered by username."""
+        rows = self.db.fetchall("SELECT * FROM smtp_credentials ORDER BY username")
+        return [self._row_to_user(row) for row in rows]
+
+    def get_by_id(self, user_id: int) -> SMTPUser | None:
+        """Get an SMTP user by ID."""
+        row = self.db.fetchone("SELECT * FROM smtp_credentials WHERE id = ?", (user_id,))
+        return self._row_to_user(row) if row else None
+
+    def get_by_username(self, username: str) -> SMTPUser | None:
+        """Get an SMTP user by username."""
+        row = self.db.fetchone("SELECT * FROM smtp_credentials WHERE username = ?", (username,))
+        return self._row_to_user(row) if row else None
+
+    def exists(self, username: str) -> bool:
+        """Check if an SMTP user with the given username exists."""
+        row = self.db.fetchone("SELECT 1 FROM smtp_credentials WHERE username = ?", (username,))
+        return row is not None
+
+    def create(self, username: str) -> tuple[int, str]:
+        """Create an SMTP user with a generated password, returning its ID and the password."""
+        password = secrets.token_urlsafe(GENERATED_PASSWORD_BYTES)
+        query = """
+            INSERT INTO smtp_credentials (username, password_hash, created_at)
+            VALUES (?, ?, ?)
+        """
+        cursor = self.db.execute(
+            query, (username, self._hash_password(password), datetime.now().isoformat())
+        )
+        return cursor.lastrowid, password
+
+    def regenerate_password(self, user_id: int) -> str | None:
+        """Replace an SMTP user's password with a new generated one and return it."""
+        password = secrets.token_urlsafe(GENERATED_PASSWORD_BYTES)
+        cursor = self.db.execute(
+            "UPDATE smtp_credentials SET password_hash = ? WHERE id = ?",
+            (self._hash_password(password), user_id),
+        )
+        return password if cursor.rowcount > 0 else None
+
+    def set_disabled(self, user_id: int, disabled: bool) -> bool:
+        """Disable or re-enable an SMTP user."""
+        cursor = self.db.execute(
+            "UPDATE smtp_credentials SET disabled = ? WHERE id = ?", (int(disabled), user_id)
+        )
+        return cursor.rowcount > 0
+
+    def set_allowed_senders(self, user_id: int, patterns: list[str]) -> bool:
+        """Replace an SMTP user's MAIL FROM allowlist; an empty list allows any sender."""
+        cursor = self.db.execute(
+            "UPDATE smtp_credentials SET allowed_senders = ? WHERE id = ?",
+            ("\n".join(patterns), user_id),
+        )
+        return cursor.rowcount > 0
+
+    def set_max_messages_per_day(self, user_id: int, limit: int) -> bool:
+        """Set an SMTP user's daily message quota; 0 removes it."""
+        cursor = self.db.execute(
+            "UPDATE smtp_credentials SET max_messages_per_day = ? WHERE id = ?", (limit, user_id)
+        )
+        return cursor.rowcount > 0
+
+    def verify(self, username: str, password: str) -> bool | None:
+        """Check a username and password.
+
+        Returns None when no such user is stored, so callers can fall back
+        to other credentials, and False for a disabled user whatever the
+        password. A successful check records when the user last signed in.
+        """
+        user = self.get_by_username(username)
+        if user is None:
+            return None
+        if user.disabled:
+            return False
+        try:
+            matched = bcrypt.checkpw(password.encode(), user.password_hash.encode())
+        except ValueError:
+            return False
+        if matched:
+            self.db.execute(
+                "UPDATE smtp_credentials SET last_used_at = ? WHERE id = ?",
+                (datetime.now().isoformat(), user.id),
+            )
+        return matched
+
+    def _hash_password(self, password: str) -> str:
+        """Hash a password with bcrypt."""
+        return bcrypt.hashpw(password.encode(), bcrypt.gensalt()).decode()
+
+    def _row_to_user(self, row) -> SMTPUser:
+        """Convert a database row to an SMTPUser object."""
+        created_at = row["created_at"]
+        if isinstance(created_at, str):
+            created_at = datetime.fromisoformat(created_at)
+        last_used_at = row["last_used_at"]
+        if isinstance(last_used_at, str):
+            last_used_at = datetime.fromisoformat(last_used_at)
+
+        return SMTPUser(
+            id=row["id"],
+            username=row["username"],
+            password_hash=row["password_hash"],
+            disabled=bool(row["disabled"]),
+            created_at=created_at,
+            last_used_at=last_used_at,
+            allowed_senders=(row["allowed_senders"] or "").split(),
+            max_messages_per_day=row["max_messages_per_day"] or 0,
+        )
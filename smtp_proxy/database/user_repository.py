@@ -1,31 +1,44 @@
 """User repository for database operations."""
 
-import hashlib
+import logging
 import secrets
 from datetime import datetime
 
 from ..models import User
+from ..passwords import BcryptHasher, Passwords
 from .connection import Database
 
+logger = logging.getLogger(__name__)
+
+GENERATED_PASSWORD_BYTES = 12
+
+
+def generate_password() -> str:
+    """Return a random password for a new user or a reset."""
+    return secrets.token_urlsafe(GENERATED_PASSWORD_BYTES)
+
 
 class UserRepository:
-    """Repository for user CRUD operations."""
+    """Repository for user CRUD operations.
 
-    HASH_ITERATIONS = 100000
+    Passwords are hashed with the configured algorithm, and checked
+    against whichever one their stored hash names.
+    """
 
-    def __init__(self, db: Database):
+    def __init__(self, db: Database, passwords: Passwords | None = None):
         self.db = db
+        self.passwords = passwords or Passwords(BcryptHasher())
 
-    def create(self, username: str, password: str) -> int:
+    def create(self, username: str, password: str, role: str = "admin") -> int:
         """Create a new user and return their ID."""
-        password_hash = self._hash_password(password)
+        password_hash = self.passwords.hash(password)
         query = """
-            INSERT INTO users (username, password_hash, created_at)
-            VALUES (?, ?, ?)
+            INSERT INTO users (username, password_hash, created_at, role)
+            VALUES (?, ?, ?, ?)
         """
         cursor = self.db.execute(
             query,
-            (username, password_hash, datetime.now().isoformat()),
+            (username, password_hash, datetime.now().isoformat(), role),
         )
         return cursor.lastrowid
 
@@ -37,6 +50,11 @@ class UserRepository:
             return None
         return self._row_to_user(row)
 
+    def get_all(self) -> list[User]:
+        """Get all users ordered by username."""
+        rows = self.db.fetchall("SELECT * FROM users ORDER BY username")
+        return [self._row_to_user(row) for row in rows]
+
     def get_by_id(self, user_id: int) -> User | None:
         """Get a user by their ID."""
         query = "SELECT * FROM users WHERE id = ?"
@@ -46,42 +64,93 @@ class UserRepository:
         return self._row_to_user(row)
 
     def verify_password(self, user: User, password: str) -> bool:
-        """Verify a password against the stored hash."""
-        try:
-            salt, stored_hash = user.password_hash.split("$")
-            computed_hash = hashlib.pbkdf2_hmac(
-                "sha256",
-                password.encode(),
-                salt.encode(),
-                self.HASH_ITERATIONS,
-            ).hex()
-            return secrets.compare_digest(computed_hash, stored_hash)
-        except (ValueError, AttributeError):
-            return False
+        """Verify a password against the stored hash, whatever its algorithm."""
+        return self.passwords.verify(password, user.password_hash)
+
+    def authenticate(self, username: str, password: str) -> User | None:
+        """Return the user if the username and password match, otherwise None.
+
+        An unknown username still costs one hash computation, so the time
+        taken does not reveal whether the user exists. An inactive user's
+        password is checked too, and then refused like a wrong one. A
+        password stored with another algorithm or parameters than
+        configured is rehashed once it has matched, unless the database
+        is read-only.
+        """
+        user = self.get_by_username(username)
+        if user is None:
+            self.passwords.hash(password)
+            return None
+        if not self.verify_password(user, password) or not user.active:
+            return None
+        if not self.db.read_only and self.passwords.needs_rehash(user.password_hash):
+            # The password is only known now, so this is the time to move
+            # it to the configured algorithm and parameters
+            if self.rehash_password(user.id, user.password_hash, password):
+                logger.info(
+                    f"Rehashed password of user {username} with {self.passwords.hasher.name}"
+                )
+        return user
 
     def update_password(self, user_id: int, new_password: str) -> bool:
         """Update a user's password."""
-        password_hash = self._hash_password(new_password)
+        password_hash = self.passwords.hash(new_password)
         query = "UPDATE users SET password_hash = ? WHERE id = ?"
         cursor = self.db.execute(query, (password_hash, user_id))
         return cursor.rowcount > 0
 
+    def rehash_password(self, user_id: int, old_hash: str, password: str) -> bool:
+        """Replace a verified password's hash if it is still the one that was checked.
+
+        Concurrent sign-ins of the same user may all find the old hash;
+        only the first to write replaces it, and the others leave the new
+        hash alone rather than replacing it again.
+        """
+        password_hash = self.passwords.hash(password)
+        cursor = self.db.execute(
+            "UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?",
+            (password_hash, user_id, old_hash),
+        )
+        return cursor.rowcount > 0
+
+    def reset_password(self, user_id: int) -> str | None:
+        """Replace a user's password with a generated one and return it."""
+        password = generate_password()
+        return password if self.update_password(user_id, password) else None
+
+    def set_active(self, user_id: int, active: bool) -> bool:
+        """Activate or deactivate a user."""
+        cursor = self.db.execute("UPDATE users SET active = ? WHERE id = ?", (int(active), user_id))
+        return cursor.rowcount > 0
+
+    def set_role(self, user_id: int, role: str) -> bool:
+        """Change a user's role."""
+        cursor = self.db.execute("UPDATE users SET role = ? WHERE id = ?", (role, user_id))
+        return cursor.rowcount > 0
+
+    def delete(self, user_id: int) -> bool:
+        """Delete a user."""
+        cursor = self.db.execute("DELETE FROM users WHERE id = ?", (user_id,))
+        return cursor.rowcount > 0
+
     def exists(self, username: str) -> bool:
         """Check if a user with the given username exists."""
         query = "SELECT 1 FROM users WHERE username = ? LIMIT 1"
         row = self.db.fetchone(query, (username,))
         return row is not None
 
-    def _hash_password(self, password: str) -> str:
-        """Hash a password with a random salt using PBKDF2."""
-        salt = secrets.token_hex(16)
-        hash_value = hashlib.pbkdf2_hmac(
-            "sha256",
-            password.encode(),
-            salt.encode(),
-            self.HASH_ITERATIONS,
-        ).hex()
-        return f"{salt}${hash_value}"
+    def count(self) -> int:
+        """Get the total count of users."""
+        query = "SELECT COUNT(*) as count FROM users"
+        row = self.db.fetchone(query)
+        return row["count"] if row else 0
+
+    def count_active_admins(self) -> int:
+        """Get the count of admins who can sign in."""
+        row = self.db.fetchone(
+            "SELECT COUNT(*) AS count FROM users WHERE active = 1 AND role = 'admin'"
+        )
+        return row["count"] if row else 0
 
     def _row_to_user(self, row) -> User:
         """Convert a database row to a User object."""
@@ -94,4 +163,6 @@ class UserRepository:
             username=row["username"],
             password_hash=row["password_hash"],
             created_at=created_at,
+            active=bool(row["active"]),
+            role=row["role"] or "admin",
         )
@@ -0,0 +1,127 @@
+"""Line-based text diffing with intra-line highlighting."""
+
+from dataclasses import dataclass, field
+from difflib import SequenceMatcher
+from itertools import zip_longest
+
+# Inputs longer than this are cut before diffing to keep the view usable
+MAX_DIFF_CHARS = 200_000
+
+KIND_EQUAL = "equal"
+KIND_DELETE = "delete"
+KIND_INSERT = "insert"
+KIND_CHANGE = "change"
+
+
+@dataclass
+class Segment:
+    """A run of characters within a line, flagged when it changed."""
+    text: str
+    changed: bool = False
+
+
+@dataclass
+class DiffLine:
+    """One row of a side-by-side diff.
+
+    Deleted rows only have a left side, inserted rows only a right side,
+    and changed rows have both with the differing characters flagged.
+    """
+    kind: str
+    left_no: int | None = None
+    right_no: int | None = None
+    left: list[Segment] = field(default_factory=list)
+    right: list[Segment] = field(default_factory=list)
+
+
+@dataclass
+class DiffResult:
+    """Rows of a diff plus whether either input was truncated."""
+    lines: list[DiffLine] = field(default_factory=list)
+    truncated: bool = False
+
+    @property
+    def identical(self) -> bool:
+        return all(line.kind == KIND_EQUAL for line in self.lines)
+
+    def to_dict(self) -> dict:
+        """Return a JSON-serialisable representation."""
+        return {
+            "identical": self.identical,
+            "truncated": self.truncated,
+            "lines": [
+                {
+                    "kind": line.kind,
+                    "left_no": line.left_no,
+                    "right_no": line.right_no,
+                    "left": [s.__dict__ for s in line.left],
+                    "right": [s.__dict__ for s in line.right],
+                }
+                for line in self.lines
+            ],
+        }
+
+
+def _intraline(a: str, b: str) -> tuple[list[Segment], list[Segment]]:
+    """Split two lines into segments flagging the characters that differ."""
+    left: list[Segment] = []
+    right: list[Segment] = []
+    matcher = SequenceMatcher(None, a, b, autojunk=False)
+    for tag, i1, i2, j1, j2 in matcher.get_opcodes():
+        changed = tag != "equal"
+        if i2 > i1:
+            left.append(Segment(a[i1:i2], changed))
+        if j2 > j1:
+            right.append(Segment(b[j1:j2], changed))
+    return left, right
+
+
+def diff_text(a: str, b: str, max_chars: int = MAX_DIFF_CHARS) -> DiffResult:
+    """Diff two texts line by line."""
+    result = DiffResult()
+    if len(a) > max_chars or len(b) > max_chars:
+        result.truncated = True
+        a, b = a[:max_chars], b[:max_chars]
+
+    a_lines = a.splitlines()
+    b_lines = b.splitlines()
+    matcher = SequenceMatcher(None, a_lines, b_lines)
+
+    for tag, i1, i2, j1, j2 in matcher.get_opcodes():
+        if tag == "equal":
+            for offset in range(i2 - i1):
+                line = a_lines[i1 + offset]
+                result.lines.append(
+                    DiffLine(
+                        KIND_EQUAL,
+                        i1 + offset + 1,
+                        j1 + offset + 1,
+                        [Segment(line)],
+                        [Segment(line)],
+                    )
+                )
+            continue
+
+        # Pair replaced lines for intra-line highlighting; leftovers on
+        # either side become plain deletions or insertions
+        pairs = zip_longest(range(i1, i2), range(j1, j2))
+        for left_idx, right_idx in pairs:
+            if left_idx is not None and right_idx is not None:
+                left, right = _intraline(a_lines[left_idx], b_lines[right_idx])
+                result.lines.append(
+                    DiffLine(KIND_CHANGE, left_idx + 1, right_idx + 1, left, right)
+                )
+            elif left_idx is not None:
+                result.lines.append(
+                    DiffLine(
+                        KIND_DELETE, left_no=left_idx + 1, left=[Segment(a_lines[left_idx])]
+                    )
+                )
+            else:
+                result.lines.append(
+                    DiffLine(
+                        KIND_INSERT, right_no=right_idx + 1, right=[Segment(b_lines[right_idx])]
+                    )
+                )
+
+    return result
@@ -0,0 +1,101 @@
+"""In-process broadcast of newly stored emails to web clients."""
+
+import asyncio
+from dataclasses import asdict, dataclass
+import logging
+
+from .models import Email
+
+logger = logging.getLogger(__name__)
+
+# Events held for a client that has not read them yet; later ones are dropped
+QUEUE_SIZE = 100
+
+
+@dataclass
+class EmailEvent:
+    """A newly stored email, as announced to the email list."""
+    id: int
+    sender: str
+    subject: str
+    received_at: str
+
+    @classmethod
+    def from_email(cls, email: Email) -> "EmailEvent":
+        """Describe a stored email; its subject is hashed if it was stored hashed."""
+        return cls(email.id, email.sender, email.subject, email.received_at.isoformat())
+
+    def to_dict(self) -> dict:
+        """Return the event as the JSON data of a server-sent event."""
+        return asdict(self)
+
+
+class Subscription:
+    """One client's queue of events, and how many were dropped since it last read."""
+
+    def __init__(self, size: int):
+        self.queue: asyncio.Queue[EmailEvent | None] = asyncio.Queue(maxsize=size)
+        self.dropped = 0
+
+    async def get(self) -> EmailEvent | None:
+        """Wait for the next event; None means the broadcaster was closed."""
+        return await self.queue.get()
+
+    def take_dropped(self) -> int:
+        """Return the number of events dropped since the last call, and reset it."""
+        dropped, self.dropped = self.dropped, 0
+        return dropped
+
+
+class EmailEvents:
+    """Fans out email events to every subscribed client without ever waiting.
+
+    Events are only seen by subscribers on this process, so with split
+    deployments a web node hears nothing from a separate SMTP node. A
+    client that falls QUEUE_SIZE events behind misses the ones that
+    follow, and is told how many it missed, instead of slowing the
+    publisher.
+    """
+
+    def __init__(self, queue_size: int = QUEUE_SIZE):
+        self.queue_size = queue_size
+        self.closed = False
+        self._subscribers: set[Subscription] = set()
+
+    @property
+    def active(self) -> bool:
+        """Check whether any client is listening."""
+        return bool(self._subscribers)
+
+    def subscribe(self) -> Subscription:
+        """Start queueing events for a new client."""
+        subscription = Subscription(self.queue_size)
+        if self.closed:
+            subscription.queue.put_nowait(None)
+        else:
+            self._subscribers.add(subscription)
+        return subscription
+
+    def unsubscribe(self, subscription: Subscription) -> None:
+        """Stop queueing events for a client."""
+        self._subscribers.discard(subscription)
+
+    def publish(self, event: EmailEvent) -> None:
+        """Queue an event for every client, dropping it for those whose queue is full."""
+        for subscription in list(self._subscribers):
+            try:
+                subscription.queue.put_nowait(event)
+            except asyncio.QueueFull:
+                subscription.dropped += 1
+
+    def close(self) -> None:
+        """End every client's stream, as on shutdown."""
+        self.closed = True
+        for subscription in list(self._subscribers):
+            # The end of the stream matters more than events it will never send
+            while subscription.queue.full():
+                subscription.queue.get_nowait()
+            subscription.queue.put_nowait(None)
+        if self._subscribers:
+            logger.info(f"Closed {len(self._subscribers)} live update stream(s)")
+        self._subscribers.clear()
@@ -0,0 +1,128 @@
+"""Export of stored emails as .eml files, mbox files and zip archives, and their attachments."""
+
+from datetime import datetime
+from typing import BinaryIO, Callable, Iterable, Iterator
+from urllib.parse import quote
+import re
+import unicodedata
+import zipfile
+
+from .models import Email
+
+# Downloads are streamed in chunks of this size
+CHUNK_BYTES = 64 * 1024
+
+# Characters of the subject kept in a download's filename
+FILENAME_SUBJECT_CHARS = 60
+FILENAME_UNSAFE = re.compile(r"[^A-Za-z0-9._-]+")
+
+# The envelope sender written for bounces, which have none
+NULL_SENDER_NAME = "MAILER-DAEMON"
+
+# mboxrd quotes every line that would read as a separator once unquoted
+FROM_LINE = re.compile(rb"^(>*From )", re.MULTILINE)
+WHITESPACE = re.compile(r"\s+")
+
+
+def subject_slug(email: Email) -> str:
+    """Return the subject of an email in characters safe in any filename, or ""."""
+    if email.subject_hashed:
+        return ""
+    ascii_subject = unicodedata.normalize("NFKD", email.subject).encode("ascii", "ignore")
+    slug = FILENAME_UNSAFE.sub("-", ascii_subject.decode()).strip("-.")
+    return slug[:FILENAME_SUBJECT_CHARS].rstrip("-.")
+
+
+def content_disposition(filename: str, disposition: str = "attachment") -> str:
+    """Build a Content-Disposition header that saves a file under its own name.
+
+    Names outside ASCII are sent as RFC 6266 filename*, with an ASCII
+    fallback for older clients.
+    """
+    ascii_name = unicodedata.normalize("NFKD", filename).encode("ascii", "ignore").decode()
+    fallback = FILENAME_UNSAFE.sub("_", ascii_name).strip("_") or "download"
+    return f"{disposition}; filename=\"{fallback}\"; filename*=UTF-8''{quote(filename, safe='')}"
+
+
+def read_chunks(f: BinaryIO) -> Iterator[bytes]:
+    """Yield a file in download-sized chunks, closing it at the end."""
+    with f:
+        while chunk := f.read(CHUNK_BYTES):
+            yield chunk
+
+
+def from_line(sender: str, received_at: datetime) -> bytes:
+    """Build the separator line that starts a message in an mbox file."""
+    sender = WHITESPACE.sub("", sender.strip("<>")) or NULL_SENDER_NAME
+    return f"From {sender} {received_at.ctime()}\n".encode("ascii", "replace")
+
+
+def mboxrd_message(email: Email) -> bytes:
+    """Return an email as one mboxrd entry: separator, quoted message and a blank line.
+
+    Lines are written with LF endings, as mail clients expect of mbox files.
+    """
+    message = email.raw_message.replace(b"\r\n", b"\n")
+    message = FROM_LINE.sub(rb">\1", message)
+    if not message.endswith(b"\n"):
+        message += b"\n"
+    return from_line(email.sender, email.received_at) + message + b"\n"
+
+
+def mbox_chunks(emails: Iterable[Email]) -> Iterator[bytes]:
+    """Yield an mboxrd file of emails one message at a time.
+
+    Emails stored without their raw message have nothing to export and
+    are left out.
+    """
+    for email in emails:
+        if not email.raw_redacted:
+            yield mboxrd_message(email)
+
+
+def zip_entry_name(email: Email) -> str:
+    """Name an email's entry in a zip archive, e.g. 0042-Quarterly-report.eml.
+
+    The ID prefix keeps names unique however many emails share a subject.
+    """
+    return f"{email.id:04d}-{subject_slug(email) or 'no-subject'}.eml"
+
+
+class _ChunkBuffer:
+    """A write-only file that hands over what was written since it was last taken."""
+
+    def __init__(self):
+        self.chunks: list[bytes] = []
+
+    def write(self, data: bytes) -> int:
+        self.chunks.append(bytes(data))
+        return len(data)
+
+    def flush(self) -> None:
+        pass
+
+    def take(self) -> bytes:
+        data = b"".join(self.chunks)
+        self.chunks.clear()
+        return data
+
+
+def zip_chunks(emails: Iterable[Email], open_raw: Callable[[Email], BinaryIO]) -> Iterator[bytes]:
+    """Yield a zip archive with one .eml entry per email, as it is written.
+
+    The archive goes to a buffer that is emptied after every chunk of
+    message read, so neither the archive nor any one message is held
+    whole in memory.
+    """
+    buffer = _ChunkBuffer()
+    with zipfile.ZipFile(buffer, "w", compression=zipfile.ZIP_DEFLATED) as archive:
+        for email in emails:
+            info = zipfile.ZipInfo(zip_entry_name(email), email.received_at.timetuple()[:6])
+            info.compress_type = zipfile.ZIP_DEFLATED
+            with open_raw(email) as raw, archive.open(info, "w") as entry:
+                while chunk := raw.read(CHUNK_BYTES):
+                    entry.write(chunk)
+                    if data := buffer.take():
+                        yield data
+    if data := buffer.take():
+        yield data
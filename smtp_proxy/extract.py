@@ -0,0 +1,557 @@
+"""Extraction of subject and body from raw received messages."""
+
+from dataclasses import dataclass, field
+from email import message_from_bytes
+from typing import Iterator
+from email.message import Message
+from email.parser import BytesHeaderParser
+from email.policy import compat32, default as email_policy
+from email.utils import getaddresses
+from html.parser import HTMLParser
+import base64
+import binascii
+import codecs
+import logging
+import mimetypes
+import quopri
+import re
+
+logger = logging.getLogger(__name__)
+
+LINE_ENDING = re.compile(rb"\r\n|\r|\n")
+PATH_SEPARATOR = re.compile(r"[\\/]")
+WHITESPACE = re.compile(rb"\s+")
+# The first delimiter line of a multipart whose boundary parameter is missing or wrong
+DELIMITER_LINE = re.compile(rb"^--([^\s]{1,70}?)(?:--)?[ \t]*\r?$", re.MULTILINE)
+# A line break followed by whitespace continues the header on the next line
+HEADER_FOLD = re.compile(r"\r?\n(?=[ \t])")
+# An RFC 2047 encoded-word: charset, optional RFC 2231 language, B or Q, text
+ENCODED_WORD = re.compile(r"=\?([^?*\s]+)(?:\*[^?\s]*)?\?([BbQq])\?([^?\s]*)\?=")
+# Charset labels that mail clients send for a superset, or that Python does not know
+CHARSET_ALIASES = {
+    "gb2312": "gb18030",
+    "gbk": "gb18030",
+    "x-gbk": "gb18030",
+    "iso-8859-8-i": "iso-8859-8",
+    "ks_c_5601-1987": "cp949",
+    "x-sjis": "shift_jis",
+    "windows-31j": "cp932",
+}
+
+# Human-readable descriptions of parser defects worth surfacing in the UI
+DEFECT_DESCRIPTIONS = {
+    "MissingHeaderBodySeparatorDefect": "no blank line between headers and body",
+    "NoBoundaryInMultipartDefect": "multipart message without a boundary",
+    "StartBoundaryNotFoundDefect": "multipart start boundary not found",
+    "CloseBoundaryNotFoundDefect": "multipart closing boundary not found",
+    "MultipartInvariantViolationDefect": "multipart message has no parts",
+    "FirstHeaderLineIsContinuationDefect": "first header line is a continuation",
+    "MisplacedEnvelopeHeaderDefect": "misplaced envelope header",
+    "MalformedHeaderDefect": "malformed header",
+    "InvalidBase64PaddingDefect": "invalid base64 padding",
+    "InvalidBase64CharactersDefect": "invalid base64 characters",
+    "InvalidBase64LengthDefect": "invalid base64 length",
+}
+
+
+# Body parts in order of preference, after which any other text part will do
+BODY_TYPES = ("text/plain", "text/html")
+
+# HTML elements whose text is not part of the message, and ones that start a line
+HTML_HIDDEN = {"head", "script", "style", "title", "template"}
+HTML_BLOCKS = {
+    "address", "blockquote", "br", "dd", "div", "dl", "dt", "h1", "h2", "h3", "h4", "h5",
+    "h6", "hr", "li", "ol", "p", "pre", "section", "table", "tr", "ul",
+}
+# Characters of the body shown under the subject on the email list
+PREVIEW_CHARS = 160
+QUOTED_LINE = re.compile(r"^[ \t]*>.*$", re.MULTILINE)
+
+BLANK_LINES = re.compile(r"\n\s*\n(\s*\n)+")
+SPACES = re.compile(r"[ \t\r\f\v]+")
+
+
+@dataclass
+class ExtractedContent:
+    """Subject and body extracted from a raw message."""
+    subject: str = ""
+    body: str = ""
+    body_type: str = ""  # Content type of the part the body was taken from
+    parse_error: str = ""
+    attachments: list[dict] = field(default_factory=list)
+
+
+@dataclass
+class MessageHeader:
+    """One header line of a message, unfolded."""
+    name: str
+    value: str  # As sent, encoded-words included
+    decoded: str  # With RFC 2047 encoded-words decoded
+
+
+@dataclass
+class MimePart:
+    """One node of a message's MIME tree.
+
+    path numbers the node's position from 1 at each level, dotted, e.g.
+    1.2 for the second part of the first part; the message itself has
+    an empty path. An attached message has the message as its only child.
+    """
+    path: str
+    depth: int
+    content_type: str = ""
+    charset: str = ""
+    transfer_encoding: str = ""
+    disposition: str = ""
+    filename: str = ""
+    content_id: str = ""
+    size: int = 0  # Decoded bytes of a leaf part
+    problems: list[str] = field(default_factory=list)
+    children: list["MimePart"] = field(default_factory=list)
+
+    def flatten(self) -> list["MimePart"]:
+        """Return this node and its descendants, depth first."""
+        return [self] + [node for child in self.children for node in child.flatten()]
+
+
+def normalize_line_endings(raw_message: bytes) -> bytes:
+    """Convert bare CR and bare LF line endings to CRLF."""
+    return LINE_ENDING.sub(b"\r\n", raw_message)
+
+
+def _defects(msg: Message) -> list[str]:
+    """Collect descriptions of parser defects across all parts."""
+    found: list[str] = []
+    for part in msg.walk():
+        for defect in part.defects:
+            name = type(defect).__name__
+            description = DEFECT_DESCRIPTIONS.get(name, name)
+            if description not in found:
+                found.append(description)
+    return found
+
+
+def _attachment_parts(msg: Message) -> list[tuple[Message, dict]]:
+    """Find every named part with its filename, content type, size and Content-ID.
+
+    Parts nested at any depth of multiparts are found. get_filename()
+    decodes RFC 2231 and RFC 2047 encoded names. The size is of the
+    decoded content.
+    """
+    found = []
+    for part in msg.walk():
+        if part.is_multipart():
+            continue
+        try:
+            filename = part.get_filename()
+        except Exception:
+            filename = None
+        if filename or part.get_content_disposition() == "attachment":
+            found.append((part, {
+                "filename": str(filename or ""),
+                "content_type": part.get_content_type(),
+                "size": len(part.get_payload(decode=True) or b""),
+                "content_id": str(part.get("Content-ID", "") or "").strip().strip("<>"),
+            }))
+    return found
+
+
+def _attachments(msg: Message) -> list[dict]:
+    """List the filename and content type of every named part."""
+    return [attachment for _, attachment in _attachment_parts(msg)]
+
+
+def extract_attachments(raw_message: bytes) -> list[dict]:
+    """List the attachments of a raw message, or nothing if it won't parse."""
+    try:
+        return _attachments(message_from_bytes(raw_message, policy=email_policy))
+    except Exception:
+        return []
+
+
+def content_id_key(content_id: str) -> str:
+    """Normalize a Content-ID for comparison: no angle brackets, any case."""
+    return content_id.strip().strip("<>").strip().lower()
+
+
+def inline_part(raw_message: bytes, content_id: str) -> tuple[str, bytes] | None:
+    """Find the part of a message with a Content-ID, returning its content type and content.
+
+    Content-IDs match ignoring case and angle brackets.
+    """
+    wanted = content_id_key(content_id)
+    if not wanted:
+        return None
+    try:
+        msg = message_from_bytes(raw_message, policy=email_policy)
+        for part in msg.walk():
+            if not part.is_multipart() and (
+                content_id_key(str(part.get("Content-ID", "") or "")) == wanted
+            ):
+                return part.get_content_type(), part.get_payload(decode=True) or b""
+    except Exception:
+        pass
+    return None
+
+
+def attachment_filename(attachment: dict, index: int) -> str:
+    """Return the name an attachment is saved as, without any directory.
+
+    Attachments without a filename are named by position: part-1.bin for
+    the first.
+    """
+    name = PATH_SEPARATOR.split(attachment.get("filename", ""))[-1].strip()
+    return name or f"part-{index + 1}.bin"
+
+
+def part_filename(filename: str, path: str, content_type: str) -> str:
+    """Return the name a MIME part is saved as: its own, or one from its path and type."""
+    name = PATH_SEPARATOR.split(filename)[-1].strip()
+    return name or f"part-{path}{mimetypes.guess_extension(content_type) or '.bin'}"
+
+
+def attachment_payloads(raw_message: bytes) -> list[tuple[dict, bytes, str]]:
+    """Return each attachment with its decoded content and declared charset.
+
+    Attachments are in extract_attachments order.
+    """
+    try:
+        msg = message_from_bytes(raw_message, policy=email_policy)
+        return [
+            (attachment, part.get_payload(decode=True) or b"", part.get_content_charset() or "")
+            for part, attachment in _attachment_parts(msg)
+        ]
+    except Exception:
+        return []
+
+
+def html_parts(msg: Message) -> list[str]:
+    """Return the decoded text of every HTML part that is not an attachment."""
+    return [
+        _text_content(part)
+        for part in msg.walk()
+        if part.get_content_type() == "text/html"
+        and part.get_content_disposition() != "attachment"
+    ]
+
+
+def header_addresses(raw_message: bytes) -> dict[str, list[tuple[str, str]]]:
+    """Return the (display name, address) pairs of the From, To and Cc headers."""
+    try:
+        msg = message_from_bytes(raw_message, policy=compat32)
+        return {
+            kind: [(name, addr) for name, addr in getaddresses(msg.get_all(kind, [])) if addr]
+            for kind in ("from", "to", "cc")
+        }
+    except Exception:
+        return {"from": [], "to": [], "cc": []}
+
+
+def _header_text(value: str) -> str:
+    """Return a raw header value as text, unfolded, reading 8-bit bytes as UTF-8."""
+    value = HEADER_FOLD.sub("", value).strip()
+    return value.encode("ascii", "surrogateescape").decode("utf-8", errors="replace")
+
+
+def _decode_word(word: re.Match) -> str:
+    """Decode one encoded-word, or return it as sent if it cannot be decoded."""
+    charset, encoding, text = word.groups()
+    charset = CHARSET_ALIASES.get(charset.lower(), charset)
+    try:
+        if encoding in "Bb":
+            data = base64.b64decode(text + "=" * (-len(text) % 4), validate=True)
+        else:
+            data = quopri.decodestring(text.encode("ascii"), header=True)
+        return data.decode(codecs.lookup(charset).name)
+    except (binascii.Error, ValueError, LookupError):
+        return word.group(0)
+
+
+def decode_header_value(value: str) -> str:
+    """Decode the RFC 2047 encoded-words in a header value.
+
+    Whitespace between adjacent encoded-words is dropped, as the RFC
+    asks. A word with an unknown charset, bad base64 or bytes that are
+    invalid in its charset is kept as sent rather than lost.
+    """
+    decoded = []
+    end = 0
+    for word in ENCODED_WORD.finditer(value):
+        between = value[end:word.start()]
+        if not decoded or between.strip():
+            decoded.append(between)
+        decoded.append(_decode_word(word))
+        end = word.end()
+    decoded.append(value[end:])
+    return "".join(decoded)
+
+
+def _raw_headers(raw_message: bytes) -> list[tuple[str, str]]:
+    """Parse the top-level headers of a message as sent, unfolded."""
+    msg = BytesHeaderParser(policy=compat32).parsebytes(raw_message)
+    return [(name, _header_text(str(value))) for name, value in msg.raw_items()]
+
+
+def message_headers(raw_message: bytes) -> list[MessageHeader]:
+    """Return the top-level headers of a message in the order they were sent.
+
+    Repeated headers, such as Received, are all kept.
+    """
+    try:
+        headers = _raw_headers(raw_message)
+    except Exception:
+        return []
+    return [
+        MessageHeader(name=name, value=value, decoded=decode_header_value(value))
+        for name, value in headers
+    ]
+
+
+def extract_subject(raw_message: bytes) -> str:
+    """Return the decoded Subject header of a message, or "" if it has none."""
+    try:
+        headers = _raw_headers(raw_message)
+    except Exception:
+        return ""
+    value = next((value for name, value in headers if name.lower() == "subject"), "")
+    return decode_header_value(value)
+
+
+def _mime_part(part: Message, path: str, depth: int) -> MimePart:
+    """Describe one part and its children, recording problems instead of raising."""
+    node = MimePart(path=path, depth=depth)
+    try:
+        node.content_type = part.get_content_type()
+        node.charset = part.get_content_charset() or ""
+        node.transfer_encoding = str(part.get("Content-Transfer-Encoding", "") or "").strip()
+        node.disposition = part.get_content_disposition() or ""
+        node.filename = str(part.get_filename() or "")
+        node.content_id = str(part.get("Content-ID", "") or "").strip().strip("<>")
+    except Exception as e:
+        node.problems.append(f"headers could not be read: {e}")
+    try:
+        if part.is_multipart():
+            node.children = [
+                _mime_part(child, f"{path}.{number}" if path else str(number), depth + 1)
+                for number, child in enumerate(part.get_payload(), 1)
+            ]
+        else:
+            node.size = len(part.get_payload(decode=True) or b"")
+    except Exception as e:
+        node.problems.append(f"content could not be decoded: {e}")
+    # Decoding the content records defects of its own, such as bad base64
+    defects = [type(defect).__name__ for defect in part.defects]
+    node.problems[:0] = [DEFECT_DESCRIPTIONS.get(name, name) for name in defects]
+    return node
+
+
+def mime_tree(raw_message: bytes) -> MimePart | None:
+    """Parse the MIME tree of a message, or None if it does not parse at all."""
+    try:
+        return _mime_part(message_from_bytes(raw_message, policy=email_policy), "", 0)
+    except Exception:
+        return None
+
+
+def find_part(raw_message: bytes, path: str) -> Message | None:
+    """Find the part of a message at a MimePart path, or None if there is none."""
+    try:
+        part = message_from_bytes(raw_message, policy=email_policy)
+        for number in path.split("."):
+            if not number.isdigit() or not part.is_multipart():
+                return None
+            children = part.get_payload()
+            if not 1 <= int(number) <= len(children):
+                return None
+            part = children[int(number) - 1]
+        return part
+    except Exception:
+        return None
+
+
+def _transfer_decoded(part: Message) -> bytes:
+    """Undo the Content-Transfer-Encoding of a leaf part.
+
+    Base64 may be broken over lines and spaces and lack its padding. When
+    it still does not decode, the encoded text is returned as it is,
+    with a warning, rather than nothing.
+    """
+    payload = part.get_payload()
+    if isinstance(payload, str):
+        payload = payload.encode("ascii", "surrogateescape")
+    encoding = str(part.get("Content-Transfer-Encoding", "") or "").strip().lower()
+    if encoding == "quoted-printable":
+        return quopri.decodestring(payload)
+    if encoding == "base64":
+        data = WHITESPACE.sub(b"", payload)
+        try:
+            return base64.b64decode(data + b"=" * (-len(data) % 4), validate=True)
+        except (binascii.Error, ValueError) as e:
+            logger.warning(f"Base64 {part.get_content_type()} part kept encoded: {e}")
+    return payload
+
+
+def _text_content(part: Message) -> str:
+    """Return the text of a part decoded to a str from its transfer encoding and charset.
+
+    Bytes that are invalid in the declared charset are replaced, and an
+    unknown charset is read as UTF-8 with a warning.
+    """
+    payload = _transfer_decoded(part)
+    charset = part.get_content_charset() or "utf-8"
+    charset = CHARSET_ALIASES.get(charset, charset)
+    try:
+        return payload.decode(charset, errors="replace")
+    except LookupError:
+        logger.warning(
+            f"Unknown charset {charset!r}, reading the {part.get_content_type()} part as UTF-8"
+        )
+        return payload.decode("utf-8", errors="replace")
+
+
+class _HTMLText(HTMLParser):
+    """Collects the visible text of an HTML body, a line per block element."""
+
+    def __init__(self):
+        super().__init__(convert_charrefs=True)
+        self.out: list[str] = []
+        self._hidden = 0
+
+    def handle_starttag(self, tag: str, attrs: list[tuple[str, str | None]]) -> None:
+        if tag in HTML_HIDDEN:
+            self._hidden += 1
+        elif tag in HTML_BLOCKS:
+            self.out.append("\n")
+
+    def handle_endtag(self, tag: str) -> None:
+        if tag in HTML_HIDDEN:
+            self._hidden = max(self._hidden - 1, 0)
+        elif tag in HTML_BLOCKS:
+            self.out.append("\n")
+
+    def handle_data(self, data: str) -> None:
+        if not self._hidden:
+            self.out.append(SPACES.sub(" ", data.replace("\n", " ")))
+
+
+def html_to_text(html: str) -> str:
+    """Reduce an HTML body to its text, for search and previews."""
+    parser = _HTMLText()
+    parser.feed(html)
+    parser.close()
+    lines = (line.strip() for line in "".join(parser.out).split("\n"))
+    return BLANK_LINES.sub("\n\n", "\n".join(lines)).strip()
+
+
+def body_preview(body: str) -> str:
+    """Return the start of a text body on one line, without quoted reply lines.
+
+    Longer bodies are cut at the last word that fits in PREVIEW_CHARS.
+    """
+    text = " ".join(QUOTED_LINE.sub("", body).split())
+    if len(text) <= PREVIEW_CHARS:
+        return text
+    cut = text[:PREVIEW_CHARS + 1].rsplit(" ", 1)[0]
+    if len(cut) > PREVIEW_CHARS:
+        cut = text[:PREVIEW_CHARS]
+    return cut + "\u2026"
+
+
+def _repaired(part: Message) -> Message:
+    """Reparse a multipart whose boundary is missing or wrong, using the one its body has.
+
+    The parser leaves such a part as one block of text. The first line
+    that looks like a delimiter is taken to be one.
+    """
+    if part.get_content_maintype() != "multipart" or part.is_multipart():
+        return part
+    payload = part.get_payload()
+    if isinstance(payload, str):
+        payload = payload.encode("ascii", "surrogateescape")
+    delimiter = DELIMITER_LINE.search(payload)
+    if not delimiter:
+        return part
+    try:
+        part.set_boundary(delimiter.group(1).decode("ascii", "replace"))
+        repaired = message_from_bytes(part.as_bytes(policy=compat32), policy=email_policy)
+    except Exception:
+        return part
+    return repaired if repaired.is_multipart() else part
+
+
+def _body_candidates(part: Message, top: bool = True) -> Iterator[Message]:
+    """Yield the leaf parts that could be the body, in order.
+
+    Multiparts of any kind are searched, alternative and related ones
+    included, but attachments and attached messages are not.
+    """
+    if not top and part.get_content_maintype() == "message":
+        return
+    part = _repaired(part)
+    if part.is_multipart():
+        for child in part.get_payload():
+            yield from _body_candidates(child, top=False)
+    elif part.get_content_disposition() != "attachment":
+        yield part
+
+
+def body_part(msg: Message) -> Message | None:
+    """Choose the part a message's text body is taken from.
+
+    text/plain is preferred, so the plain alternative of
+    multipart/alternative wins; then text/html, then any other text part.
+    """
+    candidates = [part for part in _body_candidates(msg) if part.get_content_maintype() == "text"]
+    for content_type in BODY_TYPES:
+        for part in candidates:
+            if part.get_content_type() == content_type:
+                return part
+    return candidates[0] if candidates else None
+
+
+def extract_content(raw_message: bytes) -> ExtractedContent:
+    """Extract the subject and plain-text body from a raw message.
+
+    The body is taken from the part body_part chooses, reduced to text
+    when that is HTML.
+
+    Never raises: when parsing fails the raw message is used as the body
+    and parse_error describes what went wrong.
+    """
+    problems: list[str] = []
+    try:
+        msg = message_from_bytes(raw_message, policy=email_policy)
+    except Exception as e:
+        return ExtractedContent(
+            body=raw_message.decode("utf-8", errors="replace"),
+            parse_error=f"message could not be parsed: {e}",
+        )
+
+    subject = extract_subject(raw_message)
+
+    body = body_type = ""
+    try:
+        part = body_part(msg)
+        if part is not None:
+            body_type = part.get_content_type()
+            body = _text_content(part)
+            if body_type == "text/html":
+                body = html_to_text(body)
+    except Exception as e:
+        problems.append(f"body could not be decoded: {e}")
+        body = raw_message.decode("utf-8", errors="replace")
+
+    try:
+        attachments = _attachments(msg)
+    except Exception as e:
+        problems.append(f"attachments could not be listed: {e}")
+        attachments = []
+
+    problems.extend(_defects(msg))
+    return ExtractedContent(
+        subject=subject,
+        body=body,
+        body_type=body_type,
+        parse_error="; ".join(problems),
+        attachments=attachments,
+    )
@@ -0,0 +1,218 @@
+"""Deliverability checks for captured outbound mail.
+
+Each check is a function registered with the @check decorator. It takes
+the parsed message and the stored Email, and returns None when the
+message passes or a short description of the problem when it does not.
+"""
+
+from dataclasses import dataclass, field
+from email import message_from_bytes
+from email.message import Message
+from email.policy import compat32
+from typing import Callable
+import base64
+import binascii
+import quopri
+import re
+
+from .models import Email
+
+SEVERITY_ERROR = "error"
+SEVERITY_WARNING = "warning"
+
+# Score weight of a failed check per severity
+SEVERITY_WEIGHTS = {SEVERITY_ERROR: 2, SEVERITY_WARNING: 1}
+
+MAX_SUBJECT_LENGTH = 200
+MAX_TOTAL_BYTES = 10 * 1024 * 1024
+MAX_INLINE_IMAGE_BYTES = 512 * 1024
+
+ENCODED_WORD = re.compile(r"=\?([^?\s]+)\?([bBqQ])\?([^?\s]*)\?=")
+
+
+@dataclass
+class Check:
+    """A registered deliverability check."""
+    name: str
+    title: str
+    severity: str
+    func: Callable[[Message, Email], str | None]
+
+
+@dataclass
+class Finding:
+    """Outcome of a single check against a message."""
+    name: str
+    title: str
+    severity: str
+    passed: bool
+    detail: str = ""
+
+
+@dataclass
+class LintReport:
+    """All check outcomes for a message with an overall score."""
+    score: int = 100
+    findings: list[Finding] = field(default_factory=list)
+
+    @property
+    def failures(self) -> list[Finding]:
+        return [f for f in self.findings if not f.passed]
+
+
+CHECKS: list[Check] = []
+
+
+def check(name: str, title: str, severity: str = SEVERITY_WARNING):
+    """Register a function as a deliverability check."""
+    def decorator(func: Callable[[Message, Email], str | None]):
+        CHECKS.append(Check(name, title, severity, func))
+        return func
+    return decorator
+
+
+def run_checks(email: Email) -> LintReport:
+    """Run all registered checks against an email and score the result."""
+    msg = message_from_bytes(email.raw_message, policy=compat32)
+    report = LintReport()
+    total_weight = 0
+    failed_weight = 0
+
+    for registered in CHECKS:
+        try:
+            problem = registered.func(msg, email)
+        except Exception as e:
+            problem = f"Check failed to run: {e}"
+
+        weight = SEVERITY_WEIGHTS[registered.severity]
+        total_weight += weight
+        if problem:
+            failed_weight += weight
+
+        report.findings.append(
+            Finding(
+                name=registered.name,
+                title=registered.title,
+                severity=registered.severity,
+                passed=problem is None,
+                detail=problem or "",
+            )
+        )
+
+    if total_weight:
+        report.score = round(100 * (total_weight - failed_weight) / total_weight)
+    return report
+
+
+def _content_types(msg: Message) -> list[str]:
+    """Return the content types of all non-multipart parts."""
+    return [part.get_content_type() for part in msg.walk() if not part.is_multipart()]
+
+
+def _address_domain(address: str) -> str:
+    """Return the lowercase domain of an email address."""
+    match = re.search(r"@([^\s>]+)", address)
+    return match.group(1).lower().rstrip(".") if match else ""
+
+
+@check("message_id", "Exactly one Message-ID header", SEVERITY_ERROR)
+def check_message_id(msg: Message, email: Email) -> str | None:
+    values = msg.get_all("Message-ID", [])
+    if not values:
+        return "Message-ID header is missing"
+    if len(values) > 1:
+        return f"Message-ID header appears {len(values)} times"
+    return None
+
+
+@check("date", "Exactly one Date header", SEVERITY_ERROR)
+def check_date(msg: Message, email: Email) -> str | None:
+    values = msg.get_all("Date", [])
+    if not values:
+        return "Date header is missing"
+    if len(values) > 1:
+        return f"Date header appears {len(values)} times"
+    return None
+
+
+@check("text_alternative", "HTML mail includes a text/plain alternative")
+def check_text_alternative(msg: Message, email: Email) -> str | None:
+    types = _content_types(msg)
+    if "text/html" in types and "text/plain" not in types:
+        return "Message has an HTML part but no text/plain alternative"
+    return None
+
+
+@check("inline_images", "HTML-only mail does not embed large images")
+def check_inline_images(msg: Message, email: Email) -> str | None:
+    types = _content_types(msg)
+    if "text/html" not in types or "text/plain" in types:
+        return None
+    image_bytes = sum(
+        len(part.get_payload(decode=True) or b"")
+        for part in msg.walk()
+        if part.get_content_maintype() == "image"
+    )
+    if image_bytes > MAX_INLINE_IMAGE_BYTES:
+        return f"HTML-only message embeds {image_bytes} bytes of images"
+    return None
+
+
+@check("subject_length", f"Subject is at most {MAX_SUBJECT_LENGTH} characters")
+def check_subject_length(msg: Message, email: Email) -> str | None:
+    if len(email.subject) > MAX_SUBJECT_LENGTH:
+        return f"Subject is {len(email.subject)} characters long"
+    return None
+
+
+@check("list_unsubscribe", "Bulk mail carries a List-Unsubscribe header")
+def check_list_unsubscribe(msg: Message, email: Email) -> str | None:
+    precedence = (msg.get("Precedence") or "").strip().lower()
+    if precedence in ("bulk", "list") and not msg.get("List-Unsubscribe"):
+        return f"Precedence is '{precedence}' but List-Unsubscribe is missing"
+    return None
+
+
+@check("from_domain", "From header domain matches the envelope sender")
+def check_from_domain(msg: Message, email: Email) -> str | None:
+    header_domain = _address_domain(str(msg.get("From") or ""))
+    envelope_domain = _address_domain(email.sender)
+    if not header_domain:
+        return "From header is missing or has no domain"
+    if envelope_domain and header_domain != envelope_domain:
+        return f"From domain {header_domain} differs from envelope domain {envelope_domain}"
+    return None
+
+
+@check("total_size", f"Message is at most {MAX_TOTAL_BYTES // (1024 * 1024)} MB")
+def check_total_size(msg: Message, email: Email) -> str | None:
+    if email.size_bytes > MAX_TOTAL_BYTES:
+        return f"Message is {email.size_bytes} bytes"
+    return None
+
+
+@check("encoded_words", "Encoded-word headers decode cleanly", SEVERITY_ERROR)
+def check_encoded_words(msg: Message, email: Email) -> str | None:
+    for name in ("Subject", "From", "To", "Cc", "Reply-To"):
+        for value in msg.get_all(name, []):
+            value = str(value)
+            if "=?" not in value:
+                continue
+            words = ENCODED_WORD.findall(value)
+            if "=?" in ENCODED_WORD.sub("", value):
+                return f"{name} header contains a malformed encoded-word"
+            for charset, encoding, text in words:
+                try:
+                    _decode_encoded_word(charset, encoding, text)
+                except (LookupError, UnicodeDecodeError, binascii.Error, ValueError) as e:
+                    return f"{name} header has an undecodable encoded-word: {e}"
+    return None
+
+
+def _decode_encoded_word(charset: str, encoding: str, text: str) -> str:
+    """Strictly decode a single RFC 2047 encoded-word."""
+    if encoding.upper() == "B":
+        data = base64.b64decode(text, validate=True)
+    else:
+        data = quopri.decodestring(text.replace("_", " ").encode("ascii"), header=True)
+    return data.decode(charset.split("*")[0])
@@ -2,17 +2,56 @@
 
 import argparse
 import asyncio
+import copy
+import getpass
+import json
 import logging
+import os
 import signal
+import socket
+import sqlite3
 import sys
+import tempfile
 from pathlib import Path
 
+import bcrypt
 import uvicorn
 
-from .config import Config
-from .database import Database, EmailRepository, UserRepository
+from . import settings, support
+from .config import COMPONENTS, USER_ROLES, AdminConfig, Config
+from .database import (
+    AddressRepository,
+    ApiTokenRepository,
+    AuditRepository,
+    AggregateCache,
+    Database,
+    EmailRepository,
+    JournalRepository,
+    LeaseRepository,
+    LoginAttemptRepository,
+    QuotaRepository,
+    RawMessageStore,
+    RuleRepository,
+    SMTPCredentialRepository,
+    UserRepository,
+)
+from .database.replica import ReplicaError, Replicator, restore_replica
+from .attachment_text import AttachmentIndexer
+from .events import EmailEvents
+from .passwords import build_passwords
+from .privacy import Redactor
+from .notify import RuleNotifier
+from .relay import Relay, local_address_error
+from .responders import ResponderEngine
+from .selftest import FAIL, SKIP, STAGES, SelfTest, StageResult
+from .siem import SIEMShipper
 from .smtp import SMTPServer
+from .tracking import TrackingAnalyzer
 from .web import create_app
+from .web.auth import MagicLinkManager
+from .web.providers import build_providers
+from .web.redirect import HTTPSRedirectApp
+from .web.templating import TemplateLoadError
 
 # Configure logging
 logging.basicConfig(
@@ -20,6 +59,14 @@ logging.basicConfig(
     format="%(asctime)s - %(name)s - %(levelname)s - %(message)s",
 )
 logger = logging.getLogger(__name__)
+logging.getLogger().addHandler(support.log_buffer)
+
+PURGE_INTERVAL_SECONDS = 3600
+# Renewed on every run, so the lease only lapses once its holder stops
+PURGE_LEASE_SECONDS = 2 * PURGE_INTERVAL_SECONDS
+
+# Time relays in progress get to finish on shutdown before being marked relay_failed
+RELAY_DRAIN_SECONDS = 10.0
 
 
 def parse_args() -> argparse.Namespace:
@@ -33,16 +80,422 @@ def parse_args() -> argparse.Namespace:
         default="config.json",
         help="Path to configuration file (default: config.json)",
     )
+    parser.add_argument(
+        "--read-only",
+        action="store_true",
+        help="Start in read-only mode: refuse SMTP mail and block changes in the web UI",
+    )
+    parser.add_argument(
+        "--mode",
+        choices=COMPONENTS,
+        help="Components to run: smtp, web or all (default: components from the config)",
+    )
+    parser.add_argument(
+        "--dev",
+        action="store_true",
+        help="Development mode: reload changed templates, disable caching and log verbosely",
+    )
+
+    subparsers = parser.add_subparsers(dest="command")
+    user_parser = subparsers.add_parser("user", help="Manage web UI users")
+    user_subparsers = user_parser.add_subparsers(dest="user_command", required=True)
+    user_add_parser = user_subparsers.add_parser("add", help="Create a web UI user")
+    user_add_parser.add_argument("username", help="Username of the new user")
+    user_add_parser.add_argument(
+        "--password",
+        help="Password of the new user (prompted for when omitted)",
+    )
+    user_add_parser.add_argument(
+        "--role",
+        choices=USER_ROLES,
+        default="admin",
+        help="Role of the new user (default: admin)",
+    )
+
+    settings_parser = subparsers.add_parser("settings", help="Export or import settings")
+    settings_subparsers = settings_parser.add_subparsers(dest="settings_command", required=True)
+    settings_export_parser = settings_subparsers.add_parser(
+        "export", help="Write rules and other settings to a JSON bundle"
+    )
+    settings_export_parser.add_argument(
+        "file", nargs="?", default="-", help="Output file (default: stdout)"
+    )
+    settings_import_parser = settings_subparsers.add_parser(
+        "import", help="Create and update settings from a JSON bundle"
+    )
+    settings_import_parser.add_argument("file", help="Settings bundle to import")
+    settings_import_parser.add_argument(
+        "--dry-run",
+        action="store_true",
+        help="Show what would be created, updated or deleted without changing anything",
+    )
+    settings_import_parser.add_argument(
+        "--prune",
+        action="store_true",
+        help="Delete settings that are not in the bundle",
+    )
+
+    restore_parser = subparsers.add_parser(
+        "restore-replica", help="Rebuild the database from the newest good replica snapshot"
+    )
+    restore_parser.add_argument(
+        "--from",
+        dest="replica_path",
+        help="Replica directory (default: database.replica_path)",
+    )
+    restore_parser.add_argument(
+        "--to",
+        dest="target",
+        help="Database file to write (default: database.path)",
+    )
+    restore_parser.add_argument(
+        "--force",
+        action="store_true",
+        help="Overwrite the target database if it exists",
+    )
+
+    bundle_parser = subparsers.add_parser(
+        "support-bundle", help="Write diagnostics for a bug report to a zip file"
+    )
+    bundle_parser.add_argument("--out", default="support-bundle.zip", help="Zip file to write")
+    bundle_parser.add_argument(
+        "--log-file", help="Log file to include the last lines of (default: no logs)"
+    )
+    bundle_parser.add_argument(
+        "--log-lines", type=int, default=500, help="Log lines to include (default: 500)"
+    )
+    bundle_parser.add_argument(
+        "--exclude",
+        action="append",
+        default=[],
+        choices=support.SECTIONS,
+        help="Leave out a section; can be repeated",
+    )
+    bundle_parser.add_argument(
+        "--rejections",
+        type=int,
+        default=0,
+        metavar="N",
+        help="Include the N most recent rejections found in the logs (default: none)",
+    )
+
+    subparsers.add_parser(
+        "verify-audit", help="Check the hash chain of the audit log for tampering"
+    )
+
+    selftest_parser = subparsers.add_parser(
+        "selftest", help="Send a test message end to end and report each stage"
+    )
+    selftest_parser.add_argument(
+        "--standalone",
+        action="store_true",
+        help="Test an in-process SMTP server on a temporary copy of the database "
+        "instead of the running instance",
+    )
+    selftest_parser.add_argument("--host", help="SMTP host to test (default: smtp.host)")
+    selftest_parser.add_argument("--port", type=int, help="SMTP port to test (default: smtp.port)")
+    selftest_parser.add_argument(
+        "--username", help="SMTP AUTH username (default: the first configured user)"
+    )
+    selftest_parser.add_argument("--password", help="SMTP AUTH password for --username")
+    selftest_parser.add_argument(
+        "--sender", help="MAIL FROM address (default: one the user's allowed senders accept)"
+    )
+    selftest_parser.add_argument(
+        "--recipient", help="RCPT TO address (default: selftest@ the SMTP domain)"
+    )
+    selftest_parser.add_argument(
+        "--timeout",
+        type=float,
+        default=10.0,
+        help="Seconds to wait for the SMTP server and for the stored email (default: 10)",
+    )
+    selftest_parser.add_argument(
+        "--skip",
+        action="append",
+        default=[],
+        choices=STAGES,
+        help="Skip a stage; can be repeated",
+    )
+
+    hash_parser = subparsers.add_parser(
+        "hash-password", help="Print a bcrypt hash for smtp.auth.password_hash"
+    )
+    hash_parser.add_argument(
+        "--stdin",
+        action="store_true",
+        help="Read the password from the first line of standard input instead of prompting",
+    )
     return parser.parse_args()
 
 
-def ensure_admin_user(user_repo: UserRepository, username: str, password: str) -> None:
-    """Ensure the admin user exists in the database."""
-    if not user_repo.exists(username):
-        user_repo.create(username, password)
-        logger.info(f"Created admin user: {username}")
+class StartupError(Exception):
+    """Raised when the application cannot start with the current state."""
+
+
+def ensure_admin_user(user_repo: UserRepository, admin: AdminConfig | None) -> None:
+    """Bootstrap or reconcile the configured admin user.
+
+    Without an admin block, or with admin.disabled, nothing is created and
+    at least one user must already exist. When the configured password no
+    longer matches the stored one it is only applied with force_password.
+    """
+    if admin is None or admin.disabled:
+        if user_repo.count() == 0:
+            raise StartupError(
+                "No web users exist and admin bootstrap is disabled. Create one with: "
+                "python -m smtp_proxy.main user add <username>"
+            )
+        logger.info("Admin bootstrap disabled, using existing users")
+        return
+
+    user = user_repo.get_by_username(admin.username)
+    if user is None:
+        user_repo.create(admin.username, admin.password, role="admin")
+        logger.info(f"Created admin user: {admin.username}")
+        return
+
+    if user_repo.verify_password(user, admin.password):
+        logger.info(f"Admin user already exists: {admin.username}")
+    elif admin.force_password:
+        user_repo.update_password(user.id, admin.password)
+        logger.info(f"Updated password of admin user from config: {admin.username}")
     else:
-        logger.info(f"Admin user already exists: {username}")
+        logger.warning(
+            f"Configured password for admin user {admin.username} differs from the "
+            "stored one; set admin.force_password to apply it"
+        )
+
+
+def run_user_command(args: argparse.Namespace, config: Config) -> None:
+    """Run a `user` subcommand against the configured database."""
+    db = Database(config.database.path)
+    try:
+        user_repo = UserRepository(db, build_passwords(config.web))
+        if args.user_command == "add":
+            if user_repo.exists(args.username):
+                logger.error(f"User already exists: {args.username}")
+                sys.exit(1)
+            password = args.password
+            if not password:
+                password = getpass.getpass("Password: ")
+                if password != getpass.getpass("Repeat password: "):
+                    logger.error("Passwords do not match")
+                    sys.exit(1)
+            if not password:
+                logger.error("Password must not be empty")
+                sys.exit(1)
+            user_repo.create(args.username, password, args.role)
+            logger.info(f"Created {args.role} user: {args.username}")
+    finally:
+        db.close()
+
+
+def run_settings_command(args: argparse.Namespace, config: Config) -> None:
+    """Run a `settings` subcommand against the configured database."""
+    db = Database(config.database.path)
+    try:
+        rule_repo = RuleRepository(db)
+        if args.settings_command == "export":
+            bundle = json.dumps(settings.export_settings(rule_repo), indent=2)
+            if args.file == "-":
+                print(bundle)
+            else:
+                Path(args.file).write_text(bundle + "\n")
+                logger.info(f"Exported settings to {args.file}")
+        elif args.settings_command == "import":
+            try:
+                bundle = json.loads(Path(args.file).read_text())
+            except (OSError, ValueError) as e:
+                logger.error(f"Failed to read settings bundle: {e}")
+                sys.exit(1)
+            plan = settings.plan_import(bundle, rule_repo, prune=args.prune)
+            for action in ("create", "update", "delete"):
+                label = f"Would {action}" if args.dry_run else action.capitalize()
+                for rule in getattr(plan, action):
+                    logger.info(f"{label} rule: {rule.name}")
+            if not (plan.create or plan.update or plan.delete):
+                logger.info("Settings are already up to date")
+            for error in plan.errors:
+                logger.error(error)
+            if plan.errors:
+                sys.exit(1)
+            if not args.dry_run:
+                settings.apply_import(plan, rule_repo)
+                logger.info("Settings imported")
+    finally:
+        db.close()
+
+
+def run_restore_command(args: argparse.Namespace, config: Config) -> None:
+    """Run the `restore-replica` command."""
+    directory = args.replica_path or config.database.replica_path
+    if not directory:
+        logger.error("No replica directory: pass --from or set database.replica_path")
+        sys.exit(1)
+    target = args.target or config.database.path
+    try:
+        snapshot, count = restore_replica(directory, target, force=args.force)
+    except (ReplicaError, OSError, sqlite3.Error) as e:
+        logger.error(f"Failed to restore replica: {e}")
+        sys.exit(1)
+    logger.info(f"Restored {target} from {snapshot} ({count} emails)")
+
+
+def run_support_bundle_command(args: argparse.Namespace, config: Config) -> None:
+    """Run the `support-bundle` command."""
+    log_lines = []
+    if args.log_file:
+        try:
+            log_lines = support.tail_lines(args.log_file, args.log_lines)
+        except OSError as e:
+            logger.error(f"Failed to read log file: {e}")
+            sys.exit(1)
+    sections = [s for s in support.DEFAULT_SECTIONS if s not in args.exclude]
+    if args.rejections and "rejections" not in args.exclude:
+        sections.append("rejections")
+
+    db = Database(config.database.path)
+    try:
+        bundle = support.SupportBundle(
+            config,
+            db,
+            log_lines,
+            max_log_lines=args.log_lines,
+            max_rejections=args.rejections,
+        )
+        files = bundle.write(args.out, sections)
+    finally:
+        db.close()
+    logger.info(f"Wrote support bundle {args.out} with {', '.join(files)}")
+
+
+def run_hash_password_command(args: argparse.Namespace) -> None:
+    """Run the `hash-password` command, which needs no configuration file."""
+    if args.stdin:
+        password = sys.stdin.readline().rstrip("\r\n")
+    else:
+        password = getpass.getpass("Password: ")
+        if password != getpass.getpass("Repeat password: "):
+            logger.error("Passwords do not match")
+            sys.exit(1)
+    if not password:
+        logger.error("Password must not be empty")
+        sys.exit(1)
+    print(bcrypt.hashpw(password.encode(), bcrypt.gensalt()).decode())
+
+
+def run_verify_audit_command(config: Config) -> None:
+    """Run the `verify-audit` command."""
+    db = Database(config.database.path)
+    try:
+        checked, problem = AuditRepository(db).verify()
+    finally:
+        db.close()
+    if problem:
+        logger.error(f"Audit log chain is broken after {checked} event(s): {problem}")
+        sys.exit(1)
+    logger.info(f"Audit log chain verified: {checked} event(s)")
+
+
+def print_selftest_report(results: list[StageResult]) -> bool:
+    """Print one line per self-test stage and return whether none failed."""
+    for result in results:
+        timing = "-" if result.status == SKIP else f"{result.duration_ms:.0f} ms"
+        print(f"{result.status.upper():4}  {result.stage:8}  {timing:>9}  {result.detail}")
+    passed = all(result.status != FAIL for result in results)
+    print("Self-test passed" if passed else "Self-test FAILED")
+    return passed
+
+
+def local_host(host: str) -> str:
+    """Return an address to connect to for a listener bound to host."""
+    return "127.0.0.1" if host in ("", "0.0.0.0", "::") else host
+
+
+def run_selftest_command(args: argparse.Namespace, config: Config) -> None:
+    """Run the `selftest` command and exit non-zero if any stage failed."""
+    options = dict(
+        username=args.username or "",
+        password=args.password or "",
+        sender=args.sender or "",
+        recipient=args.recipient or "",
+        timeout_seconds=args.timeout,
+        skip=tuple(args.skip),
+    )
+    if args.standalone:
+        results = asyncio.run(run_standalone_selftest(config, options))
+    else:
+        results = SelfTest(
+            config,
+            args.host or local_host(config.smtp.host),
+            args.port or config.smtp.port,
+            config.database.path,
+            **options,
+        ).run()
+    if not print_selftest_report(results):
+        sys.exit(1)
+
+
+async def run_standalone_selftest(config: Config, options: dict) -> list[StageResult]:
+    """Run the self-test against an SMTP server started in this process.
+
+    The server uses a copy of the configuration on a loopback port and a
+    temporary copy of the database, so SMTP users and rules apply but
+    nothing is written to the real one. Relaying is left to the relay
+    stage's dry run.
+    """
+    with tempfile.TemporaryDirectory(prefix="smtp-proxy-selftest-") as directory:
+        standalone = copy.deepcopy(config)
+        standalone.database.path = os.path.join(directory, "selftest.db")
+        standalone.database.replica_path = ""
+        if Path(config.database.path).exists():
+            # Read-only, so the real database is neither created nor migrated
+            source = Database(config.database.path, read_only=True)
+            try:
+                source.backup_to(standalone.database.path)
+            finally:
+                source.close()
+        with socket.socket() as probe:
+            probe.bind(("127.0.0.1", 0))
+            port = probe.getsockname()[1]
+        standalone.smtp.host, standalone.smtp.port = "127.0.0.1", port
+        standalone.components, standalone.background_jobs = "smtp", False
+        standalone.read_only = False
+        standalone.smtp.relay.enabled = False
+
+        application = Application(standalone)
+        try:
+            application.build()
+        except StartupError as e:
+            application.close()
+            return [StageResult("submit", FAIL, f"Cannot start the SMTP server: {e}")]
+        shutdown_event = asyncio.Event()
+        server = asyncio.create_task(application.run(shutdown_event))
+        try:
+            await wait_for_listener("127.0.0.1", port, options["timeout_seconds"])
+            # The original config keeps relaying on for the relay stage's dry run
+            return await asyncio.to_thread(
+                SelfTest(config, "127.0.0.1", port, standalone.database.path, **options).run
+            )
+        finally:
+            shutdown_event.set()
+            await server
+
+
+async def wait_for_listener(host: str, port: int, timeout_seconds: float) -> None:
+    """Wait until a TCP listener accepts connections, or the timeout passes."""
+    deadline = asyncio.get_running_loop().time() + timeout_seconds
+    while True:
+        try:
+            _, writer = await asyncio.open_connection(host, port)
+        except OSError:
+            if asyncio.get_running_loop().time() >= deadline:
+                return
+            await asyncio.sleep(0.05)
+            continue
+        writer.close()
+        return
 
 
 async def run_smtp_server(smtp_server: SMTPServer) -> None:
@@ -56,15 +509,29 @@ async def run_smtp_server(smtp_server: SMTPServer) -> None:
 
 
 class WebServer:
-    """Wrapper for Uvicorn server with graceful shutdown support."""
+    """Wrapper for Uvicorn server with graceful shutdown support.
+
+    With a certificate and key it serves HTTPS.
+    """
 
-    def __init__(self, app, host: str, port: int):
+    def __init__(
+        self,
+        app,
+        host: str,
+        port: int,
+        log_level: str = "info",
+        cert_file: str | None = None,
+        key_file: str | None = None,
+    ):
         self.config = uvicorn.Config(
             app,
             host=host,
             port=port,
-            log_level="info",
-            access_log=True,
+            log_level=log_level,
+            # Requests are logged by the app's own access log
+            access_log=False,
+            ssl_certfile=cert_file,
+            ssl_keyfile=key_file,
         )
         self.server = uvicorn.Server(self.config)
 
@@ -77,25 +544,543 @@ class WebServer:
         self.server.should_exit = True
 
 
-async def main_async(config: Config) -> None:
-    """Async main function to run both servers."""
-    # Initialize database
-    db = Database(config.database.path)
-    logger.info(f"Database initialized at: {config.database.path}")
+def log_magic_login_link(
+    config: Config,
+    user_repo: UserRepository,
+    magic_links: MagicLinkManager,
+    audit_repo: AuditRepository,
+) -> None:
+    """Log a one-time login link for the admin user."""
+    logger.warning("Magic login links are enabled; do not use this in production")
+    user = user_repo.get_by_username(config.admin.username) if config.admin else None
+    if not user:
+        logger.warning("No admin user to create a magic login link for")
+        return
+    host = "localhost" if config.web.host in ("0.0.0.0", "::") else config.web.host
+    if ":" in host:
+        host = f"[{host}]"
+    token = magic_links.issue(user.id)
+    audit_repo.record(
+        "web.magic_link.create", actor=user.username, ttl_seconds=magic_links.ttl_seconds
+    )
+    logger.info(
+        f"Magic login link for {user.username} (valid for "
+        f"{magic_links.ttl_seconds // 60} minutes): "
+        f"{config.web.scheme}://{host}:{config.web.port}{config.web.base_path}"
+        f"/login/magic?token={token}"
+    )
+
+
+async def run_storage_probe(db: Database, interval_seconds: int) -> None:
+    """Periodically probe storage while the breaker is open."""
+    while True:
+        await asyncio.sleep(interval_seconds)
+        if db.breaker.is_open:
+            await asyncio.to_thread(db.probe)
 
-    # Create repositories
-    email_repo = EmailRepository(db)
-    user_repo = UserRepository(db)
 
-    # Ensure admin user exists
-    ensure_admin_user(user_repo, config.admin.username, config.admin.password)
+async def run_journal_purge(
+    journal_repo: JournalRepository, retention_days: int, leases: LeaseRepository
+) -> None:
+    """Prune change journal entries past their retention once an hour.
+
+    Only the instance holding the job's lease prunes.
+    """
+    while True:
+        try:
+            if await asyncio.to_thread(leases.acquire, "journal_purge", PURGE_LEASE_SECONDS):
+                purged = await asyncio.to_thread(journal_repo.purge, retention_days)
+                if purged:
+                    logger.info(
+                        f"Pruned {purged} change journal entries older than {retention_days} day(s)"
+                    )
+        except Exception as e:
+            logger.warning(f"Failed to prune change journal: {e}")
+        await asyncio.sleep(PURGE_INTERVAL_SECONDS)
+
 
-    # Create SMTP server
-    smtp_server = SMTPServer(config.smtp, email_repo)
+async def run_login_attempt_purge(
+    login_attempt_repo: LoginAttemptRepository, retention_days: int, leases: LeaseRepository
+) -> None:
+    """Prune failed web sign-ins past their retention once an hour.
+
+    Only the instance holding the job's lease prunes.
+    """
+    while True:
+        try:
+            if await asyncio.to_thread(leases.acquire, "login_attempt_purge", PURGE_LEASE_SECONDS):
+                purged = await asyncio.to_thread(login_attempt_repo.purge, retention_days)
+                if purged:
+                    logger.info(
+                        f"Pruned {purged} failed sign-ins older than {retention_days} day(s)"
+                    )
+        except Exception as e:
+            logger.warning(f"Failed to prune failed sign-ins: {e}")
+        await asyncio.sleep(PURGE_INTERVAL_SECONDS)
+
+
+async def run_replication(replicator: Replicator, interval_seconds: int) -> None:
+    """Snapshot the database to the replica directory on an interval."""
+    while True:
+        await asyncio.sleep(interval_seconds)
+        try:
+            snapshot = await asyncio.to_thread(replicator.replicate)
+            if snapshot:
+                logger.debug(f"Wrote replica snapshot {snapshot}")
+        except Exception as e:
+            logger.error(f"Replication to {replicator.directory} failed: {e}")
+
+
+def database_write_error(path: str) -> str | None:
+    """Explain why the SQLite database cannot be written, or return None.
+
+    Checks the database file if it exists, otherwise the directory it
+    would be created in, including whether that mount is read-only.
+    """
+    target = Path(path)
+    directory = target.parent
+    while not directory.exists() and directory != directory.parent:
+        directory = directory.parent
+    try:
+        if os.statvfs(directory).f_flag & os.ST_RDONLY:
+            return f"{directory} is on a read-only filesystem"
+    except (AttributeError, OSError):
+        pass
+    if target.exists() and not os.access(target, os.W_OK):
+        return f"{target} is not writable"
+    if not os.access(directory, os.W_OK):
+        return f"{directory} is not writable"
+    return None
+
+
+class Application:
+    """Builds and runs the components enabled on this node.
+
+    config.components selects the SMTP server, the web UI or both, and
+    config.background_jobs decides whether this node runs the jobs that
+    must only run once per database: backfills, journal purge,
+    replication and SIEM export. Read-only mode runs none of them, as they
+    all write. Where several nodes run them anyway, the purges and SIEM
+    export only run on the one holding their lease, while replication
+    writes to each node's own directory. Construction only wires objects
+    together; nothing listens until run() is awaited.
+    """
+
+    def __init__(self, config: Config):
+        self.config = config
+        self.db: Database | None = None
+        self.smtp_server: SMTPServer | None = None
+        self.web_server: WebServer | None = None
+        self.redirect_server: WebServer | None = None
+        self.replicator: Replicator | None = None
+        self.attachment_indexer: AttachmentIndexer | None = None
+        self.siem: SIEMShipper | None = None
+        self.leases: LeaseRepository | None = None
+        self.notifier: RuleNotifier | None = None
+        self.relay: Relay | None = None
+        # New emails are announced to live email lists on this process
+        self.events = EmailEvents()
+        self._tasks: list[asyncio.Task] = []
+
+    @property
+    def runs_smtp(self) -> bool:
+        return self.config.components in ("all", "smtp")
+
+    @property
+    def runs_web(self) -> bool:
+        return self.config.components in ("all", "web")
+
+    @property
+    def runs_background_jobs(self) -> bool:
+        """Whether this process runs the jobs that write, which read-only mode never does."""
+        return self.config.background_jobs and not self.config.read_only
+
+    def check(self) -> None:
+        """Refuse configurations that cannot work before opening anything."""
+        if self.config.read_only and not Path(self.config.database.path).exists():
+            raise StartupError(
+                f"Cannot run read-only: no database at {self.config.database.path}; "
+                "start once without --read-only to create it"
+            )
+        if self.runs_smtp and not self.config.read_only:
+            reason = database_write_error(self.config.database.path)
+            if reason:
+                raise StartupError(
+                    f"Cannot accept SMTP mail: {reason}. Store the database on a writable "
+                    "volume, or run this node with --mode web or --read-only"
+                )
+            if self.config.storage.mode == "files":
+                # Checked like a database file that would be created inside it
+                reason = database_write_error(str(Path(self.config.storage.dir) / "raw"))
+                if reason:
+                    raise StartupError(
+                        f"Cannot store raw messages as files: {reason}. Point storage.dir "
+                        "at a writable directory, or use storage.mode blob"
+                    )
+        smtp = self.config.smtp
+        local_addresses = {smtp.relay.local_address, smtp.upstream.local_address}
+        local_addresses.update(route.local_address for route in smtp.relay.routes)
+        for address in sorted(local_addresses - {""}):
+            reason = local_address_error(address)
+            if reason:
+                raise StartupError(
+                    f"Cannot connect to upstream SMTP servers from {address}: {reason}"
+                )
+
+    def build(self) -> None:
+        """Open the database and create the enabled components."""
+        config = self.config
+        self.check()
+        self.db = Database(config.database.path, read_only=config.read_only)
+        logger.info(f"Database initialized at: {config.database.path}")
+        logger.info(f"Instance ID: {config.instance_id}")
+        logger.info(
+            f"Components: {config.components}; background jobs "
+            + ("enabled" if self.runs_background_jobs else "disabled")
+        )
+        if config.read_only:
+            logger.warning("Running in read-only mode: SMTP mail and web UI changes are refused")
+
+        # Create repositories
+        aggregate_cache = AggregateCache(
+            ttl_seconds=config.database.aggregate_cache_ttl_seconds,
+            enabled=config.database.aggregate_cache,
+        )
+        redactor = Redactor(config.privacy)
+        email_repo = EmailRepository(
+            self.db,
+            aggregate_cache,
+            config.smtp.subaddress_separators,
+            redactor,
+            max_total_bytes=config.database.max_total_bytes,
+            max_emails=config.database.max_emails,
+            compress_raw=config.database.compress_raw,
+            raw_store=RawMessageStore(config.storage.dir),
+            raw_files=config.storage.mode == "files",
+        )
+        if config.storage.mode == "files":
+            logger.info(f"Storing raw messages as files under {config.storage.dir}")
+        if redactor.active:
+            logger.info(
+                "Storing message content per privacy settings: "
+                f"body {'kept' if config.privacy.store_body else 'dropped'}, "
+                f"raw {'kept' if config.privacy.store_raw else 'dropped'}, "
+                f"subject {'hashed' if config.privacy.hash_subject else 'kept'}, "
+                f"{len(config.privacy.scrub_patterns)} scrub pattern(s)"
+            )
+        user_repo = UserRepository(self.db, build_passwords(config.web))
+        rule_repo = RuleRepository(self.db)
+        address_repo = AddressRepository(self.db)
+        self.journal_repo = JournalRepository(self.db)
+        credential_repo = SMTPCredentialRepository(self.db)
+        quota_repo = QuotaRepository(self.db)
+        audit_repo = AuditRepository(self.db, config.instance_id)
+        self.leases = LeaseRepository(self.db, config.instance_id)
+
+        tracking_analyzer = None
+        if config.tracking.enabled:
+            tracking_analyzer = TrackingAnalyzer(config.tracking)
+            logger.info(
+                f"Detecting open tracking with {len(config.tracking.tracker_domains)} "
+                "tracker domain(s)"
+            )
+
+        if self.runs_background_jobs:
+            self._backfill(email_repo, address_repo, tracking_analyzer)
+            self._reconcile_raw_files(email_repo, config.storage.dir)
+            quota_repo.prune()
+
+        if config.smtp.relay.enabled:
+            self.relay = Relay(
+                config.smtp.upstream,
+                email_repo,
+                config.smtp.relay.routes,
+                local_address=config.smtp.relay.local_address,
+            )
+            logger.info(
+                f"Relaying received mail through {len(config.smtp.relay.routes)} route(s)"
+                + (f" and default {config.smtp.upstream.host}:{config.smtp.upstream.port}"
+                   if config.smtp.upstream.host else " with no default")
+            )
+
+        if self.runs_background_jobs and config.database.replica_path:
+            self.replicator = Replicator(
+                self.db, config.database.replica_path, config.database.replica_keep
+            )
+            try:
+                self.replicator.replicate()
+            except Exception as e:
+                logger.error(f"Initial replication to {config.database.replica_path} failed: {e}")
+            logger.info(
+                f"Replicating database to {config.database.replica_path} "
+                f"every {config.database.replica_interval_seconds}s"
+            )
 
-    # Create FastAPI app and web server
-    app = create_app(config, email_repo, user_repo)
-    web_server = WebServer(app, config.web.host, config.web.port)
+        if self.runs_smtp:
+            if config.attachment_index.types:
+                self.attachment_indexer = AttachmentIndexer(config.attachment_index, email_repo)
+                logger.info(
+                    f"Indexing attachment text for: {', '.join(config.attachment_index.types)} "
+                    f"with {config.attachment_index.workers} worker(s)"
+                )
+            self.notifier = RuleNotifier(hash_subjects=config.privacy.hash_subject)
+            self.smtp_server = SMTPServer(
+                config.smtp,
+                email_repo,
+                config.instance_id,
+                read_only=config.read_only,
+                rule_repo=rule_repo,
+                address_repo=address_repo,
+                responders=ResponderEngine(
+                    config.responders,
+                    email_repo,
+                    config.smtp.domain,
+                    config.instance_id,
+                    relay=self.relay,
+                    subaddress_separators=config.smtp.subaddress_separators,
+                ),
+                relay=self.relay,
+                attachment_indexer=self.attachment_indexer,
+                credential_repo=credential_repo,
+                audit_repo=audit_repo,
+                user_repo=user_repo,
+                quota_repo=quota_repo,
+                tracking_analyzer=tracking_analyzer,
+                events=self.events,
+                notifier=self.notifier,
+            )
+            if config.smtp.auth.use_web_users:
+                logger.info("SMTP AUTH checks web UI users instead of configured credentials")
+
+        if self.runs_background_jobs and config.siem.enabled:
+            self.siem = SIEMShipper(config.siem, audit_repo, leases=self.leases)
+            logger.info(
+                f"Exporting audit events over {config.siem.transport} to "
+                + (config.siem.url or f"{config.siem.host}:{config.siem.port}")
+            )
+
+        if self.runs_web:
+            auth_providers = build_providers(config.web.auth_providers, user_repo)
+            logger.info(
+                "Web auth providers: "
+                + ", ".join(provider.name for provider in auth_providers.providers)
+            )
+            # Ensure admin user exists, unless no provider keeps users in the
+            # database or it cannot be written
+            if auth_providers.manages_users and not config.read_only:
+                ensure_admin_user(user_repo, config.admin)
+            try:
+                app = create_app(
+                    config,
+                    email_repo,
+                    user_repo,
+                    rule_repo,
+                    address_repo,
+                    self.journal_repo,
+                    auth_providers,
+                    replicator=self.replicator,
+                    relay=self.relay,
+                    credential_repo=credential_repo,
+                    audit_repo=audit_repo,
+                    siem=self.siem,
+                    smtp_server=self.smtp_server,
+                    quota_repo=quota_repo,
+                    api_token_repo=ApiTokenRepository(self.db),
+                    events=self.events,
+                )
+            except TemplateLoadError as e:
+                raise StartupError(str(e)) from e
+            log_level = "debug" if config.dev else "info"
+            tls = config.web.tls
+            self.web_server = WebServer(
+                app,
+                config.web.host,
+                config.web.port,
+                log_level=log_level,
+                cert_file=tls.cert_file if tls.enabled else None,
+                key_file=tls.key_file if tls.enabled else None,
+            )
+            if tls.enabled and tls.redirect_port:
+                self.redirect_server = WebServer(
+                    HTTPSRedirectApp(config.web.port, config.web.host),
+                    config.web.host,
+                    tls.redirect_port,
+                    log_level=log_level,
+                )
+            if app.state.magic_links is not None:
+                log_magic_login_link(config, user_repo, app.state.magic_links, audit_repo)
+
+    def _reconcile_raw_files(self, email_repo: EmailRepository, directory: str) -> None:
+        """Report raw message files without an email, and emails without their file."""
+        orphaned, missing = email_repo.reconcile_raw_files()
+        if orphaned:
+            logger.warning(
+                f"{len(orphaned)} raw message file(s) in {directory} belong to no email, "
+                f"such as {min(orphaned)}; they are safe to delete"
+            )
+        if missing:
+            logger.error(
+                f"{len(missing)} raw message file(s) referred to by emails are missing "
+                f"from {directory}, such as {min(missing)}"
+            )
+
+    def _backfill(
+        self,
+        email_repo: EmailRepository,
+        address_repo: AddressRepository,
+        tracking_analyzer: TrackingAnalyzer | None,
+    ) -> None:
+        """Fill in derived columns for emails stored by older versions."""
+        backfilled = email_repo.backfill_content_hashes()
+        if backfilled:
+            logger.info(f"Computed content hashes for {backfilled} existing email(s)")
+        backfilled = email_repo.backfill_subjects()
+        if backfilled:
+            logger.info(f"Decoded the subjects of {backfilled} existing email(s)")
+        backfilled = email_repo.backfill_previews()
+        if backfilled:
+            logger.info(f"Computed list previews for {backfilled} existing email(s)")
+        backfilled = email_repo.backfill_security()
+        if backfilled:
+            logger.info(f"Detected signing and encryption for {backfilled} existing email(s)")
+        backfilled = email_repo.backfill_attachments()
+        if backfilled:
+            logger.info(f"Indexed attachment filenames for {backfilled} existing email(s)")
+        backfilled = email_repo.backfill_recipients()
+        if backfilled:
+            logger.info(f"Indexed recipients for {backfilled} existing email(s)")
+        backfilled = email_repo.backfill_canonical_recipients()
+        if backfilled:
+            logger.info(f"Indexed canonical addresses for {backfilled} existing recipient(s)")
+        if tracking_analyzer:
+            backfilled = email_repo.backfill_tracking(tracking_analyzer)
+            if backfilled:
+                logger.info(f"Checked {backfilled} existing email(s) for open tracking")
+        if address_repo.count() == 0 and email_repo.count() > 0:
+            backfilled = address_repo.rebuild()
+            logger.info(f"Built address book from {backfilled} existing email(s)")
+
+    async def run(self, shutdown_event: asyncio.Event) -> None:
+        """Serve until shutdown_event is set or a server stops."""
+        config = self.config
+        servers = []
+        if self.smtp_server:
+            logger.info(f"Starting SMTP server on {config.smtp.address}")
+            servers.append(asyncio.create_task(run_smtp_server(self.smtp_server)))
+        if self.web_server:
+            logger.info(
+                f"Starting Web server on {config.web.address}"
+                + (" with HTTPS" if config.web.tls.enabled else "")
+            )
+            servers.append(asyncio.create_task(self.web_server.start()))
+        if self.redirect_server:
+            logger.info(
+                f"Redirecting HTTP on {config.web.host}:{config.web.tls.redirect_port} to HTTPS"
+            )
+            servers.append(asyncio.create_task(self.redirect_server.start()))
+
+        self._tasks.append(
+            asyncio.create_task(
+                run_storage_probe(self.db, config.database.probe_interval_seconds)
+            )
+        )
+        if self.runs_background_jobs:
+            self._tasks.append(
+                asyncio.create_task(
+                    run_journal_purge(
+                        self.journal_repo, config.database.journal_retention_days, self.leases
+                    )
+                )
+            )
+            self._tasks.append(
+                asyncio.create_task(
+                    run_login_attempt_purge(
+                        LoginAttemptRepository(self.db),
+                        config.web.login_attempt_retention_days,
+                        self.leases,
+                    )
+                )
+            )
+        if self.replicator:
+            self._tasks.append(
+                asyncio.create_task(
+                    run_replication(self.replicator, config.database.replica_interval_seconds)
+                )
+            )
+        if self.siem:
+            self._tasks.append(asyncio.create_task(self.siem.run()))
+
+        # Wait for shutdown signal or server failure
+        done, pending = await asyncio.wait(
+            servers + [asyncio.create_task(shutdown_event.wait())],
+            return_when=asyncio.FIRST_COMPLETED,
+        )
+        await self.shutdown(pending)
+
+    async def shutdown(self, pending: set[asyncio.Task]) -> None:
+        """Stop the servers and background tasks, then close the database."""
+        logger.info("Shutting down servers...")
+        for task in self._tasks:
+            task.cancel()
+        if self.attachment_indexer:
+            self.attachment_indexer.shutdown()
+
+        # Open event streams would otherwise keep the web server waiting
+        self.events.close()
+
+        # Signal the servers to shutdown gracefully
+        if self.smtp_server:
+            await self.smtp_server.shutdown()
+        if self.notifier:
+            await self.notifier.drain(5.0)
+        if self.web_server:
+            await self.web_server.shutdown()
+        if self.redirect_server:
+            await self.redirect_server.shutdown()
+
+        # Wait for tasks to complete with timeout
+        for task in pending:
+            if not task.done():
+                try:
+                    await asyncio.wait_for(asyncio.shield(task), timeout=5.0)
+                except asyncio.TimeoutError:
+                    logger.warning("Task did not complete in time, cancelling...")
+                    task.cancel()
+                    try:
+                        await task
+                    except asyncio.CancelledError:
+                        pass
+
+        # Relays started by the last sessions get a deadline too
+        if self.relay:
+            await self.relay.drain(RELAY_DRAIN_SECONDS)
+
+        # Replicate the final state before closing
+        if self.replicator:
+            try:
+                self.replicator.replicate()
+            except Exception as e:
+                logger.error(f"Final replication to {self.replicator.directory} failed: {e}")
+
+        self.close()
+        logger.info("Shutdown complete")
+
+    def close(self) -> None:
+        """Close the database."""
+        if self.db:
+            self.db.close()
+            self.db = None
+
+
+async def main_async(config: Config) -> None:
+    """Async main function to run the enabled servers."""
+    application = Application(config)
+    try:
+        application.build()
+    except StartupError as e:
+        logger.error(str(e))
+        application.close()
+        sys.exit(1)
 
     # Setup shutdown event
     shutdown_event = asyncio.Event()
@@ -114,48 +1099,17 @@ async def main_async(config: Config) -> None:
             # Windows doesn't support add_signal_handler
             signal.signal(sig, lambda s, f: signal_handler())
 
-    # Start servers
-    logger.info(f"Starting SMTP server on {config.smtp.address}")
-    logger.info(f"Starting Web server on {config.web.address}")
-
-    smtp_task = asyncio.create_task(run_smtp_server(smtp_server))
-    web_task = asyncio.create_task(web_server.start())
-
-    # Wait for shutdown signal or server failure
-    done, pending = await asyncio.wait(
-        [smtp_task, web_task, asyncio.create_task(shutdown_event.wait())],
-        return_when=asyncio.FIRST_COMPLETED,
-    )
-
-    # Graceful shutdown
-    logger.info("Shutting down servers...")
-
-    # Signal both servers to shutdown gracefully
-    await smtp_server.shutdown()
-    await web_server.shutdown()
-
-    # Wait for tasks to complete with timeout
-    for task in pending:
-        if not task.done():
-            try:
-                await asyncio.wait_for(asyncio.shield(task), timeout=5.0)
-            except asyncio.TimeoutError:
-                logger.warning("Task did not complete in time, cancelling...")
-                task.cancel()
-                try:
-                    await task
-                except asyncio.CancelledError:
-                    pass
-
-    # Close database
-    db.close()
-    logger.info("Shutdown complete")
+    await application.run(shutdown_event)
 
 
 def main() -> None:
     """Main entry point."""
     args = parse_args()
 
+    if args.command == "hash-password":
+        run_hash_password_command(args)
+        return
+
     # Load configuration
     config_path = Path(args.config)
     if not config_path.exists():
@@ -169,6 +1123,41 @@ def main() -> None:
         logger.error(f"Failed to load configuration: {e}")
         sys.exit(1)
 
+    if args.command == "user":
+        run_user_command(args, config)
+        return
+
+    if args.command == "settings":
+        run_settings_command(args, config)
+        return
+
+    if args.command == "restore-replica":
+        run_restore_command(args, config)
+        return
+
+    if args.command == "support-bundle":
+        run_support_bundle_command(args, config)
+        return
+
+    if args.command == "verify-audit":
+        run_verify_audit_command(config)
+        return
+
+    if args.command == "selftest":
+        run_selftest_command(args, config)
+        return
+
+    if args.read_only:
+        config.read_only = True
+
+    if args.mode:
+        config.components = args.mode
+
+    if args.dev:
+        config.dev = True
+        logging.getLogger().setLevel(logging.DEBUG)
+        logger.warning("Development mode: templates reload on change; do not use in production")
+
     # Run the async main - signal handlers are set up inside main_async
     asyncio.run(main_async(config))
 
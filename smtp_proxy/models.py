@@ -1,10 +1,31 @@
 """Data models for SMTP Proxy."""
 
 from dataclasses import dataclass, field
-from datetime import datetime
+from datetime import datetime, timezone
+from typing import Callable
+import hashlib
 import json
 
 
+class LazyBytes:
+    """Dataclass field holding bytes, or a function that loads them on first access."""
+
+    def __set_name__(self, owner, name: str):
+        self.attr = f"_{name}"
+
+    def __get__(self, obj, owner=None) -> bytes:
+        if obj is None:
+            return b""
+        value = getattr(obj, self.attr)
+        if callable(value):
+            value = value()
+            setattr(obj, self.attr, value)
+        return value
+
+    def __set__(self, obj, value: bytes | Callable[[], bytes]) -> None:
+        setattr(obj, self.attr, value)
+
+
 @dataclass
 class Email:
     """Email model representing a received email."""
@@ -13,12 +34,53 @@ class Email:
     recipients: list[str] = field(default_factory=list)
     subject: str = ""
     body: str = ""
-    raw_message: bytes = b""
+    body_type: str = ""  # Content type of the part the body came from; "" if stored before
+    preview: str = ""  # Start of the stored body, as shown on the email list
+    # Raw messages kept as files or compressed are read when first used
+    raw_message: bytes = LazyBytes()
     size_bytes: int = 0
     received_at: datetime = field(default_factory=datetime.now)
     status: str = "received"
     auth_user: str = ""
     client_ip: str = ""
+    instance_id: str = ""
+    timing: dict = field(default_factory=dict)
+    content_hash: str = ""
+    parse_error: str = ""
+    anomalies: str = ""
+    attachments: list[dict] = field(default_factory=list)
+    relay_routes: list[dict] = field(default_factory=list)
+    redactions: list[str] = field(default_factory=list)  # Content withheld from storage
+    tracking: list[dict] | None = None  # Tracking findings; None when not analyzed
+    tls_version: str | None = None  # "" for plaintext; None when not received over SMTP
+    tls_cipher: str = ""
+    raw_path: str = ""  # File under storage.dir holding the raw message; "" when stored inline
+    stored_bytes: int = 0  # Size of the raw message as stored, after any compression
+    # S/MIME or PGP signing and encryption as SecurityReport.summary; "" for
+    # neither, None when not detected yet
+    security: str | None = None
+    labels: list[str] = field(default_factory=list)  # Added by rules
+    mailbox: str = ""  # Set by a rule; "" for none
+
+    @property
+    def body_redacted(self) -> bool:
+        """Check whether the text body was not stored."""
+        return "body" in self.redactions
+
+    @property
+    def raw_redacted(self) -> bool:
+        """Check whether the raw message was not stored."""
+        return "raw" in self.redactions
+
+    @property
+    def subject_hashed(self) -> bool:
+        """Check whether the subject was stored as a hash."""
+        return "subject" in self.redactions
+
+    @property
+    def scrubbed(self) -> bool:
+        """Check whether scrub patterns masked part of the stored content."""
+        return "scrubbed" in self.redactions
 
     def recipients_json(self) -> str:
         """Return recipients as a JSON string."""
@@ -32,6 +94,70 @@ class Email:
         except (json.JSONDecodeError, TypeError):
             return []
 
+    def timing_json(self) -> str:
+        """Return the timing breakdown as a JSON string."""
+        return json.dumps(self.timing)
+
+    @staticmethod
+    def parse_timing_json(timing_json: str) -> dict:
+        """Parse the timing breakdown from a JSON string."""
+        try:
+            return json.loads(timing_json) or {}
+        except (json.JSONDecodeError, TypeError):
+            return {}
+
+    def attachments_json(self) -> str:
+        """Return the attachment list as a JSON string."""
+        return json.dumps(self.attachments)
+
+    @staticmethod
+    def parse_attachments_json(attachments_json: str) -> list[dict]:
+        """Parse the attachment list from a JSON string."""
+        try:
+            return json.loads(attachments_json) or []
+        except (json.JSONDecodeError, TypeError):
+            return []
+
+    def attachment_names(self) -> str:
+        """Return lowercased attachment filenames, one per line, for searching."""
+        return "\n".join(a["filename"].lower() for a in self.attachments if a.get("filename"))
+
+    def attachments_matching(self, term: str) -> list[dict]:
+        """Return the attachments whose filename contains term, ignoring case."""
+        term = term.lower()
+        return [a for a in self.attachments if term and term in a.get("filename", "").lower()]
+
+    def relay_routes_json(self) -> str:
+        """Return the per-recipient relay routes as a JSON string."""
+        return json.dumps(self.relay_routes)
+
+    @staticmethod
+    def parse_relay_routes_json(routes_json: str) -> list[dict]:
+        """Parse the per-recipient relay routes from a JSON string."""
+        try:
+            return json.loads(routes_json) or []
+        except (json.JSONDecodeError, TypeError):
+            return []
+
+    @property
+    def has_tracking(self) -> bool:
+        """Check whether tracking analysis found anything."""
+        return bool(self.tracking)
+
+    def tracking_json(self) -> str:
+        """Return the tracking findings as a JSON string, or "" when not analyzed."""
+        return "" if self.tracking is None else json.dumps(self.tracking)
+
+    @staticmethod
+    def parse_tracking_json(tracking_json: str) -> list[dict] | None:
+        """Parse the tracking findings from a JSON string."""
+        if not tracking_json:
+            return None
+        try:
+            return json.loads(tracking_json)
+        except (json.JSONDecodeError, TypeError):
+            return None
+
     def recipients_display(self) -> str:
         """Return recipients as a comma-separated string for display."""
         return ", ".join(self.recipients)
@@ -52,3 +178,231 @@ class User:
     username: str = ""
     password_hash: str = ""
     created_at: datetime = field(default_factory=datetime.now)
+    active: bool = True  # Inactive users cannot sign in and their sessions are refused
+    role: str = "admin"  # "admin" or "viewer"
+
+
+@dataclass
+class SMTPUser:
+    """SMTP AUTH user managed in the web UI."""
+    id: int = 0
+    username: str = ""
+    password_hash: str = ""
+    disabled: bool = False
+    created_at: datetime = field(default_factory=datetime.now)
+    last_used_at: datetime | None = None
+    allowed_senders: list[str] = field(default_factory=list)  # MAIL FROM allowlist; empty allows any
+    max_messages_per_day: int = 0  # 0 is unlimited
+
+
+@dataclass
+class ApiToken:
+    """Bearer token that API clients use instead of a web session."""
+    id: int = 0
+    name: str = ""
+    token_hash: str = ""  # SHA-256 hex digest of the token
+    created_by: str = ""
+    created_at: datetime = field(default_factory=datetime.now)
+    last_used_at: datetime | None = None
+
+
+@dataclass
+class LoginAttempt:
+    """A failed web sign-in."""
+    id: int = 0
+    username: str = ""  # As typed, whether or not such a user exists
+    source: str = ""  # Client IP
+    attempted_at: datetime = field(default_factory=datetime.now)
+
+
+@dataclass
+class LoginLockout:
+    """Consecutive failed sign-ins for a username and any lock they caused."""
+    username: str = ""
+    failures: int = 0
+    last_failed_at: datetime | None = None
+    locked_until: datetime | None = None
+
+    @property
+    def locked(self) -> bool:
+        """Check whether the username is locked right now."""
+        return self.locked_until is not None and self.locked_until > datetime.now()
+
+
+@dataclass
+class QuotaUsage:
+    """Messages an SMTP credential has sent today against its daily limit."""
+    username: str = ""
+    source: str = ""  # web UI or config
+    messages: int = 0
+    limit: int = 0  # 0 is unlimited
+
+    @property
+    def percent(self) -> float:
+        """Return how much of the limit is used, or 0 when unlimited."""
+        return min(100.0, 100 * self.messages / self.limit) if self.limit else 0.0
+
+
+# Negotiated TLS versions that no longer meet current guidance (RFC 8996)
+DEPRECATED_TLS_VERSIONS = ("SSLv3", "TLSv1", "TLSv1.1")
+
+
+@dataclass
+class TLSClientUsage:
+    """The TLS versions and ciphers one SMTP client sent mail with."""
+    auth_user: str = ""
+    client_ip: str = ""
+    messages: int = 0
+    last_seen: str = ""
+    # Message counts by version ("" for plaintext) and cipher
+    connections: list[dict] = field(default_factory=list)
+
+    @property
+    def plaintext(self) -> int:
+        """Return how many messages were sent without TLS."""
+        return sum(c["messages"] for c in self.connections if not c["version"])
+
+    @property
+    def deprecated(self) -> int:
+        """Return how many messages were sent over a deprecated TLS version."""
+        return sum(
+            c["messages"] for c in self.connections if c["version"] in DEPRECATED_TLS_VERSIONS
+        )
+
+
+@dataclass
+class Rule:
+    """Rule matching received emails and the action to take on a match."""
+    id: int = 0
+    name: str = ""
+    priority: int = 100
+    enabled: bool = True
+    sender_pattern: str = ""
+    recipient_pattern: str = ""
+    subject_pattern: str = ""
+    auth_user: str = ""
+    min_size_bytes: int = 0
+    action: str = "set_status"
+    action_value: str = ""
+    created_at: datetime = field(default_factory=datetime.now)
+
+
+@dataclass
+class Address:
+    """Address book entry for an address seen in received mail."""
+    address: str = ""
+    display_names: list[str] = field(default_factory=list)
+    first_seen: datetime = field(default_factory=datetime.now)
+    last_seen: datetime = field(default_factory=datetime.now)
+    sent_count: int = 0
+    received_count: int = 0
+
+    @property
+    def display_name(self) -> str:
+        """Return the most recently seen display name."""
+        return self.display_names[-1] if self.display_names else ""
+
+
+@dataclass
+class DeliveryAttempt:
+    """One attempt to relay an email to an upstream server."""
+    id: int = 0
+    email_id: int = 0
+    attempted_at: datetime = field(default_factory=datetime.now)
+    upstream: str = ""  # host:port
+    smtp_code: int = 0  # Negative for attempts that got no SMTP reply
+    response: str = ""
+    duration_ms: int = 0
+
+    @property
+    def succeeded(self) -> bool:
+        """Check whether the upstream accepted the message."""
+        return 200 <= self.smtp_code < 300
+
+
+@dataclass
+class JournalEntry:
+    """Change journal entry recording an email's receipt, status change, deletion or copy sent elsewhere."""
+    id: int = 0
+    occurred_at: datetime = field(default_factory=datetime.now)
+    action: str = ""  # "receive", "status", "delete", "wipe", "release" or "forward"
+    email_id: int | None = None  # None for wipes
+    actor: str = ""
+    old_status: str = ""
+    new_status: str = ""
+    sender: str = ""
+    subject: str = ""
+    size_bytes: int = 0
+    received_at: datetime | None = None
+    count: int = 0  # Emails removed by a wipe
+    detail: str = ""  # Where a release or forward went and what the server answered
+
+
+AUDIT_SCHEMA_VERSION = 1
+# prev_hash of the first event in the chain
+AUDIT_GENESIS_HASH = "0" * 64
+
+
+@dataclass
+class AuditEvent:
+    """Security-relevant event in the hash-chained audit log.
+
+    Each event's hash covers its canonical JSON, which includes the hash
+    of the event before it, so editing, removing or reordering a stored
+    event breaks the chain from that point on.
+    """
+    id: int = 0  # Position in the chain, starting at 1
+    occurred_at: datetime = field(default_factory=lambda: datetime.now(timezone.utc))
+    event: str = ""  # Dotted name such as "web.login" or "smtp.auth"
+    outcome: str = "success"  # "success" or "failure"
+    actor: str = ""  # Web or SMTP username
+    source: str = ""  # Client IP address
+    instance_id: str = ""
+    data: dict = field(default_factory=dict)
+    prev_hash: str = AUDIT_GENESIS_HASH
+    hash: str = ""
+    shipped_at: datetime | None = None
+
+    def record(self) -> dict:
+        """Return the event in the stable export schema, without its own hash."""
+        return {
+            "schema": AUDIT_SCHEMA_VERSION,
+            "seq": self.id,
+            "time": self.occurred_at.isoformat(timespec="microseconds"),
+            "event": self.event,
+            "outcome": self.outcome,
+            "actor": self.actor,
+            "source": self.source,
+            "instance": self.instance_id,
+            "data": self.data,
+            "prev_hash": self.prev_hash,
+        }
+
+    def canonical(self) -> bytes:
+        """Serialize the record with sorted keys and no whitespace, as hashed."""
+        return json.dumps(
+            self.record(), sort_keys=True, separators=(",", ":"), ensure_ascii=False
+        ).encode("utf-8")
+
+    def compute_hash(self) -> str:
+        return hashlib.sha256(self.canonical()).hexdigest()
+
+    def to_json(self) -> str:
+        """Serialize the record and its hash as exported to collectors."""
+        return json.dumps(
+            {**self.record(), "hash": self.hash},
+            sort_keys=True,
+            separators=(",", ":"),
+            ensure_ascii=False,
+        )
+
+
+@dataclass
+class AttachmentText:
+    """Text extracted from one attachment for search, or why there is none."""
+    index: int = 0  # Position in the email's attachment list
+    filename: str = ""
+    content_type: str = ""
+    status: str = ""  # "indexed", "skipped", "too_large", "failed" or "timeout"
+    text: str = ""
+    error: str = ""
@@ -0,0 +1,80 @@
+"""Notifications sent by rules when a matching email is stored."""
+
+import asyncio
+import json
+import logging
+import urllib.error
+import urllib.request
+
+from .models import Email, Rule
+from .privacy import hash_subject
+
+logger = logging.getLogger(__name__)
+
+TIMEOUT_SECONDS = 10
+
+
+def notification(rule: Rule, email_id: int, email: Email, hash_subjects: bool = False) -> dict:
+    """Build the JSON body posted for a notify rule.
+
+    text is what Slack and compatible incoming webhooks show; the other
+    fields are for endpoints that read the email's details. The subject
+    is hashed when stored subjects are.
+    """
+    subject = hash_subject(email.subject) if hash_subjects and email.subject else email.subject
+    return {
+        "text": f"Rule {rule.name} matched email {email_id} from {email.sender}: {subject}",
+        "rule": rule.name,
+        "email": {
+            "id": email_id,
+            "sender": email.sender,
+            "recipients": email.recipients,
+            "subject": subject,
+            "received_at": email.received_at.isoformat(),
+            "labels": email.labels,
+            "mailbox": email.mailbox,
+        },
+    }
+
+
+def post(url: str, body: dict, timeout: float = TIMEOUT_SECONDS) -> int:
+    """POST a JSON body to url and return the response status."""
+    request = urllib.request.Request(url, data=json.dumps(body).encode(), method="POST")
+    request.add_header("Content-Type", "application/json")
+    with urllib.request.urlopen(request, timeout=timeout) as response:
+        response.read()
+        return response.status
+
+
+class RuleNotifier:
+    """Posts a notification for each email a notify rule matched.
+
+    Notifications are sent in the background once the email is stored,
+    so a slow or failing endpoint never delays the SMTP client; failures
+    are logged and not retried.
+    """
+
+    def __init__(self, hash_subjects: bool = False, timeout_seconds: float = TIMEOUT_SECONDS):
+        self.hash_subjects = hash_subjects
+        self.timeout_seconds = timeout_seconds
+        self._tasks: set[asyncio.Task] = set()
+
+    def submit(self, rule: Rule, email_id: int, email: Email) -> None:
+        """Schedule the notification of a rule for a stored email."""
+        body = notification(rule, email_id, email, self.hash_subjects)
+        task = asyncio.create_task(self._send(rule, email_id, body))
+        self._tasks.add(task)
+        task.add_done_callback(self._tasks.discard)
+
+    async def _send(self, rule: Rule, email_id: int, body: dict) -> None:
+        try:
+            await asyncio.to_thread(post, rule.action_value, body, self.timeout_seconds)
+        except (urllib.error.URLError, OSError, ValueError) as e:
+            logger.warning(f"Failed to notify {rule.action_value} of email {email_id}: {e}")
+            return
+        logger.info(f"Notified {rule.action_value} of email {email_id} by rule {rule.name}")
+
+    async def drain(self, timeout: float) -> None:
+        """Wait up to timeout for notifications still being sent."""
+        if self._tasks:
+            await asyncio.wait(set(self._tasks), timeout=timeout)
@@ -0,0 +1,171 @@
+"""Password hashing for web users with bcrypt or Argon2id."""
+
+import hashlib
+import secrets
+
+from argon2 import PasswordHasher as Argon2PasswordHasher, Type
+from argon2.exceptions import InvalidHashError, VerificationError
+import bcrypt
+
+from .config import WebConfig
+
+BCRYPT_PREFIXES = ("$2a$", "$2b$", "$2y$")
+ARGON2ID_PREFIX = "$argon2id$"
+
+# Lanes of an Argon2id hash; fixed, as the memory and iterations are
+# what deployments tune
+ARGON2_PARALLELISM = 4
+
+
+class PasswordHasher:
+    """One password hashing algorithm.
+
+    Hashes are self-describing strings that carry the algorithm and its
+    parameters, so a stored hash can be checked whatever is configured
+    now. recognizes() tells which hasher a stored hash belongs to.
+    """
+
+    name = ""
+
+    def hash(self, password: str) -> str:
+        raise NotImplementedError
+
+    def verify(self, password: str, password_hash: str) -> bool:
+        raise NotImplementedError
+
+    def recognizes(self, password_hash: str) -> bool:
+        raise NotImplementedError
+
+    def needs_rehash(self, password_hash: str) -> bool:
+        """Check whether a hash of this algorithm uses other parameters than configured."""
+        return False
+
+
+class BcryptHasher(PasswordHasher):
+    """bcrypt in its $2b$<cost>$ modular crypt format."""
+
+    name = "bcrypt"
+
+    def __init__(self, cost: int = 12):
+        self.cost = cost
+
+    def hash(self, password: str) -> str:
+        return bcrypt.hashpw(password.encode(), bcrypt.gensalt(rounds=self.cost)).decode()
+
+    def verify(self, password: str, password_hash: str) -> bool:
+        # $2y$ is PHP's name for the same algorithm as $2b$
+        password_hash = "$2b$" + password_hash[4:]
+        try:
+            return bcrypt.checkpw(password.encode(), password_hash.encode())
+        except ValueError:
+            return False
+
+    def recognizes(self, password_hash: str) -> bool:
+        return password_hash.startswith(BCRYPT_PREFIXES)
+
+    def needs_rehash(self, password_hash: str) -> bool:
+        # The cost is the two digits after the prefix, as in $2b$12$
+        cost = password_hash[4:6]
+        return not cost.isdigit() or int(cost) != self.cost
+
+
+class Argon2idHasher(PasswordHasher):
+    """Argon2id in the PHC string format, $argon2id$v=19$m=...,t=...,p=...$salt$hash."""
+
+    name = "argon2id"
+
+    def __init__(self, memory_kib: int = 65536, iterations: int = 3):
+        self._hasher = Argon2PasswordHasher(
+            time_cost=iterations,
+            memory_cost=memory_kib,
+            parallelism=ARGON2_PARALLELISM,
+            type=Type.ID,
+        )
+
+    def hash(self, password: str) -> str:
+        return self._hasher.hash(password)
+
+    def verify(self, password: str, password_hash: str) -> bool:
+        try:
+            return self._hasher.verify(password_hash, password)
+        except (VerificationError, InvalidHashError):
+            return False
+
+    def recognizes(self, password_hash: str) -> bool:
+        return password_hash.startswith(ARGON2ID_PREFIX)
+
+    def needs_rehash(self, password_hash: str) -> bool:
+        try:
+            return self._hasher.check_needs_rehash(password_hash)
+        except InvalidHashError:
+            return True
+
+
+class PBKDF2Hasher(PasswordHasher):
+    """The salt$hex PBKDF2-SHA256 hashes of web users created before bcrypt.
+
+    Only verified, never created: a user with one is rehashed with the
+    configured algorithm when they next sign in.
+    """
+
+    name = "pbkdf2"
+    ITERATIONS = 100000
+
+    def hash(self, password: str) -> str:
+        raise NotImplementedError("PBKDF2 hashes are only verified")
+
+    def verify(self, password: str, password_hash: str) -> bool:
+        salt, _, stored_hash = password_hash.partition("$")
+        computed_hash = hashlib.pbkdf2_hmac(
+            "sha256", password.encode(), salt.encode(), self.ITERATIONS
+        ).hex()
+        return secrets.compare_digest(computed_hash, stored_hash)
+
+    def recognizes(self, password_hash: str) -> bool:
+        salt, sep, stored_hash = password_hash.partition("$")
+        return bool(sep and salt and stored_hash) and not password_hash.startswith("$")
+
+
+class Passwords:
+    """Hashes new passwords with the configured algorithm and checks any known one."""
+
+    def __init__(self, hasher: PasswordHasher):
+        self.hasher = hasher
+        self.hashers = [hasher] + [
+            other for other in default_hashers() if other.name != hasher.name
+        ]
+
+    def hash(self, password: str) -> str:
+        """Hash a password with the configured algorithm."""
+        return self.hasher.hash(password)
+
+    def verify(self, password: str, password_hash: str) -> bool:
+        """Check a password against a hash of any known algorithm."""
+        hasher = self._hasher_for(password_hash)
+        return hasher is not None and hasher.verify(password, password_hash)
+
+    def needs_rehash(self, password_hash: str) -> bool:
+        """Check whether a hash is of another algorithm or parameters than configured."""
+        if not self.hasher.recognizes(password_hash):
+            return True
+        return self.hasher.needs_rehash(password_hash)
+
+    def _hasher_for(self, password_hash: str) -> PasswordHasher | None:
+        for hasher in self.hashers:
+            if hasher.recognizes(password_hash):
+                return hasher
+        return None
+
+
+def default_hashers() -> list[PasswordHasher]:
+    """Return a hasher for every algorithm stored hashes may use."""
+    return [BcryptHasher(), Argon2idHasher(), PBKDF2Hasher()]
+
+
+def build_passwords(config: WebConfig) -> Passwords:
+    """Create the password hashing configured for web users."""
+    if config.password_hash == "argon2id":
+        hasher = Argon2idHasher(config.argon2_memory_kib, config.argon2_iterations)
+    else:
+        hasher = BcryptHasher(config.bcrypt_cost)
+    return Passwords(hasher)
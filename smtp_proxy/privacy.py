@@ -0,0 +1,108 @@
+"""Redaction of message content before it is stored."""
+
+from dataclasses import replace
+from urllib.parse import urlsplit
+import hashlib
+import re
+
+from .config import PrivacyConfig
+from .models import Email
+from .tracking import KIND_READ_RECEIPT
+
+REDACTED_BODY = "body"
+REDACTED_RAW = "raw"
+HASHED_SUBJECT = "subject"
+SCRUBBED = "scrubbed"
+
+SUBJECT_HASH_PREFIX = "sha256:"
+
+
+def hash_subject(subject: str) -> str:
+    """Return the stored form of a hashed subject."""
+    return SUBJECT_HASH_PREFIX + hashlib.sha256(subject.encode("utf-8")).hexdigest()
+
+
+class Redactor:
+    """Produces the copy of an email that is written to the database.
+
+    Size, envelope, timing and attachment names are always kept. The
+    body and raw message are dropped or scrubbed and the subject hashed
+    as configured. Tracking URLs, which often carry recipient tokens,
+    are cut to their host along with the body or scrubbed like it. The
+    copy lists what was withheld so the UI can say so. The caller's
+    email is left whole for relaying, responders and other work done
+    before the SMTP reply.
+    """
+
+    def __init__(self, config: PrivacyConfig):
+        self.config = config
+        self._patterns = [re.compile(pattern) for pattern in config.scrub_patterns]
+
+    @property
+    def active(self) -> bool:
+        """Check whether stored emails differ from received ones."""
+        config = self.config
+        return (
+            not config.store_body
+            or not config.store_raw
+            or config.hash_subject
+            or bool(self._patterns)
+        )
+
+    def redact(self, email: Email) -> Email:
+        """Return the email as it should be stored."""
+        if not self.active:
+            return email
+        redactions = []
+        body, raw_message, subject = email.body, email.raw_message, email.subject
+        if not self.config.store_body:
+            body = ""
+            redactions.append(REDACTED_BODY)
+        if not self.config.store_raw:
+            raw_message = b""
+            redactions.append(REDACTED_RAW)
+        if self.config.hash_subject and subject:
+            subject = hash_subject(subject)
+            redactions.append(HASHED_SUBJECT)
+        if self._patterns:
+            body, body_count = self._scrub(body)
+            # Latin-1 maps every byte to one character and back, so the
+            # raw message survives the round trip except where masked
+            raw_text, raw_count = self._scrub(raw_message.decode("latin-1"))
+            raw_message = raw_text.encode("latin-1", errors="replace")
+            if body_count or raw_count:
+                redactions.append(SCRUBBED)
+        return replace(
+            email,
+            body=body,
+            raw_message=raw_message,
+            subject=subject,
+            redactions=redactions,
+            tracking=self._redact_tracking(email.tracking),
+        )
+
+    def _redact_tracking(self, findings: list[dict] | None) -> list[dict] | None:
+        """Reduce tracking URLs to their host without the body, and scrub them."""
+        if not findings:
+            return findings
+        redacted = []
+        for finding in findings:
+            url = finding["url"]
+            if finding["kind"] != KIND_READ_RECEIPT:
+                if not self.config.store_body:
+                    try:
+                        url = urlsplit(url)._replace(path="", query="", fragment="").geturl()
+                    except ValueError:
+                        url = ""
+                else:
+                    url, _ = self._scrub(url)
+            redacted.append({**finding, "url": url})
+        return redacted
+
+    def _scrub(self, text: str) -> tuple[str, int]:
+        """Mask every match of the scrub patterns, returning the text and match count."""
+        total = 0
+        for pattern in self._patterns:
+            text, count = pattern.subn(self.config.scrub_replacement, text)
+            total += count
+        return text, total
@@ -0,0 +1,368 @@
+"""Relay of stored emails to an upstream SMTP server."""
+
+import asyncio
+import ipaddress
+import logging
+import smtplib
+import socket
+import ssl
+import time
+
+from .config import RelayRoute, UpstreamConfig
+from .database.email_repository import EmailRepository
+from .models import Email
+
+logger = logging.getLogger(__name__)
+
+
+# Statuses of emails whose relay did not deliver to every recipient
+FAILED_STATUSES = ("relay_failed", "unrouted")
+
+# Synthetic reply codes for attempts that ended without an SMTP reply
+CODE_CONNECT_FAILED = -1
+CODE_TIMEOUT = -2
+CODE_CONNECTION_LOST = -3
+CODE_PROTOCOL_ERROR = -4
+
+SYNTHETIC_CODES = {
+    CODE_CONNECT_FAILED: "connection failed",
+    CODE_TIMEOUT: "timeout",
+    CODE_CONNECTION_LOST: "connection lost",
+    CODE_PROTOCOL_ERROR: "protocol error",
+}
+
+
+class RelayError(Exception):
+    """Raised when the upstream server does not accept a message."""
+
+    def __init__(self, code: int, response: str):
+        super().__init__(f"{code} {response}")
+        self.code = code
+        self.response = response
+
+
+def local_address_error(address: str) -> str | None:
+    """Explain why connections cannot be made from a local address, or return None."""
+    try:
+        ip = ipaddress.ip_address(address)
+    except ValueError:
+        return f"{address!r} is not an IP address"
+    family = socket.AF_INET6 if ip.version == 6 else socket.AF_INET
+    try:
+        with socket.socket(family, socket.SOCK_STREAM) as sock:
+            sock.bind((address, 0))
+    except OSError as e:
+        return f"{address} is not assigned to a local interface ({e.strerror or e})"
+    return None
+
+
+def connect_from(host: str, port: int, timeout: float, local_address: str) -> socket.socket:
+    """Open a TCP connection to host from local_address.
+
+    Only the host's addresses in the family of local_address are tried,
+    as a socket bound to an IPv4 address cannot reach an IPv6 one or the
+    other way round; a host with none is reported as such rather than
+    with a bind error.
+    """
+    version = ipaddress.ip_address(local_address).version
+    family = socket.AF_INET6 if version == 6 else socket.AF_INET
+    try:
+        candidates = socket.getaddrinfo(host, port, family, socket.SOCK_STREAM)
+    except socket.gaierror as e:
+        raise OSError(
+            f"{host} has no IPv{version} address to connect to from {local_address}: {e}"
+        ) from e
+    error: OSError | None = None
+    for family, type_, proto, _, address in candidates:
+        sock = socket.socket(family, type_, proto)
+        try:
+            sock.settimeout(timeout)
+            sock.bind((local_address, 0))
+            sock.connect(address)
+            return sock
+        except OSError as e:
+            error = e
+            sock.close()
+    raise error
+
+
+class BoundSMTP(smtplib.SMTP):
+    """SMTP client that connects from its source_address with connect_from."""
+
+    def _get_socket(self, host, port, timeout):
+        if not self.source_address:
+            return super()._get_socket(host, port, timeout)
+        return connect_from(host, port, timeout, self.source_address[0])
+
+
+class BoundSMTPSSL(smtplib.SMTP_SSL, BoundSMTP):
+    """Implicit-TLS variant of BoundSMTP; SMTP_SSL wraps the socket it opens."""
+
+
+def source_address(config: UpstreamConfig, default: str = "") -> str:
+    """Return the local address to connect to an upstream from, or "" for any."""
+    return config.local_address or default
+
+
+def deliver(
+    config: UpstreamConfig,
+    sender: str,
+    recipients: list[str],
+    raw_message: bytes,
+    dry_run: bool = False,
+    local_address: str = "",
+) -> tuple[int, str]:
+    """Submit a message to the upstream server with its original envelope.
+
+    Blocks until the upstream answers and returns its reply to DATA.
+    Raises RelayError with the upstream's reply, or a synthetic code when
+    there was none, if the message or any recipient is refused. With
+    dry_run the transaction is reset after RCPT instead of sending DATA,
+    and the reply to the last RCPT is returned. The connection is made
+    from the upstream's local_address, or else from local_address.
+    """
+    context = ssl.create_default_context()
+    source = source_address(config, local_address)
+    bind = (source, 0) if source else None
+    try:
+        if config.implicit_tls:
+            client = BoundSMTPSSL(
+                config.host,
+                config.port,
+                timeout=config.timeout_seconds,
+                context=context,
+                source_address=bind,
+            )
+        else:
+            client = BoundSMTP(
+                config.host, config.port, timeout=config.timeout_seconds, source_address=bind
+            )
+        with client:
+            if config.starttls:
+                client.starttls(context=context)
+            if config.username:
+                client.login(config.username, config.password)
+            return _submit(client, sender, recipients, raw_message, dry_run)
+    except RelayError:
+        raise
+    except TimeoutError as e:
+        raise RelayError(CODE_TIMEOUT, str(e) or "Timed out") from e
+    except ssl.SSLError as e:
+        raise RelayError(CODE_PROTOCOL_ERROR, str(e)) from e
+    except smtplib.SMTPServerDisconnected as e:
+        # smtplib reports a timeout waiting for a reply as a disconnect
+        code = CODE_TIMEOUT if isinstance(e.__context__, TimeoutError) else CODE_CONNECTION_LOST
+        raise RelayError(code, str(e)) from e
+    except smtplib.SMTPResponseException as e:
+        raise RelayError(e.smtp_code, _text(e.smtp_error)) from e
+    except smtplib.SMTPException as e:
+        raise RelayError(CODE_PROTOCOL_ERROR, str(e)) from e
+    except OSError as e:
+        raise RelayError(CODE_CONNECT_FAILED, str(e)) from e
+
+
+def _submit(
+    client: smtplib.SMTP,
+    sender: str,
+    recipients: list[str],
+    raw_message: bytes,
+    dry_run: bool = False,
+) -> tuple[int, str]:
+    """Run one MAIL/RCPT/DATA transaction, keeping every reply."""
+    client.ehlo_or_helo_if_needed()
+    options = [f"SIZE={len(raw_message)}"] if client.has_extn("size") else []
+    code, reply = client.mail(sender, options)
+    if code != 250:
+        raise RelayError(code, _text(reply))
+
+    refused = []
+    for recipient in recipients:
+        code, reply = client.rcpt(recipient)
+        if code not in (250, 251):
+            refused.append((recipient, code, _text(reply)))
+    if len(refused) == len(recipients):
+        client.rset()
+        raise RelayError(code, _text(reply))
+
+    if dry_run:
+        client.rset()
+    else:
+        code, reply = client.data(raw_message)
+        if code != 250:
+            raise RelayError(code, _text(reply))
+    if refused:
+        raise RelayError(
+            refused[0][1],
+            "Recipients refused: " + ", ".join(f"{r} ({c} {t})" for r, c, t in refused),
+        )
+    return code, _text(reply)
+
+
+def _text(reply: bytes | str) -> str:
+    """Decode an SMTP reply text."""
+    return reply.decode(errors="replace") if isinstance(reply, bytes) else reply
+
+
+def domain_matches(pattern: str, domain: str) -> bool:
+    """Check a recipient domain against an exact or *.wildcard route domain."""
+    pattern = pattern.lower()
+    domain = domain.lower()
+    if pattern.startswith("*."):
+        return domain.endswith(pattern[1:])
+    return domain == pattern
+
+
+def route_recipients(
+    recipients: list[str], routes: list[RelayRoute], default: UpstreamConfig | None
+) -> tuple[list[tuple[str, UpstreamConfig, list[str]]], list[str]]:
+    """Group recipients by the first route matching their domain.
+
+    Returns (label, upstream, recipients) groups in route order and the
+    recipients no route or default handles.
+    """
+    groups: dict[str, tuple[UpstreamConfig, list[str]]] = {}
+    unrouted = []
+    for recipient in recipients:
+        domain = recipient.rpartition("@")[2]
+        route = next((r for r in routes if domain_matches(r.domain, domain)), None)
+        if route:
+            label, upstream = route.domain, route
+        elif default:
+            label, upstream = "default", default
+        else:
+            unrouted.append(recipient)
+            continue
+        groups.setdefault(label, (upstream, []))[1].append(recipient)
+    return [(label, upstream, rcpts) for label, (upstream, rcpts) in groups.items()], unrouted
+
+
+class Relay:
+    """Hands stored emails to the upstream server in the background.
+
+    Recipients are split by domain across the routes, falling back to the
+    default upstream. Each email's status moves from received to relayed,
+    relay_failed or unrouted; a failure is logged and never reported to
+    the sending client.
+    """
+
+    def __init__(
+        self,
+        config: UpstreamConfig,
+        email_repo: EmailRepository,
+        routes: list[RelayRoute] | None = None,
+        local_address: str = "",
+    ):
+        self.config = config
+        self.email_repo = email_repo
+        self.routes = routes or []
+        self.local_address = local_address
+        self._tasks: set[asyncio.Task] = set()
+
+    def submit(self, email_id: int, email: Email) -> None:
+        """Schedule relaying a stored email."""
+        task = asyncio.create_task(self._relay(email_id, email))
+        self._tasks.add(task)
+        task.add_done_callback(self._tasks.discard)
+
+    def retry(self, email_id: int, email: Email) -> None:
+        """Schedule another relay of an email whose delivery failed.
+
+        Earlier attempts stay in its history; the status is replaced by
+        the new outcome.
+        """
+        task = asyncio.create_task(self._relay(email_id, email, retry=True))
+        self._tasks.add(task)
+        task.add_done_callback(self._tasks.discard)
+
+    async def _relay(self, email_id: int, email: Email, retry: bool = False) -> None:
+        """Relay an email per route and record the outcome."""
+        default = self.config if self.config.host else None
+        groups, unrouted = route_recipients(email.recipients, self.routes, default)
+        routes = [{"recipient": r, "route": None, "upstream": None, "ok": False} for r in unrouted]
+        failed = False
+        for label, upstream, recipients in groups:
+            address = f"{upstream.host}:{upstream.port}"
+            source = source_address(upstream, self.local_address)
+            started_at = time.perf_counter()
+            try:
+                code, response = await asyncio.to_thread(
+                    deliver, upstream, email.sender, recipients, email.raw_message,
+                    local_address=self.local_address,
+                )
+                ok = True
+                logger.info(
+                    f"Relayed email {email_id} to {address} via route {label}"
+                    + (f" from {source}" if source else "")
+                )
+            except RelayError as e:
+                code, response = e.code, e.response
+                ok = False
+                failed = True
+                logger.warning(
+                    f"Failed to relay email {email_id} to {address} via route {label}"
+                    + (f" from {source}" if source else "")
+                    + f": {e}"
+                )
+            except asyncio.CancelledError:
+                self._record_interrupted(email_id, email, address, started_at, retry)
+                raise
+            duration_ms = round((time.perf_counter() - started_at) * 1000)
+            try:
+                await asyncio.to_thread(
+                    self.email_repo.add_delivery_attempt,
+                    email_id, address, code, response, duration_ms,
+                )
+            except Exception as e:
+                logger.error(f"Failed to record delivery attempt for email {email_id}: {e}")
+            routes.extend(
+                {"recipient": r, "route": label, "upstream": address, "ok": ok} for r in recipients
+            )
+        if unrouted:
+            logger.warning(f"No relay route for email {email_id} recipients: {', '.join(unrouted)}")
+
+        routes.sort(key=lambda route: email.recipients.index(route["recipient"]))
+
+        status = "relay_failed" if failed else "unrouted" if unrouted else "relayed"
+        try:
+            await asyncio.to_thread(self.email_repo.update_relay_routes, email_id, routes)
+            # A status set by a rule is kept; the outcome is in the log either way
+            if email.status == "received" or (retry and email.status in FAILED_STATUSES):
+                await asyncio.to_thread(
+                    self.email_repo.update_status, email_id, status, actor="relay"
+                )
+        except Exception as e:
+            logger.error(f"Failed to record relay status for email {email_id}: {e}")
+
+    def _record_interrupted(
+        self, email_id: int, email: Email, address: str, started_at: float, retry: bool
+    ) -> None:
+        """Record a relay cut short by shutdown as failed, so it can be retried.
+
+        Written directly rather than in a thread, as the task is already
+        being cancelled. The upstream may still have accepted the message.
+        """
+        logger.warning(f"Relay of email {email_id} to {address} interrupted by shutdown")
+        duration_ms = round((time.perf_counter() - started_at) * 1000)
+        try:
+            self.email_repo.add_delivery_attempt(
+                email_id, address, CODE_CONNECTION_LOST, "Interrupted by shutdown", duration_ms
+            )
+            if email.status == "received" or (retry and email.status in FAILED_STATUSES):
+                self.email_repo.update_status(email_id, "relay_failed", actor="relay")
+        except Exception as e:
+            logger.error(f"Failed to record interrupted relay of email {email_id}: {e}")
+
+    async def drain(self, timeout: float) -> None:
+        """Wait up to timeout for relays in progress, then interrupt the rest.
+
+        An interrupted email is marked relay_failed, so it is listed under
+        failed deliveries for a retry instead of staying received.
+        """
+        if not self._tasks:
+            return
+        _, pending = await asyncio.wait(set(self._tasks), timeout=timeout)
+        if pending:
+            logger.warning(f"Interrupting {len(pending)} relay(s) still running at shutdown")
+            for task in pending:
+                task.cancel()
+            await asyncio.gather(*pending, return_exceptions=True)
@@ -0,0 +1,216 @@
+"""Synthesized bounces and auto-replies for configured test recipients."""
+
+import asyncio
+from collections import deque
+from datetime import datetime
+from email import message_from_bytes
+from email.message import EmailMessage
+from email.policy import default as email_policy
+from email.utils import format_datetime, make_msgid
+import logging
+import re
+import time
+
+from .config import ResponderConfig
+from .database.email_repository import EmailRepository
+from .extract import extract_content
+from .models import Email
+from .relay import Relay
+from .subaddress import split_subaddress
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_STATUS = {"hard_bounce": "5.1.1", "soft_bounce": "4.2.2"}
+
+# Headers marking a message as automatic; responding to it risks a mail loop
+AUTOMATIC_PRECEDENCE = {"bulk", "junk", "list"}
+
+
+def is_automatic(email: Email) -> bool:
+    """Check whether a message is itself a bounce or an automatic reply."""
+    if not email.sender:
+        return True
+    try:
+        msg = message_from_bytes(email.raw_message, policy=email_policy)
+        auto_submitted = str(msg.get("Auto-Submitted", "no")).strip().lower()
+        precedence = str(msg.get("Precedence", "")).strip().lower()
+    except Exception:
+        return False
+    return auto_submitted != "no" or precedence in AUTOMATIC_PRECEDENCE or "List-Id" in msg
+
+
+def build_dsn(
+    responder: ResponderConfig, email: Email, recipient: str, domain: str
+) -> EmailMessage:
+    """Build an RFC 3464 delivery status notification for one recipient."""
+    status = responder.status or DEFAULT_STATUS[responder.action]
+    failed = responder.action == "hard_bounce"
+    reply_code = "550" if failed else "451"
+    diagnostic = responder.message or (
+        "Mailbox unavailable" if failed else "Mailbox temporarily unavailable"
+    )
+    original = message_from_bytes(email.raw_message, policy=email_policy)
+
+    dsn = EmailMessage()
+    dsn["From"] = f"Mail Delivery System <MAILER-DAEMON@{domain}>"
+    dsn["To"] = email.sender
+    dsn["Subject"] = (
+        "Undelivered Mail Returned to Sender" if failed else "Delayed Mail (still being retried)"
+    )
+    dsn["Date"] = format_datetime(datetime.now().astimezone())
+    dsn["Message-ID"] = make_msgid(domain=domain)
+    dsn["Auto-Submitted"] = "auto-replied"
+    if original.get("Message-ID"):
+        dsn["In-Reply-To"] = original["Message-ID"]
+        dsn["References"] = original["Message-ID"]
+
+    if failed:
+        text = f"Your message could not be delivered to {recipient}.\n\n{reply_code} {status} {diagnostic}\n"
+    else:
+        text = (
+            f"Delivery of your message to {recipient} has been delayed. "
+            f"Delivery will be retried; no action is needed yet.\n\n"
+            f"{reply_code} {status} {diagnostic}\n"
+        )
+    dsn.set_content(text)
+
+    fields = (
+        f"Reporting-MTA: dns; {domain}\n"
+        f"Arrival-Date: {format_datetime(email.received_at.astimezone())}\n"
+        f"\n"
+        f"Final-Recipient: rfc822; {recipient}\n"
+        f"Action: {'failed' if failed else 'delayed'}\n"
+        f"Status: {status}\n"
+        f"Diagnostic-Code: smtp; {reply_code} {status} {diagnostic}\n"
+    )
+    # The parser splits delivery-status fields into the per-message and
+    # per-recipient blocks the generator expects
+    dsn.make_mixed()
+    dsn.attach(message_from_bytes(
+        b"Content-Type: message/delivery-status\r\n\r\n" + fields.encode(), policy=email_policy
+    ))
+    headers, _, _ = email.raw_message.partition(b"\r\n\r\n")
+    dsn.add_attachment(
+        headers.decode("utf-8", errors="replace") + "\n",
+        subtype="rfc822-headers", disposition="inline",
+    )
+    dsn.set_type("multipart/report")
+    dsn.set_param("report-type", "delivery-status")
+    return dsn
+
+
+def build_out_of_office(
+    responder: ResponderConfig, email: Email, recipient: str, domain: str
+) -> EmailMessage:
+    """Build an RFC 3834 out-of-office reply from a recipient."""
+    original = message_from_bytes(email.raw_message, policy=email_policy)
+    reply = EmailMessage()
+    reply["From"] = recipient
+    reply["To"] = email.sender
+    reply["Subject"] = responder.subject or f"Out of Office: {email.subject}"
+    reply["Date"] = format_datetime(datetime.now().astimezone())
+    reply["Message-ID"] = make_msgid(domain=domain)
+    reply["Auto-Submitted"] = "auto-replied"
+    if original.get("Message-ID"):
+        reply["In-Reply-To"] = original["Message-ID"]
+        reply["References"] = original["Message-ID"]
+    reply.set_content(responder.message or "I am currently out of the office.\n")
+    return reply
+
+
+class ResponderEngine:
+    """Generates responses to received mail and stores them as new emails.
+
+    Responses are also relayed upstream when a relay is configured.
+    """
+
+    def __init__(
+        self,
+        responders: list[ResponderConfig],
+        email_repo: EmailRepository,
+        domain: str,
+        instance_id: str = "",
+        relay: Relay | None = None,
+        subaddress_separators: str = "",
+    ):
+        self.responders = responders
+        self.email_repo = email_repo
+        self.domain = domain
+        self.instance_id = instance_id
+        self.relay = relay
+        self.subaddress_separators = subaddress_separators
+        self._patterns = [re.compile(r.recipient_pattern, re.IGNORECASE) for r in responders]
+        self._sent: dict[int, deque[float]] = {i: deque() for i in range(len(responders))}
+        self._tasks: set[asyncio.Task] = set()
+
+    def handle(self, email: Email) -> None:
+        """Schedule responses for every recipient of email that has a responder."""
+        if not self.responders:
+            return
+        automatic = is_automatic(email)
+        for recipient in email.recipients:
+            # Patterns see the mailbox with and without its sub-address tag
+            canonical, _ = split_subaddress(recipient, self.subaddress_separators)
+            for index, responder in enumerate(self.responders):
+                pattern = self._patterns[index]
+                if not (pattern.search(canonical) or pattern.search(recipient)):
+                    continue
+                if responder.action != "accept":
+                    if automatic:
+                        logger.info(f"Responder {responder.name}: not answering automatic message")
+                    elif self._allow(index):
+                        self._schedule(responder, email, recipient)
+                    else:
+                        logger.warning(f"Responder {responder.name}: rate cap reached, dropping response")
+                break
+
+    def _allow(self, index: int) -> bool:
+        """Apply the per-responder cap on responses per minute."""
+        now = time.monotonic()
+        sent = self._sent[index]
+        while sent and now - sent[0] >= 60:
+            sent.popleft()
+        if len(sent) >= self.responders[index].max_per_minute:
+            return False
+        sent.append(now)
+        return True
+
+    def _schedule(self, responder: ResponderConfig, email: Email, recipient: str) -> None:
+        """Generate a response after the responder's delay."""
+        task = asyncio.create_task(self._respond(responder, email, recipient))
+        self._tasks.add(task)
+        task.add_done_callback(self._tasks.discard)
+
+    async def _respond(self, responder: ResponderConfig, email: Email, recipient: str) -> None:
+        """Build a response and store it as a new email."""
+        if responder.delay_seconds:
+            await asyncio.sleep(responder.delay_seconds)
+        if responder.action == "out_of_office":
+            message = build_out_of_office(responder, email, recipient, self.domain)
+            sender = recipient
+        else:
+            message = build_dsn(responder, email, recipient, self.domain)
+            sender = ""
+        raw_message = message.as_bytes(policy=email_policy.clone(linesep="\r\n"))
+        content = extract_content(raw_message)
+        response = Email(
+            sender=sender,
+            recipients=[email.sender],
+            subject=content.subject,
+            body=content.body,
+            body_type=content.body_type,
+            raw_message=raw_message,
+            size_bytes=len(raw_message),
+            received_at=datetime.now(),
+            auth_user=f"responder:{responder.name}",
+            instance_id=self.instance_id,
+            attachments=content.attachments,
+        )
+        try:
+            response_id = self.email_repo.create(response, actor=response.auth_user)
+            logger.info(f"Responder {responder.name}: stored {responder.action} for {recipient}")
+        except Exception as e:
+            logger.error(f"Responder {responder.name}: failed to store response: {e}")
+            return
+        if self.relay:
+            self.relay.submit(response_id, response)
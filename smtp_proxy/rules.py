@@ -0,0 +1,152 @@
+"""Rule evaluation for received emails."""
+
+from dataclasses import dataclass, field
+from urllib.parse import urlsplit
+import re
+
+from .models import Email, Rule
+
+ACTION_ADD_LABEL = "add_label"
+ACTION_ROUTE_TO_MAILBOX = "route_to_mailbox"
+ACTION_SET_STATUS = "set_status"
+ACTION_NOTIFY = "notify"
+ACTION_REJECT = "reject"
+ACTIONS = (
+    ACTION_ADD_LABEL,
+    ACTION_ROUTE_TO_MAILBOX,
+    ACTION_SET_STATUS,
+    ACTION_NOTIFY,
+    ACTION_REJECT,
+)
+
+STATUS_PATTERN = re.compile(r"^[a-z_]+$")
+# Labels are stored comma-separated, and both appear in list URLs
+NAME_PATTERN = re.compile(r"^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$")
+DEFAULT_REJECT_MESSAGE = "Message rejected by policy"
+
+
+@dataclass
+class RuleOutcome:
+    """Result of evaluating the rules against an email."""
+    matched: list[Rule]
+    reject: Rule | None = None
+    notify: list[Rule] = field(default_factory=list)  # Notify rules, sent once stored
+
+
+def validate_rule(rule: Rule) -> list[str]:
+    """Return a list of problems with a rule, empty when it is valid."""
+    errors = []
+
+    if not rule.name.strip():
+        errors.append("Name is required")
+
+    for label, pattern in (
+        ("Sender", rule.sender_pattern),
+        ("Recipient", rule.recipient_pattern),
+        ("Subject", rule.subject_pattern),
+    ):
+        try:
+            re.compile(pattern)
+        except re.error as e:
+            errors.append(f"{label} pattern is not a valid regex: {e}")
+
+    if rule.min_size_bytes < 0:
+        errors.append("Minimum size must not be negative")
+
+    if rule.action not in ACTIONS:
+        errors.append(f"Unknown action: {rule.action}")
+    elif rule.action == ACTION_SET_STATUS and not STATUS_PATTERN.match(rule.action_value):
+        errors.append("Status must be a lowercase word such as 'read'")
+    elif rule.action in (ACTION_ADD_LABEL, ACTION_ROUTE_TO_MAILBOX) and not (
+        NAME_PATTERN.match(rule.action_value)
+    ):
+        noun = "Label" if rule.action == ACTION_ADD_LABEL else "Mailbox"
+        errors.append(
+            f"{noun} must be up to 64 letters, digits, dots, dashes or underscores, "
+            "such as 'billing'"
+        )
+    elif rule.action == ACTION_NOTIFY and not _is_http_url(rule.action_value):
+        errors.append("Notification URL must be an http or https URL")
+    elif rule.action == ACTION_REJECT and not (
+        rule.action_value.isascii() and rule.action_value.isprintable()
+    ):
+        # Sent after "550 " as is, so a line break would forge further replies
+        errors.append("Rejection message must be one line of printable ASCII text")
+
+    return errors
+
+
+def reject_message(rule: Rule) -> str:
+    """Return the text of a reject rule's 550 reply.
+
+    Rules saved before messages were validated may hold line breaks,
+    which get the default text instead.
+    """
+    message = rule.action_value
+    if message and message.isascii() and message.isprintable():
+        return message
+    return DEFAULT_REJECT_MESSAGE
+
+
+def _is_http_url(value: str) -> bool:
+    """Check whether a value is an absolute http or https URL."""
+    try:
+        parts = urlsplit(value)
+    except ValueError:
+        return False
+    return parts.scheme in ("http", "https") and bool(parts.hostname)
+
+
+def _search(pattern: str, value: str) -> bool:
+    """Match a case-insensitive regex, treating an empty pattern as a wildcard."""
+    if not pattern:
+        return True
+    try:
+        return re.search(pattern, value, re.IGNORECASE) is not None
+    except re.error:
+        return False
+
+
+def rule_matches(rule: Rule, email: Email) -> bool:
+    """Check whether all conditions of a rule match an email."""
+    if not _search(rule.sender_pattern, email.sender):
+        return False
+    if rule.recipient_pattern and not any(
+        _search(rule.recipient_pattern, r) for r in email.recipients
+    ):
+        return False
+    if not _search(rule.subject_pattern, email.subject):
+        return False
+    if rule.auth_user and rule.auth_user != email.auth_user:
+        return False
+    if rule.min_size_bytes and email.size_bytes < rule.min_size_bytes:
+        return False
+    return True
+
+
+def evaluate(rules: list[Rule], email: Email) -> RuleOutcome:
+    """Evaluate rules in order, applying their actions to the email.
+
+    Every matching rule is applied in turn: labels add up, while a later
+    set_status or route_to_mailbox wins. Notify rules are collected for
+    the caller to send once the email is stored. A matching reject rule
+    stops evaluation.
+    """
+    outcome = RuleOutcome(matched=[])
+    for rule in rules:
+        if not rule_matches(rule, email):
+            continue
+        outcome.matched.append(rule)
+        if rule.action == ACTION_REJECT:
+            outcome.reject = rule
+            break
+        if rule.action == ACTION_SET_STATUS:
+            email.status = rule.action_value
+        elif rule.action == ACTION_ADD_LABEL:
+            if rule.action_value not in email.labels:
+                email.labels.append(rule.action_value)
+        elif rule.action == ACTION_ROUTE_TO_MAILBOX:
+            email.mailbox = rule.action_value
+        elif rule.action == ACTION_NOTIFY:
+            outcome.notify.append(rule)
+    return outcome
@@ -0,0 +1,180 @@
+"""Sanitizing of HTML email bodies for display.
+
+HTML parts are rewritten with an allowlist of URL schemes: scripts,
+embedded frames and objects, event handler attributes, javascript: URLs
+and form actions are removed, remote images and CSS resources are
+blocked unless asked for, and cid: references are pointed at the
+message's own image parts. The result is still only meant to be shown in
+a sandboxed iframe under a strict Content-Security-Policy; sanitizing is
+the first layer, not the only one.
+"""
+
+from dataclasses import dataclass
+from html import escape
+from html.parser import HTMLParser
+from urllib.parse import quote, unquote
+import re
+
+# Elements removed together with everything inside them
+DROPPED_ELEMENTS = {
+    "script", "noscript", "iframe", "frame", "frameset", "object", "applet", "template",
+    "audio", "video", "canvas",
+}
+# Void elements removed; base, meta and link could redirect, refresh or load remote CSS
+DROPPED_TAGS = {"base", "meta", "link", "param", "source", "track", "embed"}
+VOID_TAGS = {"area", "br", "col", "hr", "img", "input", "wbr"} | DROPPED_TAGS
+
+# Attributes removed wherever they appear, besides the on* event handlers
+DROPPED_ATTRIBUTES = {"formaction", "action", "ping", "srcdoc", "http-equiv", "xmlns:xlink"}
+# Attributes holding a link followed on click
+LINK_ATTRIBUTES = {"href", "xlink:href"}
+# Attributes holding a resource loaded when the message is shown
+RESOURCE_ATTRIBUTES = {"src", "background", "poster", "lowsrc", "dynsrc"}
+
+# Tag and attribute names written back out; anything else is dropped
+NAME = re.compile(r"^[a-z][a-z0-9_:.-]*$")
+
+LINK_SCHEMES = ("http:", "https:", "mailto:", "tel:")
+REMOTE_URL = re.compile(r"^\s*(?:https?:)?//", re.IGNORECASE)
+# Images embedded in the URL itself
+INLINE_URL = re.compile(r"^\s*data:image/", re.IGNORECASE)
+# References to another part of the message by its Content-ID (RFC 2392)
+CID_URL = re.compile(r"^\s*cid:(.+?)\s*$", re.IGNORECASE)
+
+CSS_URL = re.compile(r"url\(\s*(['\"]?)(.*?)\1\s*\)", re.IGNORECASE)
+CSS_IMPORT = re.compile(r"@import[^;]*;?", re.IGNORECASE)
+# CSS that runs code or binds behaviour in some browsers
+CSS_ACTIVE = re.compile(r"expression\s*\(|javascript:|behavior\s*:|-moz-binding", re.IGNORECASE)
+
+
+@dataclass
+class SanitizedHTML:
+    """An HTML body made safe to render, and how many remote resources were blocked."""
+    html: str
+    blocked: int = 0
+
+
+class _Sanitizer(HTMLParser):
+    """Rewrites an HTML body tag by tag, keeping only what is safe to render."""
+
+    def __init__(self, allow_remote: bool, inline_base: str):
+        super().__init__(convert_charrefs=True)
+        self.allow_remote = allow_remote
+        self.inline_base = inline_base
+        self.blocked = 0
+        self.out: list[str] = []
+        self._dropping = 0
+        self._in_style = False
+
+    def handle_starttag(self, tag: str, attrs: list[tuple[str, str | None]]) -> None:
+        self._start(tag, attrs, closed=False)
+
+    def handle_startendtag(self, tag: str, attrs: list[tuple[str, str | None]]) -> None:
+        self._start(tag, attrs, closed=True)
+
+    def _start(self, tag: str, attrs: list[tuple[str, str | None]], closed: bool) -> None:
+        if self._dropping:
+            if tag in DROPPED_ELEMENTS and not closed:
+                self._dropping += 1
+            return
+        if tag in DROPPED_ELEMENTS:
+            if not closed:
+                self._dropping = 1
+            return
+        if tag in DROPPED_TAGS or not NAME.match(tag):
+            return
+        if tag == "style":
+            self._in_style = not closed
+
+        kept = []
+        for name, value in attrs:
+            value = self._attribute(name, value or "")
+            if value is not None:
+                kept.append((name, value))
+        if tag == "a":
+            kept = [(n, v) for n, v in kept if n not in ("target", "rel")]
+            kept += [("target", "_blank"), ("rel", "noopener noreferrer")]
+        rendered = "".join(f' {name}="{escape(value)}"' for name, value in kept)
+        self.out.append(f"<{tag}{rendered}{' /' if closed else ''}>")
+
+    def _attribute(self, name: str, value: str) -> str | None:
+        """Return the safe value of an attribute, or None to drop it."""
+        if not NAME.match(name) or name.startswith("on") or name in DROPPED_ATTRIBUTES:
+            return None
+        if name in LINK_ATTRIBUTES:
+            target = value.strip().lower()
+            if target.startswith("#") or target.startswith(LINK_SCHEMES):
+                return value
+            return None
+        if name in RESOURCE_ATTRIBUTES:
+            return self._resource(value)
+        if name == "srcset":
+            return value if self.allow_remote and REMOTE_URL.match(value) else None
+        if name == "style":
+            return self._css(value)
+        return value
+
+    def _resource(self, url: str) -> str | None:
+        """Keep an inline resource, and a remote one only when remote content is allowed."""
+        if INLINE_URL.match(url):
+            return url
+        cid = CID_URL.match(url)
+        if cid:
+            if not self.inline_base:
+                return None
+            return self.inline_base + quote(unquote(cid.group(1)), safe="@")
+        if REMOTE_URL.match(url):
+            if self.allow_remote:
+                return url
+            self.blocked += 1
+        return None
+
+    def _css(self, css: str) -> str:
+        """Neutralize active CSS and remote url() and @import references."""
+        css = CSS_ACTIVE.sub("/* removed */", css)
+        if not self.allow_remote:
+            css, imports = CSS_IMPORT.subn("", css)
+            self.blocked += imports
+
+        def url(match: re.Match) -> str:
+            resource = self._resource(match.group(2))
+            if resource is None:
+                return "none"
+            return match.group(0) if resource == match.group(2) else f"url({resource})"
+
+        return CSS_URL.sub(url, css)
+
+    def handle_endtag(self, tag: str) -> None:
+        if self._dropping:
+            if tag in DROPPED_ELEMENTS:
+                self._dropping -= 1
+            return
+        if tag in DROPPED_ELEMENTS | VOID_TAGS or not NAME.match(tag):
+            return
+        if tag == "style":
+            self._in_style = False
+        self.out.append(f"</{tag}>")
+
+    def handle_data(self, data: str) -> None:
+        if self._dropping:
+            return
+        if self._in_style:
+            # The parser ends a style element at the first </style, so its
+            # text cannot close the element early
+            self.out.append(self._css(data))
+        else:
+            self.out.append(escape(data, quote=False))
+
+
+def sanitize_html(html: str, allow_remote: bool = False, inline_base: str = "") -> SanitizedHTML:
+    """Rewrite an HTML email body so it is safe to render.
+
+    Comments, doctypes and processing instructions are left out. Remote
+    images and CSS resources are replaced, and counted in blocked, unless
+    allow_remote is set. cid: references to parts of the message point at
+    inline_base followed by the Content-ID, or are removed without it.
+    """
+    sanitizer = _Sanitizer(allow_remote, inline_base)
+    sanitizer.feed(html)
+    sanitizer.close()
+    return SanitizedHTML("".join(sanitizer.out), sanitizer.blocked)
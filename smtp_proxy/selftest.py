@@ -0,0 +1,244 @@
+"""End-to-end self-test: submit a message over SMTP and check what was stored."""
+
+from dataclasses import dataclass
+from email.message import EmailMessage
+from email.utils import make_msgid
+import secrets
+import smtplib
+import ssl
+import time
+
+from .config import Config
+from .database import Database, EmailRepository, RawMessageStore, SMTPCredentialRepository
+from .models import Email
+from .privacy import hash_subject
+from .relay import RelayError, deliver, route_recipients
+from .senders import NULL_SENDER
+
+STAGES = ("submit", "store", "fidelity", "relay", "cleanup")
+# Stages that need the email found by the store stage
+NEEDS_STORED = ("fidelity", "cleanup")
+
+POLL_INTERVAL_SECONDS = 0.2
+TOKEN_HEADER = "X-Selftest-Token"
+# Non-ASCII text checks that encoded headers and bodies are decoded
+SUBJECT_SUFFIX = "✓"
+BODY_TEXT = "Grüße from the smtp-proxy self-test."
+
+PASS = "pass"
+FAIL = "fail"
+SKIP = "skip"
+
+
+@dataclass
+class StageResult:
+    """The outcome of one self-test stage."""
+    stage: str
+    status: str  # pass, fail or skip
+    detail: str = ""
+    duration_ms: float = 0.0
+
+
+def sender_for(patterns: list[str], domain: str) -> str:
+    """Pick a MAIL FROM address that a sender allowlist accepts."""
+    for pattern in patterns:
+        if pattern == NULL_SENDER:
+            continue
+        if "@" in pattern and not pattern.startswith("@"):
+            return pattern
+        pattern_domain = pattern.lstrip("@")
+        if pattern_domain.startswith("*."):
+            return f"selftest@selftest.{pattern_domain[2:]}"
+        return f"selftest@{pattern_domain}"
+    return f"selftest@{domain}"
+
+
+class SelfTest:
+    """Runs the self-test stages against one SMTP listener and its database.
+
+    The message is submitted with the configured TLS and auth settings
+    and looked up in the database the listener stores to, so the test
+    covers the same path as real mail. The relay stage only checks that
+    each upstream would accept the envelope; it never sends DATA.
+    """
+
+    def __init__(
+        self,
+        config: Config,
+        host: str,
+        port: int,
+        database_path: str,
+        username: str = "",
+        password: str = "",
+        sender: str = "",
+        recipient: str = "",
+        timeout_seconds: float = 10.0,
+        skip: tuple[str, ...] = (),
+    ):
+        self.config = config
+        self.host = host
+        self.port = port
+        self.database_path = database_path
+        self.username = username
+        self.password = password
+        self.sender = sender
+        self.recipient = recipient or f"selftest@{config.smtp.domain}"
+        self.timeout_seconds = timeout_seconds
+        self.skip = skip
+        self.token = secrets.token_hex(8)
+        self.subject = f"smtp-proxy selftest {self.token} {SUBJECT_SUFFIX}"
+        self.submitted = False
+        self.email: Email | None = None
+        self._db: Database | None = None
+
+    def run(self) -> list[StageResult]:
+        """Run every stage in order and return their results."""
+        self._db = Database(self.database_path)
+        try:
+            self._resolve_credentials()
+            results = []
+            for stage in STAGES:
+                if stage in self.skip:
+                    results.append(StageResult(stage, SKIP, "skipped on request"))
+                elif stage == "store" and not self.submitted:
+                    results.append(StageResult(stage, SKIP, "no message was submitted"))
+                elif stage in NEEDS_STORED and self.email is None:
+                    results.append(StageResult(stage, SKIP, "no stored email to check"))
+                else:
+                    results.append(self._timed(stage))
+            return results
+        finally:
+            self._db.close()
+
+    def _timed(self, stage: str) -> StageResult:
+        """Run one stage, turning unexpected errors into a failure."""
+        started = time.perf_counter()
+        try:
+            status, detail = getattr(self, f"_{stage}")()
+        except Exception as e:
+            status, detail = FAIL, f"{type(e).__name__}: {e}"
+        return StageResult(stage, status, detail, round((time.perf_counter() - started) * 1000, 1))
+
+    def _resolve_credentials(self) -> None:
+        """Fill in the username, password and sender from the configuration."""
+        auth = self.config.smtp.auth
+        if not self.username:
+            credential = next((c for c in auth.credentials() if c.password), None)
+            if credential:
+                self.username, self.password = credential.username, credential.password
+        if self.sender:
+            return
+        patterns = []
+        if self.username:
+            user = SMTPCredentialRepository(self._db).get_by_username(self.username)
+            credential = auth.credential_for(self.username)
+            if user:
+                patterns = user.allowed_senders
+            elif credential:
+                patterns = credential.allowed_senders
+        self.sender = sender_for(patterns, self.config.smtp.domain)
+
+    def _message(self) -> bytes:
+        """Build the test message."""
+        message = EmailMessage()
+        message["From"] = self.sender
+        message["To"] = self.recipient
+        message["Subject"] = self.subject
+        message["Message-ID"] = make_msgid(domain=self.config.smtp.domain)
+        message[TOKEN_HEADER] = self.token
+        message.set_content(f"{BODY_TEXT}\nToken: {self.token}\n")
+        return message.as_bytes()
+
+    def _submit(self) -> tuple[str, str]:
+        auth = self.config.smtp.auth
+        if auth.required and not self.password:
+            return FAIL, (
+                "SMTP AUTH is required but no configured user has a plaintext password; "
+                "pass --username and --password"
+            )
+        with smtplib.SMTP(self.host, self.port, timeout=self.timeout_seconds) as client:
+            client.ehlo()
+            tls = ""
+            if self.config.smtp.tls.enabled:
+                # The listener's certificate is often self-signed, and this
+                # stage checks that STARTTLS works rather than who answers
+                context = ssl.create_default_context()
+                context.check_hostname = False
+                context.verify_mode = ssl.CERT_NONE
+                client.starttls(context=context)
+                client.ehlo()
+                tls = " over STARTTLS"
+            if self.password:
+                client.login(self.username, self.password)
+            client.sendmail(self.sender, [self.recipient], self._message())
+        self.submitted = True
+        as_user = f" as {self.username}" if self.password else ""
+        return PASS, f"accepted by {self.host}:{self.port}{tls}{as_user} from {self.sender}"
+
+    def _store(self) -> tuple[str, str]:
+        email_repo = EmailRepository(self._db, raw_store=RawMessageStore(self.config.storage.dir))
+        stored_subject = (
+            hash_subject(self.subject) if self.config.privacy.hash_subject else self.subject
+        )
+        deadline = time.monotonic() + self.timeout_seconds
+        while True:
+            self.email = email_repo.get_latest_by_subject(stored_subject)
+            if self.email:
+                return PASS, f"stored as email {self.email.id} with status {self.email.status}"
+            if time.monotonic() >= deadline:
+                return FAIL, f"not found in {self.database_path} after {self.timeout_seconds:g}s"
+            time.sleep(POLL_INTERVAL_SECONDS)
+
+    def _fidelity(self) -> tuple[str, str]:
+        email = self.email
+        problems = []
+        if email.sender != self.sender:
+            problems.append(f"sender is {email.sender!r}, sent {self.sender!r}")
+        if email.recipients != [self.recipient]:
+            problems.append(f"recipients are {email.recipients}, sent [{self.recipient!r}]")
+        if self.password and email.auth_user != self.username:
+            problems.append(f"auth user is {email.auth_user!r}, sent as {self.username!r}")
+        if not email.subject_hashed and email.subject != self.subject:
+            problems.append(f"subject is {email.subject!r}, sent {self.subject!r}")
+        if not email.body_redacted and (
+            BODY_TEXT not in email.body or self.token not in email.body
+        ):
+            problems.append("body does not contain the text sent")
+        if not email.raw_redacted and f"{TOKEN_HEADER}: {self.token}".encode() not in (
+            email.raw_message
+        ):
+            problems.append(f"raw message lacks the {TOKEN_HEADER} header")
+        if problems:
+            return FAIL, "; ".join(problems)
+        withheld = f" ({', '.join(email.redactions)} redacted by privacy settings)" if (
+            email.redactions
+        ) else ""
+        return PASS, f"envelope, subject and body match{withheld}"
+
+    def _relay(self) -> tuple[str, str]:
+        smtp = self.config.smtp
+        if not smtp.relay.enabled:
+            return SKIP, "relay is disabled"
+        groups, unrouted = route_recipients(
+            [self.recipient], smtp.relay.routes, smtp.upstream if smtp.upstream.host else None
+        )
+        if unrouted:
+            return FAIL, f"no route or default upstream for {', '.join(unrouted)}"
+        replies = []
+        for label, upstream, recipients in groups:
+            try:
+                code, _ = deliver(
+                    upstream, self.sender, recipients, b"", dry_run=True,
+                    local_address=smtp.relay.local_address,
+                )
+            except RelayError as e:
+                return FAIL, f"{upstream.host}:{upstream.port} ({label}) refused: {e}"
+            replies.append(f"{upstream.host}:{upstream.port} ({label}) accepted RCPT with {code}")
+        return PASS, "; ".join(replies) + ", no DATA sent"
+
+    def _cleanup(self) -> tuple[str, str]:
+        email_repo = EmailRepository(self._db, raw_store=RawMessageStore(self.config.storage.dir))
+        deleted = email_repo.delete_by_ids([self.email.id], actor="selftest")
+        if not deleted:
+            return FAIL, f"email {self.email.id} was already gone"
+        return PASS, f"deleted email {self.email.id}"
@@ -0,0 +1,63 @@
+"""Sender (MAIL FROM) allowlists for SMTP credentials."""
+
+from .subaddress import split_address
+
+# Pattern allowing the null reverse-path used by bounces
+NULL_SENDER = "<>"
+
+
+def sender_pattern_error(pattern: str) -> str | None:
+    """Return why an allowlist pattern is invalid, or None if it is valid.
+
+    A pattern is an exact address (app@example.com), a domain with or
+    without a leading @ (example.com, @example.com), a wildcard for its
+    subdomains (*.example.com) or <> for the null sender.
+    """
+    if pattern == NULL_SENDER:
+        return None
+    if not pattern or any(c.isspace() for c in pattern):
+        return f"Invalid allowed sender {pattern!r}: must be an address or domain without spaces"
+    local, domain = split_address(pattern) if "@" in pattern else ("", pattern)
+    if not domain:
+        return f"Invalid allowed sender {pattern!r}: missing domain"
+    if domain.startswith("*."):
+        domain = domain[2:]
+        if local:
+            return f"Invalid allowed sender {pattern!r}: wildcards only apply to whole domains"
+    if not domain or "*" in domain or "@" in domain:
+        return f"Invalid allowed sender {pattern!r}"
+    return None
+
+
+def sender_allowed(sender: str, patterns: list[str]) -> bool:
+    """Check a MAIL FROM address against an allowlist.
+
+    An empty allowlist allows every sender. Addresses and domains are
+    compared case-insensitively.
+    """
+    if not patterns:
+        return True
+    if not sender:
+        return NULL_SENDER in patterns
+    local, domain = split_address(sender.lower())
+    if not domain:
+        return False
+    address = f"{local}@{domain}"
+    for pattern in patterns:
+        pattern = pattern.lower()
+        if pattern == address:
+            return True
+        if "@" in pattern and not pattern.startswith("@"):
+            continue
+        pattern_domain = pattern.lstrip("@")
+        if pattern_domain.startswith("*."):
+            if domain.endswith(pattern_domain[1:]):
+                return True
+        elif domain == pattern_domain:
+            return True
+    return False
+
+
+def parse_sender_patterns(text: str) -> list[str]:
+    """Split patterns separated by commas, spaces or newlines."""
+    return [pattern for pattern in text.replace(",", " ").split() if pattern]
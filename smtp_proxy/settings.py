@@ -0,0 +1,116 @@
+"""Export and import of settings stored in the database."""
+
+from dataclasses import dataclass, field
+from datetime import datetime
+
+from .database.rule_repository import RuleRepository
+from .models import Rule
+from . import rules
+
+SETTINGS_VERSION = 1
+
+# Rule fields carried in a settings bundle; IDs and timestamps are per-database
+RULE_FIELDS = (
+    "name",
+    "priority",
+    "enabled",
+    "sender_pattern",
+    "recipient_pattern",
+    "subject_pattern",
+    "auth_user",
+    "min_size_bytes",
+    "action",
+    "action_value",
+)
+
+
+@dataclass
+class ImportPlan:
+    """Changes an import would make, matched by rule name."""
+    create: list[Rule] = field(default_factory=list)
+    update: list[Rule] = field(default_factory=list)
+    delete: list[Rule] = field(default_factory=list)
+    unchanged: list[str] = field(default_factory=list)
+    errors: list[str] = field(default_factory=list)
+
+    def to_dict(self) -> dict:
+        """Summarize the plan by rule name."""
+        return {
+            "create": [rule.name for rule in self.create],
+            "update": [rule.name for rule in self.update],
+            "delete": [rule.name for rule in self.delete],
+            "unchanged": self.unchanged,
+            "errors": self.errors,
+        }
+
+
+def export_settings(rule_repo: RuleRepository) -> dict:
+    """Build a versioned bundle of all non-email settings."""
+    return {
+        "version": SETTINGS_VERSION,
+        "exported_at": datetime.now().isoformat(),
+        "rules": [
+            {name: getattr(rule, name) for name in RULE_FIELDS}
+            for rule in rule_repo.get_all()
+        ],
+    }
+
+
+def plan_import(bundle: dict, rule_repo: RuleRepository, prune: bool = False) -> ImportPlan:
+    """Work out what importing a bundle would change.
+
+    Rules are matched by name. Existing rules missing from the bundle are
+    only deleted when prune is set.
+    """
+    plan = ImportPlan()
+    if not isinstance(bundle, dict) or bundle.get("version") != SETTINGS_VERSION:
+        plan.errors.append(f"Unsupported settings bundle version, expected {SETTINGS_VERSION}")
+        return plan
+
+    existing = {rule.name: rule for rule in rule_repo.get_all()}
+    seen: set[str] = set()
+    for index, data in enumerate(bundle.get("rules", [])):
+        if not isinstance(data, dict):
+            plan.errors.append(f"Rule #{index + 1}: not an object")
+            continue
+        defaults = Rule()
+        wrong_types = [
+            name for name in RULE_FIELDS
+            if name in data and not isinstance(data[name], type(getattr(defaults, name)))
+        ]
+        if wrong_types:
+            plan.errors.append(f"Rule #{index + 1}: wrong type for {', '.join(wrong_types)}")
+            continue
+        rule = Rule(**{name: data[name] for name in RULE_FIELDS if name in data})
+        problems = rules.validate_rule(rule)
+        if rule.name in seen:
+            problems.append("Name appears more than once in the bundle")
+        if problems:
+            plan.errors.extend(f"Rule {rule.name or '#' + str(index + 1)}: {p}" for p in problems)
+            continue
+        seen.add(rule.name)
+
+        current = existing.get(rule.name)
+        if current is None:
+            plan.create.append(rule)
+        elif all(getattr(current, name) == getattr(rule, name) for name in RULE_FIELDS):
+            plan.unchanged.append(rule.name)
+        else:
+            rule.id = current.id
+            plan.update.append(rule)
+
+    if prune:
+        plan.delete = [rule for name, rule in existing.items() if name not in seen]
+    return plan
+
+
+def apply_import(plan: ImportPlan, rule_repo: RuleRepository) -> None:
+    """Apply an import plan that has no errors."""
+    if plan.errors:
+        raise ValueError("Cannot apply a settings import with errors")
+    for rule in plan.create:
+        rule_repo.create(rule)
+    for rule in plan.update:
+        rule_repo.update(rule)
+    for rule in plan.delete:
+        rule_repo.delete(rule.id)
@@ -1,10 +1,23 @@
 """Async SMTP server implementation."""
 
 import asyncio
+from collections import Counter
 import logging
 
+from ..attachment_text import AttachmentIndexer
 from ..config import SMTPConfig
+from ..database.address_repository import AddressRepository
+from ..database.audit_repository import AuditRepository
 from ..database.email_repository import EmailRepository
+from ..database.quota_repository import QuotaRepository
+from ..database.rule_repository import RuleRepository
+from ..database.smtp_credential_repository import SMTPCredentialRepository
+from ..database.user_repository import UserRepository
+from ..events import EmailEvents
+from ..notify import RuleNotifier
+from ..relay import Relay
+from ..responders import ResponderEngine
+from ..tracking import TrackingAnalyzer
 from .session import SMTPSession
 
 logger = logging.getLogger(__name__)
@@ -13,12 +26,47 @@ logger = logging.getLogger(__name__)
 class SMTPServer:
     """Async SMTP server using asyncio."""
 
-    def __init__(self, config: SMTPConfig, email_repo: EmailRepository):
+    def __init__(
+        self,
+        config: SMTPConfig,
+        email_repo: EmailRepository,
+        instance_id: str = "",
+        read_only: bool = False,
+        rule_repo: RuleRepository | None = None,
+        address_repo: AddressRepository | None = None,
+        responders: ResponderEngine | None = None,
+        relay: Relay | None = None,
+        attachment_indexer: AttachmentIndexer | None = None,
+        credential_repo: SMTPCredentialRepository | None = None,
+        audit_repo: AuditRepository | None = None,
+        user_repo: UserRepository | None = None,
+        quota_repo: QuotaRepository | None = None,
+        tracking_analyzer: TrackingAnalyzer | None = None,
+        events: EmailEvents | None = None,
+        notifier: RuleNotifier | None = None,
+    ):
         self.config = config
         self.email_repo = email_repo
+        self.instance_id = instance_id
+        self.read_only = read_only
+        self.rule_repo = rule_repo
+        self.address_repo = address_repo
+        self.responders = responders
+        self.relay = relay
+        self.attachment_indexer = attachment_indexer
+        self.credential_repo = credential_repo
+        self.audit_repo = audit_repo
+        self.user_repo = user_repo
+        self.quota_repo = quota_repo
+        self.tracking_analyzer = tracking_analyzer
+        self.events = events
+        self.notifier = notifier
         self._server: asyncio.Server | None = None
         self._shutdown_event = asyncio.Event()
+        self._draining = False
         self._active_connections: set[asyncio.StreamWriter] = set()
+        # Sessions closed for being idle, slow or too long, by reason
+        self.reaped: Counter = Counter()
 
     async def start(self) -> None:
         """Start the SMTP server."""
@@ -43,8 +91,32 @@ class SMTPServer:
         peername = writer.get_extra_info("peername")
         logger.debug(f"New SMTP connection from {peername}")
 
+        if self._draining:
+            await self._reject_during_shutdown(writer)
+            return
+
         self._active_connections.add(writer)
-        session = SMTPSession(self.config, self.email_repo, reader, writer)
+        session = SMTPSession(
+            self.config,
+            self.email_repo,
+            reader,
+            writer,
+            self.instance_id,
+            read_only=self.read_only,
+            rule_repo=self.rule_repo,
+            address_repo=self.address_repo,
+            responders=self.responders,
+            relay=self.relay,
+            attachment_indexer=self.attachment_indexer,
+            credential_repo=self.credential_repo,
+            audit_repo=self.audit_repo,
+            user_repo=self.user_repo,
+            reaped=self.reaped,
+            quota_repo=self.quota_repo,
+            tracking_analyzer=self.tracking_analyzer,
+            events=self.events,
+            notifier=self.notifier,
+        )
         try:
             await session.handle()
         except Exception as e:
@@ -59,12 +131,63 @@ class SMTPServer:
                     pass
             logger.debug(f"SMTP connection closed from {peername}")
 
+    async def _reject_during_shutdown(self, writer: asyncio.StreamWriter) -> None:
+        """Tell a new client to retry elsewhere and close the connection."""
+        try:
+            writer.write(
+                f"421 {self.config.domain} {self.config.shutdown_message}\r\n".encode()
+            )
+            await writer.drain()
+        except (ConnectionResetError, BrokenPipeError):
+            pass
+        finally:
+            writer.close()
+            try:
+                await writer.wait_closed()
+            except Exception:
+                pass
+
+    async def _wait_for_sessions(self, timeout: float, whole_period: bool = False) -> None:
+        """Wait for active sessions to finish, up to timeout seconds.
+
+        With whole_period, keep waiting until timeout even once none are left.
+        """
+        loop = asyncio.get_running_loop()
+        deadline = loop.time() + timeout
+        while (self._active_connections or whole_period) and loop.time() < deadline:
+            await asyncio.sleep(0.1)
+
     async def shutdown(self) -> None:
-        """Shutdown the SMTP server."""
+        """Shutdown the SMTP server.
+
+        Active sessions get up to shutdown_drain_seconds to finish. While
+        draining, new connections are either answered with a 421 carrying
+        shutdown_message (when announce_shutdown is enabled) or refused by
+        closing the listener. The 421 is given for the whole drain period,
+        even with no session active, so clients and load balancers polling
+        the port see the server going away rather than it vanishing.
+        """
+        if self._draining:
+            return
         logger.info("Shutting down SMTP server...")
+        self._draining = True
+        drain_seconds = self.config.shutdown_drain_seconds
+
+        if not self.config.announce_shutdown and self._server:
+            self._server.close()
+
+        if self._active_connections:
+            logger.info(
+                f"Waiting up to {drain_seconds}s for "
+                f"{len(self._active_connections)} active session(s) to finish..."
+            )
+        elif self.config.announce_shutdown and drain_seconds:
+            logger.info(f"Answering new connections with 421 for {drain_seconds}s...")
+        await self._wait_for_sessions(drain_seconds, whole_period=self.config.announce_shutdown)
+
         self._shutdown_event.set()
 
-        # Close all active connections
+        # Close any connections still open after the drain window
         if self._active_connections:
             logger.info(f"Closing {len(self._active_connections)} active connection(s)...")
             for writer in list(self._active_connections):
@@ -82,6 +205,10 @@ class SMTPServer:
             self._server.close()
             await self._server.wait_closed()
 
+    def stats(self) -> dict:
+        """Return connection counts for health checks."""
+        return {"active_sessions": len(self._active_connections), "reaped": dict(self.reaped)}
+
     @property
     def address(self) -> str:
         """Get the server address."""
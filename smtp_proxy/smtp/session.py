@@ -2,14 +2,119 @@
 
 import asyncio
 import base64
+import hashlib
+import hmac
+import ipaddress
+import logging
+import os
+import sqlite3
 import ssl
-from datetime import datetime
-from email import message_from_bytes
-from email.policy import default as email_policy
-
-from ..config import SMTPConfig
-from ..database.email_repository import EmailRepository
+import time
+from collections import Counter
+from datetime import datetime, timedelta
+
+from ..attachment_text import AttachmentIndexer
+from ..config import AuthConfig, SMTPConfig, TLSConfig, TrustedNetwork
+from ..database.address_repository import AddressRepository
+from ..database.audit_repository import AuditRepository
+from ..database.email_repository import EmailRepository, content_hash
+from ..database.health import STORAGE_DISK_FULL, classify_storage_error
+from ..database.quota_repository import QuotaExceededError, QuotaRepository
+from ..database.rule_repository import RuleRepository
+from ..database.smtp_credential_repository import SMTPCredentialRepository
+from ..database.user_repository import UserRepository
+from ..events import EmailEvent, EmailEvents
+from ..extract import extract_content, normalize_line_endings
 from ..models import Email
+from ..notify import RuleNotifier
+from ..relay import Relay
+from ..responders import ResponderEngine
+from ..senders import sender_allowed
+from ..tracking import TrackingAnalyzer
+from .. import rules
+
+logger = logging.getLogger(__name__)
+
+# Reasons a session is closed for holding the connection too long, with
+# the text of the 421 sent before closing
+REAPED_IDLE = "idle"
+REAPED_SESSION_LIMIT = "session_limit"
+REAPED_SLOW_DATA = "slow_data"
+REAP_REPLIES = {
+    REAPED_IDLE: "Idle timeout",
+    REAPED_SESSION_LIMIT: "Session time limit exceeded",
+    REAPED_SLOW_DATA: "Transfer rate too low",
+}
+
+# Text of the 552 5.3.4 for messages over max_message_bytes (RFC 1870)
+MESSAGE_TOO_LARGE = "Message size exceeds fixed maximum message size"
+
+# Configured tls.min_version values and the versions they stand for
+SSL_MIN_VERSIONS = {
+    "1.0": ssl.TLSVersion.TLSv1,
+    "1.1": ssl.TLSVersion.TLSv1_1,
+    "1.2": ssl.TLSVersion.TLSv1_2,
+    "1.3": ssl.TLSVersion.TLSv1_3,
+}
+
+
+def trusted_network_name(client_ip: str, networks: list[TrustedNetwork]) -> str | None:
+    """Return the name of the first trusted network containing client_ip."""
+    if not networks:
+        return None
+    try:
+        ip = ipaddress.ip_address(client_ip)
+    except ValueError:
+        return None
+    # IPv4 clients on a dual-stack listener show up as ::ffff:a.b.c.d
+    if ip.version == 6 and ip.ipv4_mapped:
+        ip = ip.ipv4_mapped
+    for trusted in networks:
+        if ip in ipaddress.ip_network(trusted.network, strict=False):
+            return trusted.name
+    return None
+
+
+def starttls_context(config: TLSConfig) -> ssl.SSLContext:
+    """Build the server context STARTTLS upgrades connections with."""
+    context = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+    context.minimum_version = SSL_MIN_VERSIONS[config.min_version]
+    if config.min_version in ("1.0", "1.1"):
+        # OpenSSL's default security level refuses the ciphers TLS 1.0 and 1.1 need
+        context.set_ciphers("DEFAULT:@SECLEVEL=0")
+    context.load_cert_chain(config.cert_file, config.key_file)
+    return context
+
+
+def storage_error_reply(error: Exception) -> str:
+    """Return the SMTP reply for a message that could not be stored."""
+    if classify_storage_error(error) == STORAGE_DISK_FULL:
+        return "452 4.3.1 Insufficient system storage"
+    return "451 4.3.0 Requested action aborted: local error in processing"
+
+
+def cram_md5_challenge(domain: str) -> str:
+    """Return a fresh CRAM-MD5 challenge in the RFC 2195 <unique.timestamp@host> form."""
+    return f"<{os.urandom(8).hex()}.{int(time.time())}@{domain}>"
+
+
+def cram_md5_verify(challenge: str, response: str, auth: AuthConfig) -> str | None:
+    """Check a decoded CRAM-MD5 response of "username hexdigest".
+
+    Returns the authenticated username, or None if the user is unknown
+    or the digest was not keyed with their password.
+    """
+    username, _, digest = response.rpartition(" ")
+    password = auth.password_for(username)
+    if password is None:
+        return None
+    expected = hmac.new(password.encode(), challenge.encode(), hashlib.md5).hexdigest()
+    return username if hmac.compare_digest(digest.lower(), expected) else None
+
+
+def _elapsed_ms(start: float, end: float) -> float:
+    """Return the time between two perf_counter marks in milliseconds."""
+    return round((end - start) * 1000, 3)
 
 
 class SMTPSession:
@@ -21,33 +126,104 @@ class SMTPSession:
         email_repo: EmailRepository,
         reader: asyncio.StreamReader,
         writer: asyncio.StreamWriter,
+        instance_id: str = "",
+        read_only: bool = False,
+        rule_repo: RuleRepository | None = None,
+        address_repo: AddressRepository | None = None,
+        responders: ResponderEngine | None = None,
+        relay: Relay | None = None,
+        attachment_indexer: AttachmentIndexer | None = None,
+        credential_repo: SMTPCredentialRepository | None = None,
+        audit_repo: AuditRepository | None = None,
+        user_repo: UserRepository | None = None,
+        reaped: Counter | None = None,
+        quota_repo: QuotaRepository | None = None,
+        tracking_analyzer: TrackingAnalyzer | None = None,
+        events: EmailEvents | None = None,
+        notifier: RuleNotifier | None = None,
     ):
         self.config = config
         self.email_repo = email_repo
         self.reader = reader
         self.writer = writer
+        self.instance_id = instance_id
+        self.read_only = read_only
+        self.rule_repo = rule_repo
+        self.address_repo = address_repo
+        self.responders = responders
+        self.relay = relay
+        self.attachment_indexer = attachment_indexer
+        self.credential_repo = credential_repo
+        self.audit_repo = audit_repo
+        self.user_repo = user_repo
+        self.quota_repo = quota_repo
+        self.tracking_analyzer = tracking_analyzer
+        self.events = events
+        self.notifier = notifier
+        # Shared count of reaped sessions by reason, kept by the server
+        self.reaped = reaped if reaped is not None else Counter()
 
         # Session state
         self.authenticated = False
         self.auth_user = ""
+        # MAIL FROM patterns of the authenticated credential; empty allows any
+        self.allowed_senders: list[str] = []
+        # Daily message limit of the authenticated credential; 0 is unlimited
+        self.daily_quota = 0
+        self.in_transaction = False
         self.mail_from = ""
         self.rcpt_to: list[str] = []
         self.client_ip = ""
+        self.early_talker = False
+        # Input read while watching for an early talker, owed to the first command
+        self.early_input = b""
+        self.reap_reason = ""
+        # Negotiated by STARTTLS; empty while the connection is plaintext
+        self.tls_version = ""
+        self.tls_cipher = ""
+
+        # Timing marks (time.perf_counter values) for the current transaction,
+        # which starts at connect and then wherever the previous one ended
+        self.connected_at = 0.0
+        self.transaction_started_at = 0.0
+        self.mail_at = 0.0
+
+    @property
+    def idle_timeout(self) -> int:
+        """Return the seconds a client may take to send its next command."""
+        return self.config.idle_timeout_seconds or self.config.read_timeout_seconds
 
     async def handle(self) -> None:
         """Handle the SMTP session."""
+        session_limit = None
+        if self.config.max_session_seconds > 0:
+            session_limit = asyncio.create_task(self._enforce_session_limit())
         try:
+            self.connected_at = self.transaction_started_at = time.perf_counter()
             peername = self.writer.get_extra_info("peername")
             self.client_ip = peername[0] if peername else "unknown"
+            self._apply_trusted_network()
+
+            if self.read_only:
+                await self._send(
+                    f"421 {self.config.domain} Service in read-only mode, try again later"
+                )
+                return
+
+            if not await self._check_early_talker():
+                return
 
             await self._send(f"220 {self.config.domain} SMTP Ready")
 
             while True:
                 try:
+                    # The deadline restarts with each command, so a client
+                    # trickling a command a byte at a time still times out
                     line = await asyncio.wait_for(
                         self.reader.readline(),
-                        timeout=self.config.read_timeout_seconds,
+                        timeout=self.idle_timeout,
                     )
+                    line, self.early_input = self.early_input + line, b""
                     if not line:
                         break
 
@@ -58,17 +234,44 @@ class SMTPSession:
                     if not await self._process_command(command):
                         break
                 except asyncio.TimeoutError:
-                    await self._send("421 Timeout")
+                    await self._reap(REAPED_IDLE)
                     break
         except (ConnectionResetError, BrokenPipeError):
             pass
         finally:
+            if session_limit:
+                session_limit.cancel()
             self.writer.close()
             try:
                 await self.writer.wait_closed()
             except Exception:
                 pass
 
+    async def _check_early_talker(self) -> bool:
+        """Watch for input before the banner; return False to drop the client."""
+        if self.config.early_talker_action == "off":
+            return True
+
+        # StreamReader cannot peek, so the byte read is kept for the first command
+        try:
+            self.early_input = await asyncio.wait_for(
+                self.reader.read(1), self.config.early_talker_wait_ms / 1000
+            )
+        except asyncio.TimeoutError:
+            return True
+        if not self.early_input:
+            # Closed before the banner; the command loop sees the end of input
+            return True
+
+        self.early_talker = True
+        logger.warning(f"Early talker: {self.client_ip} sent data before the banner")
+        if self.config.early_talker_action == "reject":
+            await self._send("554 5.5.1 Protocol error: data sent before greeting")
+            return False
+        if self.config.early_talker_action == "delay":
+            await asyncio.sleep(self.config.early_talker_delay_seconds)
+        return True
+
     async def _process_command(self, line: str) -> bool:
         """Process a single SMTP command. Returns False to end session."""
         parts = line.split(None, 1)
@@ -100,12 +303,18 @@ class SMTPSession:
 
     async def _handle_ehlo(self, line: str) -> bool:
         """Handle EHLO/HELO command."""
+        # A new greeting aborts any transaction in progress (RFC 5321 4.1.4)
+        self._reset_transaction()
+
         extensions = [f"250-{self.config.domain} Hello"]
 
-        if self.config.auth.required or self.config.auth.username:
-            extensions.append("250-AUTH PLAIN LOGIN")
+        auth = self.config.auth
+        if auth.required or auth.credentials() or auth.use_web_users or self.credential_repo:
+            mechanisms = " ".join(auth.offered_mechanisms())
+            if mechanisms:
+                extensions.append(f"250-AUTH {mechanisms}")
 
-        if self.config.tls.enabled:
+        if self.config.tls.enabled and not self.tls_version:
             extensions.append("250-STARTTLS")
 
         extensions.append(f"250-SIZE {self.config.max_message_bytes}")
@@ -123,14 +332,66 @@ class SMTPSession:
             return True
 
         mechanism = parts[1].upper()
-        if mechanism not in ("PLAIN", "LOGIN"):
+        if mechanism not in self.config.auth.offered_mechanisms():
             await self._send("504 Unsupported authentication mechanism")
             return True
 
+        # A new AUTH replaces any earlier one, so a user disabled since then
+        # loses access when it fails
+        self.authenticated = False
+        self.auth_user = ""
+        self.allowed_senders = []
+        self.daily_quota = 0
+        self._apply_trusted_network()
+
         if mechanism == "PLAIN":
             return await self._handle_auth_plain(parts)
+        elif mechanism == "CRAM-MD5":
+            return await self._handle_auth_cram_md5()
         else:
-            return await self._handle_auth_login()
+            return await self._handle_auth_login(parts)
+
+    async def _check_credentials(self, username: str, password: str) -> bool:
+        """Check a username and password for PLAIN and LOGIN.
+
+        Users managed in the web UI are looked up first, on every AUTH, so
+        disabling one takes effect for connections that are already open.
+        Only usernames not stored there fall back to the web UI's own users
+        when use_web_users is set, or to the configured ones otherwise.
+        On success the credential's sender allowlist and daily quota apply to
+        the session; web UI users have neither.
+        """
+        if self.credential_repo:
+            try:
+                verified = await asyncio.to_thread(
+                    self.credential_repo.verify, username, password
+                )
+                if verified:
+                    user = await asyncio.to_thread(
+                        self.credential_repo.get_by_username, username
+                    )
+                    self.allowed_senders = user.allowed_senders if user else []
+                    self.daily_quota = user.max_messages_per_day if user else 0
+            except sqlite3.Error as e:
+                logger.error(f"Failed to look up SMTP user {username}: {e}")
+                return False
+            if verified is not None:
+                return verified
+        if self.config.auth.use_web_users:
+            if not self.user_repo:
+                return False
+            try:
+                user = await asyncio.to_thread(self.user_repo.authenticate, username, password)
+            except sqlite3.Error as e:
+                logger.error(f"Failed to look up web user {username}: {e}")
+                return False
+            return user is not None
+        credential = self.config.auth.credential_for(username)
+        if credential is None or not credential.matches(password):
+            return False
+        self.allowed_senders = credential.allowed_senders
+        self.daily_quota = credential.max_messages_per_day
+        return True
 
     async def _handle_auth_plain(self, parts: list[str]) -> bool:
         """Handle AUTH PLAIN mechanism."""
@@ -145,9 +406,9 @@ class SMTPSession:
                 )
                 credentials = cred_line.decode().strip()
             except asyncio.TimeoutError:
-                await self._send("421 Timeout")
-                return False
+                return await self._reap(REAPED_IDLE)
 
+        username = ""
         try:
             decoded = base64.b64decode(credentials).decode()
             # Format: \0username\0password or identity\0username\0password
@@ -159,10 +420,7 @@ class SMTPSession:
             else:
                 raise ValueError("Invalid credentials format")
 
-            if (
-                username == self.config.auth.username
-                and password == self.config.auth.password
-            ):
+            if await self._check_credentials(username, password):
                 self.authenticated = True
                 self.auth_user = username
                 await self._send("235 Authentication successful")
@@ -170,18 +428,21 @@ class SMTPSession:
         except Exception:
             pass
 
-        await self._send("535 Authentication failed")
-        return True
+        return await self._auth_failed("PLAIN", username)
 
-    async def _handle_auth_login(self) -> bool:
+    async def _handle_auth_login(self, parts: list[str]) -> bool:
         """Handle AUTH LOGIN mechanism."""
+        username = ""
         try:
-            # Send username prompt
-            await self._send("334 VXNlcm5hbWU6")  # Base64 "Username:"
-            username_line = await asyncio.wait_for(
-                self.reader.readline(),
-                timeout=self.config.read_timeout_seconds,
-            )
+            if len(parts) == 3:
+                # Username sent as an initial response (RFC 4954)
+                username_line = parts[2].encode()
+            else:
+                await self._send("334 VXNlcm5hbWU6")  # Base64 "Username:"
+                username_line = await asyncio.wait_for(
+                    self.reader.readline(),
+                    timeout=self.config.read_timeout_seconds,
+                )
             username = base64.b64decode(username_line.strip()).decode()
 
             # Send password prompt
@@ -192,26 +453,85 @@ class SMTPSession:
             )
             password = base64.b64decode(password_line.strip()).decode()
 
-            if (
-                username == self.config.auth.username
-                and password == self.config.auth.password
-            ):
+            if await self._check_credentials(username, password):
                 self.authenticated = True
                 self.auth_user = username
                 await self._send("235 Authentication successful")
                 return True
+        except asyncio.TimeoutError:
+            return await self._reap(REAPED_IDLE)
         except Exception:
             pass
 
+        return await self._auth_failed("LOGIN", username)
+
+    async def _handle_auth_cram_md5(self) -> bool:
+        """Handle AUTH CRAM-MD5 mechanism."""
+        challenge = cram_md5_challenge(self.config.domain)
+        try:
+            await self._send("334 " + base64.b64encode(challenge.encode()).decode())
+            response_line = await asyncio.wait_for(
+                self.reader.readline(),
+                timeout=self.config.read_timeout_seconds,
+            )
+        except asyncio.TimeoutError:
+            return await self._reap(REAPED_IDLE)
+
+        response = response_line.strip()
+        if response == b"*":
+            await self._send("501 Authentication cancelled")
+            return True
+        claimed = ""
+        try:
+            decoded = base64.b64decode(response, validate=True).decode()
+            claimed = decoded.rpartition(" ")[0]
+            # SMTP users from the web UI take precedence, as for PLAIN and
+            # LOGIN, and only keep a hash, so a configured user of the same
+            # name must not authenticate in their place
+            stored = self.credential_repo is not None and await asyncio.to_thread(
+                self.credential_repo.exists, claimed
+            )
+            username = None if stored else cram_md5_verify(challenge, decoded, self.config.auth)
+            if username is not None:
+                self.authenticated = True
+                self.auth_user = username
+                credential = self.config.auth.credential_for(username)
+                self.allowed_senders = credential.allowed_senders
+                self.daily_quota = credential.max_messages_per_day
+                await self._send("235 Authentication successful")
+                return True
+        except Exception:
+            pass
+
+        return await self._auth_failed("CRAM-MD5", claimed)
+
+    async def _auth_failed(self, mechanism: str, username: str) -> bool:
+        """Refuse an AUTH attempt and record it in the audit log."""
+        if self.audit_repo:
+            await asyncio.to_thread(
+                self.audit_repo.record, "smtp.auth", "failure", username, self.client_ip,
+                mechanism=mechanism,
+            )
         await self._send("535 Authentication failed")
         return True
 
     async def _handle_mail(self, line: str) -> bool:
         """Handle MAIL FROM command."""
+        if self.starttls_required:
+            return await self._starttls_missing()
+
         if self.config.auth.required and not self.authenticated:
             await self._send("530 Authentication required")
             return True
 
+        if self.in_transaction and self.config.duplicate_mail == "reject":
+            await self._send("503 Nested MAIL command")
+            return True
+
+        if self.email_repo.db.breaker.is_open:
+            await self._send("451 4.3.0 Storage temporarily unavailable, try again later")
+            return True
+
         upper_line = line.upper()
         if "FROM:" not in upper_line:
             await self._send("501 Syntax error")
@@ -222,23 +542,111 @@ class SMTPSession:
         addr = line[idx + 5 :].strip()
 
         # Handle SIZE parameter
+        params = []
         if " " in addr:
-            addr = addr.split()[0]
+            addr, *params = addr.split()
+        declared_size = next(
+            (p[5:] for p in params if p.upper().startswith("SIZE=") and p[5:].isdigit()), ""
+        )
+        if declared_size and int(declared_size) > self.config.max_message_bytes:
+            await self._send(f"552 5.3.4 {MESSAGE_TOO_LARGE}")
+            return True
 
         # Remove angle brackets
         if addr.startswith("<") and addr.endswith(">"):
             addr = addr[1:-1]
 
+        if not sender_allowed(addr, self.allowed_senders):
+            return await self._sender_rejected(addr)
+
+        # A repeated MAIL starts a fresh transaction so recipients given for
+        # the previous sender are never attached to this one. It is timed
+        # from where the abandoned one started rather than from now.
+        started_at = self.transaction_started_at
+        self._reset_transaction()
+        self.transaction_started_at = started_at
+        self.in_transaction = True
+        self.mail_at = time.perf_counter()
         self.mail_from = addr
         await self._send("250 OK")
         return True
 
+    @property
+    def starttls_required(self) -> bool:
+        """Check whether tls.require refuses mail on this session until STARTTLS."""
+        require = self.config.tls.require
+        if self.tls_version or require == "off":
+            return False
+        return require == "all" or not self.authenticated
+
+    async def _starttls_missing(self) -> bool:
+        """Refuse MAIL on a plaintext session that must use STARTTLS, and record it."""
+        logger.warning(
+            f"Rejected MAIL from {self.client_ip}"
+            + (f" as SMTP user {self.auth_user}" if self.auth_user else "")
+            + ": STARTTLS required"
+        )
+        if self.audit_repo:
+            await asyncio.to_thread(
+                self.audit_repo.record, "smtp.tls_required", "failure",
+                self.auth_user, self.client_ip, require=self.config.tls.require,
+            )
+        await self._send("530 5.7.0 Must issue a STARTTLS command first")
+        return True
+
+    async def _sender_rejected(self, sender: str) -> bool:
+        """Refuse a MAIL FROM outside the credential's allowlist and record it."""
+        logger.warning(
+            f"Rejected MAIL FROM <{sender}> for SMTP user {self.auth_user} "
+            f"from {self.client_ip}: not an allowed sender"
+        )
+        if self.audit_repo:
+            await asyncio.to_thread(
+                self.audit_repo.record, "smtp.sender_reject", "failure",
+                self.auth_user, self.client_ip, sender=sender,
+            )
+        # A refused MAIL ends any earlier transaction rather than keeping its sender
+        self._reset_transaction()
+        await self._send(f"550 5.7.1 Sender <{sender}> is not allowed for user {self.auth_user}")
+        return True
+
+    async def _read_data_line(self) -> bytes:
+        """Read the next line of message data, or part of one.
+
+        A line longer than the reader's buffer limit comes back in pieces
+        instead of failing the session, so an endless line costs no more
+        memory than the limit. Returns b"" when the client has gone.
+        """
+        try:
+            return await self.reader.readuntil(b"\n")
+        except asyncio.IncompleteReadError as e:
+            return e.partial
+        except asyncio.LimitOverrunError as e:
+            return await self.reader.read(e.consumed)
+
+    async def _quota_exceeded(self) -> bool:
+        """Refuse a message from a credential that has used its daily quota."""
+        logger.warning(
+            f"Rejected message from SMTP user {self.auth_user} at {self.client_ip}: "
+            f"daily quota of {self.daily_quota} message(s) exceeded"
+        )
+        self._reset_transaction()
+        await self._send(
+            f"452 4.7.1 Daily message quota exceeded for user {self.auth_user}, "
+            "try again after midnight UTC"
+        )
+        return True
+
     async def _handle_rcpt(self, line: str) -> bool:
         """Handle RCPT TO command."""
         if self.config.auth.required and not self.authenticated:
             await self._send("530 Authentication required")
             return True
 
+        if not self.in_transaction:
+            await self._send("503 Bad sequence of commands: MAIL required first")
+            return True
+
         if len(self.rcpt_to) >= self.config.max_recipients:
             await self._send("452 Too many recipients")
             return True
@@ -266,92 +674,243 @@ class SMTPSession:
             await self._send("530 Authentication required")
             return True
 
-        if not self.mail_from or not self.rcpt_to:
-            await self._send("503 Bad sequence of commands")
+        if not self.in_transaction:
+            await self._send("503 Bad sequence of commands: MAIL required first")
             return True
 
+        if not self.rcpt_to:
+            await self._send("554 No valid recipients")
+            return True
+
+        try:
+            exceeded = await asyncio.to_thread(self.email_repo.storage_quota_exceeded)
+        except sqlite3.Error as e:
+            logger.error(f"Failed to read storage usage: {e}")
+            await self._send(storage_error_reply(e))
+            return True
+        if exceeded:
+            logger.warning(f"Refused message from {self.mail_from}: storage quota reached, {exceeded}")
+            self._reset_transaction()
+            await self._send("452 4.3.1 Insufficient system storage")
+            return True
+
+        # Checked before the message is read so a client over its quota
+        # does not send it for nothing; _accept counts it when stored
+        if self.daily_quota and self.quota_repo:
+            try:
+                used = await asyncio.to_thread(self.quota_repo.used, self.auth_user)
+            except sqlite3.Error as e:
+                logger.error(f"Failed to read the quota of SMTP user {self.auth_user}: {e}")
+                await self._send(storage_error_reply(e))
+                return True
+            if used >= self.daily_quota:
+                return await self._quota_exceeded()
+
         await self._send("354 Start mail input; end with <CRLF>.<CRLF>")
+        data_started_at = time.perf_counter()
 
         data = []
         total_size = 0
+        previous_crlf = True
+        improper_end = False
+        too_large = False
+        # Whether the next chunk starts a line, and whether the last one ended in CR
+        line_start = True
+        pending_cr = False
 
         while True:
             try:
                 line = await asyncio.wait_for(
-                    self.reader.readline(),
+                    self._read_data_line(),
                     timeout=self.config.read_timeout_seconds,
                 )
             except asyncio.TimeoutError:
-                await self._send("421 Timeout")
+                return await self._reap(REAPED_IDLE)
+            if not line:
+                # Connection closed mid-message
                 return False
 
-            # Check for end of data
-            if line in (b".\r\n", b".\n"):
-                break
+            if line_start:
+                # Check for end of data. Only CRLF.CRLF ends the message unless
+                # protection is off: a downstream relay may read a bare-LF dot
+                # line differently (SMTP smuggling).
+                if line in (b".\r\n", b".\n"):
+                    if self.config.smuggling_protection == "off":
+                        break
+                    if line == b".\r\n" and previous_crlf:
+                        break
+                    improper_end = True
 
-            # Dot-stuffing: remove leading dot if doubled
-            if line.startswith(b".."):
-                line = line[1:]
+                # Dot-stuffing: remove leading dot if doubled
+                if line.startswith(b".."):
+                    line = line[1:]
+            line_start = line.endswith(b"\n")
+            if line_start:
+                previous_crlf = line.endswith(b"\r\n") or (line == b"\n" and pending_cr)
+            pending_cr = line.endswith(b"\r")
 
             total_size += len(line)
-            if total_size > self.config.max_message_bytes:
-                await self._send("552 Message too large")
+            if not too_large and total_size > self.config.max_message_bytes:
+                # The rest is read and dropped so the client sees the 552
+                # at end of data and the session stays in sync
+                too_large = True
+                data = []
+            if not too_large:
+                data.append(line)
+
+            # Each line has read_timeout_seconds, so a client trickling
+            # many short lines is only bounded by its overall rate
+            elapsed = time.perf_counter() - data_started_at
+            if (
+                self.config.min_data_rate_bytes_per_second > 0
+                and elapsed > self.config.data_rate_grace_seconds
+                and total_size / elapsed < self.config.min_data_rate_bytes_per_second
+            ):
                 self._reset_transaction()
-                return True
+                return await self._reap(REAPED_SLOW_DATA)
 
-            data.append(line)
+        if too_large:
+            logger.info(
+                f"Rejected message from {self.mail_from}: {total_size} bytes exceeds "
+                f"max_message_bytes of {self.config.max_message_bytes}"
+            )
+            await self._send(f"552 5.3.4 {MESSAGE_TOO_LARGE}")
+            self._reset_transaction()
+            return True
 
         raw_message = b"".join(data)
+        data_ended_at = time.perf_counter()
 
-        # Parse email
-        subject = ""
-        body = ""
-        try:
-            msg = message_from_bytes(raw_message, policy=email_policy)
-            subject = msg.get("Subject", "") or ""
-
-            # Extract body
-            if msg.is_multipart():
-                for part in msg.walk():
-                    content_type = part.get_content_type()
-                    if content_type == "text/plain":
-                        try:
-                            body = part.get_content()
-                        except Exception:
-                            body = str(part.get_payload(decode=True) or "")
-                        break
-            else:
-                try:
-                    body = msg.get_content()
-                except Exception:
-                    payload = msg.get_payload(decode=True)
-                    body = payload.decode("utf-8", errors="replace") if payload else ""
-        except Exception:
-            # If parsing fails, use raw message
-            body = raw_message.decode("utf-8", errors="replace")
+        if improper_end and self.config.smuggling_protection == "reject":
+            logger.warning(f"Rejected message from {self.client_ip}: end-of-data without CRLF.CRLF")
+            await self._send("554 5.5.2 Message rejected: end-of-data without CRLF.CRLF")
+            self._reset_transaction()
+            return True
 
-        if not isinstance(body, str):
-            body = str(body)
+        anomalies = []
+        if self.early_talker:
+            anomalies.append("data sent before greeting")
+        if improper_end:
+            anomalies.append("end-of-data without CRLF.CRLF")
+
+        if self.config.normalize_line_endings:
+            raw_message = normalize_line_endings(raw_message)
+
+        content = extract_content(raw_message)
 
         email = Email(
             sender=self.mail_from,
             recipients=self.rcpt_to.copy(),
-            subject=subject,
-            body=body,
+            subject=content.subject,
+            body=content.body,
+            body_type=content.body_type,
             raw_message=raw_message,
             size_bytes=len(raw_message),
             received_at=datetime.now(),
             status="received",
             auth_user=self.auth_user,
             client_ip=self.client_ip,
+            instance_id=self.instance_id,
+            parse_error=content.parse_error,
+            anomalies="; ".join(anomalies),
+            attachments=content.attachments,
+            tls_version=self.tls_version,
+            tls_cipher=self.tls_cipher,
+            tracking=(
+                self.tracking_analyzer.analyze(raw_message) if self.tracking_analyzer else None
+            ),
+            timing={
+                "connect_to_mail_ms": _elapsed_ms(self.transaction_started_at, self.mail_at),
+                "mail_to_data_ms": _elapsed_ms(self.mail_at, data_started_at),
+                "data_transfer_ms": _elapsed_ms(data_started_at, data_ended_at),
+            },
         )
 
-        self.email_repo.create(email)
-        await self._send("250 OK: Message accepted")
+        try:
+            await self._accept(email)
+        except sqlite3.Error as e:
+            logger.error(f"Failed to store message from {self.mail_from}: {e}")
+            await self._send(storage_error_reply(e))
 
         self._reset_transaction()
         return True
 
+    async def _accept(self, email: Email) -> None:
+        """Apply rules and duplicate checks, then store an email."""
+        notify = []
+        if self.rule_repo:
+            enabled_rules = await asyncio.to_thread(self.rule_repo.get_enabled)
+            outcome = rules.evaluate(enabled_rules, email)
+            if outcome.reject:
+                message = rules.reject_message(outcome.reject)
+                logger.info(
+                    f"Rejected message from {self.mail_from} by rule {outcome.reject.name}"
+                )
+                if self.audit_repo:
+                    await asyncio.to_thread(
+                        self.audit_repo.record, "smtp.rule_reject", "failure",
+                        self.auth_user, self.client_ip,
+                        rule=outcome.reject.name, sender=email.sender,
+                        recipients=len(email.recipients),
+                    )
+                await self._send(f"550 {message}")
+                return
+            notify = outcome.notify
+
+        if self.config.skip_duplicates_within_seconds > 0:
+            email.content_hash = content_hash(email.raw_message)
+            since = email.received_at - timedelta(
+                seconds=self.config.skip_duplicates_within_seconds
+            )
+            duplicate = await asyncio.to_thread(
+                self.email_repo.has_duplicate_since, email.content_hash, since
+            )
+            if duplicate:
+                logger.info(f"Skipped storing duplicate message from {self.mail_from}")
+                await self._send("250 OK: Duplicate message accepted")
+                return
+
+        # Counted in the transaction that stores the email, so a failed
+        # insert uses up none of the quota
+        quota = (self.auth_user, self.daily_quota) if self.daily_quota and self.quota_repo else None
+        store_started_at = time.perf_counter()
+        try:
+            email_id = await asyncio.to_thread(
+                self.email_repo.create, email, actor="smtp", quota=quota
+            )
+        except QuotaExceededError:
+            await self._quota_exceeded()
+            return
+        email.timing["store_ms"] = _elapsed_ms(store_started_at, time.perf_counter())
+        await asyncio.to_thread(self.email_repo.update_timing, email_id, email.timing)
+        if self.events and self.events.active:
+            await self._announce(email_id)
+        if self.address_repo:
+            try:
+                await asyncio.to_thread(self.address_repo.record, email)
+            except sqlite3.Error as e:
+                logger.warning(f"Failed to update address book for email {email_id}: {e}")
+        if self.notifier:
+            for rule in notify:
+                self.notifier.submit(rule, email_id, email)
+        if self.relay:
+            self.relay.submit(email_id, email)
+        if self.attachment_indexer and email.attachments:
+            self.attachment_indexer.submit(email_id, email.raw_message)
+        if self.responders:
+            self.responders.handle(email)
+        await self._send("250 OK: Message accepted")
+
+    async def _announce(self, email_id: int) -> None:
+        """Tell open email lists about a new email, as it was stored after redaction."""
+        try:
+            stored = await asyncio.to_thread(self.email_repo.get_by_id, email_id)
+        except sqlite3.Error as e:
+            logger.warning(f"Failed to announce email {email_id} to live email lists: {e}")
+            return
+        if stored:
+            self.events.publish(EmailEvent.from_email(stored))
+
     async def _handle_rset(self) -> bool:
         """Handle RSET command."""
         self._reset_transaction()
@@ -363,16 +922,14 @@ class SMTPSession:
         if not self.config.tls.enabled:
             await self._send("502 STARTTLS not available")
             return True
+        if self.tls_version:
+            await self._send("503 5.5.1 TLS already active")
+            return True
 
         await self._send("220 Ready to start TLS")
 
         try:
-            ssl_context = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
-            ssl_context.minimum_version = ssl.TLSVersion.TLSv1_2
-            ssl_context.load_cert_chain(
-                self.config.tls.cert_file,
-                self.config.tls.key_file,
-            )
+            ssl_context = starttls_context(self.config.tls)
 
             # Upgrade connection to TLS
             transport = self.writer.transport
@@ -388,26 +945,80 @@ class SMTPSession:
 
             # Update writer with new transport
             self.writer._transport = new_transport
+            ssl_object = new_transport.get_extra_info("ssl_object")
+            self.tls_version = ssl_object.version() or ""
+            self.tls_cipher = (ssl_object.cipher() or ("",))[0]
 
             # Reset session state after STARTTLS
             self.authenticated = False
             self.auth_user = ""
+            self.allowed_senders = []
+            self.daily_quota = 0
             self._reset_transaction()
+            self._apply_trusted_network()
 
         except Exception as e:
             await self._send(f"454 TLS not available: {e}")
 
         return True
 
+    def _apply_trusted_network(self) -> None:
+        """Treat clients from a trusted network as authenticated."""
+        name = trusted_network_name(self.client_ip, self.config.trusted_networks)
+        if name is not None:
+            self.authenticated = True
+            self.auth_user = f"ip:{name}"
+
     def _reset_transaction(self) -> None:
-        """Reset the current mail transaction."""
+        """Reset the current mail transaction, keeping authentication.
+
+        Ending a transaction starts the wait for the next one, so a later
+        message on the connection is timed from here instead of connect.
+        """
+        if self.in_transaction:
+            self.transaction_started_at = time.perf_counter()
+        self.in_transaction = False
         self.mail_from = ""
         self.rcpt_to = []
 
+    async def _enforce_session_limit(self) -> None:
+        """Close the connection once the session has lasted max_session_seconds.
+
+        Aborting the transport ends whatever read the session is waiting
+        on, including in the middle of DATA.
+        """
+        await asyncio.sleep(self.config.max_session_seconds)
+        await self._reap(REAPED_SESSION_LIMIT)
+        self.writer.transport.abort()
+
+    async def _reap(self, reason: str) -> bool:
+        """Send a 421 for a session held too long and count it; returns False to end it."""
+        if self.reap_reason:
+            return False
+        self.reap_reason = reason
+        self.reaped[reason] += 1
+        elapsed = time.perf_counter() - self.connected_at
+        logger.info(
+            f"Closing SMTP session from {self.client_ip} after {elapsed:.1f}s: "
+            f"{REAP_REPLIES[reason].lower()}"
+        )
+        await self._send(
+            f"421 4.4.2 {self.config.domain} {REAP_REPLIES[reason]}, closing connection"
+        )
+        return False
+
     async def _send(self, message: str) -> None:
-        """Send a response to the client."""
+        """Send a response to the client.
+
+        A client that stops reading is cut off after write_timeout_seconds
+        rather than holding the session open.
+        """
         try:
             self.writer.write(f"{message}\r\n".encode())
-            await self.writer.drain()
+            await asyncio.wait_for(
+                self.writer.drain(), timeout=self.config.write_timeout_seconds
+            )
+        except asyncio.TimeoutError:
+            self.writer.transport.abort()
         except (ConnectionResetError, BrokenPipeError):
             pass
@@ -0,0 +1,51 @@
+"""Sub-address (plus-address) parsing for recipient addresses."""
+
+
+def split_address(address: str) -> tuple[str, str]:
+    """Split an address into local part and domain at the last @ outside quotes.
+
+    The domain is empty when the address has no @.
+    """
+    at = -1
+    quoted = False
+    escaped = False
+    for index, char in enumerate(address):
+        if escaped:
+            escaped = False
+        elif char == "\\" and quoted:
+            escaped = True
+        elif char == '"':
+            quoted = not quoted
+        elif char == "@" and not quoted:
+            at = index
+    if at < 0:
+        return address, ""
+    return address[:at], address[at + 1 :]
+
+
+def split_subaddress(address: str, separators: str) -> tuple[str, str]:
+    """Split the tag off an address and return (canonical address, tag).
+
+    Any character in separators starts the tag, and everything after the
+    first unquoted separator belongs to it, so signup+run+1@qa.test has
+    the tag "run+1". Separators inside a quoted local part, or at its
+    start, are part of the mailbox name. The tag is empty when there is
+    none, and the canonical address keeps the original case.
+    """
+    address = address.strip().strip("<>")
+    if not separators:
+        return address, ""
+    local, domain = split_address(address)
+    quoted = False
+    escaped = False
+    for index, char in enumerate(local):
+        if escaped:
+            escaped = False
+        elif char == "\\" and quoted:
+            escaped = True
+        elif char == '"':
+            quoted = not quoted
+        elif char in separators and not quoted and index > 0:
+            canonical = local[:index] + ("@" + domain if domain else "")
+            return canonical, local[index + 1 :]
+    return address, ""
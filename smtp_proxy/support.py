@@ -0,0 +1,241 @@
+"""Support bundles: diagnostics for bug reports without email content or secrets.
+
+A bundle is a zip with one file per section. Only what the sections
+below name is collected: the email tables are counted and measured but
+never read, config fields that look like secrets are redacted, and any
+secret value that turns up in log lines is scrubbed.
+"""
+
+from collections import deque
+from dataclasses import asdict
+from datetime import datetime
+import json
+import logging
+import os
+import platform
+import re
+import sqlite3
+import sys
+from typing import BinaryIO, Iterable
+import zipfile
+
+from . import __version__
+from .config import Config
+from .database.connection import Database
+
+SECTIONS = ("config", "schema", "logs", "integrity", "tables", "version", "runtime", "rejections")
+# Rejection records name senders and recipients, so they are opt-in
+DEFAULT_SECTIONS = tuple(section for section in SECTIONS if section != "rejections")
+
+REDACTED = "[redacted]"
+# Config fields whose names match are never written, whatever their value
+SECRET_FIELD = re.compile(r"password|secret|passphrase|token|private", re.IGNORECASE)
+SECRET_ASSIGNMENT = re.compile(
+    r"\b((?:password|passwd|secret|token|passphrase)=)[^\s&]+", re.IGNORECASE
+)
+# Shorter secret values are too likely to match ordinary text to scrub
+MIN_SCRUBBED_LENGTH = 4
+REJECTION = re.compile(r"\breject", re.IGNORECASE)
+
+
+class LogBuffer(logging.Handler):
+    """Keeps the most recent formatted log lines in memory for support bundles."""
+
+    def __init__(self, capacity: int = 1000):
+        super().__init__()
+        self.records: deque[str] = deque(maxlen=capacity)
+        self.setFormatter(
+            logging.Formatter("%(asctime)s - %(name)s - %(levelname)s - %(message)s")
+        )
+
+    def emit(self, record: logging.LogRecord) -> None:
+        try:
+            self.records.append(self.format(record))
+        except Exception:
+            self.handleError(record)
+
+    def lines(self) -> list[str]:
+        return list(self.records)
+
+
+log_buffer = LogBuffer()
+
+
+def redact_config(value, key: str = ""):
+    """Return a copy of config data with secret-looking fields replaced."""
+    if isinstance(value, dict):
+        return {k: redact_config(v, k) for k, v in value.items()}
+    if isinstance(value, list):
+        return [redact_config(item, key) for item in value]
+    if key and SECRET_FIELD.search(key) and value not in ("", None, False):
+        return REDACTED
+    return value
+
+
+def secret_values(value, key: str = "") -> set[str]:
+    """Collect the values of secret-looking config fields, to scrub from free text."""
+    if isinstance(value, dict):
+        return set().union(*(secret_values(v, k) for k, v in value.items()))
+    if isinstance(value, list):
+        return set().union(*(secret_values(item, key) for item in value))
+    if key and SECRET_FIELD.search(key) and isinstance(value, str):
+        if len(value) >= MIN_SCRUBBED_LENGTH:
+            return {value}
+    return set()
+
+
+class SupportBundle:
+    """Writes a support bundle for one database and configuration.
+
+    log_lines are the recent log lines to include; the web UI passes the
+    in-process buffer and the command line a tail of a log file. runtime
+    holds stats only a running server knows, such as the storage breaker.
+    """
+
+    def __init__(
+        self,
+        config: Config,
+        db: Database,
+        log_lines: Iterable[str] = (),
+        runtime: dict | None = None,
+        max_log_lines: int = 500,
+        max_rejections: int = 100,
+    ):
+        self.config = config
+        self.db = db
+        self.log_lines = list(log_lines)[-max_log_lines:] if max_log_lines else []
+        self.runtime = runtime or {}
+        self.max_rejections = max_rejections
+        config_data = asdict(config)
+        self._secrets = sorted(secret_values(config_data), key=len, reverse=True)
+        self._config_data = redact_config(config_data)
+
+    def scrub(self, text: str) -> str:
+        """Remove secret values and secret-looking assignments from free text."""
+        for secret in self._secrets:
+            text = text.replace(secret, REDACTED)
+        return SECRET_ASSIGNMENT.sub(rf"\1{REDACTED}", text)
+
+    def write(self, out: str | BinaryIO, sections: Iterable[str] = DEFAULT_SECTIONS) -> list[str]:
+        """Write the selected sections to a zip file, returning the file names.
+
+        Each section is written straight into its zip entry, so large
+        sections are never held in memory as a whole. A section that
+        fails is replaced by a note with the error.
+        """
+        selected = [section for section in SECTIONS if section in set(sections)]
+        names = []
+        with zipfile.ZipFile(out, "w", compression=zipfile.ZIP_DEFLATED) as bundle:
+            for section in selected:
+                name, writer = self._writers()[section]
+                with bundle.open(name, "w") as entry:
+                    try:
+                        writer(entry)
+                    except (sqlite3.Error, OSError) as e:
+                        entry.write(f"\n{section} could not be collected: {e}\n".encode())
+                names.append(name)
+            manifest = {
+                "generated_at": datetime.now().isoformat(),
+                "instance_id": self.config.instance_id,
+                "version": __version__,
+                "sections": selected,
+                "files": names,
+            }
+            bundle.writestr("manifest.json", json.dumps(manifest, indent=2))
+        return ["manifest.json"] + names
+
+    def _writers(self) -> dict:
+        return {
+            "config": ("config.json", self._write_config),
+            "schema": ("schema.json", self._write_schema),
+            "logs": ("logs.txt", self._write_logs),
+            "integrity": ("integrity.txt", self._write_integrity),
+            "tables": ("tables.json", self._write_tables),
+            "version": ("version.json", self._write_version),
+            "runtime": ("runtime.json", self._write_runtime),
+            "rejections": ("rejections.txt", self._write_rejections),
+        }
+
+    @staticmethod
+    def _json(entry: BinaryIO, data) -> None:
+        entry.write(json.dumps(data, indent=2, default=str).encode())
+
+    def _write_config(self, entry: BinaryIO) -> None:
+        self._json(entry, self._config_data)
+
+    def _write_schema(self, entry: BinaryIO) -> None:
+        # Columns added by later versions show which migrations have run
+        objects = self.db.fetchall(
+            "SELECT type, name, sql FROM sqlite_master WHERE sql IS NOT NULL ORDER BY type, name"
+        )
+        tables = [row["name"] for row in objects if row["type"] == "table"]
+        self._json(entry, {
+            "user_version": self.db.fetchone("PRAGMA user_version")[0],
+            "sqlite_version": sqlite3.sqlite_version,
+            "objects": [dict(row) for row in objects],
+            "columns": {
+                table: [row["name"] for row in self.db.fetchall(f'PRAGMA table_info("{table}")')]
+                for table in tables
+            },
+        })
+
+    def _write_logs(self, entry: BinaryIO) -> None:
+        for line in self.log_lines:
+            entry.write((self.scrub(line.rstrip("\n")) + "\n").encode())
+
+    def _write_integrity(self, entry: BinaryIO) -> None:
+        for row in self.db.fetchall("PRAGMA integrity_check"):
+            entry.write(f"{row[0]}\n".encode())
+
+    def _write_tables(self, entry: BinaryIO) -> None:
+        tables = [
+            row["name"]
+            for row in self.db.fetchall(
+                "SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name"
+            )
+        ]
+        sizes = {}
+        try:
+            sizes = {
+                row["name"]: row["bytes"]
+                for row in self.db.fetchall(
+                    "SELECT name, SUM(pgsize) AS bytes FROM dbstat GROUP BY name"
+                )
+            }
+        except sqlite3.Error:
+            # dbstat is an optional SQLite build feature
+            pass
+        self._json(entry, {
+            table: {
+                "rows": self.db.fetchone(f'SELECT COUNT(*) FROM "{table}"')[0],
+                "bytes": sizes.get(table),
+            }
+            for table in tables
+        })
+
+    def _write_version(self, entry: BinaryIO) -> None:
+        self._json(entry, {
+            "version": __version__,
+            "python": sys.version,
+            "platform": platform.platform(),
+            "sqlite": sqlite3.sqlite_version,
+        })
+
+    def _write_runtime(self, entry: BinaryIO) -> None:
+        files = {}
+        for suffix in ("", "-wal", "-shm"):
+            path = self.config.database.path + suffix
+            if os.path.exists(path):
+                files[os.path.basename(path)] = os.path.getsize(path)
+        self._json(entry, {"database_files": files, **self.runtime})
+
+    def _write_rejections(self, entry: BinaryIO) -> None:
+        rejections = [line for line in self.log_lines if REJECTION.search(line)]
+        for line in rejections[-self.max_rejections :]:
+            entry.write((self.scrub(line.rstrip("\n")) + "\n").encode())
+
+
+def tail_lines(path: str, count: int) -> list[str]:
+    """Return the last count lines of a text file."""
+    with open(path, "r", errors="replace") as f:
+        return list(deque(f, maxlen=count))
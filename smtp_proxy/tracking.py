@@ -0,0 +1,238 @@
+"""Detection of open-tracking and read receipt requests in received mail.
+
+HTML parts are scanned for remote content fetched when a message is
+opened: tiny or hidden images (tracking pixels), images from known
+tracker domains, and remote stylesheets and fonts. Headers asking the
+reader's client for a read receipt are flagged too. Detection is
+heuristic; it points at likely tracking for a person to review.
+"""
+
+from dataclasses import asdict, dataclass
+from email import message_from_bytes
+from email.policy import default as email_policy
+from html.parser import HTMLParser
+from typing import Callable
+from urllib.parse import urlsplit
+import logging
+import re
+
+from .config import TrackingConfig
+from .extract import html_parts
+
+logger = logging.getLogger(__name__)
+
+KIND_PIXEL = "pixel"
+KIND_TRACKER_DOMAIN = "tracker_domain"
+KIND_REMOTE_CSS = "remote_css"
+KIND_REMOTE_FONT = "remote_font"
+KIND_READ_RECEIPT = "read_receipt"
+
+KIND_TITLES = {
+    KIND_PIXEL: "Tracking pixel",
+    KIND_TRACKER_DOMAIN: "Tracker domain",
+    KIND_REMOTE_CSS: "Remote stylesheet",
+    KIND_REMOTE_FONT: "Remote font",
+    KIND_READ_RECEIPT: "Read receipt request",
+}
+
+RECEIPT_HEADERS = ("Disposition-Notification-To", "Return-Receipt-To", "X-Confirm-Reading-To")
+
+# Stylesheets from these hosts serve web fonts
+FONT_HOSTS = (
+    "fonts.googleapis.com",
+    "fonts.gstatic.com",
+    "use.typekit.net",
+    "fonts.bunny.net",
+    "use.fontawesome.com",
+)
+
+# Bounds on what is stored per email
+MAX_FINDINGS = 100
+MAX_URL_LENGTH = 2000
+
+REMOTE_URL = re.compile(r"^\s*(?:https?:)?//", re.IGNORECASE)
+CSS_URL = re.compile(r"url\(\s*(['\"]?)(.*?)\1\s*\)", re.IGNORECASE)
+CSS_IMPORT = re.compile(r"@import\s+(?:url\(\s*)?(['\"]?)([^'\"\s);]+)\1", re.IGNORECASE)
+FONT_FACE = re.compile(r"@font-face\s*\{([^}]*)\}", re.IGNORECASE)
+STYLE_DIMENSION = re.compile(r"(?:^|;)\s*(width|height)\s*:\s*([^;]*)", re.IGNORECASE)
+HIDDEN_STYLE = re.compile(
+    r"display\s*:\s*none|visibility\s*:\s*hidden"
+    r"|opacity\s*:\s*0(?:\.0+)?\s*(?:!important)?\s*(?:;|$)",
+    re.IGNORECASE,
+)
+PIXEL_SIZE = re.compile(r"^\s*([\d.]+)\s*(?:px)?\s*(?:!important)?\s*$", re.IGNORECASE)
+
+# Records a finding given its kind, URL and detail
+AddFinding = Callable[[str, str, str], None]
+
+
+@dataclass
+class TrackingFinding:
+    """One likely tracking mechanism found in a message."""
+    kind: str
+    url: str  # The remote URL, or the address a read receipt goes to
+    detail: str = ""
+
+
+class _ResourceParser(HTMLParser):
+    """Collects the tags and CSS of an HTML body that may load remote content."""
+
+    def __init__(self):
+        super().__init__(convert_charrefs=True)
+        self.tags: list[tuple[str, dict[str, str]]] = []
+        self.css: list[str] = []
+        self._in_style = False
+
+    def handle_starttag(self, tag: str, attrs: list[tuple[str, str | None]]) -> None:
+        values = {name: value or "" for name, value in attrs}
+        if tag == "style":
+            self._in_style = True
+        if values.get("style"):
+            self.css.append(values["style"])
+        if tag in ("img", "link") or values.get("background"):
+            self.tags.append((tag, values))
+
+    def handle_endtag(self, tag: str) -> None:
+        if tag == "style":
+            self._in_style = False
+
+    def handle_data(self, data: str) -> None:
+        if self._in_style:
+            self.css.append(data)
+
+
+def _pixels(value: str) -> float | None:
+    """Parse a width or height in pixels, or None if it is not one."""
+    match = PIXEL_SIZE.match(value)
+    if not match:
+        return None
+    try:
+        return float(match.group(1))
+    except ValueError:
+        return None
+
+
+def _host(url: str) -> str:
+    """Return the lowercase host of a URL."""
+    try:
+        return (urlsplit(url.strip()).hostname or "").rstrip(".")
+    except ValueError:
+        return ""
+
+
+def _is_remote(url: str) -> bool:
+    """Check whether a URL is fetched over the network when rendered."""
+    return bool(REMOTE_URL.match(url))
+
+
+class TrackingAnalyzer:
+    """Finds tracking pixels, tracker domains, remote CSS and fonts and read receipts."""
+
+    def __init__(self, config: TrackingConfig):
+        self.config = config
+        self.tracker_domains = tuple(d.lower().strip(".") for d in config.tracker_domains)
+
+    def analyze(self, raw_message: bytes) -> list[dict] | None:
+        """Return the findings of a message as stored on its email.
+
+        Never raises: None means the message could not be analyzed.
+        """
+        try:
+            return [asdict(finding) for finding in self.findings(raw_message)]
+        except Exception as e:
+            logger.warning(f"Tracking analysis failed: {e}")
+            return None
+
+    def findings(self, raw_message: bytes) -> list[TrackingFinding]:
+        """Find every likely tracking mechanism in a raw message."""
+        msg = message_from_bytes(raw_message, policy=email_policy)
+        found: dict[tuple[str, str], TrackingFinding] = {}
+
+        def add(kind: str, url: str, detail: str) -> None:
+            url = url.strip()[:MAX_URL_LENGTH]
+            if (kind, url) not in found and len(found) < MAX_FINDINGS:
+                found[(kind, url)] = TrackingFinding(kind, url, detail)
+
+        for header in RECEIPT_HEADERS:
+            for value in msg.get_all(header, []):
+                add(KIND_READ_RECEIPT, str(value), f"{header} header requests a read receipt")
+        for html in html_parts(msg):
+            self._scan_html(html, add)
+        return list(found.values())
+
+    def tracker_domain(self, url: str) -> str:
+        """Return the configured tracker domain a URL belongs to, or ""."""
+        host = _host(url)
+        for domain in self.tracker_domains:
+            if host == domain or host.endswith("." + domain):
+                return domain
+        return ""
+
+    def _scan_html(self, html: str, add: AddFinding) -> None:
+        parser = _ResourceParser()
+        parser.feed(html)
+        parser.close()
+
+        for tag, attrs in parser.tags:
+            if tag == "img" and _is_remote(attrs.get("src", "")):
+                self._scan_image(attrs, add)
+            elif tag == "link" and _is_remote(attrs.get("href", "")):
+                self._scan_link(attrs, add)
+            background = attrs.get("background", "")
+            if _is_remote(background):
+                self._scan_remote(background, "background image", add)
+
+        for css in parser.css:
+            self._scan_css(css, add)
+
+    def _scan_image(self, attrs: dict[str, str], add: AddFinding) -> None:
+        src = attrs["src"]
+        style = attrs.get("style", "")
+        sizes = {"width": attrs.get("width", ""), "height": attrs.get("height", "")}
+        for name, value in STYLE_DIMENSION.findall(style):
+            sizes[name.lower()] = value
+        dimensions = [d for d in (_pixels(v) for v in sizes.values() if v) if d is not None]
+        tracker = self.tracker_domain(src)
+        on_tracker = f" from known tracker {tracker}" if tracker else ""
+
+        if dimensions and min(dimensions) == 0:
+            add(KIND_PIXEL, src, f"Zero-size remote image{on_tracker}")
+        elif dimensions and max(dimensions) <= 1:
+            add(KIND_PIXEL, src, f"1x1 remote image{on_tracker}")
+        elif HIDDEN_STYLE.search(style):
+            add(KIND_PIXEL, src, f"Hidden remote image{on_tracker}")
+        elif tracker:
+            add(KIND_TRACKER_DOMAIN, src, f"Remote image from known tracker {tracker}")
+
+    def _scan_link(self, attrs: dict[str, str], add: AddFinding) -> None:
+        href = attrs["href"]
+        rel = attrs.get("rel", "").lower().split()
+        if attrs.get("as", "").lower() == "font" or (
+            "stylesheet" in rel and _host(href) in FONT_HOSTS
+        ):
+            add(KIND_REMOTE_FONT, href, "Remote font loaded when the message is opened")
+        elif "stylesheet" in rel:
+            add(KIND_REMOTE_CSS, href, "Remote stylesheet loaded when the message is opened")
+        else:
+            self._scan_remote(href, "linked resource", add)
+
+    def _scan_css(self, css: str, add: AddFinding) -> None:
+        fonts = set()
+        for block in FONT_FACE.findall(css):
+            for _, url in CSS_URL.findall(block):
+                if _is_remote(url):
+                    fonts.add(url)
+                    add(KIND_REMOTE_FONT, url, "@font-face loads a remote font")
+        for _, url in CSS_IMPORT.findall(css):
+            if _is_remote(url):
+                kind = KIND_REMOTE_FONT if _host(url) in FONT_HOSTS else KIND_REMOTE_CSS
+                add(kind, url, "@import of a remote stylesheet")
+        for _, url in CSS_URL.findall(css):
+            if _is_remote(url) and url not in fonts:
+                self._scan_remote(url, "CSS resource", add)
+
+    def _scan_remote(self, url: str, what: str, add: AddFinding) -> None:
+        """Flag a remote resource when it comes from a known tracker domain."""
+        tracker = self.tracker_domain(url)
+        if tracker:
+            add(KIND_TRACKER_DOMAIN, url, f"Remote {what} from known tracker {tracker}")
@@ -0,0 +1,86 @@
+"""Access log of web requests."""
+
+import json
+import logging
+import time
+
+from fastapi import Request
+
+from .ratelimit import IPNetwork, client_address
+
+logger = logging.getLogger(__name__)
+
+# Assets fetched with every page would drown out the requests that matter
+EXCLUDED_PATHS = ("/static", "/favicon.ico")
+
+
+def _excluded(path: str) -> bool:
+    return any(path == prefix or path.startswith(prefix + "/") for prefix in EXCLUDED_PATHS)
+
+
+class AccessLogMiddleware:
+    """ASGI middleware logging one line per web request once it has been answered.
+
+    Each line has the method, path, status, response body size, duration,
+    client address and the signed-in user, or the API token's name. The
+    response is passed through message by message, so streamed responses
+    such as the live event stream reach the client as they are sent and
+    are logged when they end.
+    """
+
+    def __init__(self, app, session_manager, trusted_proxies: list[IPNetwork], log_format: str):
+        self.app = app
+        self.session_manager = session_manager
+        self.trusted_proxies = trusted_proxies
+        self.log_format = log_format
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http" or _excluded(scope["path"]):
+            await self.app(scope, receive, send)
+            return
+
+        started = time.monotonic()
+        # The path as requested, before the base path middleware strips it
+        path = scope["path"]
+        status = 500
+        size = 0
+
+        async def logging_send(message):
+            nonlocal status, size
+            if message["type"] == "http.response.start":
+                status = message["status"]
+            elif message["type"] == "http.response.body":
+                size += len(message.get("body", b""))
+            await send(message)
+
+        try:
+            await self.app(scope, receive, logging_send)
+        finally:
+            self.log(scope, path, status, size, time.monotonic() - started)
+
+    def user(self, request: Request) -> str:
+        """Return who made a request: the API token set by its middleware, or the session's user."""
+        api_token = request.scope.get("state", {}).get("api_token")
+        if api_token is not None:
+            return f"token:{api_token.name}"
+        session = self.session_manager.get_session(request) or {}
+        return session.get("username", "")
+
+    def log(self, scope, path: str, status: int, size: int, duration: float) -> None:
+        request = Request(scope)
+        entry = {
+            "method": scope["method"],
+            "path": path,
+            "status": status,
+            "bytes": size,
+            "duration_ms": round(duration * 1000, 1),
+            "client": client_address(request, self.trusted_proxies),
+            "user": self.user(request),
+        }
+        if self.log_format == "json":
+            logger.info(json.dumps(entry))
+        else:
+            logger.info(
+                f'{entry["client"]} {entry["user"] or "-"} "{entry["method"]} {path}" '
+                f'{status} {size} {entry["duration_ms"]}ms'
+            )
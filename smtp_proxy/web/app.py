@@ -1,24 +1,69 @@
 """FastAPI application factory."""
 
-from pathlib import Path
+import asyncio
 
-from fastapi import FastAPI
+from fastapi import FastAPI, Request
+from fastapi.responses import JSONResponse
 from fastapi.staticfiles import StaticFiles
-from fastapi.templating import Jinja2Templates
 
 from ..config import Config
+from ..crypto import CryptoInspector
+from ..events import EmailEvents
+from ..database.address_repository import AddressRepository
+from ..database.api_token_repository import ApiTokenRepository
+from ..database.audit_repository import AuditRepository
 from ..database.email_repository import EmailRepository
+from ..database.journal_repository import JournalRepository
+from ..database.login_attempt_repository import LoginAttemptRepository
+from ..database.quota_repository import QuotaRepository
+from ..database.replica import Replicator
+from ..database.rule_repository import RuleRepository
+from ..database.smtp_credential_repository import SMTPCredentialRepository
 from ..database.user_repository import UserRepository
-from .auth import SessionManager
-from .routes import router
+from ..relay import Relay
+from ..siem import SIEMShipper
+from ..smtp.server import SMTPServer
+from .accesslog import AccessLogMiddleware
+from .auth import MagicLinkManager, SessionManager
+from .basepath import BasePathMiddleware
+from .errors import UnavailableError, register_error_handlers, render_error
+from .limits import RequestLimitsMiddleware
+from .providers import ProviderChain
+from .ratelimit import LoginRateLimiter, client_address, forwarded_scheme, parse_networks
+from .routes import is_admin, router
+from .templating import build_templates
+
+MUTATING_METHODS = {"POST", "PUT", "PATCH", "DELETE"}
+
+# Session endpoints must keep working so users can still sign in and out,
+# and support bundles only read; sign-ins record no attempts or audit
+# events, as the database is opened read-only
+READ_ONLY_ALLOWED_PATHS = {"/login", "/logout", "/admin/support-bundle"}
 
 
 def create_app(
     config: Config,
     email_repo: EmailRepository,
     user_repo: UserRepository,
+    rule_repo: RuleRepository,
+    address_repo: AddressRepository,
+    journal_repo: JournalRepository,
+    auth_providers: ProviderChain,
+    replicator: Replicator | None = None,
+    relay: Relay | None = None,
+    credential_repo: SMTPCredentialRepository | None = None,
+    audit_repo: AuditRepository | None = None,
+    siem: SIEMShipper | None = None,
+    smtp_server: SMTPServer | None = None,
+    quota_repo: QuotaRepository | None = None,
+    api_token_repo: ApiTokenRepository | None = None,
+    events: EmailEvents | None = None,
+    login_attempt_repo: LoginAttemptRepository | None = None,
 ) -> FastAPI:
-    """Create and configure the FastAPI application."""
+    """Create and configure the FastAPI application.
+
+    Raises TemplateLoadError if a template does not parse.
+    """
     app = FastAPI(
         title="SMTP Proxy",
         description="A development SMTP blackhole server with web UI",
@@ -26,22 +71,130 @@ def create_app(
     )
 
     # Setup templates
-    templates_dir = Path(__file__).parent.parent.parent / "templates"
-    templates = Jinja2Templates(directory=str(templates_dir))
+    templates = build_templates(config)
+    templates.env.globals["read_only"] = config.read_only
+    templates.env.globals["is_admin"] = is_admin
+    templates.env.globals["base_path"] = config.web.base_path
 
     # Setup session manager
     session_manager = SessionManager(
         secret=config.web.session_secret,
         cookie_name=config.web.session_name,
-        max_age=86400,  # 24 hours
+        max_age=config.web.session_max_age_seconds,
+        idle_timeout=config.web.session_idle_timeout_seconds,
+        secure=config.web.cookie_secure or config.web.tls.enabled,
+        path=config.web.base_path or "/",
     )
 
     # Store dependencies in app state
     app.state.config = config
     app.state.email_repo = email_repo
     app.state.user_repo = user_repo
+    app.state.rule_repo = rule_repo
+    app.state.address_repo = address_repo
+    app.state.journal_repo = journal_repo
+    app.state.auth_providers = auth_providers
+    app.state.replicator = replicator
+    app.state.relay = relay
+    app.state.credential_repo = credential_repo or SMTPCredentialRepository(email_repo.db)
+    app.state.audit_repo = audit_repo or AuditRepository(email_repo.db, config.instance_id)
+    app.state.quota_repo = quota_repo or QuotaRepository(email_repo.db)
+    app.state.api_token_repo = api_token_repo or ApiTokenRepository(email_repo.db)
+    app.state.login_attempt_repo = login_attempt_repo or LoginAttemptRepository(email_repo.db)
+    app.state.siem = siem
+    app.state.smtp_server = smtp_server
+    app.state.events = events or EmailEvents()
+    app.state.crypto = CryptoInspector(config.crypto)
     app.state.templates = templates
     app.state.session_manager = session_manager
+    app.state.trusted_proxies = parse_networks(config.web.trusted_proxies)
+    app.state.login_limiter = LoginRateLimiter(
+        config.web.login_max_failures, config.web.login_window_seconds
+    )
+    app.state.magic_links = (
+        MagicLinkManager(config.web.session_secret) if config.web.magic_login else None
+    )
+
+    # Block mutating requests in read-only mode
+    if config.read_only:
+        @app.middleware("http")
+        async def read_only_guard(request: Request, call_next):
+            if (
+                request.method in MUTATING_METHODS
+                and request.url.path not in READ_ONLY_ALLOWED_PATHS
+            ):
+                return render_error(
+                    request, UnavailableError("Server is running in read-only mode")
+                )
+            return await call_next(request)
+
+    # API clients may send a bearer token instead of a session cookie; an
+    # invalid one is refused here rather than falling back to the cookie
+    @app.middleware("http")
+    async def api_token_auth(request: Request, call_next):
+        scheme, _, token = request.headers.get("authorization", "").partition(" ")
+        if request.url.path.startswith("/api/") and scheme.lower() == "bearer":
+            api_token = await asyncio.to_thread(app.state.api_token_repo.verify, token.strip())
+            if api_token is None:
+                source = client_address(request, app.state.trusted_proxies)
+                app.state.audit_repo.record("api_token.auth", "failure", "", source)
+                return JSONResponse(
+                    {"detail": "Invalid API token"},
+                    status_code=401,
+                    headers={"WWW-Authenticate": 'Bearer error="invalid_token"'},
+                )
+            request.state.api_token = api_token
+        return await call_next(request)
+
+    # Sliding expiry: activity keeps a session from timing out while idle
+    if config.web.session_idle_timeout_seconds:
+        @app.middleware("http")
+        async def refresh_session(request: Request, call_next):
+            response = await call_next(request)
+            session_manager.refresh_session(request, response)
+            return response
+
+    # Never let the browser cache anything while developing
+    if config.dev:
+        @app.middleware("http")
+        async def no_cache(request: Request, call_next):
+            response = await call_next(request)
+            response.headers["Cache-Control"] = "no-store"
+            return response
+
+    # A TLS-terminating proxy talks plain HTTP to us; the scheme the client
+    # used decides the Secure flag and any absolute URLs. Added after the
+    # other request middleware so it runs before them.
+    if config.web.behind_proxy:
+        @app.middleware("http")
+        async def proxy_scheme(request: Request, call_next):
+            scheme = forwarded_scheme(request, app.state.trusted_proxies)
+            if scheme:
+                request.scope["scheme"] = scheme
+            return await call_next(request)
+
+    # Added before the error handlers so the request ID middleware wraps it
+    app.add_middleware(
+        RequestLimitsMiddleware,
+        timeout_seconds=config.web.request_timeout_seconds,
+        max_body_bytes=config.web.max_body_bytes,
+        max_upload_bytes=config.web.max_upload_bytes,
+        on_error=lambda scope, error: render_error(Request(scope), error),
+    )
+
+    register_error_handlers(app)
+
+    # Outermost, so everything inside sees paths from the root of the UI
+    app.add_middleware(BasePathMiddleware, base_path=config.web.base_path)
+
+    # Around even that, so requests are logged with the path the client asked for
+    if config.web.access_log != "off":
+        app.add_middleware(
+            AccessLogMiddleware,
+            session_manager=session_manager,
+            trusted_proxies=app.state.trusted_proxies,
+            log_format=config.web.access_log,
+        )
 
     # Include routes
     app.include_router(router)
@@ -1,45 +1,129 @@
 """Session management using signed cookies."""
 
+import hashlib
+import hmac
+import secrets
+import time
+
 from itsdangerous import URLSafeTimedSerializer, BadSignature, SignatureExpired
 from fastapi import Request, Response
 
+# How long the browser keeps a cookie past its session's end, so the
+# next request can still tell the user their session expired
+EXPIRED_COOKIE_GRACE_SECONDS = 86400
+
 
 class SessionManager:
-    """Manages user sessions using signed cookies."""
+    """Manages user sessions using signed cookies.
 
-    def __init__(self, secret: str, cookie_name: str, max_age: int = 86400):
+    A session ends max_age seconds after sign-in, recorded as issued_at in
+    the session data. With an idle timeout it also ends after that long
+    without a request; refresh_session re-signs the cookie on each one,
+    and the signature's timestamp is then the last activity.
+    """
+
+    def __init__(
+        self,
+        secret: str,
+        cookie_name: str,
+        max_age: int = 86400,
+        idle_timeout: int = 0,
+        secure: bool = False,
+        path: str = "/",
+    ):
         self.serializer = URLSafeTimedSerializer(secret)
         self.cookie_name = cookie_name
         self.max_age = max_age
+        self.idle_timeout = idle_timeout
+        self.secure = secure
+        self.path = path
 
     def create_session(
-        self, response: Response, user_id: int, username: str
+        self,
+        request: Request,
+        response: Response,
+        user_id: int,
+        username: str,
+        provider: str = "database",
+        role: str = "admin",
     ) -> None:
-        """Create a new session and set the cookie."""
-        data = {"user_id": user_id, "username": username}
-        token = self.serializer.dumps(data)
-        response.set_cookie(
-            key=self.cookie_name,
-            value=token,
-            max_age=self.max_age,
-            httponly=True,
-            samesite="lax",
-        )
+        """Create a new session recording the provider that authenticated the user.
+
+        The role only counts for users without an ID, whose provider keeps
+        no record to look it up in again.
+        """
+        data = {
+            "user_id": user_id, "username": username, "provider": provider, "role": role,
+            "issued_at": int(time.time()),
+        }
+        self._write(request, response, data)
 
     def get_session(self, request: Request) -> dict | None:
         """Get session data from the request cookie."""
+        data, _ = self._load(request)
+        return data
+
+    def expired(self, request: Request) -> bool:
+        """Check whether the request carries a genuine session cookie that has expired."""
+        _, expired = self._load(request)
+        return expired
+
+    def refresh_session(self, request: Request, response: Response) -> None:
+        """Re-sign a live session's cookie, pushing back its idle timeout.
+
+        Nothing is done without an idle timeout, or when the response sets
+        or deletes the cookie itself, as signing in and out do.
+        """
+        if not self.idle_timeout:
+            return
+        prefix = f"{self.cookie_name}="
+        if any(cookie.startswith(prefix) for cookie in response.headers.getlist("set-cookie")):
+            return
+        data = self.get_session(request)
+        if data is not None:
+            self._write(request, response, data)
+
+    def _load(self, request: Request) -> tuple[dict | None, bool]:
+        """Return the session data, or None and whether that is because it expired."""
         token = request.cookies.get(self.cookie_name)
         if not token:
-            return None
+            return None, False
         try:
-            data = self.serializer.loads(token, max_age=self.max_age)
-            return data
-        except (BadSignature, SignatureExpired):
-            return None
+            data, signed_at = self.serializer.loads(
+                token, max_age=self.idle_timeout or self.max_age, return_timestamp=True
+            )
+        except SignatureExpired:
+            return None, True
+        except BadSignature:
+            return None, False
+        # Sessions from before issued_at was recorded count from their signature
+        issued_at = data.get("issued_at", signed_at.timestamp())
+        if time.time() - issued_at > self.max_age:
+            return None, True
+        return data, False
+
+    def _write(self, request: Request, response: Response, data: dict) -> None:
+        """Set the signed session cookie, kept by the browser until the session ends.
+
+        The cookie is Secure when configured so or when the request came
+        over HTTPS, as seen by the client. SameSite=Lax keeps it off
+        cross-site form posts while links to the UI from emails and chat
+        still arrive signed in.
+        """
+        remaining = self.max_age - (int(time.time()) - data.get("issued_at", int(time.time())))
+        response.set_cookie(
+            key=self.cookie_name,
+            value=self.serializer.dumps(data),
+            max_age=max(remaining, 0) + EXPIRED_COOKIE_GRACE_SECONDS,
+            path=self.path,
+            httponly=True,
+            secure=self.secure or request.url.scheme == "https",
+            samesite="lax",
+        )
 
     def destroy_session(self, response: Response) -> None:
         """Destroy the session by deleting the cookie."""
-        response.delete_cookie(self.cookie_name)
+        response.delete_cookie(self.cookie_name, path=self.path)
 
     def get_user_id(self, request: Request) -> int | None:
         """Get the user ID from the session."""
@@ -54,3 +138,48 @@ class SessionManager:
         if session:
             return session.get("username")
         return None
+
+
+class MagicLinkManager:
+    """Issues and verifies one-time signed login tokens.
+
+    Tokens are HMAC-signed over the user ID, expiry and a random nonce.
+    Issued nonces are kept in memory, so a token can be used once and
+    every outstanding token is revoked by a restart.
+    """
+
+    def __init__(self, secret: str, ttl_seconds: int = 600):
+        self.secret = secret.encode()
+        self.ttl_seconds = ttl_seconds
+        self._issued: set[str] = set()
+
+    def issue(self, user_id: int) -> str:
+        """Create a login token for a user."""
+        expires = int(time.time()) + self.ttl_seconds
+        nonce = secrets.token_hex(16)
+        self._issued.add(nonce)
+        payload = f"{user_id}.{expires}.{nonce}"
+        return f"{payload}.{self._sign(payload)}"
+
+    def verify(self, token: str) -> int | None:
+        """Consume a token and return its user ID, or None if it is invalid.
+
+        Tampered, expired and already used tokens are all rejected.
+        """
+        try:
+            user_id, expires, nonce, signature = token.split(".")
+            payload = f"{user_id}.{expires}.{nonce}"
+            if not hmac.compare_digest(signature, self._sign(payload)):
+                return None
+            if nonce not in self._issued:
+                return None
+            self._issued.discard(nonce)
+            if int(expires) < time.time():
+                return None
+            return int(user_id)
+        except ValueError:
+            return None
+
+    def _sign(self, payload: str) -> str:
+        """Return the hex HMAC-SHA256 of a payload."""
+        return hmac.new(self.secret, payload.encode(), hashlib.sha256).hexdigest()
@@ -0,0 +1,50 @@
+"""Serving the web UI under a sub-path behind a reverse proxy."""
+
+
+class BasePathMiddleware:
+    """ASGI middleware mounting the web UI under a base path.
+
+    Routes, templates and handlers all work with paths from the root of
+    the UI. The base path is stripped from request paths here, and added
+    to the root-relative Location of every redirect on the way out.
+    Requests without it are served too, for proxies that strip it
+    themselves. A trailing slash is ignored, so /mailproxy, /mailproxy/
+    and /emails/ reach the same routes as /mailproxy/ and /emails.
+    """
+
+    def __init__(self, app, base_path: str):
+        self.app = app
+        self.base_path = base_path
+
+    def strip(self, path: str) -> str:
+        """Return a request path relative to the base path, without a trailing slash."""
+        if self.base_path and (path == self.base_path or path.startswith(self.base_path + "/")):
+            path = path[len(self.base_path):]
+        return path.rstrip("/") or "/"
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] not in ("http", "websocket"):
+            await self.app(scope, receive, send)
+            return
+
+        scope["path"] = self.strip(scope["path"])
+        if not self.base_path:
+            await self.app(scope, receive, send)
+            return
+
+        async def prefixed_send(message):
+            if message["type"] == "http.response.start":
+                message["headers"] = [
+                    (name, self._prefix(value) if name.lower() == b"location" else value)
+                    for name, value in message.get("headers", [])
+                ]
+            await send(message)
+
+        await self.app(scope, receive, prefixed_send)
+
+    def _prefix(self, location: bytes) -> bytes:
+        # Only root-relative paths; absolute and protocol-relative URLs
+        # point elsewhere
+        if location.startswith(b"/") and not location.startswith(b"//"):
+            return self.base_path.encode() + location
+        return location
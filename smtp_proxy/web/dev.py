@@ -0,0 +1,40 @@
+"""Development mode helpers for the web UI."""
+
+import logging
+
+from jinja2 import FileSystemLoader, Template, TemplateSyntaxError
+
+logger = logging.getLogger(__name__)
+
+
+class LastGoodLoader(FileSystemLoader):
+    """Template loader that survives template syntax errors.
+
+    Jinja re-parses a template whenever its file changes. If the new
+    version fails to parse, the error is logged once and the last version
+    that parsed is served until the file is fixed.
+    """
+
+    def __init__(self, searchpath: str | list[str]):
+        super().__init__(searchpath)
+        self._last_good: dict[str, Template] = {}
+        self._errors: dict[str, str] = {}
+
+    def load(self, environment, name, globals=None):
+        try:
+            template = super().load(environment, name, globals)
+        except TemplateSyntaxError as e:
+            last_good = self._last_good.get(name)
+            message = f"{e.filename or name}, line {e.lineno}: {e.message}"
+            if self._errors.get(name) != message:
+                self._errors[name] = message
+                fallback = "serving last good version" if last_good else "no good version to serve"
+                logger.error(f"TEMPLATE ERROR in {message} ({fallback})")
+            if last_good is None:
+                raise
+            return last_good
+
+        if self._errors.pop(name, None):
+            logger.info(f"Template {name} parses again")
+        self._last_good[name] = template
+        return template
@@ -0,0 +1,174 @@
+"""Typed web errors, request IDs and error rendering."""
+
+import logging
+import re
+import secrets
+import sqlite3
+
+from fastapi import FastAPI, Request
+from fastapi.exceptions import RequestValidationError
+from fastapi.responses import JSONResponse, Response
+from starlette.exceptions import HTTPException as StarletteHTTPException
+
+logger = logging.getLogger(__name__)
+
+REQUEST_ID_HEADER = "X-Request-ID"
+
+# Client-supplied request IDs are reused only if they look like one
+REQUEST_ID_PATTERN = re.compile(r"^[A-Za-z0-9._-]{1,64}$")
+
+
+class WebError(Exception):
+    """An error that maps to an HTTP status and a user-facing message."""
+    status_code = 500
+    code = "internal"
+    title = "Something went wrong"
+
+    def __init__(self, message: str = ""):
+        self.message = message or self.title
+        super().__init__(self.message)
+
+
+class NotFoundError(WebError):
+    """The requested page or record does not exist."""
+    status_code = 404
+    code = "not_found"
+    title = "Page not found"
+
+
+class ForbiddenError(WebError):
+    """The user may not perform the request."""
+    status_code = 403
+    code = "forbidden"
+    title = "Access denied"
+
+
+class ValidationError(WebError):
+    """The request was malformed or had invalid parameters."""
+    status_code = 400
+    code = "validation"
+    title = "Invalid request"
+
+
+class RedactedError(WebError):
+    """The content needed was withheld from storage by the privacy settings."""
+    status_code = 410
+    code = "redacted"
+    title = "Content not stored"
+
+
+class PayloadTooLargeError(WebError):
+    """The request body was larger than its route accepts."""
+    status_code = 413
+    code = "too_large"
+    title = "Request too large"
+
+
+class InternalError(WebError):
+    """An unexpected server-side failure."""
+
+
+class UnavailableError(WebError):
+    """A dependency such as storage is temporarily unavailable."""
+    status_code = 503
+    code = "unavailable"
+    title = "Service temporarily unavailable"
+
+
+def request_id(request: Request) -> str:
+    """Return the ID assigned to a request by the middleware."""
+    return getattr(request.state, "request_id", "")
+
+
+def wants_json(request: Request) -> bool:
+    """Check whether an error for this request should be rendered as JSON."""
+    path = request.url.path
+    if path.startswith(("/api/", "/admin/")) or path.endswith((".json", "/lint")) or path == "/readyz":
+        return True
+    accept = request.headers.get("accept", "")
+    return "application/json" in accept and "text/html" not in accept
+
+
+def render_error(request: Request, error: WebError) -> Response:
+    """Render an error as a JSON envelope or an HTML page."""
+    if error.status_code >= 500:
+        logger.error(
+            f"[{request_id(request)}] {request.method} {request.url.path} "
+            f"failed with {error.status_code}: {error.message}"
+        )
+    else:
+        logger.info(
+            f"[{request_id(request)}] {request.method} {request.url.path} "
+            f"returned {error.status_code}: {error.message}"
+        )
+
+    if wants_json(request):
+        return JSONResponse(
+            {"detail": error.message, "error": error.code, "request_id": request_id(request)},
+            status_code=error.status_code,
+        )
+
+    session = request.app.state.session_manager.get_session(request) or {}
+    return request.app.state.templates.TemplateResponse(
+        "error.html",
+        {
+            "request": request,
+            "error": error,
+            "request_id": request_id(request),
+            "username": session.get("username"),
+        },
+        status_code=error.status_code,
+    )
+
+
+def _error_for_status(status_code: int, message: str) -> WebError:
+    """Convert a raw HTTP status into the matching typed error."""
+    for error_class in (NotFoundError, ForbiddenError, UnavailableError):
+        if status_code == error_class.status_code:
+            return error_class(message)
+    if status_code in (400, 405, 422):
+        return ValidationError(message)
+    error = WebError(message)
+    error.status_code = status_code
+    error.code = "http_error"
+    return error
+
+
+def register_error_handlers(app: FastAPI) -> None:
+    """Install the request ID middleware and error handlers on an app."""
+
+    @app.middleware("http")
+    async def assign_request_id(request: Request, call_next):
+        supplied = request.headers.get(REQUEST_ID_HEADER, "")
+        request.state.request_id = (
+            supplied if REQUEST_ID_PATTERN.match(supplied) else secrets.token_hex(8)
+        )
+        response = await call_next(request)
+        response.headers[REQUEST_ID_HEADER] = request.state.request_id
+        return response
+
+    @app.exception_handler(WebError)
+    async def web_error_handler(request: Request, exc: WebError):
+        return render_error(request, exc)
+
+    @app.exception_handler(StarletteHTTPException)
+    async def http_error_handler(request: Request, exc: StarletteHTTPException):
+        if exc.status_code < 400:
+            return Response(status_code=exc.status_code, headers=exc.headers)
+        detail = exc.detail if isinstance(exc.detail, str) else ""
+        return render_error(request, _error_for_status(exc.status_code, detail))
+
+    @app.exception_handler(RequestValidationError)
+    async def request_validation_handler(request: Request, exc: RequestValidationError):
+        fields = ", ".join(".".join(str(p) for p in e["loc"][1:]) for e in exc.errors())
+        return render_error(request, ValidationError(f"Invalid value for: {fields}"))
+
+    # Storage failures are reported as 503 rather than a generic 500
+    @app.exception_handler(sqlite3.Error)
+    async def storage_error_handler(request: Request, exc: sqlite3.Error):
+        return render_error(request, UnavailableError("Storage is temporarily unavailable"))
+
+    @app.exception_handler(Exception)
+    async def unhandled_error_handler(request: Request, exc: Exception):
+        logger.exception(f"[{request_id(request)}] Unhandled error", exc_info=exc)
+        return render_error(request, InternalError())
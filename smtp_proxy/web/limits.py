@@ -0,0 +1,169 @@
+"""Per-route request timeouts and body size limits."""
+
+import asyncio
+import time
+from typing import Callable, Iterable, Iterator
+
+from .errors import PayloadTooLargeError, UnavailableError, WebError
+
+# Routes whose responses stream for as long as they need, such as
+# downloads and the live event stream; they are never cut off by the
+# request timeout
+UNTIMED_PATHS = ("/admin/support-bundle", "/events")
+
+# Sign-in forms only ever carry a username and password
+LOGIN_PATHS = ("/login",)
+LOGIN_MAX_BODY_BYTES = 16 * 1024
+
+# Routes that accept uploaded files use the larger upload limit
+UPLOAD_PATHS = ("/admin/import-settings",)
+
+
+class BodyTooLarge(Exception):
+    """Raised from receive() once a request body passes its route's limit."""
+
+
+class Deadline:
+    """The time a request must finish by, which handlers may push back.
+
+    A handler doing long work that is still making progress calls
+    extend_deadline() between steps instead of being exempt from the
+    timeout altogether.
+    """
+
+    def __init__(self, seconds: float):
+        self.expires_at = time.monotonic() + seconds
+
+    def extend(self, seconds: float) -> None:
+        self.expires_at = max(self.expires_at, time.monotonic() + seconds)
+
+    def remaining(self) -> float:
+        return self.expires_at - time.monotonic()
+
+
+def extend_deadline(request, seconds: float) -> None:
+    """Give the current request at least seconds more before it times out."""
+    deadline = getattr(request.state, "deadline", None)
+    if deadline is not None:
+        deadline.extend(seconds)
+
+
+def extending_deadline(request, chunks: Iterable[bytes], seconds: float) -> Iterator[bytes]:
+    """Yield a download's chunks, giving the request seconds more after each one.
+
+    An export that keeps producing data runs for as long as it needs,
+    while one that stalls for longer than seconds is still cut off.
+    """
+    for chunk in chunks:
+        extend_deadline(request, seconds)
+        yield chunk
+
+
+def _matches(path: str, prefixes: tuple[str, ...]) -> bool:
+    return any(path == prefix or path.startswith(prefix + "/") for prefix in prefixes)
+
+
+class RequestLimitsMiddleware:
+    """ASGI middleware applying a timeout and a body size limit per route.
+
+    A timed-out request that has not started its response gets a 503; one
+    that has is cut off, as there is no way to change its status. Bodies
+    are checked against Content-Length up front and counted as they are
+    read, so chunked uploads are stopped too. on_error turns a WebError
+    into a response for the request's scope.
+    """
+
+    def __init__(
+        self,
+        app,
+        timeout_seconds: float,
+        max_body_bytes: int,
+        max_upload_bytes: int,
+        on_error: Callable,
+    ):
+        self.app = app
+        self.timeout_seconds = timeout_seconds
+        self.max_body_bytes = max_body_bytes
+        self.max_upload_bytes = max_upload_bytes
+        self.on_error = on_error
+
+    def body_limit(self, path: str) -> int:
+        """Return the largest request body accepted on a path."""
+        if _matches(path, LOGIN_PATHS):
+            return LOGIN_MAX_BODY_BYTES
+        if _matches(path, UPLOAD_PATHS):
+            return self.max_upload_bytes
+        return self.max_body_bytes
+
+    def timed(self, path: str) -> bool:
+        """Check whether a path is subject to the request timeout."""
+        return self.timeout_seconds > 0 and not _matches(path, UNTIMED_PATHS)
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+
+        path = scope["path"]
+        limit = self.body_limit(path)
+        for name, value in scope.get("headers", []):
+            if name == b"content-length" and value.isdigit() and int(value) > limit:
+                await self._error(scope, receive, send, self._too_large(limit))
+                return
+
+        received = 0
+
+        async def limited_receive():
+            nonlocal received
+            message = await receive()
+            if message["type"] == "http.request":
+                received += len(message.get("body", b""))
+                if received > limit:
+                    raise BodyTooLarge()
+            return message
+
+        started = False
+
+        async def tracking_send(message):
+            nonlocal started
+            if message["type"] == "http.response.start":
+                started = True
+            await send(message)
+
+        deadline = Deadline(self.timeout_seconds)
+        scope.setdefault("state", {})["deadline"] = deadline
+        task = asyncio.ensure_future(self.app(scope, limited_receive, tracking_send))
+        try:
+            if self.timed(path):
+                while not task.done():
+                    remaining = deadline.remaining()
+                    if remaining <= 0:
+                        break
+                    await asyncio.wait({task}, timeout=remaining)
+                if not task.done():
+                    task.cancel()
+                    try:
+                        await task
+                    except asyncio.CancelledError:
+                        pass
+                    if not started:
+                        error = UnavailableError(
+                            f"The request took longer than {self.timeout_seconds:g}s"
+                        )
+                        await self._error(scope, receive, send, error)
+                    return
+            await task
+        except BodyTooLarge:
+            if not started:
+                await self._error(scope, receive, send, self._too_large(limit))
+        finally:
+            if not task.done():
+                task.cancel()
+
+    @staticmethod
+    def _too_large(limit: int) -> WebError:
+        return PayloadTooLargeError(f"Request body is larger than {limit} bytes")
+
+    async def _error(self, scope, receive, send, error: WebError) -> None:
+        response = self.on_error(scope, error)
+        await response(scope, receive, send)
@@ -0,0 +1,148 @@
+"""Authentication providers for web login."""
+
+import logging
+import os
+import threading
+
+import bcrypt
+
+from ..config import AuthProviderConfig
+from ..database.user_repository import UserRepository
+from ..models import User
+
+logger = logging.getLogger(__name__)
+
+BCRYPT_PREFIXES = ("$2a$", "$2b$", "$2y$")
+
+
+class ProviderError(Exception):
+    """Raised when a provider cannot check credentials at all."""
+
+
+class AuthProvider:
+    """Checks a username and password against one source of users.
+
+    authenticate returns the user on success and None when the provider
+    does not know the user or the password is wrong, so the next provider
+    can be tried. It raises ProviderError when the source is unavailable.
+    """
+
+    name = ""
+    # Users live in this app's database and can be created and changed here
+    manages_users = False
+
+    def authenticate(self, username: str, password: str) -> User | None:
+        raise NotImplementedError
+
+
+class DatabaseProvider(AuthProvider):
+    """Users stored in the SQLite users table."""
+
+    name = "database"
+    manages_users = True
+
+    def __init__(self, user_repo: UserRepository):
+        self.user_repo = user_repo
+
+    def authenticate(self, username: str, password: str) -> User | None:
+        return self.user_repo.authenticate(username, password)
+
+
+class HtpasswdProvider(AuthProvider):
+    """Users in an htpasswd-style file of username:bcrypt-hash lines.
+
+    The file is re-read whenever its modification time changes, so users
+    can be added or removed without a restart.
+    """
+
+    name = "htpasswd"
+
+    def __init__(self, path: str, role: str = "admin"):
+        self.path = path
+        self.role = role
+        self._lock = threading.Lock()
+        self._users: dict[str, str] = {}
+        self._mtime_ns: int | None = None
+
+    def authenticate(self, username: str, password: str) -> User | None:
+        password_hash = self._load().get(username)
+        if not password_hash:
+            return None
+        # $2y$ is PHP's name for the same algorithm as $2b$
+        password_hash = "$2b$" + password_hash[4:]
+        try:
+            matched = bcrypt.checkpw(password.encode(), password_hash.encode())
+        except ValueError:
+            logger.warning(f"Invalid bcrypt hash for user {username} in {self.path}")
+            return None
+        return User(username=username, role=self.role) if matched else None
+
+    def _load(self) -> dict[str, str]:
+        """Return the users in the file, re-reading it if it has changed."""
+        try:
+            mtime_ns = os.stat(self.path).st_mtime_ns
+        except OSError as e:
+            raise ProviderError(f"Cannot read {self.path}: {e}") from e
+
+        with self._lock:
+            if mtime_ns != self._mtime_ns:
+                try:
+                    with open(self.path, "r") as f:
+                        self._users = self._parse(f.read())
+                except OSError as e:
+                    raise ProviderError(f"Cannot read {self.path}: {e}") from e
+                self._mtime_ns = mtime_ns
+                logger.info(f"Loaded {len(self._users)} user(s) from {self.path}")
+            return self._users
+
+    def _parse(self, content: str) -> dict[str, str]:
+        """Parse username:hash lines, skipping blanks, comments and non-bcrypt hashes."""
+        users = {}
+        for number, line in enumerate(content.splitlines(), start=1):
+            line = line.strip()
+            if not line or line.startswith("#"):
+                continue
+            username, sep, password_hash = line.partition(":")
+            if not sep or not password_hash.startswith(BCRYPT_PREFIXES):
+                logger.warning(f"Skipping line {number} of {self.path}: expected username:bcrypt-hash")
+                continue
+            users[username] = password_hash
+        return users
+
+
+class ProviderChain:
+    """Tries authentication providers in priority order."""
+
+    def __init__(self, providers: list[AuthProvider]):
+        self.providers = providers
+
+    @property
+    def manages_users(self) -> bool:
+        """Check whether any provider keeps users in the database."""
+        return any(provider.manages_users for provider in self.providers)
+
+    def authenticate(self, username: str, password: str) -> tuple[User, AuthProvider] | None:
+        """Return the user and the provider that accepted them, or None.
+
+        A provider that is unavailable is logged and skipped.
+        """
+        for provider in self.providers:
+            try:
+                user = provider.authenticate(username, password)
+            except ProviderError as e:
+                logger.warning(f"Authentication provider {provider.name} unavailable: {e}")
+                continue
+            if user:
+                return user, provider
+        return None
+
+
+def build_providers(configs: list[AuthProviderConfig], user_repo: UserRepository) -> ProviderChain:
+    """Create the configured providers in priority order."""
+    providers: list[AuthProvider] = []
+    for config in configs:
+        if config.type == "database":
+            providers.append(DatabaseProvider(user_repo))
+        elif config.type == "htpasswd":
+            providers.append(HtpasswdProvider(config.path, config.role))
+    return ProviderChain(providers)
@@ -0,0 +1,139 @@
+"""Sliding-window limits on failed web sign-ins."""
+
+from collections import deque
+import ipaddress
+import math
+import time
+
+from fastapi import Request
+
+# Keys tracked at once; past this the least recently failed are forgotten
+MAX_KEYS = 10000
+
+IPNetwork = ipaddress.IPv4Network | ipaddress.IPv6Network
+
+
+def parse_networks(networks: list[str]) -> list[IPNetwork]:
+    """Parse CIDR strings, as validated by the configuration."""
+    return [ipaddress.ip_network(network, strict=False) for network in networks]
+
+
+def _in_networks(address: str, networks: list[IPNetwork]) -> bool:
+    try:
+        ip = ipaddress.ip_address(address.strip())
+    except ValueError:
+        return False
+    # IPv4 clients on a dual-stack listener show up as ::ffff:a.b.c.d
+    if ip.version == 6 and ip.ipv4_mapped:
+        ip = ip.ipv4_mapped
+    return any(ip in network for network in networks)
+
+
+def client_address(request: Request, trusted_proxies: list[IPNetwork]) -> str:
+    """Return the address of the client behind any trusted proxies.
+
+    X-Forwarded-For is only believed when the connection comes from a
+    trusted proxy, and is read from the right, as each proxy appends the
+    address it received the request from. The first address that is not
+    itself a trusted proxy is the client.
+    """
+    peer = request.client.host if request.client else ""
+    if not trusted_proxies or not _in_networks(peer, trusted_proxies):
+        return peer
+    forwarded = ",".join(request.headers.getlist("x-forwarded-for"))
+    hops = [hop.strip() for hop in forwarded.split(",") if hop.strip()]
+    for hop in reversed(hops):
+        if not _in_networks(hop, trusted_proxies):
+            return hop
+    return hops[0] if hops else peer
+
+
+def forwarded_scheme(request: Request, trusted_proxies: list[IPNetwork]) -> str | None:
+    """Return the scheme a proxy says the client used, or None if it says none.
+
+    The leftmost X-Forwarded-Proto value is the client's, as each proxy
+    appends its own. Without trusted proxies any peer is believed, as
+    the web server is then expected to be reachable through the proxy
+    only.
+    """
+    peer = request.client.host if request.client else ""
+    if trusted_proxies and not _in_networks(peer, trusted_proxies):
+        return None
+    proto = request.headers.get("x-forwarded-proto", "").split(",")[0].strip().lower()
+    return proto if proto in ("http", "https") else None
+
+
+class LoginRateLimiter:
+    """Counts failed sign-ins per client address and per username.
+
+    A key that has failed max_failures times within the last
+    window_seconds is refused until the oldest of those failures leaves
+    the window. Counts are kept in memory only, so they are per process
+    and cleared by a restart; keys with no recent failures are evicted.
+    """
+
+    def __init__(self, max_failures: int, window_seconds: int, max_keys: int = MAX_KEYS):
+        self.max_failures = max_failures
+        self.window_seconds = window_seconds
+        self.max_keys = max_keys
+        self._failures: dict[str, deque[float]] = {}
+        self._last_sweep = time.monotonic()
+
+    @property
+    def enabled(self) -> bool:
+        return self.max_failures > 0
+
+    @staticmethod
+    def keys(address: str, username: str) -> tuple[str, str]:
+        """Return the counter keys for a sign-in attempt."""
+        return f"ip:{address}", f"user:{username.strip().lower()}"
+
+    def _recent(self, key: str, now: float) -> deque[float] | None:
+        failures = self._failures.get(key)
+        if failures is None:
+            return None
+        while failures and failures[0] <= now - self.window_seconds:
+            failures.popleft()
+        if not failures:
+            del self._failures[key]
+            return None
+        return failures
+
+    def retry_after(self, address: str, username: str) -> int:
+        """Return the seconds until an attempt is allowed, or 0 if it is now."""
+        if not self.enabled:
+            return 0
+        now = time.monotonic()
+        wait = 0.0
+        for key in self.keys(address, username):
+            failures = self._recent(key, now)
+            if failures is not None and len(failures) >= self.max_failures:
+                # The attempt is allowed once enough failures have aged out
+                oldest = failures[len(failures) - self.max_failures]
+                wait = max(wait, oldest + self.window_seconds - now)
+        return math.ceil(wait) if wait > 0 else 0
+
+    def record_failure(self, address: str, username: str) -> None:
+        """Count a failed sign-in against the address and the username."""
+        if not self.enabled:
+            return
+        now = time.monotonic()
+        for key in self.keys(address, username):
+            failures = self._failures.pop(key, None) or deque(maxlen=self.max_failures)
+            failures.append(now)
+            # Reinserted so the dict stays ordered by most recent failure
+            self._failures[key] = failures
+        self._evict(now)
+
+    def reset(self, address: str, username: str) -> None:
+        """Forget the failures of an address and username that signed in."""
+        for key in self.keys(address, username):
+            self._failures.pop(key, None)
+
+    def _evict(self, now: float) -> None:
+        if now - self._last_sweep >= self.window_seconds:
+            self._last_sweep = now
+            for key in list(self._failures):
+                self._recent(key, now)
+        while len(self._failures) > self.max_keys:
+            del self._failures[next(iter(self._failures))]
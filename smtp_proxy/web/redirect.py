@@ -0,0 +1,49 @@
+"""Plain HTTP listener that sends browsers to the HTTPS web UI."""
+
+from urllib.parse import quote
+
+
+class HTTPSRedirectApp:
+    """ASGI app answering every request with a 308 to the same URL over HTTPS.
+
+    The host comes from the request's Host header, as the name the client
+    used, with the HTTPS port in place of the one it connected to. 308
+    keeps the method and body, so a form posted over HTTP is posted again.
+    """
+
+    def __init__(self, https_port: int, default_host: str):
+        self.https_port = https_port
+        self.default_host = default_host
+
+    def location(self, scope) -> str:
+        """Return the HTTPS URL of a request."""
+        headers = dict(scope.get("headers", []))
+        host = headers.get(b"host", b"").decode("latin-1") or self.default_host
+        # Drop the port, minding the brackets of an IPv6 address
+        if host.rfind(":") > host.rfind("]"):
+            host = host[:host.rfind(":")]
+        port = "" if self.https_port == 443 else f":{self.https_port}"
+        url = f"https://{host}{port}{quote(scope['path'])}"
+        if scope.get("query_string"):
+            url += "?" + scope["query_string"].decode("latin-1")
+        return url
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] == "lifespan":
+            message = await receive()
+            while message["type"] != "lifespan.shutdown":
+                await send({"type": f"{message['type']}.complete"})
+                message = await receive()
+            await send({"type": "lifespan.shutdown.complete"})
+            return
+        if scope["type"] != "http":
+            return
+        await send({
+            "type": "http.response.start",
+            "status": 308,
+            "headers": [
+                (b"location", self.location(scope).encode("latin-1")),
+                (b"content-length", b"0"),
+            ],
+        })
+        await send({"type": "http.response.body", "body": b""})
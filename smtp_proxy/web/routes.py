@@ -1,14 +1,84 @@
 """Web routes for the SMTP Proxy UI."""
 
+import asyncio
+import json
+import logging
+import re
+import shlex
+import tempfile
+from datetime import datetime, timedelta
+from email import message_from_bytes
+from email.policy import default as email_policy
+from email.utils import format_datetime, make_msgid, parseaddr
+from urllib.parse import parse_qsl, urlencode
+
 from fastapi import APIRouter, Request, Form, HTTPException
-from fastapi.responses import HTMLResponse, RedirectResponse
+from fastapi.responses import (
+    HTMLResponse, JSONResponse, RedirectResponse, Response, StreamingResponse,
+)
 
 from .auth import SessionManager
+from .errors import ForbiddenError, NotFoundError, RedactedError, ValidationError
+from .limits import extending_deadline
+from .ratelimit import client_address
+from .. import diff, export, lint, rules, sanitize, settings, support, tracking
+from ..events import EmailEvents
+from ..database.address_repository import AddressRepository
+from ..database.api_token_repository import ApiTokenRepository
 from ..database.email_repository import EmailRepository
-from ..database.user_repository import UserRepository
+from ..database.journal_repository import JournalRepository
+from ..database.login_attempt_repository import LoginAttemptRepository
+from ..database.quota_repository import QuotaRepository, quota_day
+from ..database.rule_repository import RuleRepository
+from ..database.smtp_credential_repository import SMTPCredentialRepository
+from ..database.user_repository import UserRepository, generate_password
+from ..models import DEPRECATED_TLS_VERSIONS, Email, QuotaUsage, Rule, TLSClientUsage, User
+from ..config import MAX_PAGE_SIZE, USER_ROLES, UpstreamConfig
+from ..crypto import SecurityReport, detect
+from ..extract import (
+    attachment_filename, attachment_payloads, find_part, inline_part, message_headers, mime_tree,
+    part_filename,
+)
+from ..relay import (
+    FAILED_STATUSES,
+    SYNTHETIC_CODES,
+    RelayError,
+    deliver,
+    route_recipients,
+    source_address,
+)
+from ..senders import parse_sender_patterns, sender_pattern_error
+from ..subaddress import split_subaddress
+
+logger = logging.getLogger(__name__)
 
 router = APIRouter()
 
+# Recent MAIL FROM rejections listed on the SMTP users page
+SENDER_REJECTIONS_SHOWN = 20
+
+# Emails one zip download may hold
+MAX_ZIP_EMAILS = 200
+
+# An idle event stream gets a comment this often, so proxies do not time it out
+EVENT_KEEPALIVE_SECONDS = 15
+# How long a browser waits before reconnecting a broken event stream
+EVENT_RETRY_MS = 5000
+
+# HTML bodies are shown in a sandboxed iframe that may not run scripts,
+# submit forms or load anything but inline images and the message's own
+# parts, unless remote images are asked for
+HTML_BODY_POLICY = (
+    "default-src 'none'; img-src {images}; style-src 'unsafe-inline'; font-src data:; "
+    "form-action 'none'; base-uri 'none'; frame-ancestors 'self'; "
+    "sandbox allow-popups allow-popups-to-escape-sandbox"
+)
+# Parts viewed on their own may be sender-written HTML, so they can load nothing
+MIME_PART_POLICY = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+HTML_BODY_DOCUMENT = (
+    '<!DOCTYPE html>\n<html><head><meta charset="utf-8"></head><body>{}</body></html>'
+)
+
 
 def get_session_manager(request: Request) -> SessionManager:
     """Get session manager from app state."""
@@ -25,32 +95,129 @@ def get_user_repo(request: Request) -> UserRepository:
     return request.app.state.user_repo
 
 
-def require_auth(request: Request) -> dict:
-    """Check authentication and return session data."""
-    session_manager = get_session_manager(request)
-    session = session_manager.get_session(request)
+def get_rule_repo(request: Request) -> RuleRepository:
+    """Get rule repository from app state."""
+    return request.app.state.rule_repo
+
+
+def get_credential_repo(request: Request) -> SMTPCredentialRepository:
+    """Get SMTP credential repository from app state."""
+    return request.app.state.credential_repo
+
+
+def get_quota_repo(request: Request) -> QuotaRepository:
+    """Get SMTP quota repository from app state."""
+    return request.app.state.quota_repo
+
+
+def get_api_token_repo(request: Request) -> ApiTokenRepository:
+    """Get API token repository from app state."""
+    return request.app.state.api_token_repo
+
+
+def get_login_attempt_repo(request: Request) -> LoginAttemptRepository:
+    """Get failed sign-in repository from app state."""
+    return request.app.state.login_attempt_repo
 
+
+def get_address_repo(request: Request) -> AddressRepository:
+    """Get address repository from app state."""
+    return request.app.state.address_repo
+
+
+def get_journal_repo(request: Request) -> JournalRepository:
+    """Get journal repository from app state."""
+    return request.app.state.journal_repo
+
+
+def audit(request: Request, event: str, outcome: str = "success", actor: str = "", **data) -> None:
+    """Record a security-relevant event from a web request in the audit log."""
+    source = client_address(request, request.app.state.trusted_proxies)
+    request.app.state.audit_repo.record(event, outcome, actor, source, **data)
+
+
+def active_session(request: Request) -> dict | None:
+    """Return the session data if the request has a session of a user who may sign in.
+
+    Sessions of database users are checked against the users table on
+    every request, so deactivating or deleting a user ends their
+    sessions at once, and a changed role applies from the next request.
+    Users from other providers have no ID to check and keep the role
+    they signed in with; sessions from before roles existed are admins.
+    """
+    session = get_session_manager(request).get_session(request)
     if not session or "user_id" not in session:
+        return None
+    if session["user_id"]:
+        user = get_user_repo(request).get_by_id(session["user_id"])
+        if not user or not user.active:
+            return None
+        return {**session, "role": user.role}
+    return {**session, "role": session.get("role", "admin")}
+
+
+def require_auth(request: Request) -> dict:
+    """Check authentication and return session data.
+
+    On /api/ routes a valid bearer token, checked by the API token
+    middleware, stands in for the session; tokens are created by admins
+    and act as one.
+    """
+    api_token = getattr(request.state, "api_token", None)
+    if api_token is not None:
+        session = {
+            "user_id": 0, "username": f"token:{api_token.name}",
+            "provider": "api_token", "role": "admin",
+        }
+    else:
+        session = active_session(request)
+    if session is None:
         raise HTTPException(status_code=303, headers={"Location": "/login"})
 
+    # Read by templates to hide what the user may not do
+    request.state.role = session["role"]
+    return session
+
+
+def require_role(request: Request, role: str) -> dict:
+    """Check authentication and a role, and return session data.
+
+    Unauthenticated requests raise like require_auth; a user without the
+    role gets a 403.
+    """
+    session = require_auth(request)
+    if session["role"] != role:
+        raise ForbiddenError(f"This requires the {role} role")
     return session
 
 
+def is_admin(request: Request) -> bool:
+    """Check whether the signed-in user of a request is an admin, for templates."""
+    return getattr(request.state, "role", None) == "admin"
+
+
 @router.get("/login", response_class=HTMLResponse)
 async def login_page(request: Request):
     """Render the login page."""
-    session_manager = get_session_manager(request)
-    session = session_manager.get_session(request)
-
     # Redirect to emails if already logged in
-    if session and "user_id" in session:
+    if active_session(request):
         return RedirectResponse("/emails", status_code=303)
 
+    # Say why the user is back here, and drop the cookie so it is said once
+    session_manager = get_session_manager(request)
+    expired = session_manager.expired(request)
     templates = request.app.state.templates
-    return templates.TemplateResponse(
+    response = templates.TemplateResponse(
         "login.html",
-        {"request": request, "error": None},
+        {
+            "request": request,
+            "error": None,
+            "notice": "Your session has expired. Please sign in again." if expired else None,
+        },
     )
+    if expired:
+        session_manager.destroy_session(response)
+    return response
 
 
 @router.post("/login")
@@ -60,20 +227,98 @@ async def login_submit(
     password: str = Form(...),
 ):
     """Process login form submission."""
-    user_repo = get_user_repo(request)
     session_manager = get_session_manager(request)
     templates = request.app.state.templates
+    limiter = request.app.state.login_limiter
+    address = client_address(request, request.app.state.trusted_proxies)
+
+    # Refused before the password is checked, so guessing gains nothing
+    retry_after = limiter.retry_after(address, username)
+    if retry_after:
+        logger.warning(
+            f"Rate limited login for user {username} from {address}, retry in {retry_after}s"
+        )
+        audit(request, "web.login", "failure", username, reason="rate_limited")
+        return templates.TemplateResponse(
+            "login.html",
+            {
+                "request": request,
+                "error": f"Too many failed sign-ins. Try again in {retry_after} seconds.",
+            },
+            status_code=429,
+            headers={"Retry-After": str(retry_after)},
+        )
 
-    user = user_repo.get_by_username(username)
-    if not user or not user_repo.verify_password(user, password):
+    # A locked username gets the same answer as a wrong password, without
+    # the password being checked, so neither the lock nor the account is
+    # confirmed to exist
+    web_config = request.app.state.config.web
+    attempts = get_login_attempt_repo(request)
+    locked = attempts.locked_until(username) is not None
+    result = None if locked else request.app.state.auth_providers.authenticate(username, password)
+    if result is None:
+        limiter.record_failure(address, username)
+        locked_until = attempts.record_failure(
+            username, address, web_config.lockout_failures, web_config.lockout_minutes
+        )
+        if locked:
+            logger.warning(f"Refused login for locked user {username} from {address}")
+            audit(request, "web.login", "failure", username, reason="locked")
+        else:
+            logger.info(f"Failed login for user {username}")
+            audit(request, "web.login", "failure", username)
+        if locked_until:
+            logger.warning(
+                f"Locked user {username} until {locked_until:%Y-%m-%d %H:%M:%S} after "
+                f"{web_config.lockout_failures} consecutive failed logins, the last from {address}"
+            )
+            audit(
+                request, "web.lockout", actor=username,
+                failures=web_config.lockout_failures,
+                locked_until=locked_until.isoformat(timespec="seconds"),
+            )
         return templates.TemplateResponse(
             "login.html",
             {"request": request, "error": "Invalid username or password"},
             status_code=401,
         )
 
+    user, provider = result
+    limiter.reset(address, username)
+    attempts.reset(username)
+    logger.info(f"User {user.username} signed in via the {provider.name} provider")
+    audit(request, "web.login", "success", user.username, provider=provider.name)
+    response = RedirectResponse("/emails", status_code=303)
+    session_manager.create_session(
+        request, response, user.id, user.username, provider.name, user.role
+    )
+    return response
+
+
+@router.get("/login/magic", response_class=HTMLResponse)
+async def magic_login(request: Request, token: str = ""):
+    """Sign in with a one-time login link."""
+    magic_links = request.app.state.magic_links
+    if magic_links is None:
+        raise NotFoundError()
+
+    user_id = magic_links.verify(token)
+    user = get_user_repo(request).get_by_id(user_id) if user_id is not None else None
+    if not user or not user.active:
+        audit(request, "web.login", "failure", provider="magic_link")
+        templates = request.app.state.templates
+        return templates.TemplateResponse(
+            "login.html",
+            {"request": request, "error": "This login link is invalid, expired or already used"},
+            status_code=401,
+        )
+
+    logger.info(f"User {user.username} signed in with a magic login link")
+    audit(request, "web.login", "success", user.username, provider="magic_link")
     response = RedirectResponse("/emails", status_code=303)
-    session_manager.create_session(response, user.id, user.username)
+    get_session_manager(request).create_session(
+        request, response, user.id, user.username, "magic_link", user.role
+    )
     return response
 
 
@@ -86,6 +331,38 @@ async def logout(request: Request):
     return response
 
 
+@router.get("/readyz")
+async def readyz(request: Request):
+    """Report readiness and the current operating mode."""
+    config = request.app.state.config
+    email_repo = get_email_repo(request)
+    status = {
+        "status": "ok",
+        "instance_id": config.instance_id,
+        "read_only": config.read_only,
+        "components": config.components,
+        "background_jobs": config.background_jobs,
+        "aggregate_cache": email_repo.cache.stats(),
+        "storage": email_repo.db.breaker.stats(),
+    }
+    if request.app.state.replicator:
+        status["replica"] = request.app.state.replicator.stats()
+    if request.app.state.siem:
+        status["siem"] = request.app.state.siem.stats()
+    if request.app.state.smtp_server:
+        status["smtp"] = request.app.state.smtp_server.stats()
+    try:
+        email_repo.count()
+    except Exception as e:
+        status["status"] = "unavailable"
+        status["error"] = str(e)
+        return JSONResponse(status, status_code=503)
+    if email_repo.db.breaker.is_open:
+        status["status"] = "unavailable"
+        return JSONResponse(status, status_code=503)
+    return status
+
+
 @router.get("/", response_class=HTMLResponse)
 async def root(request: Request):
     """Redirect to emails page."""
@@ -96,9 +373,111 @@ async def root(request: Request):
     return RedirectResponse("/emails", status_code=303)
 
 
+SEARCH_OPERATORS = ("filename", "to", "from", "canonical", "auth", "has", "label", "mailbox")
+
+# since= and until= also take a time ago, such as 30m, 1h, 7d or 2w
+RELATIVE_TIME = re.compile(r"^(\d+)\s*([mhdw])$", re.IGNORECASE)
+RELATIVE_UNITS = {"m": "minutes", "h": "hours", "d": "days", "w": "weeks"}
+
+
+def parse_time_bound(name: str, value: str, end: bool = False) -> datetime | None:
+    """Parse a since= or until= filter into a local time, or None when empty.
+
+    Accepts an ISO date or date and time, or a time ago like 1h. A date
+    alone means its start, or with end the start of the next day, so
+    until=2026-10-15 includes that day.
+    """
+    value = value.strip()
+    if not value:
+        return None
+    relative = RELATIVE_TIME.match(value)
+    if relative:
+        amount, unit = int(relative.group(1)), relative.group(2).lower()
+        return datetime.now() - timedelta(**{RELATIVE_UNITS[unit]: amount})
+    try:
+        parsed = datetime.fromisoformat(value)
+    except ValueError:
+        raise ValidationError(
+            f"Invalid {name} {value!r}: use a date like 2026-10-15, a date and time "
+            "like 2026-10-15T09:30, or a time ago like 30m, 1h, 7d or 2w"
+        )
+    if parsed.tzinfo is not None:
+        # Emails are stored with the server's local time
+        parsed = parsed.astimezone().replace(tzinfo=None)
+    if end and len(value) == len("2026-10-15"):
+        parsed += timedelta(days=1)
+    return parsed
+
+
+def page_bounds(total: int, page: int, per_page: int) -> tuple[int, int]:
+    """Clamp a page number into range, returning it and the number of pages."""
+    pages = max(1, -(-total // per_page))
+    return min(max(page, 1), pages), pages
+
+
+def app_url(request: Request, path: str) -> str:
+    """Return the URL of a path of the UI for a page, under web.base_path.
+
+    Redirects need none of this: their Location gets the base path from
+    the base path middleware.
+    """
+    return request.app.state.config.web.base_path + path
+
+
+def list_url(back: str) -> str:
+    """Return the email list URL for a query string saved from the list page.
+
+    The query is parsed and re-encoded, so it can only ever add filters
+    to /emails and never redirect anywhere else.
+    """
+    query = urlencode(parse_qsl(back))
+    return f"/emails?{query}" if query else "/emails"
+
+
+def email_filters(request: Request) -> dict:
+    """Read the email list's search box and filters from the query string.
+
+    The result holds the keyword arguments of EmailRepository.search.
+    """
+    query = request.query_params.get("q", "").strip()
+    text, operators = parse_search(query)
+    filename = request.query_params.get("filename", "").strip() or operators.get("filename", "")
+    recipient = request.query_params.get("recipient", "").strip() or operators.get("to", "")
+    sender = request.query_params.get("sender", "").strip() or operators.get("from", "")
+    canonical = request.query_params.get("canonical", "").strip() or operators.get("canonical", "")
+    auth_user = request.query_params.get("auth_user", "").strip() or operators.get("auth", "")
+    has_tracking = request.query_params.get("tracking") == "1" or (
+        operators.get("has", "").lower() == "tracking"
+    )
+    status = request.query_params.get("status", "").strip()
+    since = parse_time_bound("since", request.query_params.get("since", ""))
+    until = parse_time_bound("until", request.query_params.get("until", ""), end=True)
+    label = request.query_params.get("label", "").strip() or operators.get("label", "")
+    mailbox = request.query_params.get("mailbox", "").strip() or operators.get("mailbox", "")
+    return {
+        "text": text,
+        "filename": filename,
+        "recipient": recipient,
+        "sender": sender,
+        "canonical": canonical,
+        "auth_user": auth_user,
+        "has_tracking": has_tracking,
+        "status": status,
+        "since": since,
+        "until": until,
+        "label": label,
+        "mailbox": mailbox,
+    }
+
+
 @router.get("/emails", response_class=HTMLResponse)
-async def email_list(request: Request):
-    """Display the list of all emails."""
+async def email_list(request: Request, page: int = 1, per_page: int = 0):
+    """Display one page of the emails, optionally narrowed by a search and filters.
+
+    status, label, mailbox, since and until narrow the list further; see
+    parse_time_bound for the times accepted. per_page defaults to
+    web.page_size; it and page are clamped into range rather than refused.
+    """
     try:
         session = require_auth(request)
     except HTTPException:
@@ -107,8 +486,37 @@ async def email_list(request: Request):
     email_repo = get_email_repo(request)
     templates = request.app.state.templates
 
-    emails = email_repo.get_all()
-    email_count = len(emails)
+    query = request.query_params.get("q", "").strip()
+    filters = email_filters(request)
+    text, filename, status = filters["text"], filters["filename"], filters["status"]
+    auth_user, has_tracking = filters["auth_user"], filters["has_tracking"]
+    since, until = filters["since"], filters["until"]
+    label, mailbox = filters["label"], filters["mailbox"]
+    searching = any(filters.values())
+    email_count = email_repo.search_count(**filters) if searching else email_repo.count()
+    if not per_page:
+        per_page = request.app.state.config.web.page_size
+    per_page = min(max(per_page, 1), MAX_PAGE_SIZE)
+    page, pages = page_bounds(email_count, page, per_page)
+    offset = (page - 1) * per_page
+    if searching:
+        emails = email_repo.search(**filters, limit=per_page, offset=offset)
+    else:
+        emails = email_repo.get_page(per_page, offset)
+
+    statuses = email_repo.statuses()
+    if status and status not in statuses:
+        statuses.append(status)
+
+    def page_url(number: int) -> str:
+        return app_url(request, "/emails?" + urlencode({**request.query_params, "page": number}))
+
+    matched_attachments = {
+        email.id: email.attachments_matching(filename or text) for email in emails
+    }
+    content_matches = email_repo.attachment_text_matches([email.id for email in emails], text)
+    snippets = email_repo.body_snippets([email.id for email in emails], text)
+    security = {email.id: SecurityReport.from_summary(email.security) for email in emails}
 
     return templates.TemplateResponse(
         "emails.html",
@@ -116,59 +524,2131 @@ async def email_list(request: Request):
             "request": request,
             "emails": emails,
             "email_count": email_count,
+            "total_count": email_repo.count() if searching else email_count,
+            "page": page,
+            "pages": pages,
+            "first_shown": offset + 1 if emails else 0,
+            "last_shown": offset + len(emails),
+            "list_query": urlencode(request.query_params),
+            "prev_url": page_url(page - 1) if page > 1 else "",
+            "next_url": page_url(page + 1) if page < pages else "",
+            "query": query,
+            "auth_user": auth_user,
+            "auth_users": email_repo.auth_users(),
+            "has_tracking": has_tracking,
+            "status": status,
+            "statuses": statuses,
+            "label": label,
+            "labels": email_repo.labels(),
+            "mailbox": mailbox,
+            "mailboxes": email_repo.mailboxes(),
+            "since": since,
+            "until": until,
+            "tracking_url": app_url(request, "/emails?" + urlencode({
+                **{name: request.query_params.get(name, "") for name in ("since", "until")},
+                "q": query,
+                "auth_user": auth_user,
+                "status": status,
+                "label": label,
+                "mailbox": mailbox,
+                "tracking": "" if has_tracking else "1",
+            })),
+            "matched_attachments": matched_attachments,
+            "content_matches": content_matches,
+            "snippets": snippets,
+            "security": security,
+            "journal_retention_days": request.app.state.config.database.journal_retention_days,
+            "preview_marks_read": request.app.state.config.web.preview_marks_read,
             "username": session.get("username"),
         },
     )
 
 
-@router.get("/emails/{email_id}", response_class=HTMLResponse)
-async def email_detail(request: Request, email_id: int):
-    """Display a single email's details."""
+def server_sent_event(event: str, data: dict, event_id: int | None = None) -> str:
+    """Format one server-sent event."""
+    lines = [f"id: {event_id}"] if event_id is not None else []
+    lines += [f"event: {event}", f"data: {json.dumps(data)}"]
+    return "\n".join(lines) + "\n\n"
+
+
+async def email_event_stream(events: EmailEvents):
+    """Yield new emails as server-sent events until the broadcaster is closed.
+
+    The client is only subscribed once the response starts streaming. A
+    client that fell behind is sent a dropped event with the number of
+    emails it missed.
+    """
+    subscription = events.subscribe()
+    try:
+        yield f"retry: {EVENT_RETRY_MS}\n\n"
+        while True:
+            try:
+                event = await asyncio.wait_for(subscription.get(), EVENT_KEEPALIVE_SECONDS)
+            except asyncio.TimeoutError:
+                yield ": keepalive\n\n"
+                continue
+            if event is None:
+                return
+            yield server_sent_event("email", event.to_dict(), event.id)
+            dropped = subscription.take_dropped()
+            if dropped:
+                yield server_sent_event("dropped", {"count": dropped})
+    finally:
+        events.unsubscribe(subscription)
+
+
+@router.get("/events")
+async def email_events(request: Request):
+    """Stream each email stored from now on as a server-sent event for the email list."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    return StreamingResponse(
+        email_event_stream(request.app.state.events),
+        media_type="text/event-stream",
+        # Buffering by a reverse proxy would hold events back until it fills
+        headers={"Cache-Control": "no-cache", "X-Accel-Buffering": "no"},
+    )
+
+
+@router.get("/emails/export.mbox")
+async def export_mbox(request: Request):
+    """Download the emails matching the list page's search and filters as an mboxrd file."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    emails = get_email_repo(request).iter_search(**email_filters(request))
+    instance_id = request.app.state.config.instance_id
+    filename = f"smtp-proxy-emails-{instance_id}-{datetime.now():%Y%m%d-%H%M%S}.mbox"
+    timeout = request.app.state.config.web.request_timeout_seconds
+    return StreamingResponse(
+        extending_deadline(request, export.mbox_chunks(emails), timeout),
+        media_type="application/mbox",
+        headers={"Content-Disposition": f'attachment; filename="{filename}"'},
+    )
+
+
+@router.post("/emails/export.zip")
+async def export_zip(request: Request):
+    """Download the emails ticked on the list page as a zip of .eml files."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    values = (await request.form()).getlist("id")
+    if not values:
+        raise ValidationError("Select at least one email to download")
+    if not all(str(value).isdigit() for value in values):
+        raise ValidationError("Email IDs must be numbers")
+    email_ids = sorted({int(value) for value in values})
+    if len(email_ids) > MAX_ZIP_EMAILS:
+        raise ValidationError(
+            f"{len(email_ids)} emails were selected, but at most {MAX_ZIP_EMAILS} can be "
+            "downloaded at once; export a filtered list as mbox instead"
+        )
+
+    email_repo = get_email_repo(request)
+    stored = email_repo.raw_stored(email_ids)
+    missing = [str(email_id) for email_id in email_ids if email_id not in stored]
+    if missing:
+        raise NotFoundError(f"Emails not found: {', '.join(missing)}")
+    withheld = [str(email_id) for email_id, has_raw in stored.items() if not has_raw]
+    if withheld:
+        raise RedactedError(
+            f"Emails {', '.join(withheld)} cannot be downloaded: their raw messages were not "
+            "stored because privacy.store_raw is off"
+        )
+
+    config = request.app.state.config
+    filename = f"smtp-proxy-emails-{config.instance_id}-{datetime.now():%Y%m%d-%H%M%S}.zip"
+    chunks = export.zip_chunks(email_repo.iter_by_ids(email_ids), email_repo.open_raw)
+    return StreamingResponse(
+        extending_deadline(request, chunks, config.web.request_timeout_seconds),
+        media_type="application/zip",
+        headers={"Content-Disposition": f'attachment; filename="{filename}"'},
+    )
+
+
+def parse_search(query: str) -> tuple[str, dict[str, str]]:
+    """Split a search box query into free text and operator values.
+
+    Supported operators are listed in SEARCH_OPERATORS, e.g. filename:invoice.pdf.
+    """
+    try:
+        tokens = shlex.split(query)
+    except ValueError:
+        tokens = query.split()
+    text = []
+    operators: dict[str, str] = {}
+    for token in tokens:
+        name, sep, value = token.partition(":")
+        if sep and name.lower() in SEARCH_OPERATORS:
+            operators[name.lower()] = value
+        else:
+            text.append(token)
+    return " ".join(text), operators
+
+
+COMPARE_HEADERS = ("From", "To", "Cc", "Reply-To", "Subject", "Date", "Content-Type")
+
+
+def extract_html(raw_message: bytes) -> str:
+    """Return the first text/html part of a message, or an empty string."""
+    try:
+        msg = message_from_bytes(raw_message, policy=email_policy)
+        part = msg.get_body(preferencelist=("html",))
+        return part.get_content() if part else ""
+    except Exception:
+        return ""
+
+
+def compare_sections(a: Email, b: Email) -> list[dict]:
+    """Diff the headers of interest, text bodies and HTML of two emails."""
+    def headers(email: Email) -> str:
+        try:
+            msg = message_from_bytes(email.raw_message, policy=email_policy)
+        except Exception:
+            return ""
+        return "\n".join(
+            f"{name}: {value}" for name in COMPARE_HEADERS for value in msg.get_all(name, [])
+        )
+
+    return [
+        {"name": "Headers", "diff": diff.diff_text(headers(a), headers(b))},
+        {"name": "Text Body", "diff": diff.diff_text(a.body, b.body)},
+        {
+            "name": "HTML Source",
+            "diff": diff.diff_text(extract_html(a.raw_message), extract_html(b.raw_message)),
+        },
+    ]
+
+
+def require_raw_message(email: Email, action: str) -> None:
+    """Refuse an action that needs the raw message of an email stored without it."""
+    if email.raw_redacted:
+        raise RedactedError(
+            f"Email {email.id} cannot be {action}: its raw message was not stored "
+            "because privacy.store_raw is off"
+        )
+
+
+def compare_ids(request: Request) -> tuple[int, int] | None:
+    """Read the two email IDs to compare from ?a=&b= or repeated ?id=."""
+    params = request.query_params
+    values = [params.get("a"), params.get("b")]
+    if not all(values):
+        values = params.getlist("id")
+    if len(values) != 2 or not all(str(v).isdigit() for v in values):
+        return None
+    return int(values[0]), int(values[1])
+
+
+@router.get("/emails/compare", response_class=HTMLResponse)
+async def email_compare(request: Request):
+    """Display a diff of two emails."""
     try:
         session = require_auth(request)
     except HTTPException:
         return RedirectResponse("/login", status_code=303)
 
+    ids = compare_ids(request)
+    if not ids:
+        raise ValidationError("Select exactly two emails to compare")
+
     email_repo = get_email_repo(request)
+    a, b = email_repo.get_by_id(ids[0]), email_repo.get_by_id(ids[1])
+    if not a or not b:
+        raise NotFoundError("Email not found")
+    require_raw_message(a, "compared")
+    require_raw_message(b, "compared")
+
+    mode = "unified" if request.query_params.get("mode") == "unified" else "side"
     templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "compare.html",
+        {
+            "request": request,
+            "a": a,
+            "b": b,
+            "mode": mode,
+            "sections": compare_sections(a, b),
+            "max_chars": diff.MAX_DIFF_CHARS,
+            "username": session.get("username"),
+        },
+    )
+
+
+@router.get("/emails/compare.json")
+async def email_compare_json(request: Request):
+    """Return a diff of two emails as JSON."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    ids = compare_ids(request)
+    if not ids:
+        raise ValidationError("Select exactly two emails to compare")
 
+    email_repo = get_email_repo(request)
+    a, b = email_repo.get_by_id(ids[0]), email_repo.get_by_id(ids[1])
+    if not a or not b:
+        raise NotFoundError("Email not found")
+    require_raw_message(a, "compared")
+    require_raw_message(b, "compared")
+
+    return {
+        "a": a.id,
+        "b": b.id,
+        "sections": {
+            section["name"]: section["diff"].to_dict() for section in compare_sections(a, b)
+        },
+    }
+
+
+# Characters of body text shown in the list page's preview pane
+PREVIEW_BODY_CHARS = 2000
+
+
+def email_detail_context(request: Request, email_id: int) -> dict:
+    """Assemble the data shown for one email on its detail page and preview."""
+    email_repo = get_email_repo(request)
     email = email_repo.get_by_id(email_id)
     if not email:
-        raise HTTPException(status_code=404, detail="Email not found")
+        raise NotFoundError("Email not found")
+
+    separators = request.app.state.config.smtp.subaddress_separators
+    return {
+        "email": email,
+        "recipients": [
+            (recipient, *split_subaddress(recipient, separators))
+            for recipient in email.recipients
+        ],
+        # Checks read the headers, which are gone with the raw message
+        "lint": None if email.raw_redacted else lint.run_checks(email),
+        "history": get_journal_repo(request).for_email(email_id),
+        "delivery_attempts": email_repo.get_delivery_attempts(email_id),
+        "attachment_texts": {
+            text.index: text for text in email_repo.get_attachment_texts(email_id)
+        },
+        "attachment_filenames": [
+            attachment_filename(attachment, index)
+            for index, attachment in enumerate(email.attachments)
+        ],
+        "synthetic_codes": SYNTHETIC_CODES,
+        "tracking_titles": tracking.KIND_TITLES,
+        "security": detect(email.raw_message),
+        "persist_decrypted": request.app.state.config.crypto.persist_decrypted,
+    }
+
+
+async def inspect_security(request: Request, email: Email) -> SecurityReport | None:
+    """Verify and decrypt a signed or encrypted email with the configured keys.
+
+    The decrypted text is only returned for rendering, unless
+    crypto.persist_decrypted asks for it to replace the stored body.
+    """
+    report = await asyncio.to_thread(request.app.state.crypto.inspect, email.raw_message)
+    if report and report.decrypted and report.body and report.body != email.body:
+        if request.app.state.config.crypto.persist_decrypted and not email.body_redacted:
+            get_email_repo(request).update_body(email.id, report.body)
+            logger.info(f"Stored decrypted body of email {email.id}")
+    return report
+
+
+@router.get("/emails/{email_id}", response_class=HTMLResponse)
+async def email_detail(request: Request, email_id: int):
+    """Display a single email's details."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
 
+    context = email_detail_context(request, email_id)
+    if context["security"]:
+        context["security"] = await inspect_security(request, context["email"])
+    email = context["email"]
+    html = "" if email.raw_redacted else extract_html(email.raw_message)
+    tree = None if email.raw_redacted else mime_tree(email.raw_message)
+    templates = request.app.state.templates
     return templates.TemplateResponse(
         "email_detail.html",
         {
             "request": request,
-            "email": email,
+            **context,
+            "has_html": bool(html),
+            "remote_blocked": sanitize.sanitize_html(html).blocked if html else 0,
+            "mime_parts": tree.flatten() if tree else [],
+            "headers": [] if email.raw_redacted else message_headers(email.raw_message),
+            "back": request.query_params.get("back", ""),
+            "list_url": app_url(request, list_url(request.query_params.get("back", ""))),
             "username": session.get("username"),
         },
     )
 
 
-@router.post("/emails/{email_id}/mark-read")
-async def mark_email_read(request: Request, email_id: int):
-    """Mark an email as read."""
+@router.get("/emails/{email_id}/attachments/{index}")
+async def email_attachment(request: Request, email_id: int, index: int):
+    """Download one attachment of an email, counting from 0 in attachment order."""
     try:
         require_auth(request)
     except HTTPException:
         return RedirectResponse("/login", status_code=303)
 
-    email_repo = get_email_repo(request)
-    email_repo.update_status(email_id, "read")
+    email = get_email_repo(request).get_by_id(email_id)
+    if not email:
+        raise NotFoundError("Email not found")
+    require_raw_message(email, "have its attachments downloaded")
+    payloads = attachment_payloads(email.raw_message)
+    if not 0 <= index < len(payloads):
+        raise NotFoundError(f"Email {email_id} has no attachment {index}")
 
-    return RedirectResponse(f"/emails/{email_id}", status_code=303)
+    attachment, content, charset = payloads[index]
+    media_type = attachment["content_type"]
+    if charset and media_type.startswith("text/"):
+        media_type += f"; charset={charset}"
+    return Response(
+        content,
+        media_type=media_type,
+        headers={
+            "Content-Disposition": export.content_disposition(
+                attachment_filename(attachment, index)
+            ),
+            # Attachments are sender-controlled, so never render them as part of the app
+            "Content-Security-Policy": "sandbox",
+            "X-Content-Type-Options": "nosniff",
+        },
+    )
 
 
-@router.post("/emails/wipe")
-async def wipe_emails(request: Request):
-    """Delete all emails."""
+@router.get("/emails/{email_id}/parts/{path}")
+async def email_part(request: Request, email_id: int, path: str, download: bool = False):
+    """View or download one part of an email's MIME tree by its dotted path, e.g. 1.2.
+
+    Leaf parts are served decoded with their own content type, and
+    multiparts and attached messages as their source text.
+    """
+    try:
+        require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    email = get_email_repo(request).get_by_id(email_id)
+    if not email:
+        raise NotFoundError("Email not found")
+    require_raw_message(email, "split into parts")
+    part = find_part(email.raw_message, path)
+    if part is None:
+        raise NotFoundError(f"Email {email_id} has no part {path}")
+
+    try:
+        if part.is_multipart():
+            content, media_type, saved_as = part.as_bytes(), "text/plain", "message/rfc822"
+        else:
+            content, media_type = part.get_payload(decode=True) or b"", part.get_content_type()
+            saved_as = media_type
+            if media_type.startswith("text/") and part.get_content_charset():
+                media_type += f"; charset={part.get_content_charset()}"
+        filename = part_filename(str(part.get_filename() or ""), path, saved_as)
+    except Exception as e:
+        raise ValidationError(f"Part {path} of email {email_id} could not be decoded: {e}")
+
+    return Response(
+        content,
+        media_type=media_type,
+        headers={
+            "Content-Disposition": export.content_disposition(
+                filename, "attachment" if download else "inline"
+            ),
+            "Content-Security-Policy": MIME_PART_POLICY,
+            "X-Content-Type-Options": "nosniff",
+        },
+    )
+
+
+@router.get("/emails/{email_id}/inline/{content_id:path}")
+async def email_inline_image(request: Request, email_id: int, content_id: str):
+    """Serve the image part an HTML body refers to as cid:content_id.
+
+    Only images are served, so Content-IDs cannot be used to fetch other
+    parts of a message through this route.
+    """
+    try:
+        require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    email = get_email_repo(request).get_by_id(email_id)
+    if not email:
+        raise NotFoundError("Email not found")
+    require_raw_message(email, "shown as HTML")
+    found = inline_part(email.raw_message, content_id)
+    if not found:
+        raise NotFoundError(f"Email {email_id} has no part with Content-ID {content_id}")
+    content_type, content = found
+    if not content_type.startswith("image/"):
+        raise ForbiddenError(f"Content-ID {content_id} is {content_type}, not an image")
+
+    return Response(
+        content,
+        media_type=content_type,
+        headers={"Content-Security-Policy": "sandbox", "X-Content-Type-Options": "nosniff"},
+    )
+
+
+@router.get("/emails/{email_id}/html", response_class=HTMLResponse)
+async def email_html(request: Request, email_id: int, images: bool = False):
+    """Serve an email's sanitized HTML body for the detail page's sandboxed iframe.
+
+    Remote images stay blocked unless images is set.
+    """
+    try:
+        require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    email = get_email_repo(request).get_by_id(email_id)
+    if not email:
+        raise NotFoundError("Email not found")
+    require_raw_message(email, "shown as HTML")
+    html = extract_html(email.raw_message)
+    if not html:
+        raise NotFoundError(f"Email {email_id} has no HTML body")
+
+    body = sanitize.sanitize_html(
+        html, allow_remote=images, inline_base=app_url(request, f"/emails/{email_id}/inline/")
+    ).html
+    return HTMLResponse(
+        HTML_BODY_DOCUMENT.format(body),
+        headers={
+            "Content-Security-Policy": HTML_BODY_POLICY.format(
+                images="'self' data: http: https:" if images else "'self' data:"
+            ),
+            "Referrer-Policy": "no-referrer",
+            "X-Content-Type-Options": "nosniff",
+        },
+    )
+
+
+@router.get("/emails/{email_id}/preview", response_class=HTMLResponse)
+async def email_preview(request: Request, email_id: int):
+    """Render the summary fragment loaded into the list page's preview pane."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "email_preview.html",
+        {
+            "request": request,
+            **email_detail_context(request, email_id),
+            "preview_chars": PREVIEW_BODY_CHARS,
+        },
+    )
+
+
+@router.get("/emails/{email_id}/lint")
+async def email_lint(request: Request, email_id: int):
+    """Return the deliverability checklist for an email as JSON."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    email = get_email_repo(request).get_by_id(email_id)
+    if not email:
+        raise NotFoundError("Email not found")
+    require_raw_message(email, "checked")
+
+    report = lint.run_checks(email)
+    return {
+        "email_id": email.id,
+        "score": report.score,
+        "passed": not report.failures,
+        "findings": [finding.__dict__ for finding in report.findings],
+    }
+
+
+def download_filename(email: Email, extension: str) -> str:
+    """Name a downloaded email after its ID and subject."""
+    subject = export.subject_slug(email)
+    return f"email-{email.id}-{subject}.{extension}" if subject else f"email-{email.id}.{extension}"
+
+
+@router.get("/emails/{email_id}/raw")
+async def email_raw(request: Request, email_id: int):
+    """Download an email's raw message as a .eml file."""
     try:
         require_auth(request)
     except HTTPException:
         return RedirectResponse("/login", status_code=303)
 
     email_repo = get_email_repo(request)
-    email_repo.delete_all()
+    email = email_repo.get_by_id(email_id)
+    if not email:
+        raise NotFoundError("Email not found")
+    require_raw_message(email, "downloaded")
+
+    filename = download_filename(email, "eml")
+    return StreamingResponse(
+        export.read_chunks(email_repo.open_raw(email)),
+        media_type="message/rfc822",
+        headers={"Content-Disposition": f'attachment; filename="{filename}"'},
+    )
+
+
+@router.post("/emails/{email_id}/mark-read")
+async def mark_email_read(request: Request, email_id: int):
+    """Mark an email as read."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    email_repo = get_email_repo(request)
+    email_repo.update_status(email_id, "read", actor=session.get("username"))
+
+    return RedirectResponse(f"/emails/{email_id}", status_code=303)
+
+
+@router.post("/emails/{email_id}/mark-unread")
+async def mark_email_unread(request: Request, email_id: int, back: str = Form("")):
+    """Mark an email as unread and return to the list page it was opened from."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    if not get_email_repo(request).update_status(
+        email_id, "received", actor=session.get("username")
+    ):
+        raise NotFoundError("Email not found")
+
+    return RedirectResponse(list_url(back), status_code=303)
+
+
+@router.post("/emails/mark-all-read")
+async def mark_all_emails_read(request: Request, back: str = Form("")):
+    """Mark every unread email as read, keeping the list's page and filters."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    get_email_repo(request).update_status_all("received", "read", actor=session.get("username"))
+
+    return RedirectResponse(list_url(back), status_code=303)
+
+
+@router.post("/emails/{email_id}/delete")
+async def delete_email(request: Request, email_id: int):
+    """Delete one email and return to the list."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    if not get_email_repo(request).delete(email_id, actor=session.get("username")):
+        raise NotFoundError("Email not found")
+    audit(
+        request, "emails.delete", actor=session.get("username"),
+        count=1, email_ids=[email_id], via="detail",
+    )
+    return RedirectResponse("/emails", status_code=303)
+
+
+def parse_target_address(value: str) -> str | None:
+    """Return the bare address from a form field, or None if it is not one."""
+    _, address = parseaddr(value.strip())
+    if not address or "@" not in address or address.startswith("@") or address.endswith("@"):
+        return None
+    return address
+
+
+async def send_copy(
+    request: Request,
+    session: dict,
+    email_id: int,
+    action: str,
+    upstream: UpstreamConfig,
+    sender: str,
+    recipient: str,
+    raw_message: bytes,
+) -> dict:
+    """Send a copy of an email to one recipient and journal the outcome.
+
+    Returns ok, code and response for display; code is a label for
+    failures without an SMTP reply.
+    """
+    local_address = request.app.state.config.smtp.relay.local_address
+    target = f"{upstream.host}:{upstream.port}"
+    source = source_address(upstream, local_address)
+    if source:
+        target += f" from {source}"
+    try:
+        code, response = await asyncio.to_thread(
+            deliver, upstream, sender, [recipient], raw_message, local_address=local_address
+        )
+        ok = True
+    except RelayError as e:
+        code, response = e.code, e.response
+        ok = False
+    label = SYNTHETIC_CODES.get(code, code)
+    detail = f"to {recipient} via {target}: {label} {response}"
+    logger.info(f"{action.capitalize()} of email {email_id} {detail}")
+    get_journal_repo(request).record(email_id, action, session.get("username", ""), detail)
+    return {"ok": ok, "code": label, "response": response}
+
+
+@router.post("/emails/{email_id}/release", response_class=HTMLResponse)
+async def release_email(request: Request, email_id: int):
+    """Re-submit a stored email to an SMTP server given in the form.
+
+    The stored message is sent unchanged with its original sender; the
+    attempt and the server's reply are added to the email's history.
+    """
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    context = email_detail_context(request, email_id)
+    email = context["email"]
+    form = await request.form()
+    release = {
+        "host": (form.get("host") or "").strip(),
+        "port": (form.get("port") or "25").strip(),
+        "security": form.get("security") or "none",
+        "username": (form.get("username") or "").strip(),
+        "recipient": (form.get("recipient") or "").strip(),
+        "errors": [],
+    }
+
+    if not release["host"]:
+        release["errors"].append("SMTP host is required")
+    if not release["port"].isdigit() or not 1 <= int(release["port"]) <= 65535:
+        release["errors"].append("Port must be between 1 and 65535")
+    if release["security"] not in ("none", "starttls", "tls"):
+        release["errors"].append("Unknown connection security")
+    recipient = parse_target_address(release["recipient"])
+    if not recipient:
+        release["errors"].append("Recipient must be an email address")
+    if email.raw_redacted:
+        release["errors"].append(
+            "The raw message was not stored (privacy.store_raw is off), so it cannot be released"
+        )
+
+    status_code = 200
+    if release["errors"]:
+        status_code = 400
+    else:
+        upstream = UpstreamConfig(
+            host=release["host"],
+            port=int(release["port"]),
+            starttls=release["security"] == "starttls",
+            implicit_tls=release["security"] == "tls",
+            username=release["username"],
+            password=form.get("password") or "",
+        )
+        release.update(
+            await send_copy(
+                request, session, email_id, "release", upstream,
+                email.sender, recipient, email.raw_message,
+            )
+        )
+        context["history"] = get_journal_repo(request).for_email(email_id)
+
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "email_detail.html",
+        {
+            "request": request,
+            **context,
+            "release": release,
+            "username": session.get("username"),
+        },
+        status_code=status_code,
+    )
+
+
+def resent_message(raw_message: bytes, resent_from: str, resent_to: str, domain: str) -> bytes:
+    """Prepend an RFC 5322 resent block to a raw message, leaving it otherwise unchanged."""
+    newline = b"\r\n" if b"\r\n" in raw_message else b"\n"
+    headers = [
+        f"Resent-From: {resent_from}",
+        f"Resent-To: {resent_to}",
+        f"Resent-Date: {format_datetime(datetime.now().astimezone())}",
+        f"Resent-Message-ID: {make_msgid(domain=domain)}",
+    ]
+    return newline.join(header.encode() for header in headers) + newline + raw_message
+
+
+@router.post("/emails/{email_id}/forward", response_class=HTMLResponse)
+async def forward_email(request: Request, email_id: int):
+    """Forward a stored email to an address through the configured upstream.
+
+    The raw message gets Resent-* headers and is sent with its original
+    sender to the given address only; the route is chosen by the
+    address's domain like relayed mail.
+    """
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    config = request.app.state.config
+    context = email_detail_context(request, email_id)
+    email = context["email"]
+    form = await request.form()
+    forward = {"recipient": (form.get("recipient") or "").strip(), "errors": []}
+
+    recipient = parse_target_address(forward["recipient"])
+    upstream = None
+    if email.raw_redacted:
+        forward["errors"].append(
+            "The raw message was not stored (privacy.store_raw is off), so it cannot be forwarded"
+        )
+    elif not recipient:
+        forward["errors"].append("Forward address must be an email address")
+    else:
+        default = config.smtp.upstream if config.smtp.upstream.host else None
+        groups, _ = route_recipients([recipient], config.smtp.relay.routes, default)
+        if groups:
+            upstream = groups[0][1]
+        else:
+            forward["errors"].append(
+                f"No upstream SMTP server is configured for {recipient.rpartition('@')[2]}; "
+                "set smtp.upstream or a matching smtp.relay.routes entry"
+            )
+
+    status_code = 200
+    if forward["errors"]:
+        status_code = 400
+    else:
+        username = session.get("username", "")
+        raw_message = resent_message(
+            email.raw_message, f"{username}@{config.smtp.domain}", recipient, config.smtp.domain
+        )
+        forward.update(
+            await send_copy(
+                request, session, email_id, "forward", upstream,
+                email.sender, recipient, raw_message,
+            )
+        )
+        context["history"] = get_journal_repo(request).for_email(email_id)
+
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "email_detail.html",
+        {
+            "request": request,
+            **context,
+            "forward": forward,
+            "username": session.get("username"),
+        },
+        status_code=status_code,
+    )
+
+
+@router.post("/emails/wipe")
+async def wipe_emails(request: Request):
+    """Delete all emails."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    email_repo = get_email_repo(request)
+    count = email_repo.delete_all(actor=session.get("username"))
+    audit(request, "emails.wipe", actor=session.get("username"), count=count)
 
     return RedirectResponse("/emails", status_code=303)
+
+
+def build_storage_report(email_repo: EmailRepository) -> dict:
+    """Collect the aggregate figures shown on the storage report."""
+    return {
+        "total_emails": email_repo.count(),
+        "total_bytes": email_repo.total_size(),
+        "stored_bytes": email_repo.stored_size(),
+        "compress_raw": email_repo.compress_raw,
+        "histogram": email_repo.size_histogram(),
+        "largest": email_repo.get_largest(50),
+        "by_sender": email_repo.size_by_sender(20),
+        "quota": {
+            **email_repo.storage_usage(),
+            "max_total_bytes": email_repo.max_total_bytes,
+            "max_emails": email_repo.max_emails,
+            "exceeded": email_repo.storage_quota_exceeded(),
+        },
+    }
+
+
+@router.get("/stats/storage", response_class=HTMLResponse)
+async def storage_report(request: Request):
+    """Display where the stored bytes are going."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    email_repo = get_email_repo(request)
+    templates = request.app.state.templates
+
+    return templates.TemplateResponse(
+        "storage.html",
+        {
+            "request": request,
+            "report": build_storage_report(email_repo),
+            "support_sections": support.SECTIONS,
+            "default_support_sections": support.DEFAULT_SECTIONS,
+            "username": session.get("username"),
+        },
+    )
+
+
+@router.get("/stats/storage.json")
+async def storage_report_json(request: Request):
+    """Return the storage report as JSON."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    report = build_storage_report(get_email_repo(request))
+    report["largest"] = [
+        {**email, "url": app_url(request, f"/emails/{email['id']}")}
+        for email in report["largest"]
+    ]
+    return report
+
+
+@router.post("/stats/storage/delete")
+async def storage_delete(request: Request):
+    """Delete the emails selected on the storage report."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    form = await request.form()
+    email_ids = [int(v) for v in form.getlist("email_id") if str(v).isdigit()]
+    deleted = get_email_repo(request).delete_by_ids(email_ids, actor=session.get("username"))
+    audit(
+        request, "emails.delete", actor=session.get("username"),
+        count=deleted, email_ids=email_ids, via="storage",
+    )
+
+    return RedirectResponse("/stats/storage", status_code=303)
+
+
+def build_quota_report(request: Request) -> list[QuotaUsage]:
+    """Collect today's message counts of every SMTP credential, fullest first.
+
+    Users managed in the web UI hide configured ones of the same name, as
+    they do for SMTP AUTH.
+    """
+    used = get_quota_repo(request).usage_today()
+    usages = [
+        QuotaUsage(user.username, "web UI", used.get(user.username, 0), user.max_messages_per_day)
+        for user in get_credential_repo(request).get_all()
+    ]
+    managed = {usage.username for usage in usages}
+    usages += [
+        QuotaUsage(
+            credential.username, "config", used.get(credential.username, 0),
+            credential.max_messages_per_day,
+        )
+        for credential in request.app.state.config.smtp.auth.credentials()
+        if credential.username not in managed
+    ]
+    return sorted(usages, key=lambda usage: (-usage.percent, -usage.messages, usage.username))
+
+
+@router.get("/stats/quotas", response_class=HTMLResponse)
+async def quota_report(request: Request):
+    """Display how much of its daily message quota each SMTP credential has used."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "quotas.html",
+        {
+            "request": request,
+            "usages": build_quota_report(request),
+            "day": quota_day(),
+            "username": session.get("username"),
+        },
+    )
+
+
+@router.get("/stats/quotas.json")
+async def quota_report_json(request: Request):
+    """Return today's quota usage as JSON."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    return {
+        "day": quota_day(),
+        "credentials": [
+            {
+                "username": usage.username,
+                "source": usage.source,
+                "messages": usage.messages,
+                "max_messages_per_day": usage.limit,
+            }
+            for usage in build_quota_report(request)
+        ],
+    }
+
+
+# Report windows offered on the TLS page, in hours
+TLS_REPORT_WINDOWS = (24, 168, 720)
+MAX_TLS_REPORT_HOURS = 24 * 366
+
+
+def build_tls_report(request: Request, hours: int) -> list[TLSClientUsage]:
+    """Group the TLS details of mail received in the last hours by auth user and client.
+
+    Clients that sent anything in plaintext or over a deprecated version
+    come first.
+    """
+    if not 0 < hours <= MAX_TLS_REPORT_HOURS:
+        raise ValidationError(f"Hours must be between 1 and {MAX_TLS_REPORT_HOURS}")
+    since = datetime.now() - timedelta(hours=hours)
+    clients: dict[tuple[str, str], TLSClientUsage] = {}
+    for row in get_email_repo(request).tls_usage(since):
+        key = (row["auth_user"], row["client_ip"])
+        client = clients.setdefault(key, TLSClientUsage(*key))
+        client.messages += row["messages"]
+        client.last_seen = max(client.last_seen, row["last_seen"])
+        client.connections.append(
+            {"version": row["version"], "cipher": row["cipher"], "messages": row["messages"]}
+        )
+    return sorted(
+        clients.values(),
+        key=lambda c: (-c.plaintext, -c.deprecated, -c.messages, c.auth_user, c.client_ip),
+    )
+
+
+@router.get("/stats/tls", response_class=HTMLResponse)
+async def tls_report(request: Request, hours: int = 24):
+    """Display the TLS versions and ciphers each SMTP client has used."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "tls.html",
+        {
+            "request": request,
+            "clients": build_tls_report(request, hours),
+            "hours": hours,
+            "windows": TLS_REPORT_WINDOWS,
+            "deprecated_versions": DEPRECATED_TLS_VERSIONS,
+            "tls": request.app.state.config.smtp.tls,
+            "username": session.get("username"),
+        },
+    )
+
+
+@router.get("/stats/tls.json")
+async def tls_report_json(request: Request, hours: int = 24):
+    """Return the TLS usage of each SMTP client as JSON."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    clients = build_tls_report(request, hours)
+    return {
+        "hours": hours,
+        "min_version": request.app.state.config.smtp.tls.min_version,
+        "require": request.app.state.config.smtp.tls.require,
+        "flagged": sum(1 for c in clients if c.plaintext or c.deprecated),
+        "clients": [
+            {
+                "auth_user": client.auth_user,
+                "client_ip": client.client_ip,
+                "messages": client.messages,
+                "plaintext_messages": client.plaintext,
+                "deprecated_messages": client.deprecated,
+                "last_seen": client.last_seen,
+                "connections": client.connections,
+            }
+            for client in clients
+        ],
+    }
+
+
+RULE_PREVIEW_LIMIT = 100
+
+
+def rule_from_form(form, rule_id: int = 0) -> Rule:
+    """Build a Rule from submitted form fields."""
+    try:
+        priority = int(form.get("priority") or 100)
+    except ValueError:
+        priority = 100
+    try:
+        min_size_bytes = int(form.get("min_size_bytes") or 0)
+    except ValueError:
+        min_size_bytes = -1
+
+    return Rule(
+        id=rule_id,
+        name=(form.get("name") or "").strip(),
+        priority=priority,
+        enabled=form.get("enabled") == "on",
+        sender_pattern=form.get("sender_pattern") or "",
+        recipient_pattern=form.get("recipient_pattern") or "",
+        subject_pattern=form.get("subject_pattern") or "",
+        auth_user=(form.get("auth_user") or "").strip(),
+        min_size_bytes=min_size_bytes,
+        action=form.get("action") or "",
+        action_value=(form.get("action_value") or "").strip(),
+    )
+
+
+def render_rule_form(
+    request: Request,
+    session: dict,
+    rule: Rule,
+    errors: list[str] | None = None,
+    preview: list | None = None,
+    status_code: int = 200,
+):
+    """Render the rule create/edit form."""
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "rule_form.html",
+        {
+            "request": request,
+            "rule": rule,
+            "actions": rules.ACTIONS,
+            "errors": errors or [],
+            "preview": preview,
+            "preview_limit": RULE_PREVIEW_LIMIT,
+            "username": session.get("username"),
+        },
+        status_code=status_code,
+    )
+
+
+@router.get("/rules", response_class=HTMLResponse)
+async def rule_list(request: Request):
+    """Display the configured rules in evaluation order."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "rules.html",
+        {
+            "request": request,
+            "rules": get_rule_repo(request).get_all(),
+            "username": session.get("username"),
+        },
+    )
+
+
+@router.get("/rules/new", response_class=HTMLResponse)
+async def rule_new(request: Request):
+    """Display the form for a new rule."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    return render_rule_form(request, session, Rule())
+
+
+@router.post("/rules/preview", response_class=HTMLResponse)
+async def rule_preview(request: Request):
+    """Show which recent emails the submitted rule would have matched."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    form = await request.form()
+    rule = rule_from_form(form, int(form.get("id") or 0))
+    errors = rules.validate_rule(rule)
+    if errors:
+        return render_rule_form(request, session, rule, errors, status_code=400)
+
+    recent = get_email_repo(request).get_recent(RULE_PREVIEW_LIMIT)
+    preview = [email for email in recent if rules.rule_matches(rule, email)]
+    return render_rule_form(request, session, rule, preview=preview)
+
+
+@router.post("/rules")
+async def rule_create(request: Request):
+    """Create a rule from the submitted form."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    rule = rule_from_form(await request.form())
+    errors = rules.validate_rule(rule)
+    if errors:
+        return render_rule_form(request, session, rule, errors, status_code=400)
+
+    get_rule_repo(request).create(rule)
+    return RedirectResponse("/rules", status_code=303)
+
+
+@router.get("/rules/{rule_id}/edit", response_class=HTMLResponse)
+async def rule_edit(request: Request, rule_id: int):
+    """Display the form for editing a rule."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    rule = get_rule_repo(request).get_by_id(rule_id)
+    if not rule:
+        raise NotFoundError("Rule not found")
+
+    return render_rule_form(request, session, rule)
+
+
+@router.post("/rules/{rule_id}")
+async def rule_update(request: Request, rule_id: int):
+    """Update a rule from the submitted form."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    rule_repo = get_rule_repo(request)
+    if not rule_repo.get_by_id(rule_id):
+        raise NotFoundError("Rule not found")
+
+    rule = rule_from_form(await request.form(), rule_id)
+    errors = rules.validate_rule(rule)
+    if errors:
+        return render_rule_form(request, session, rule, errors, status_code=400)
+
+    rule_repo.update(rule)
+    return RedirectResponse("/rules", status_code=303)
+
+
+@router.post("/rules/{rule_id}/delete")
+async def rule_delete(request: Request, rule_id: int):
+    """Delete a rule."""
+    try:
+        require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    get_rule_repo(request).delete(rule_id)
+    return RedirectResponse("/rules", status_code=303)
+
+
+def render_smtp_users(
+    request: Request, session: dict, status_code: int = 200, **extra
+) -> HTMLResponse:
+    """Render the SMTP users page, with a generated password or error when given."""
+    templates = request.app.state.templates
+    config_credentials = request.app.state.config.smtp.auth.credentials()
+    return templates.TemplateResponse(
+        "smtp_users.html",
+        {
+            "request": request,
+            "users": get_credential_repo(request).get_all(),
+            "config_usernames": [credential.username for credential in config_credentials],
+            "config_senders": {
+                credential.username: credential.allowed_senders
+                for credential in config_credentials
+                if credential.allowed_senders
+            },
+            "sender_rejections": request.app.state.audit_repo.recent(
+                SENDER_REJECTIONS_SHOWN, event="smtp.sender_reject"
+            ),
+            "use_web_users": request.app.state.config.smtp.auth.use_web_users,
+            "generated": None,
+            "error": "",
+            "new_username": "",
+            "username": session.get("username"),
+            **extra,
+        },
+        status_code=status_code,
+    )
+
+
+@router.get("/smtp-users", response_class=HTMLResponse)
+async def smtp_user_list(request: Request):
+    """Display the SMTP users managed in the web UI."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+    return render_smtp_users(request, session)
+
+
+@router.post("/smtp-users", response_class=HTMLResponse)
+async def smtp_user_create(request: Request, username: str = Form("")):
+    """Create an SMTP user and show its generated password once."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    username = username.strip()
+    credential_repo = get_credential_repo(request)
+    error = ""
+    if not username:
+        error = "Username is required"
+    elif any(c.isspace() for c in username):
+        error = "Username cannot contain spaces"
+    elif credential_repo.exists(username):
+        error = f"SMTP user {username} already exists"
+    if error:
+        return render_smtp_users(request, session, 400, error=error, new_username=username)
+
+    _, password = await asyncio.to_thread(credential_repo.create, username)
+    logger.info(f"SMTP user {username} created by {session.get('username')}")
+    audit(request, "smtp_credential.create", actor=session.get("username"), username=username)
+    return render_smtp_users(
+        request, session, generated={"username": username, "password": password}
+    )
+
+
+@router.post("/smtp-users/{user_id}/regenerate", response_class=HTMLResponse)
+async def smtp_user_regenerate(request: Request, user_id: int):
+    """Replace an SMTP user's password and show the new one once."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    credential_repo = get_credential_repo(request)
+    user = credential_repo.get_by_id(user_id)
+    if not user:
+        raise NotFoundError("SMTP user not found")
+    password = await asyncio.to_thread(credential_repo.regenerate_password, user_id)
+    logger.info(f"SMTP user {user.username} password regenerated by {session.get('username')}")
+    audit(
+        request, "smtp_credential.regenerate", actor=session.get("username"),
+        username=user.username,
+    )
+    return render_smtp_users(
+        request, session, generated={"username": user.username, "password": password}
+    )
+
+
+@router.post("/smtp-users/{user_id}/senders", response_class=HTMLResponse)
+async def smtp_user_senders(request: Request, user_id: int, allowed_senders: str = Form("")):
+    """Set the MAIL FROM addresses and domains an SMTP user may send as."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    credential_repo = get_credential_repo(request)
+    user = credential_repo.get_by_id(user_id)
+    if not user:
+        raise NotFoundError("SMTP user not found")
+    patterns = parse_sender_patterns(allowed_senders)
+    errors = [error for error in map(sender_pattern_error, patterns) if error]
+    if errors:
+        return render_smtp_users(request, session, 400, error="; ".join(errors))
+
+    credential_repo.set_allowed_senders(user_id, patterns)
+    logger.info(
+        f"SMTP user {user.username} allowed senders set to {patterns or 'any'} "
+        f"by {session.get('username')}"
+    )
+    audit(
+        request, "smtp_credential.senders", actor=session.get("username"),
+        username=user.username, allowed_senders=patterns,
+    )
+    return RedirectResponse("/smtp-users", status_code=303)
+
+
+@router.post("/smtp-users/{user_id}/quota", response_class=HTMLResponse)
+async def smtp_user_quota(request: Request, user_id: int, max_messages_per_day: str = Form("")):
+    """Set how many messages an SMTP user may send per day."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    credential_repo = get_credential_repo(request)
+    user = credential_repo.get_by_id(user_id)
+    if not user:
+        raise NotFoundError("SMTP user not found")
+    value = max_messages_per_day.strip() or "0"
+    if not value.isdigit():
+        return render_smtp_users(
+            request, session, 400,
+            error=f"Daily quota of {user.username} must be a whole number, or empty for unlimited",
+        )
+
+    limit = int(value)
+    credential_repo.set_max_messages_per_day(user_id, limit)
+    logger.info(
+        f"SMTP user {user.username} daily quota set to {limit or 'unlimited'} "
+        f"by {session.get('username')}"
+    )
+    audit(
+        request, "smtp_credential.quota", actor=session.get("username"),
+        username=user.username, max_messages_per_day=limit,
+    )
+    return RedirectResponse("/smtp-users", status_code=303)
+
+
+@router.post("/smtp-users/{user_id}/disable")
+async def smtp_user_disable(request: Request, user_id: int):
+    """Disable an SMTP user; its next AUTH fails, even on open connections."""
+    return await set_smtp_user_disabled(request, user_id, True)
+
+
+@router.post("/smtp-users/{user_id}/enable")
+async def smtp_user_enable(request: Request, user_id: int):
+    """Re-enable a disabled SMTP user."""
+    return await set_smtp_user_disabled(request, user_id, False)
+
+
+async def set_smtp_user_disabled(request: Request, user_id: int, disabled: bool):
+    """Disable or enable an SMTP user and return to the list."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    credential_repo = get_credential_repo(request)
+    user = credential_repo.get_by_id(user_id)
+    if not user:
+        raise NotFoundError("SMTP user not found")
+    credential_repo.set_disabled(user_id, disabled)
+    logger.info(
+        f"SMTP user {user.username} {'disabled' if disabled else 'enabled'} "
+        f"by {session.get('username')}"
+    )
+    audit(
+        request, "smtp_credential.disable" if disabled else "smtp_credential.enable",
+        actor=session.get("username"), username=user.username,
+    )
+    return RedirectResponse("/smtp-users", status_code=303)
+
+
+def render_users(
+    request: Request, session: dict, status_code: int = 200, **extra
+) -> HTMLResponse:
+    """Render the web users page, with a generated password or error when given."""
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "users.html",
+        {
+            "request": request,
+            "users": get_user_repo(request).get_all(),
+            "manages_users": request.app.state.auth_providers.manages_users,
+            "roles": USER_ROLES,
+            "generated": None,
+            "error": "",
+            "new_username": "",
+            "username": session.get("username"),
+            **extra,
+        },
+        status_code=status_code,
+    )
+
+
+@router.get("/users", response_class=HTMLResponse)
+async def user_list(request: Request):
+    """Display the web users."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+    return render_users(request, session)
+
+
+@router.post("/users", response_class=HTMLResponse)
+async def user_create(request: Request, username: str = Form(""), role: str = Form("viewer")):
+    """Create a web user and show their generated password once."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    username = username.strip()
+    user_repo = get_user_repo(request)
+    error = ""
+    if not username:
+        error = "Username is required"
+    elif any(c.isspace() for c in username):
+        error = "Username cannot contain spaces"
+    elif user_repo.exists(username):
+        error = f"User {username} already exists"
+    elif role not in USER_ROLES:
+        error = f"Unknown role: {role}"
+    if error:
+        return render_users(request, session, 400, error=error, new_username=username)
+
+    password = generate_password()
+    await asyncio.to_thread(user_repo.create, username, password, role)
+    logger.info(f"User {username} created as {role} by {session.get('username')}")
+    audit(request, "user.create", actor=session.get("username"), username=username, role=role)
+    return render_users(request, session, generated={"username": username, "password": password})
+
+
+@router.post("/users/{user_id}/reset-password", response_class=HTMLResponse)
+async def user_reset_password(request: Request, user_id: int):
+    """Replace a web user's password and show the new one once."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    user_repo = get_user_repo(request)
+    user = user_repo.get_by_id(user_id)
+    if not user:
+        raise NotFoundError("User not found")
+    password = await asyncio.to_thread(user_repo.reset_password, user_id)
+    logger.info(f"User {user.username} password reset by {session.get('username')}")
+    audit(request, "user.password_reset", actor=session.get("username"), username=user.username)
+    return render_users(
+        request, session, generated={"username": user.username, "password": password}
+    )
+
+
+@router.post("/users/{user_id}/role", response_class=HTMLResponse)
+async def user_role(request: Request, user_id: int, role: str = Form(...)):
+    """Change a web user's role; it applies from their next request."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    user_repo = get_user_repo(request)
+    user = user_repo.get_by_id(user_id)
+    if not user:
+        raise NotFoundError("User not found")
+    if role not in USER_ROLES:
+        return render_users(request, session, 400, error=f"Unknown role: {role}")
+    if is_last_admin(user_repo, user) and role != "admin":
+        return render_users(
+            request, session, 400,
+            error=f"{user.username} is the last active admin and must stay an admin",
+        )
+
+    user_repo.set_role(user_id, role)
+    logger.info(f"User {user.username} role set to {role} by {session.get('username')}")
+    audit(request, "user.role", actor=session.get("username"), username=user.username, role=role)
+    return RedirectResponse("/users", status_code=303)
+
+
+@router.post("/users/{user_id}/deactivate", response_class=HTMLResponse)
+async def user_deactivate(request: Request, user_id: int):
+    """Deactivate a web user; their sessions are refused from the next request on."""
+    return await change_user(request, user_id, "deactivate")
+
+
+@router.post("/users/{user_id}/activate", response_class=HTMLResponse)
+async def user_activate(request: Request, user_id: int):
+    """Let a deactivated web user sign in again."""
+    return await change_user(request, user_id, "activate")
+
+
+@router.post("/users/{user_id}/delete", response_class=HTMLResponse)
+async def user_delete(request: Request, user_id: int):
+    """Delete a web user."""
+    return await change_user(request, user_id, "delete")
+
+
+def is_last_admin(user_repo: UserRepository, user: User) -> bool:
+    """Check whether a user is the only active admin left."""
+    return user.active and user.role == "admin" and user_repo.count_active_admins() <= 1
+
+
+async def change_user(request: Request, user_id: int, action: str):
+    """Activate, deactivate or delete a web user and return to the list.
+
+    The last active admin is never deactivated or deleted, which would
+    leave nobody able to manage users.
+    """
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    user_repo = get_user_repo(request)
+    user = user_repo.get_by_id(user_id)
+    if not user:
+        raise NotFoundError("User not found")
+    if action != "activate" and is_last_admin(user_repo, user):
+        return render_users(
+            request, session, 400,
+            error=f"{user.username} is the last active admin and cannot be {action}d",
+        )
+
+    if action == "delete":
+        user_repo.delete(user_id)
+    else:
+        user_repo.set_active(user_id, action == "activate")
+    logger.info(f"User {user.username} {action}d by {session.get('username')}")
+    audit(request, f"user.{action}", actor=session.get("username"), username=user.username)
+    return RedirectResponse("/users", status_code=303)
+
+
+@router.get("/security", response_class=HTMLResponse)
+async def security_page(request: Request):
+    """Display recent failed sign-ins and the usernames they locked."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    attempts = get_login_attempt_repo(request)
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "security.html",
+        {
+            "request": request,
+            "attempts": attempts.recent(),
+            "lockouts": attempts.lockouts(),
+            "web_config": request.app.state.config.web,
+            "username": session.get("username"),
+        },
+    )
+
+
+@router.post("/security/unlock")
+async def security_unlock(request: Request, username: str = Form(...)):
+    """Clear a username's failed sign-ins so it can sign in again at once."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    if not get_login_attempt_repo(request).reset(username):
+        raise NotFoundError(f"{username} has no failed sign-ins")
+    logger.info(f"User {username} unlocked by {session.get('username')}")
+    audit(request, "web.unlock", actor=session.get("username"), username=username)
+    return RedirectResponse("/security", status_code=303)
+
+
+def render_api_tokens(
+    request: Request, session: dict, status_code: int = 200, **extra
+) -> HTMLResponse:
+    """Render the API tokens page, with a generated token or error when given."""
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "api_tokens.html",
+        {
+            "request": request,
+            "tokens": get_api_token_repo(request).get_all(),
+            "generated": None,
+            "error": "",
+            "new_name": "",
+            "username": session.get("username"),
+            **extra,
+        },
+        status_code=status_code,
+    )
+
+
+@router.get("/api-tokens", response_class=HTMLResponse)
+async def api_token_list(request: Request):
+    """Display the API tokens."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+    return render_api_tokens(request, session)
+
+
+@router.post("/api-tokens", response_class=HTMLResponse)
+async def api_token_create(request: Request, name: str = Form("")):
+    """Create an API token and show it once."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    name = name.strip()
+    token_repo = get_api_token_repo(request)
+    error = ""
+    if not name:
+        error = "Name is required"
+    elif token_repo.exists(name):
+        error = f"API token {name} already exists"
+    if error:
+        return render_api_tokens(request, session, 400, error=error, new_name=name)
+
+    _, token = token_repo.create(name, created_by=session.get("username"))
+    logger.info(f"API token {name} created by {session.get('username')}")
+    audit(request, "api_token.create", actor=session.get("username"), name=name)
+    return render_api_tokens(request, session, generated={"name": name, "token": token})
+
+
+@router.post("/api-tokens/{token_id}/revoke")
+async def api_token_revoke(request: Request, token_id: int):
+    """Revoke an API token; requests using it are refused from then on."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    token_repo = get_api_token_repo(request)
+    api_token = token_repo.get_by_id(token_id)
+    if not api_token:
+        raise NotFoundError("API token not found")
+    token_repo.revoke(token_id)
+    logger.info(f"API token {api_token.name} revoked by {session.get('username')}")
+    audit(request, "api_token.revoke", actor=session.get("username"), name=api_token.name)
+    return RedirectResponse("/api-tokens", status_code=303)
+
+
+@router.get("/duplicates", response_class=HTMLResponse)
+async def duplicates_report(request: Request):
+    """Display groups of byte-identical emails."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "duplicates.html",
+        {
+            "request": request,
+            "groups": get_email_repo(request).duplicate_groups(),
+            "plan": None,
+            "keep": "oldest",
+            "username": session.get("username"),
+        },
+    )
+
+
+@router.post("/duplicates/cleanup", response_class=HTMLResponse)
+async def duplicates_cleanup(request: Request):
+    """Delete all but one email of each duplicate group, or preview that."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    form = await request.form()
+    keep = "newest" if form.get("keep") == "newest" else "oldest"
+    email_repo = get_email_repo(request)
+    plan = email_repo.duplicate_cleanup_plan(keep)
+
+    if form.get("dry_run"):
+        groups = {group["content_hash"]: group for group in email_repo.duplicate_groups(len(plan))}
+        templates = request.app.state.templates
+        return templates.TemplateResponse(
+            "duplicates.html",
+            {
+                "request": request,
+                "groups": list(groups.values()),
+                "plan": plan,
+                "keep": keep,
+                "username": session.get("username"),
+            },
+        )
+
+    deleted = 0
+    for hash_value, email_ids in plan.items():
+        deleted += email_repo.delete_by_ids(email_ids, actor=session.get("username"))
+        logger.info(
+            f"Duplicate cleanup by {session.get('username')}: deleted {len(email_ids)} "
+            f"copies of {hash_value[:12]}, kept {keep}"
+        )
+    logger.info(f"Duplicate cleanup removed {deleted} email(s) in {len(plan)} group(s)")
+    audit(
+        request, "emails.delete", actor=session.get("username"),
+        count=deleted, email_ids=[i for ids in plan.values() for i in ids], via="duplicates",
+    )
+
+    return RedirectResponse("/duplicates", status_code=303)
+
+
+@router.get("/addresses", response_class=HTMLResponse)
+async def address_book(request: Request):
+    """Display the most active addresses seen in received mail."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "addresses.html",
+        {
+            "request": request,
+            "addresses": get_address_repo(request).most_active(),
+            "username": session.get("username"),
+        },
+    )
+
+
+FAILED_DELIVERIES_PER_PAGE = 50
+
+
+@router.get("/deliveries/failed", response_class=HTMLResponse)
+async def failed_deliveries(request: Request, page: int = 1, retried: int = -1):
+    """List emails whose relay failed or found no route, with their last error."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    email_repo = get_email_repo(request)
+    page = max(page, 1)
+    total = email_repo.count_by_status(FAILED_STATUSES)
+    emails = email_repo.get_by_status(
+        FAILED_STATUSES, FAILED_DELIVERIES_PER_PAGE, (page - 1) * FAILED_DELIVERIES_PER_PAGE
+    )
+
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "failed_deliveries.html",
+        {
+            "request": request,
+            "emails": emails,
+            "last_attempts": email_repo.last_delivery_attempts([email.id for email in emails]),
+            "synthetic_codes": SYNTHETIC_CODES,
+            "total": total,
+            "page": page,
+            "pages": max((total + FAILED_DELIVERIES_PER_PAGE - 1) // FAILED_DELIVERIES_PER_PAGE, 1),
+            "relay_enabled": request.app.state.relay is not None,
+            "retried": retried,
+            "username": session.get("username"),
+        },
+    )
+
+
+def retry_deliveries(request: Request, emails: list[Email]) -> int:
+    """Queue failed emails for another relay and return how many were queued."""
+    relay = request.app.state.relay
+    if relay is None:
+        raise ValidationError("Relaying is not enabled; set smtp.relay.enabled to retry deliveries")
+    queued = 0
+    for email in emails:
+        # Emails stored without their raw message have nothing left to send
+        if email.status in FAILED_STATUSES and not email.raw_redacted:
+            relay.retry(email.id, email)
+            queued += 1
+    return queued
+
+
+@router.post("/deliveries/failed/{email_id}/retry")
+async def retry_failed_delivery(request: Request, email_id: int):
+    """Relay one failed email again."""
+    try:
+        require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    email = get_email_repo(request).get_by_id(email_id)
+    if not email:
+        raise NotFoundError("Email not found")
+    require_raw_message(email, "retried")
+    queued = retry_deliveries(request, [email])
+    return RedirectResponse(f"/deliveries/failed?retried={queued}", status_code=303)
+
+
+@router.post("/deliveries/failed/retry-all")
+async def retry_all_failed_deliveries(request: Request):
+    """Relay every failed email again."""
+    try:
+        require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    email_repo = get_email_repo(request)
+    emails = email_repo.get_by_status(FAILED_STATUSES, limit=-1)
+    queued = retry_deliveries(request, emails)
+    return RedirectResponse(f"/deliveries/failed?retried={queued}", status_code=303)
+
+
+@router.get("/activity", response_class=HTMLResponse)
+async def activity(request: Request, as_of: str = ""):
+    """Display the change journal timeline, or the email list as of a past time."""
+    try:
+        session = require_auth(request)
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    journal_repo = get_journal_repo(request)
+    when = None
+    if as_of:
+        try:
+            when = datetime.fromisoformat(as_of)
+        except ValueError:
+            raise ValidationError("as_of must be a date and time like 2024-01-31T14:30")
+
+    templates = request.app.state.templates
+    return templates.TemplateResponse(
+        "activity.html",
+        {
+            "request": request,
+            "as_of": as_of,
+            "snapshot": journal_repo.as_of(when) if when else None,
+            "entries": [] if when else journal_repo.recent(),
+            "retention_days": request.app.state.config.database.journal_retention_days,
+            "username": session.get("username"),
+        },
+    )
+
+
+@router.get("/api/v1/addresses")
+async def address_suggestions(request: Request, q: str = "", limit: int = 10):
+    """Return addresses matching a prefix as JSON, for typeahead."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    addresses = get_address_repo(request).search_prefix(q.strip(), min(max(limit, 1), 50))
+    return {
+        "addresses": [
+            {
+                "address": address.address,
+                "display_name": address.display_name,
+                "sent_count": address.sent_count,
+                "received_count": address.received_count,
+            }
+            for address in addresses
+        ]
+    }
+
+
+def tracking_entry(email: Email) -> dict:
+    """Describe the tracking findings of an email for the API."""
+    return {
+        "email_id": email.id,
+        "sender": email.sender,
+        "subject": email.subject,
+        "received_at": email.received_at.isoformat(),
+        "analyzed": email.tracking is not None,
+        "has_tracking": email.has_tracking,
+        "findings": email.tracking or [],
+    }
+
+
+def email_summary(email: Email) -> dict:
+    """Describe an email as it is listed by the API."""
+    return {
+        "id": email.id,
+        "sender": email.sender,
+        "recipients": email.recipients,
+        "subject": email.subject,
+        "preview": email.preview,
+        "status": email.status,
+        "labels": email.labels,
+        "mailbox": email.mailbox,
+        "size_bytes": email.size_bytes,
+        "received_at": email.received_at.isoformat(),
+    }
+
+
+@router.get("/api/v1/emails")
+async def api_email_list(request: Request, page: int = 1, per_page: int = 0):
+    """Return one page of the emails as JSON, with the email list's search and filters."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    email_repo = get_email_repo(request)
+    filters = email_filters(request)
+    searching = any(filters.values())
+    total = email_repo.search_count(**filters) if searching else email_repo.count()
+    if not per_page:
+        per_page = request.app.state.config.web.page_size
+    per_page = min(max(per_page, 1), MAX_PAGE_SIZE)
+    page, pages = page_bounds(total, page, per_page)
+    offset = (page - 1) * per_page
+    if searching:
+        emails = email_repo.search(**filters, limit=per_page, offset=offset)
+    else:
+        emails = email_repo.get_page(per_page, offset)
+    return {
+        "total": total,
+        "page": page,
+        "pages": pages,
+        "per_page": per_page,
+        "emails": [email_summary(email) for email in emails],
+    }
+
+
+@router.delete("/api/v1/emails/{email_id}")
+async def api_delete_email(request: Request, email_id: int):
+    """Delete one email, answering 404 if it does not exist."""
+    try:
+        session = require_role(request, "admin")
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    if not get_email_repo(request).delete(email_id, actor=session.get("username")):
+        raise NotFoundError("Email not found")
+    audit(
+        request, "emails.delete", actor=session.get("username"),
+        count=1, email_ids=[email_id], via="api",
+    )
+    return {"deleted": email_id}
+
+
+@router.get("/api/v1/emails/{email_id}/tracking")
+async def email_tracking(request: Request, email_id: int):
+    """Return the tracking findings of one email as JSON."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    email = get_email_repo(request).get_by_id(email_id)
+    if not email:
+        raise NotFoundError("Email not found")
+    return tracking_entry(email)
+
+
+@router.get("/api/v1/emails/{email_id}/headers")
+async def email_headers(request: Request, email_id: int):
+    """Return the headers of one email as JSON, in the order they were sent."""
+    try:
+        require_auth(request)
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    email = get_email_repo(request).get_by_id(email_id)
+    if not email:
+        raise NotFoundError("Email not found")
+    require_raw_message(email, "read for its headers")
+    return {
+        "email_id": email.id,
+        "headers": [
+            {"name": header.name, "value": header.value, "decoded": header.decoded}
+            for header in message_headers(email.raw_message)
+        ],
+    }
+
+
+@router.get("/api/v1/tracking")
+async def tracking_report(request: Request, kind: str = "", auth_user: str = ""):
+    """List the emails with tracking findings as JSON, for policy checks in CI.
+
+    kind keeps only findings of one kind, such as pixel or read_receipt,
+    and auth_user only emails sent as that SMTP user.
+    """
+    try:
+        require_auth(request)
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    if kind and kind not in tracking.KIND_TITLES:
+        raise ValidationError(
+            f"Unknown tracking kind {kind!r}; expected one of {', '.join(tracking.KIND_TITLES)}"
+        )
+    emails = []
+    for email in get_email_repo(request).search(auth_user=auth_user.strip(), has_tracking=True):
+        entry = tracking_entry(email)
+        if kind:
+            entry["findings"] = [f for f in entry["findings"] if f["kind"] == kind]
+            if not entry["findings"]:
+                continue
+        emails.append(entry)
+    return {"count": len(emails), "emails": emails}
+
+
+@router.get("/admin/export-settings")
+async def export_settings(request: Request):
+    """Download all non-email settings as a JSON bundle."""
+    try:
+        require_role(request, "admin")
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    bundle = settings.export_settings(get_rule_repo(request))
+    filename = f"smtp-proxy-settings-{request.app.state.config.instance_id}.json"
+    return JSONResponse(
+        bundle,
+        headers={"Content-Disposition": f'attachment; filename="{filename}"'},
+    )
+
+
+@router.post("/admin/support-bundle")
+async def support_bundle(request: Request):
+    """Download a zip of diagnostics with the sections ticked on the storage page."""
+    try:
+        require_role(request, "admin")
+    except HTTPException:
+        return RedirectResponse("/login", status_code=303)
+
+    form = await request.form()
+    sections = [section for section in form.getlist("section") if section in support.SECTIONS]
+    if not sections:
+        raise ValidationError("Select at least one section for the support bundle")
+    config = request.app.state.config
+    email_repo = get_email_repo(request)
+    runtime = {
+        "components": config.components,
+        "read_only": config.read_only,
+        "storage": email_repo.db.breaker.stats(),
+        "aggregate_cache": email_repo.cache.stats(),
+    }
+    if request.app.state.replicator:
+        runtime["replica"] = request.app.state.replicator.stats()
+    bundle = support.SupportBundle(config, email_repo.db, support.log_buffer.lines(), runtime)
+
+    # Spooled so a large bundle goes to disk instead of memory
+    out = tempfile.SpooledTemporaryFile(max_size=8 * 1024 * 1024)
+    await asyncio.to_thread(bundle.write, out, sections)
+    out.seek(0)
+
+    def chunks():
+        with out:
+            while chunk := out.read(64 * 1024):
+                yield chunk
+
+    filename = f"smtp-proxy-support-{config.instance_id}-{datetime.now():%Y%m%d-%H%M%S}.zip"
+    return StreamingResponse(
+        chunks(),
+        media_type="application/zip",
+        headers={"Content-Disposition": f'attachment; filename="{filename}"'},
+    )
+
+
+@router.post("/admin/import-settings")
+async def import_settings(request: Request, dry_run: bool = False, prune: bool = False):
+    """Import a JSON settings bundle, or preview the changes with dry_run."""
+    try:
+        require_role(request, "admin")
+    except HTTPException:
+        return JSONResponse({"detail": "Not authenticated"}, status_code=401)
+
+    try:
+        bundle = await request.json()
+    except ValueError:
+        raise ValidationError("Request body must be a JSON settings bundle")
+
+    rule_repo = get_rule_repo(request)
+    plan = settings.plan_import(bundle, rule_repo, prune=prune)
+    if plan.errors:
+        return JSONResponse({"applied": False, **plan.to_dict()}, status_code=400)
+    if not dry_run:
+        settings.apply_import(plan, rule_repo)
+        logger.info(f"Imported settings: {plan.to_dict()}")
+    return {"applied": not dry_run, **plan.to_dict()}
@@ -0,0 +1,59 @@
+"""Loading of the web UI's Jinja templates."""
+
+from pathlib import Path
+
+from fastapi.templating import Jinja2Templates
+from jinja2 import FileSystemLoader, TemplateError
+
+from ..config import Config
+from .dev import LastGoodLoader
+
+# Shipped inside the package, so they are found whatever the working
+# directory and wherever the package is installed
+BUILTIN_TEMPLATES_DIR = Path(__file__).parent / "templates"
+
+
+class TemplateLoadError(Exception):
+    """Raised when a template cannot be parsed at startup."""
+
+
+def template_search_path(config: Config) -> list[str]:
+    """Return the directories templates are looked up in, in order.
+
+    A template in web.templates_dir replaces the built-in one of the same
+    name; any it lacks come from the built-in templates.
+    """
+    search_path = [str(BUILTIN_TEMPLATES_DIR)]
+    if config.web.templates_dir:
+        search_path.insert(0, config.web.templates_dir)
+    return search_path
+
+
+def build_templates(config: Config) -> Jinja2Templates:
+    """Create the template environment and parse every template in it.
+
+    Parsing them all now turns a syntax error into a startup failure
+    rather than a 500 on every request to the page, and fills the
+    environment's cache, which requests are then served from without
+    touching the files. Development mode instead checks each template's
+    file on every render and re-parses it when it has changed.
+    """
+    search_path = template_search_path(config)
+    templates = Jinja2Templates(directory=search_path)
+    if config.dev:
+        templates.env.loader = LastGoodLoader(search_path)
+        templates.env.auto_reload = True
+    else:
+        templates.env.loader = FileSystemLoader(search_path)
+        templates.env.auto_reload = False
+
+    errors = []
+    for name in templates.env.list_templates(extensions=["html"]):
+        try:
+            templates.env.get_template(name)
+        except TemplateError as e:
+            line = f", line {e.lineno}" if getattr(e, "lineno", None) else ""
+            errors.append(f"{name}{line}: {e.message}")
+    if errors:
+        raise TemplateLoadError("Templates failed to parse:\n  - " + "\n  - ".join(errors))
+    return templates
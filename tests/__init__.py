@@ -0,0 +1,4 @@
+import logging
+
+# Components log as they start and stop; keep test output to the results
+logging.disable(logging.CRITICAL)
@@ -0,0 +1,219 @@
+"""Shared helpers for the test suite."""
+
+import asyncio
+import contextlib
+import hashlib
+import os
+import socket
+import tempfile
+from dataclasses import dataclass, field
+from urllib.parse import urlencode
+
+from smtp_proxy.config import Config
+from smtp_proxy.main import Application
+from smtp_proxy.smtp.server import SMTPServer
+
+
+def free_port() -> int:
+    """Return a TCP port on localhost that nothing listens on right now."""
+    with socket.socket() as sock:
+        sock.bind(("127.0.0.1", 0))
+        return sock.getsockname()[1]
+
+
+def make_config(directory: str, **web) -> Config:
+    """Return a config that keeps its database in directory and listens nowhere yet."""
+    config = Config()
+    config.database.path = os.path.join(directory, "smtp_proxy.db")
+    config.smtp.host = "127.0.0.1"
+    config.smtp.port = free_port()
+    config.smtp.tls.enabled = False
+    # Tests that cover SMTP AUTH turn it back on
+    config.smtp.auth.required = False
+    # Shutdown would otherwise keep answering 421 for the whole drain period
+    config.smtp.shutdown_drain_seconds = 0
+    config.web.host = "127.0.0.1"
+    config.web.port = 0
+    config.web.session_secret = "test-secret"
+    config.admin.password = "admin-password"
+    for name, value in web.items():
+        setattr(config.web, name, value)
+    return config
+
+
+class TempDirTestCase:
+    """Mixin giving each test a temporary directory, removed afterwards."""
+
+    def setUp(self):
+        self._tempdir = tempfile.TemporaryDirectory()
+        self.directory = self._tempdir.name
+
+    def tearDown(self):
+        self._tempdir.cleanup()
+
+
+def build_application(config: Config) -> Application:
+    """Build an application without starting any listener."""
+    application = Application(config)
+    application.build()
+    return application
+
+
+def file_digest(path: str) -> str:
+    """Return the SHA-256 of a file, so tests can tell whether it was written."""
+    with open(path, "rb") as f:
+        return hashlib.sha256(f.read()).hexdigest()
+
+
+@dataclass
+class Response:
+    """A response captured from an ASGI app."""
+    status: int
+    headers: list[tuple[str, str]] = field(default_factory=list)
+    body: bytes = b""
+
+    def header(self, name: str) -> str | None:
+        for key, value in self.headers:
+            if key == name.lower():
+                return value
+        return None
+
+    def cookies(self) -> dict[str, str]:
+        cookies = {}
+        for key, value in self.headers:
+            if key == "set-cookie":
+                name, _, rest = value.partition("=")
+                cookies[name] = rest.split(";", 1)[0]
+        return cookies
+
+
+def request(
+    app,
+    method: str,
+    path: str,
+    form: dict | None = None,
+    cookies: dict[str, str] | None = None,
+    headers: dict[str, str] | None = None,
+) -> Response:
+    """Send one HTTP request straight to an ASGI app and collect the response."""
+    return asyncio.run(_request(app, method, path, form, cookies or {}, headers or {}))
+
+
+async def _request(app, method, path, form, cookies, headers) -> Response:
+    path, _, query = path.partition("?")
+    body = urlencode(form).encode() if form is not None else b""
+    raw_headers = [(b"host", b"testserver")]
+    if form is not None:
+        raw_headers.append((b"content-type", b"application/x-www-form-urlencoded"))
+        raw_headers.append((b"content-length", str(len(body)).encode()))
+    if cookies:
+        cookie = "; ".join(f"{name}={value}" for name, value in cookies.items())
+        raw_headers.append((b"cookie", cookie.encode()))
+    for name, value in headers.items():
+        raw_headers.append((name.lower().encode(), value.encode()))
+    scope = {
+        "type": "http",
+        "asgi": {"version": "3.0"},
+        "http_version": "1.1",
+        "method": method,
+        "scheme": "http",
+        "path": path,
+        "raw_path": path.encode(),
+        "root_path": "",
+        "query_string": query.encode(),
+        "headers": raw_headers,
+        "client": ("127.0.0.1", 50000),
+        "server": ("testserver", 80),
+    }
+    sent = False
+    response = Response(status=0)
+
+    async def receive():
+        nonlocal sent
+        if sent:
+            return {"type": "http.disconnect"}
+        sent = True
+        return {"type": "http.request", "body": body, "more_body": False}
+
+    async def send(message):
+        if message["type"] == "http.response.start":
+            response.status = message["status"]
+            response.headers = [
+                (key.decode().lower(), value.decode()) for key, value in message["headers"]
+            ]
+        elif message["type"] == "http.response.body":
+            response.body += message.get("body", b"")
+
+    await app(scope, receive, send)
+    return response
+
+
+@contextlib.asynccontextmanager
+async def running(server: SMTPServer):
+    """Run an SMTP server for the duration of the block, then shut it down."""
+    task = asyncio.create_task(server.start())
+    for _ in range(100):
+        try:
+            _, writer = await asyncio.open_connection(server.config.host, server.config.port)
+        except OSError:
+            await asyncio.sleep(0.02)
+            continue
+        writer.close()
+        break
+    try:
+        yield server
+    finally:
+        await server.shutdown()
+        await asyncio.wait_for(task, 5)
+
+
+class SMTPClient:
+    """A minimal SMTP client that sends raw lines and reads replies."""
+
+    def __init__(self, reader: asyncio.StreamReader, writer: asyncio.StreamWriter):
+        self.reader = reader
+        self.writer = writer
+
+    @classmethod
+    async def connect(cls, server: SMTPServer, greet: bool = True) -> "SMTPClient":
+        """Connect, read the banner and, with greet, send EHLO."""
+        client = cls(*await asyncio.open_connection(server.config.host, server.config.port))
+        code, _ = await client.reply()
+        assert code == 220, code
+        if greet:
+            code, _ = await client.command("EHLO client.example.com")
+            assert code == 250, code
+        return client
+
+    async def reply(self) -> tuple[int, list[str]]:
+        """Read one reply, returning its code and the text of each line."""
+        lines = []
+        while True:
+            line = await asyncio.wait_for(self.reader.readline(), 10)
+            if not line:
+                raise ConnectionError("Server closed the connection")
+            text = line.decode().rstrip("\r\n")
+            lines.append(text[4:])
+            if text[3:4] != "-":
+                return int(text[:3]), lines
+
+    async def command(self, line: str) -> tuple[int, list[str]]:
+        """Send one command line and read its reply."""
+        self.writer.write(line.encode() + b"\r\n")
+        await self.writer.drain()
+        return await self.reply()
+
+    async def send(self, sender: str, recipient: str, message: bytes) -> tuple[int, list[str]]:
+        """Send one message, returning the reply to its end of data."""
+        for line in (f"MAIL FROM:<{sender}>", f"RCPT TO:<{recipient}>", "DATA"):
+            code, lines = await self.command(line)
+            if code >= 400:
+                return code, lines
+        self.writer.write(message + b"\r\n.\r\n")
+        await self.writer.drain()
+        return await self.reply()
+
+    async def close(self) -> None:
+        self.writer.close()
+        with contextlib.suppress(Exception):
+            await self.writer.wait_closed()
@@ -0,0 +1,174 @@
+"""The address book counts who sends and receives mail, and under which names."""
+
+import sqlite3
+import threading
+import unittest
+from datetime import datetime, timedelta
+
+from smtp_proxy.database import AddressRepository, Database, EmailRepository
+from smtp_proxy.models import Address, Email
+from smtp_proxy.smtp.server import SMTPServer
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+
+def message(from_: str, to: str, cc: str = "") -> bytes:
+    headers = f"From: {from_}\r\nTo: {to}\r\n" + (f"Cc: {cc}\r\n" if cc else "")
+    return (headers + "Subject: Hello\r\n\r\nBody\r\n").encode()
+
+
+class AddressRepositoryTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.db = Database(f"{self.directory}/smtp_proxy.db")
+        self.repo = AddressRepository(self.db)
+        self.received_at = datetime(2026, 1, 1, 9, 0)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def record(self, sender: str, recipients: list[str], raw: bytes) -> None:
+        email = Email(
+            sender=sender, recipients=recipients, raw_message=raw, received_at=self.received_at
+        )
+        self.repo.record(email)
+        self.received_at += timedelta(minutes=1)
+
+    def addresses(self) -> dict[str, Address]:
+        return {address.address: address for address in self.repo.most_active()}
+
+    def test_sender_and_recipients_are_counted_once_per_message(self):
+        raw = message(
+            '"Build Bot" <Bot@Example.com>',
+            "Dev <dev@example.com>, dev@example.com",
+            "QA <qa@example.com>",
+        )
+        self.record("bot@example.com", ["DEV@example.com"], raw)
+        self.record("bot@example.com", ["dev@example.com"], raw)
+
+        addresses = self.addresses()
+        self.assertEqual(
+            sorted(addresses), ["bot@example.com", "dev@example.com", "qa@example.com"]
+        )
+        bot, dev, qa = (addresses[a] for a in sorted(addresses))
+        self.assertEqual((bot.sent_count, bot.received_count), (2, 0))
+        self.assertEqual((dev.sent_count, dev.received_count), (0, 2))
+        self.assertEqual((qa.sent_count, qa.received_count), (0, 2))
+        self.assertEqual(bot.display_names, ["Build Bot"])
+        self.assertEqual(bot.first_seen, datetime(2026, 1, 1, 9, 0))
+        self.assertEqual(bot.last_seen, datetime(2026, 1, 1, 9, 1))
+
+    def test_address_seen_as_sender_and_recipient(self):
+        raw = message("me@example.com", "me@example.com")
+        self.record("me@example.com", ["me@example.com"], raw)
+        me = self.addresses()["me@example.com"]
+        self.assertEqual((me.sent_count, me.received_count), (1, 1))
+
+    def test_display_name_changes_over_time(self):
+        for name in ("Alice", "Alice Smith", "Alice Smith", "Alice", "A. Smith"):
+            self.record("alice@example.com", ["bob@example.com"],
+                        message(f"{name} <alice@example.com>", "bob@example.com"))
+        alice = self.addresses()["alice@example.com"]
+        # Oldest first, each name once, the latest at the end
+        self.assertEqual(alice.display_names, ["Alice Smith", "Alice", "A. Smith"])
+        self.assertEqual(alice.display_name, "A. Smith")
+
+        # A message without a name keeps the names seen so far
+        self.record("alice@example.com", ["bob@example.com"],
+                    message("alice@example.com", "bob@example.com"))
+        self.assertEqual(self.addresses()["alice@example.com"].display_name, "A. Smith")
+        self.assertEqual(self.addresses()["bob@example.com"].display_names, [])
+
+    def test_name_that_is_a_prefix_of_another_is_kept_separate(self):
+        for name in ("Al", "Alice", "Al"):
+            self.record("al@example.com", ["x@example.com"],
+                        message(f"{name} <al@example.com>", "x@example.com"))
+        self.assertEqual(self.addresses()["al@example.com"].display_names, ["Alice", "Al"])
+
+    def test_search_by_address_or_any_display_name(self):
+        self.record("alice@example.com", ["bob@example.com"],
+                    message("Alice Smith <alice@example.com>", "Bob <bob@example.com>"))
+        self.record("alice@example.com", ["bob@example.com"],
+                    message("Alice Jones <alice@example.com>", "bob@example.com"))
+        self.assertEqual([a.address for a in self.repo.search_prefix("bo")], ["bob@example.com"])
+        self.assertEqual([a.address for a in self.repo.search_prefix("smi")], [])
+        for prefix in ("alice smith", "Alice J"):
+            self.assertEqual(
+                [a.address for a in self.repo.search_prefix(prefix)], ["alice@example.com"]
+            )
+        self.assertEqual(self.repo.search_prefix("al_ce"), [])
+
+    def test_rebuild_matches_recording_as_received(self):
+        email_repo = EmailRepository(self.db)
+        for name in ("Alice", "Alice Smith"):
+            email = Email(
+                sender="alice@example.com",
+                recipients=["bob@example.com"],
+                raw_message=message(f"{name} <alice@example.com>", "bob@example.com"),
+                received_at=self.received_at,
+            )
+            email_repo.create(email)
+            self.repo.record(email)
+            self.received_at += timedelta(minutes=1)
+        recorded = self.addresses()
+
+        self.assertEqual(self.repo.rebuild(), 2)
+        self.assertEqual(self.addresses(), recorded)
+
+
+class SMTPAddressBookTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+        self.address_repo = AddressRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    async def send(self, *messages: bytes) -> list[int]:
+        server = SMTPServer(self.config.smtp, self.email_repo, address_repo=self.address_repo)
+        async with running(server):
+            client = await SMTPClient.connect(server)
+            codes = [
+                (await client.send("alice@example.com", "bob@example.com", raw))[0]
+                for raw in messages
+            ]
+            await client.close()
+        return codes
+
+    async def test_received_mail_is_recorded_off_the_event_loop(self):
+        threads = []
+        record = self.address_repo.record
+
+        def recording(email):
+            threads.append(threading.current_thread())
+            record(email)
+
+        self.address_repo.record = recording
+        codes = await self.send(
+            message("Alice <alice@example.com>", "bob@example.com"),
+            message("Alice Smith <alice@example.com>", "bob@example.com"),
+        )
+        self.assertEqual(codes, [250, 250])
+        self.assertEqual(len(threads), 2)
+        self.assertNotIn(threading.main_thread(), threads)
+
+        alice, bob = sorted(self.address_repo.most_active(), key=lambda a: a.address)
+        self.assertEqual(alice.display_names, ["Alice", "Alice Smith"])
+        self.assertEqual((alice.sent_count, bob.received_count), (2, 2))
+
+    async def test_failure_to_record_does_not_fail_delivery(self):
+        def fail(email):
+            raise sqlite3.OperationalError("database is locked")
+
+        self.address_repo.record = fail
+        self.assertEqual(await self.send(message("alice@example.com", "bob@example.com")), [250])
+        self.assertEqual(self.email_repo.count(), 1)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,170 @@
+"""Application builds only the components and jobs this node runs."""
+
+import json
+import unittest
+from unittest import mock
+
+from smtp_proxy.config import Config
+from smtp_proxy.database import Database, UserRepository
+from smtp_proxy.main import StartupError
+from smtp_proxy.passwords import build_passwords
+
+from .helpers import TempDirTestCase, build_application, make_config
+
+
+class ComponentsTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        # Stands in for the web UI, which is covered by its own tests
+        patcher = mock.patch("smtp_proxy.main.create_app")
+        self.create_app = patcher.start()
+        self.addCleanup(patcher.stop)
+        self.create_app.return_value.state.magic_links = None
+
+    def build(self, components: str, background_jobs: bool = True):
+        config = make_config(self.directory)
+        config.components = components
+        config.background_jobs = background_jobs
+        config.database.replica_path = f"{self.directory}/replicas"
+        application = build_application(config)
+        self.addCleanup(application.db.close)
+        return application
+
+    def test_smtp(self):
+        application = self.build("smtp")
+        self.assertIsNotNone(application.smtp_server)
+        self.assertIsNone(application.web_server)
+        self.create_app.assert_not_called()
+
+    def test_web(self):
+        application = self.build("web")
+        self.assertIsNone(application.smtp_server)
+        self.assertIsNotNone(application.web_server)
+        self.create_app.assert_called_once()
+
+    def test_all(self):
+        application = self.build("all")
+        self.assertIsNotNone(application.smtp_server)
+        self.assertIsNotNone(application.web_server)
+        # The web UI shows the SMTP server's state from the same process
+        self.assertIs(self.create_app.call_args.kwargs["smtp_server"], application.smtp_server)
+
+    def test_background_jobs(self):
+        self.assertIsNotNone(self.build("web").replicator)
+
+    def test_no_background_jobs(self):
+        application = self.build("all", background_jobs=False)
+        self.assertFalse(application.runs_background_jobs)
+        self.assertIsNone(application.replicator)
+        self.assertIsNotNone(application.smtp_server)
+
+
+class AdminBootstrapTest(TempDirTestCase, unittest.TestCase):
+    """The admin block creates or reconciles the first user when the web UI starts."""
+
+    def setUp(self):
+        super().setUp()
+        patcher = mock.patch("smtp_proxy.main.create_app")
+        self.addCleanup(patcher.stop)
+        patcher.start().return_value.state.magic_links = None
+        self.config = make_config(self.directory)
+        self.config.components = "web"
+
+    def users(self) -> UserRepository:
+        db = Database(self.config.database.path)
+        self.addCleanup(db.close)
+        return UserRepository(db, build_passwords(self.config.web))
+
+    def populate(self) -> None:
+        """Give the database an existing admin with another password, and a viewer."""
+        users = self.users()
+        users.create("admin", "stored-password")
+        users.create("viewer", "viewer-password", role="viewer")
+
+    def start(self) -> None:
+        application = build_application(self.config)
+        self.addCleanup(application.close)
+
+    def password_of(self, username: str) -> str:
+        users = self.users()
+        user = users.get_by_username(username)
+        for password in ("admin-password", "stored-password"):
+            if users.verify_password(user, password):
+                return password
+        return ""
+
+    def test_fresh_database_gets_the_configured_admin(self):
+        self.start()
+        users = self.users()
+        [admin] = users.get_all()
+        self.assertEqual((admin.username, admin.role), ("admin", "admin"))
+        self.assertEqual(self.password_of("admin"), "admin-password")
+        # Starting again changes nothing
+        self.start()
+        self.assertEqual(users.count(), 1)
+
+    def test_mismatched_password_is_kept_without_force(self):
+        self.populate()
+        self.start()
+        self.assertEqual(self.password_of("admin"), "stored-password")
+        self.assertEqual(self.users().count(), 2)
+
+    def test_force_password_replaces_a_mismatched_password(self):
+        self.populate()
+        self.config.admin.force_password = True
+        self.start()
+        self.assertEqual(self.password_of("admin"), "admin-password")
+        self.assertEqual(self.users().count(), 2)
+
+    def test_force_password_on_fresh_database_just_creates(self):
+        self.config.admin.force_password = True
+        self.start()
+        self.assertEqual(self.password_of("admin"), "admin-password")
+
+    def test_new_admin_username_is_added_beside_existing_users(self):
+        self.populate()
+        self.config.admin.username = "root"
+        self.start()
+        self.assertEqual(
+            sorted(user.username for user in self.users().get_all()), ["admin", "root", "viewer"]
+        )
+        self.assertEqual(self.password_of("admin"), "stored-password")
+
+    def test_disabled_or_missing_block_needs_existing_users(self):
+        for admin in ("disabled", None):
+            with self.subTest(admin=admin):
+                if admin:
+                    self.config.admin.disabled = True
+                else:
+                    self.config.admin = None
+                with self.assertRaisesRegex(StartupError, "No web users exist"):
+                    build_application(self.config)
+                self.assertEqual(self.users().count(), 0)
+
+    def test_disabled_or_missing_block_uses_existing_users(self):
+        self.populate()
+        for admin in ("disabled", None):
+            with self.subTest(admin=admin):
+                if admin:
+                    self.config.admin.disabled = True
+                    self.config.admin.password = "new-password"
+                else:
+                    self.config.admin = None
+                self.start()
+                self.assertEqual(self.users().count(), 2)
+                self.assertEqual(self.password_of("admin"), "stored-password")
+
+    def test_config_file_without_admin_block(self):
+        path = f"{self.directory}/config.json"
+        with open(path, "w") as f:
+            json.dump({"database": {"path": self.config.database.path}}, f)
+        self.assertIsNone(Config.load(path).admin)
+
+    def test_smtp_only_node_bootstraps_nothing(self):
+        self.config.components = "smtp"
+        self.start()
+        self.assertEqual(self.users().count(), 0)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,156 @@
+"""Attachment filenames are decoded, indexed and searchable whatever their encoding."""
+
+import os
+import unittest
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.extract import extract_attachments, extract_content
+from smtp_proxy.models import Email
+from smtp_proxy.web.routes import parse_search
+
+from .helpers import TempDirTestCase
+
+
+def message(*dispositions: bytes) -> bytes:
+    """Build a multipart message with one PDF part per Content-Disposition value."""
+    parts = b"".join(
+        b"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: "
+        + disposition + b"\r\n\r\n%PDF\r\n"
+        for disposition in dispositions
+    )
+    return (
+        b'Subject: Documents\r\nContent-Type: multipart/mixed; boundary="b"\r\n\r\n'
+        b"--b\r\nContent-Type: text/plain\r\n\r\nSee attached\r\n" + parts + b"--b--\r\n"
+    )
+
+
+def filenames(raw_message: bytes) -> list[str]:
+    return [attachment["filename"] for attachment in extract_attachments(raw_message)]
+
+
+class FilenameDecodingTest(unittest.TestCase):
+    def test_plain_ascii(self):
+        self.assertEqual(
+            filenames(message(b'attachment; filename="invoice-2024-03.pdf"')),
+            ["invoice-2024-03.pdf"],
+        )
+
+    def test_raw_utf8(self):
+        raw = message('attachment; filename="Résumé 2024.pdf"'.encode())
+        self.assertEqual(filenames(raw), ["Résumé 2024.pdf"])
+
+    def test_rfc2047_encoded_word(self):
+        raw = message(b'attachment; filename="=?utf-8?B?0KHRh9C10YIucGRm?="')
+        self.assertEqual(filenames(raw), ["Счет.pdf"])
+
+    def test_rfc2231_utf8(self):
+        raw = message(b"attachment; filename*=UTF-8''%E2%82%AC%20invoice-2024-03.pdf")
+        self.assertEqual(filenames(raw), ["€ invoice-2024-03.pdf"])
+
+    def test_rfc2231_other_charset_and_language(self):
+        raw = message(b"attachment; filename*=iso-8859-1'de'Gr%FC%DFe.pdf")
+        self.assertEqual(filenames(raw), ["Grüße.pdf"])
+
+    def test_rfc2231_continuations(self):
+        raw = message(
+            b"attachment;\r\n filename*0*=UTF-8''Rechnung%20M%C3%A4rz;\r\n"
+            b" filename*1*=%20-%20Teil%201.pdf"
+        )
+        self.assertEqual(filenames(raw), ["Rechnung März - Teil 1.pdf"])
+
+    def test_content_type_name_is_used_without_disposition(self):
+        raw = (
+            b'Content-Type: multipart/mixed; boundary="b"\r\n\r\n'
+            b"--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n"
+            b'--b\r\nContent-Type: image/png; name="=?utf-8?Q?caf=C3=A9.png?="\r\n\r\nx\r\n'
+            b"--b--\r\n"
+        )
+        self.assertEqual(filenames(raw), ["café.png"])
+
+
+class FilenameSearchTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.db = Database(os.path.join(self.directory, "smtp_proxy.db"))
+        self.repo = EmailRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def store(self, raw_message: bytes) -> int:
+        content = extract_content(raw_message)
+        return self.repo.create(
+            Email(
+                sender="a@example.com",
+                recipients=["b@example.com"],
+                subject=content.subject,
+                body=content.body,
+                raw_message=raw_message,
+                size_bytes=len(raw_message),
+                attachments=content.attachments,
+            )
+        )
+
+    def found(self, **filters) -> list[int]:
+        return [email.id for email in self.repo.search(**filters)]
+
+    def test_unicode_filenames_match_ignoring_case(self):
+        email_id = self.store(message(b"attachment; filename*=UTF-8''R%C3%A9sum%C3%A9%202024.pdf"))
+        self.store(message(b'attachment; filename="resume.pdf"'))
+        for term in ("résumé", "RÉSUMÉ", "Résumé 2024.pdf"):
+            self.assertEqual(self.found(filename=term), [email_id], term)
+            self.assertEqual(self.found(text=term), [email_id], term)
+
+    def test_rfc2231_filename_is_found(self):
+        email_id = self.store(
+            message(
+                b"attachment;\r\n filename*0*=UTF-8''Rechnung%20M%C3%A4rz;\r\n"
+                b" filename*1*=%20invoice-2024-03.pdf"
+            )
+        )
+        self.assertEqual(self.found(filename="invoice-2024-03.pdf"), [email_id])
+        self.assertEqual(self.found(filename="märz"), [email_id])
+        # Matching is on the decoded name, not the encoded parameter
+        self.assertEqual(self.found(filename="%C3%A4"), [])
+        self.assertEqual(self.found(filename="UTF-8''"), [])
+
+    def test_many_attachments(self):
+        names = [f"scan-{n:03}.pdf".encode() for n in range(60)]
+        email_id = self.store(
+            message(*(b'attachment; filename="' + name + b'"' for name in names))
+        )
+        email = self.repo.get_by_id(email_id)
+        self.assertEqual(len(email.attachments), 60)
+        self.assertEqual(self.found(filename="scan-000.pdf"), [email_id])
+        self.assertEqual(self.found(filename="scan-059.pdf"), [email_id])
+        self.assertEqual(self.found(filename="scan-060.pdf"), [])
+        matching = email.attachments_matching("SCAN-05")
+        self.assertEqual([a["filename"] for a in matching], [f"scan-05{n}.pdf" for n in range(10)])
+
+    def test_filename_wildcards_are_literal(self):
+        email_id = self.store(message(b'attachment; filename="100%_done.pdf"'))
+        self.store(message(b'attachment; filename="100x-done.pdf"'))
+        self.assertEqual(self.found(filename="100%_"), [email_id])
+
+    def test_backfill_decodes_encoded_names(self):
+        raw = message(b"attachment; filename*=UTF-8''%E2%82%AC%20invoice.pdf")
+        email_id = self.repo.create(Email(sender="a@example.com", raw_message=raw))
+        self.db.execute(
+            "UPDATE emails SET attachments = '', attachment_names = '' WHERE id = ?", (email_id,)
+        )
+        self.assertEqual(self.repo.backfill_attachments(), 1)
+        self.assertEqual(self.found(filename="€ invoice"), [email_id])
+
+
+class SearchOperatorTest(unittest.TestCase):
+    def test_filename_operator(self):
+        self.assertEqual(
+            parse_search('report filename:"Résumé 2024.pdf"'),
+            ("report", {"filename": "Résumé 2024.pdf"}),
+        )
+        self.assertEqual(parse_search("FILENAME:Счет.pdf"), ("", {"filename": "Счет.pdf"}))
+
+
+if __name__ == "__main__":
+    unittest.main()
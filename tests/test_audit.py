@@ -0,0 +1,210 @@
+"""Audit events keep a stable schema and a hash chain that shows any tampering."""
+
+import json
+import os
+import threading
+import unittest
+from datetime import datetime, timezone
+
+from smtp_proxy.config import SIEMConfig
+from smtp_proxy.database import Database
+from smtp_proxy.database.audit_repository import AuditRepository
+from smtp_proxy.main import run_verify_audit_command
+from smtp_proxy.models import AUDIT_GENESIS_HASH, AUDIT_SCHEMA_VERSION, AuditEvent
+from smtp_proxy.siem import SIEMShipper, ShipError, syslog_message
+
+from .helpers import TempDirTestCase, make_config
+
+# An event whose serialized form and hash are pinned below. If either
+# changes, every collector's stored chain stops verifying: bump
+# AUDIT_SCHEMA_VERSION instead of editing these.
+PINNED = AuditEvent(
+    id=7,
+    occurred_at=datetime(2026, 10, 15, 9, 30, 0, 123456, tzinfo=timezone.utc),
+    event="web.login",
+    outcome="failure",
+    actor="alice",
+    source="203.0.113.9",
+    instance_id="node-1",
+    data={"reason": "locked", "provider": "database", "note": "Zoë"},
+    prev_hash="ab" * 32,
+)
+PINNED_CANONICAL = (
+    '{"actor":"alice","data":{"note":"Zoë","provider":"database","reason":"locked"},'
+    '"event":"web.login","instance":"node-1","outcome":"failure",'
+    '"prev_hash":"' + "ab" * 32 + '","schema":1,"seq":7,"source":"203.0.113.9",'
+    '"time":"2026-10-15T09:30:00.123456+00:00"}'
+)
+PINNED_HASH = "d2c3e6e97b0fd83ed9fac55b458ca701a3f43e1fe55c81d19c2ddf63583edef0"
+
+
+class SchemaTest(unittest.TestCase):
+    def test_canonical_form_and_hash_are_stable(self):
+        self.assertEqual(AUDIT_SCHEMA_VERSION, 1)
+        self.assertEqual(PINNED.canonical().decode("utf-8"), PINNED_CANONICAL)
+        self.assertEqual(PINNED.compute_hash(), PINNED_HASH)
+
+    def test_exported_record(self):
+        event = AuditEvent(**{**PINNED.__dict__, "hash": PINNED_HASH})
+        record = json.loads(event.to_json())
+        self.assertEqual(
+            sorted(record),
+            ["actor", "data", "event", "hash", "instance", "outcome", "prev_hash", "schema",
+             "seq", "source", "time"],
+        )
+        self.assertEqual(record["hash"], PINNED_HASH)
+        # The hash covers everything exported except itself
+        del record["hash"]
+        self.assertEqual(record, json.loads(PINNED_CANONICAL))
+
+    def test_data_key_order_does_not_change_the_hash(self):
+        reordered = AuditEvent(**{**PINNED.__dict__, "data": dict(reversed(PINNED.data.items()))})
+        self.assertEqual(reordered.compute_hash(), PINNED_HASH)
+
+    def test_syslog_message(self):
+        event = AuditEvent(**{**PINNED.__dict__, "hash": PINNED_HASH})
+        message = syslog_message(event, "smtp-proxy").decode("utf-8")
+        header, _, rest = message.partition(" [")
+        # Facility 13 (log audit), severity 4 (warning) for a failure
+        self.assertEqual(
+            header, "<108>1 2026-10-15T09:30:00.123456+00:00 node-1 smtp-proxy - web.login"
+        )
+        structured, _, body = rest.partition("] ")
+        self.assertEqual(
+            structured,
+            f'audit@32473 seq="7" outcome="failure" hash="{PINNED_HASH}" prev="{"ab" * 32}"',
+        )
+        self.assertEqual(body, event.to_json())
+
+
+class ChainTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.path = os.path.join(self.directory, "smtp_proxy.db")
+        self.db = Database(self.path)
+        self.repo = AuditRepository(self.db, instance_id="node-1")
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def record(self, count: int) -> list[AuditEvent]:
+        return [
+            self.repo.record("web.login", actor=f"user{n}", source="127.0.0.1", attempt=n)
+            for n in range(1, count + 1)
+        ]
+
+    def test_events_are_chained(self):
+        events = self.record(3)
+        self.assertEqual([event.id for event in events], [1, 2, 3])
+        self.assertEqual(events[0].prev_hash, AUDIT_GENESIS_HASH)
+        self.assertEqual(events[1].prev_hash, events[0].hash)
+        self.assertEqual(events[2].prev_hash, events[1].hash)
+        self.assertEqual(self.repo.verify(), (3, None))
+
+    def test_stored_events_hash_the_same(self):
+        [recorded] = self.record(1)
+        [stored] = self.repo.recent()
+        self.assertEqual(stored.record(), recorded.record())
+        self.assertEqual(stored.compute_hash(), recorded.hash)
+        self.assertEqual(stored.occurred_at.tzinfo, timezone.utc)
+
+    def test_empty_chain_verifies(self):
+        self.assertEqual(self.repo.verify(), (0, None))
+
+    def test_modified_event(self):
+        self.record(3)
+        self.db.execute("UPDATE audit_events SET actor = 'mallory' WHERE id = 2")
+        self.assertEqual(self.repo.verify(), (1, "event 2 was modified after it was recorded"))
+
+    def test_modified_event_with_its_hash_recomputed(self):
+        self.record(3)
+        self.db.execute("UPDATE audit_events SET outcome = 'failure' WHERE id = 2")
+        [forged] = [event for event in self.repo.iter_all() if event.id == 2]
+        self.db.execute(
+            "UPDATE audit_events SET hash = ? WHERE id = 2", (forged.compute_hash(),)
+        )
+        self.assertEqual(self.repo.verify(), (2, "event 3 does not follow event 2"))
+
+    def test_removed_event(self):
+        self.record(3)
+        self.db.execute("DELETE FROM audit_events WHERE id = 2")
+        self.assertEqual(self.repo.verify(), (1, "event 2 is missing (next is 3)"))
+
+    def test_reordered_events(self):
+        self.record(3)
+        self.db.execute("UPDATE audit_events SET id = 99 WHERE id = 2")
+        self.db.execute("UPDATE audit_events SET id = 2 WHERE id = 3")
+        self.db.execute("UPDATE audit_events SET id = 3 WHERE id = 99")
+        checked, problem = self.repo.verify()
+        self.assertEqual(checked, 1)
+        self.assertIsNotNone(problem)
+
+    def test_processes_sharing_the_database_extend_one_chain(self):
+        others = [Database(self.path) for _ in range(3)]
+        try:
+            def record(db: Database):
+                repo = AuditRepository(db)
+                for _ in range(20):
+                    self.assertIsNotNone(repo.record("smtp.auth", "failure"))
+
+            threads = [threading.Thread(target=record, args=(db,)) for db in others]
+            for thread in threads:
+                thread.start()
+            for thread in threads:
+                thread.join()
+        finally:
+            for db in others:
+                db.close()
+        self.assertEqual(self.repo.verify(), (60, None))
+
+    def test_read_only_database_records_nothing(self):
+        self.db.read_only = True
+        self.assertIsNone(self.repo.record("web.login"))
+        self.db.read_only = False
+        self.assertEqual(self.repo.verify(), (0, None))
+
+    def test_verify_command(self):
+        config = make_config(self.directory)
+        self.record(2)
+        run_verify_audit_command(config)
+        self.db.execute("UPDATE audit_events SET data = '{}' WHERE id = 1")
+        with self.assertRaises(SystemExit) as raised:
+            run_verify_audit_command(config)
+        self.assertEqual(raised.exception.code, 1)
+
+
+class FlakyTransport:
+    def __init__(self):
+        self.down = True
+        self.received: list[int] = []
+
+    def send(self, events: list[AuditEvent]) -> None:
+        if self.down:
+            raise ShipError("collector down")
+        self.received += [event.id for event in events]
+
+
+class SpoolTest(TempDirTestCase, unittest.TestCase):
+    def test_events_wait_for_the_collector_and_ship_in_order(self):
+        db = Database(os.path.join(self.directory, "smtp_proxy.db"))
+        try:
+            repo = AuditRepository(db)
+            transport = FlakyTransport()
+            shipper = SIEMShipper(SIEMConfig(batch_size=2), repo, transport=transport)
+            for n in range(5):
+                repo.record("web.login", attempt=n)
+            with self.assertRaises(ShipError):
+                shipper.ship_batch()
+            self.assertEqual(repo.pending_count(), 5)
+
+            transport.down = False
+            self.assertEqual([shipper.ship_batch() for _ in range(4)], [2, 2, 1, 0])
+            self.assertEqual(transport.received, [1, 2, 3, 4, 5])
+            self.assertEqual(repo.pending_count(), 0)
+        finally:
+            db.close()
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,213 @@
+"""Web logins try the configured providers in order and fall through to the next."""
+
+import json
+import os
+import unittest
+
+import bcrypt
+
+from smtp_proxy.config import AuthProviderConfig, Config
+from smtp_proxy.database import Database
+from smtp_proxy.database.user_repository import UserRepository
+from smtp_proxy.models import User
+from smtp_proxy.web.providers import (
+    AuthProvider,
+    DatabaseProvider,
+    HtpasswdProvider,
+    ProviderChain,
+    ProviderError,
+    build_providers,
+)
+
+from .helpers import TempDirTestCase, make_config
+
+
+def htpasswd_line(username: str, password: str, prefix: str = "$2b$") -> str:
+    password_hash = bcrypt.hashpw(password.encode(), bcrypt.gensalt(4)).decode()
+    return f"{username}:{prefix}{password_hash[4:]}"
+
+
+class UnavailableProvider(AuthProvider):
+    name = "unavailable"
+
+    def __init__(self):
+        self.calls = 0
+
+    def authenticate(self, username: str, password: str) -> User | None:
+        self.calls += 1
+        raise ProviderError("directory server down")
+
+
+class ProviderChainTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.db = Database(os.path.join(self.directory, "smtp_proxy.db"))
+        self.user_repo = UserRepository(self.db)
+        self.database = DatabaseProvider(self.user_repo)
+        self.path = os.path.join(self.directory, "htpasswd")
+        self.htpasswd = HtpasswdProvider(self.path, role="viewer")
+        self.mtime_ns = 1_000_000_000
+        # alice is in both stores with a different password in each
+        self.user_repo.create("alice", "db-secret", role="admin")
+        self.user_repo.create("bob", "bob-secret", role="admin")
+        self.write(htpasswd_line("alice", "file-secret"), htpasswd_line("carol", "carol-secret"))
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def write(self, *lines: str):
+        with open(self.path, "w") as f:
+            f.write("\n".join(lines) + "\n")
+        # Make every rewrite visible, however coarse the file system's clock
+        self.mtime_ns += 1_000_000_000
+        os.utime(self.path, ns=(self.mtime_ns, self.mtime_ns))
+
+    def sign_in(self, chain: ProviderChain, username: str, password: str) -> tuple | None:
+        result = chain.authenticate(username, password)
+        if result is None:
+            return None
+        user, provider = result
+        return user.username, user.role, provider.name
+
+    def test_first_provider_that_accepts_wins(self):
+        chain = ProviderChain([self.database, self.htpasswd])
+        self.assertEqual(self.sign_in(chain, "alice", "db-secret"), ("alice", "admin", "database"))
+        # A wrong password for the first provider falls through to the second
+        self.assertEqual(
+            self.sign_in(chain, "alice", "file-secret"), ("alice", "viewer", "htpasswd")
+        )
+        # So does a user the first provider does not know
+        self.assertEqual(
+            self.sign_in(chain, "carol", "carol-secret"), ("carol", "viewer", "htpasswd")
+        )
+        self.assertEqual(self.sign_in(chain, "bob", "bob-secret"), ("bob", "admin", "database"))
+        self.assertIsNone(self.sign_in(chain, "alice", "wrong"))
+        self.assertIsNone(self.sign_in(chain, "nobody", "db-secret"))
+
+    def test_order_decides_who_signs_in_a_user_known_to_both(self):
+        self.write(htpasswd_line("alice", "db-secret"))
+        self.assertEqual(
+            self.sign_in(ProviderChain([self.database, self.htpasswd]), "alice", "db-secret"),
+            ("alice", "admin", "database"),
+        )
+        self.assertEqual(
+            self.sign_in(ProviderChain([self.htpasswd, self.database]), "alice", "db-secret"),
+            ("alice", "viewer", "htpasswd"),
+        )
+
+    def test_unavailable_provider_is_skipped(self):
+        unavailable = UnavailableProvider()
+        chain = ProviderChain([unavailable, self.database])
+        self.assertEqual(self.sign_in(chain, "bob", "bob-secret"), ("bob", "admin", "database"))
+        self.assertEqual(unavailable.calls, 1)
+        self.assertIsNone(self.sign_in(ProviderChain([unavailable]), "bob", "bob-secret"))
+
+        os.remove(self.path)
+        chain = ProviderChain([self.htpasswd, self.database])
+        self.assertEqual(self.sign_in(chain, "alice", "db-secret"), ("alice", "admin", "database"))
+
+    def test_inactive_database_user_falls_through(self):
+        self.user_repo.set_active(self.user_repo.get_by_username("alice").id, False)
+        self.write(htpasswd_line("alice", "db-secret"))
+        chain = ProviderChain([self.database, self.htpasswd])
+        self.assertEqual(
+            self.sign_in(chain, "alice", "db-secret"), ("alice", "viewer", "htpasswd")
+        )
+
+    def test_manages_users(self):
+        self.assertTrue(ProviderChain([self.htpasswd, self.database]).manages_users)
+        self.assertFalse(ProviderChain([self.htpasswd]).manages_users)
+
+
+class HtpasswdProviderTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.path = os.path.join(self.directory, "htpasswd")
+        self.provider = HtpasswdProvider(self.path)
+
+    def write(self, content: str, mtime_ns: int):
+        with open(self.path, "w") as f:
+            f.write(content)
+        os.utime(self.path, ns=(mtime_ns, mtime_ns))
+
+    def test_reloads_when_the_file_changes(self):
+        self.write(htpasswd_line("alice", "secret") + "\n", 1_000_000_000)
+        self.assertIsNotNone(self.provider.authenticate("alice", "secret"))
+        self.assertIsNone(self.provider.authenticate("dave", "secret"))
+
+        self.write(htpasswd_line("dave", "secret") + "\n", 2_000_000_000)
+        self.assertIsNotNone(self.provider.authenticate("dave", "secret"))
+        self.assertIsNone(self.provider.authenticate("alice", "secret"))
+
+    def test_skips_lines_it_cannot_use(self):
+        self.write(
+            "\n".join([
+                "# comment",
+                "",
+                "plain:secret",
+                "apr1:$apr1$abc$def",
+                "nocolon",
+                htpasswd_line("php", "secret", prefix="$2y$"),
+                htpasswd_line("alice", "secret"),
+            ]),
+            1_000_000_000,
+        )
+        self.assertIsNone(self.provider.authenticate("plain", "secret"))
+        self.assertIsNone(self.provider.authenticate("apr1", "secret"))
+        self.assertEqual(self.provider.authenticate("php", "secret").username, "php")
+        self.assertEqual(self.provider.authenticate("alice", "secret").role, "admin")
+
+    def test_malformed_hash_refuses(self):
+        self.write("alice:$2b$\n", 1_000_000_000)
+        self.assertIsNone(self.provider.authenticate("alice", "secret"))
+
+    def test_missing_file_is_unavailable(self):
+        with self.assertRaises(ProviderError):
+            self.provider.authenticate("alice", "secret")
+
+
+class ProviderConfigTest(TempDirTestCase, unittest.TestCase):
+    def test_built_in_configured_order(self):
+        path = os.path.join(self.directory, "config.json")
+        with open(path, "w") as f:
+            json.dump({
+                "web": {
+                    "auth_providers": [
+                        {"type": "htpasswd", "path": "/etc/smtp-proxy/htpasswd", "role": "viewer"},
+                        {"type": "database"},
+                    ]
+                }
+            }, f)
+        config = Config.load(path)
+        chain = build_providers(config.web.auth_providers, user_repo=None)
+        self.assertEqual([provider.name for provider in chain.providers], ["htpasswd", "database"])
+        self.assertEqual(chain.providers[0].path, "/etc/smtp-proxy/htpasswd")
+        self.assertEqual(chain.providers[0].role, "viewer")
+
+    def test_database_is_the_default(self):
+        self.assertEqual([p.type for p in Config().web.auth_providers], ["database"])
+
+    def test_validation(self):
+        config = make_config(self.directory)
+        config.web.auth_providers = [
+            AuthProviderConfig(type="ldap"),
+            AuthProviderConfig(type="htpasswd"),
+            AuthProviderConfig(type="database", role="owner"),
+        ]
+        with self.assertRaises(ValueError) as raised:
+            config.validate()
+        for problem in (
+            "Unknown web auth provider type: ldap",
+            "Web htpasswd auth provider requires a path",
+            "Unknown web auth provider role: owner",
+        ):
+            self.assertIn(problem, str(raised.exception))
+
+        config.web.auth_providers = []
+        with self.assertRaisesRegex(ValueError, "At least one web auth provider is required"):
+            config.validate()
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,168 @@
+"""The diff behind /emails/compare lines texts up and marks what changed."""
+
+import json
+import unittest
+
+from smtp_proxy import diff
+from smtp_proxy.diff import KIND_CHANGE, KIND_DELETE, KIND_EQUAL, KIND_INSERT, Segment, diff_text
+from smtp_proxy.extract import extract_content
+from smtp_proxy.models import Email
+from smtp_proxy.web.routes import compare_sections, extract_html
+
+
+def rows(result: diff.DiffResult) -> list[tuple]:
+    """Summarise each row as (kind, left_no, right_no, left text, right text)."""
+    return [
+        (
+            line.kind,
+            line.left_no,
+            line.right_no,
+            "".join(s.text for s in line.left),
+            "".join(s.text for s in line.right),
+        )
+        for line in result.lines
+    ]
+
+
+class DiffTextTest(unittest.TestCase):
+    def test_identical(self):
+        result = diff_text("a\nb\n", "a\nb\n")
+        self.assertTrue(result.identical)
+        self.assertFalse(result.truncated)
+        self.assertEqual(rows(result), [(KIND_EQUAL, 1, 1, "a", "a"), (KIND_EQUAL, 2, 2, "b", "b")])
+
+    def test_empty(self):
+        self.assertEqual(diff_text("", "").lines, [])
+        self.assertTrue(diff_text("", "").identical)
+        self.assertEqual(rows(diff_text("", "a")), [(KIND_INSERT, None, 1, "", "a")])
+        self.assertEqual(rows(diff_text("a", "")), [(KIND_DELETE, 1, None, "a", "")])
+
+    def test_line_endings_do_not_count_as_changes(self):
+        self.assertTrue(diff_text("a\r\nb\r\n", "a\nb").identical)
+
+    def test_insertion_shifts_right_line_numbers(self):
+        result = diff_text("a\nb\nc", "a\nnew\nb\nc")
+        self.assertFalse(result.identical)
+        self.assertEqual(
+            rows(result),
+            [
+                (KIND_EQUAL, 1, 1, "a", "a"),
+                (KIND_INSERT, None, 2, "", "new"),
+                (KIND_EQUAL, 2, 3, "b", "b"),
+                (KIND_EQUAL, 3, 4, "c", "c"),
+            ],
+        )
+
+    def test_deletion_shifts_left_line_numbers(self):
+        self.assertEqual(
+            rows(diff_text("a\nold\nb", "a\nb")),
+            [
+                (KIND_EQUAL, 1, 1, "a", "a"),
+                (KIND_DELETE, 2, None, "old", ""),
+                (KIND_EQUAL, 3, 2, "b", "b"),
+            ],
+        )
+
+    def test_changed_line_flags_only_differing_characters(self):
+        [line] = diff_text("Total: 10 EUR", "Total: 12 EUR").lines
+        self.assertEqual(line.kind, KIND_CHANGE)
+        self.assertEqual((line.left_no, line.right_no), (1, 1))
+        self.assertEqual(
+            line.left, [Segment("Total: 1"), Segment("0", True), Segment(" EUR")]
+        )
+        self.assertEqual(
+            line.right, [Segment("Total: 1"), Segment("2", True), Segment(" EUR")]
+        )
+
+    def test_insertion_within_a_line_has_no_left_segment(self):
+        [line] = diff_text("Hello world", "Hello big world").lines
+        self.assertEqual(line.left, [Segment("Hello "), Segment("world")])
+        self.assertEqual(line.right, [Segment("Hello "), Segment("big ", True), Segment("world")])
+
+    def test_uneven_replacement_pairs_lines_then_inserts_the_rest(self):
+        self.assertEqual(
+            rows(diff_text("start\nx1\nx2\nend", "start\ny1\ny2\ny3\nend")),
+            [
+                (KIND_EQUAL, 1, 1, "start", "start"),
+                (KIND_CHANGE, 2, 2, "x1", "y1"),
+                (KIND_CHANGE, 3, 3, "x2", "y2"),
+                (KIND_INSERT, None, 4, "", "y3"),
+                (KIND_EQUAL, 4, 5, "end", "end"),
+            ],
+        )
+        self.assertEqual(
+            rows(diff_text("x1\nx2\nx3", "y1")),
+            [
+                (KIND_CHANGE, 1, 1, "x1", "y1"),
+                (KIND_DELETE, 2, None, "x2", ""),
+                (KIND_DELETE, 3, None, "x3", ""),
+            ],
+        )
+
+    def test_long_inputs_are_truncated(self):
+        result = diff_text("a" * 50, "a" * 10, max_chars=20)
+        self.assertTrue(result.truncated)
+        self.assertEqual(rows(result), [(KIND_CHANGE, 1, 1, "a" * 20, "a" * 10)])
+        self.assertFalse(diff_text("a" * 20, "b", max_chars=20).truncated)
+
+    def test_to_dict_is_json(self):
+        data = json.loads(json.dumps(diff_text("a\nb", "a\nc", max_chars=100).to_dict()))
+        self.assertEqual(data["identical"], False)
+        self.assertEqual(data["truncated"], False)
+        self.assertEqual(
+            data["lines"][1],
+            {
+                "kind": "change",
+                "left_no": 2,
+                "right_no": 2,
+                "left": [{"text": "b", "changed": True}],
+                "right": [{"text": "c", "changed": True}],
+            },
+        )
+
+
+def email(raw: bytes) -> Email:
+    return Email(raw_message=raw, body=extract_content(raw).body)
+
+
+HTML = (
+    b'From: a@example.com\r\nSubject: {subject}\r\nMIME-Version: 1.0\r\n'
+    b'Content-Type: multipart/alternative; boundary="b"\r\n\r\n'
+    b"--b\r\nContent-Type: text/plain\r\n\r\nHello {name}\r\n"
+    b"--b\r\nContent-Type: text/html\r\n\r\n<p>Hello {name}</p>\r\n--b--\r\n"
+)
+
+
+class CompareSectionsTest(unittest.TestCase):
+    def message(self, subject: str, name: str) -> Email:
+        return email(HTML.replace(b"{subject}", subject.encode()).replace(b"{name}", name.encode()))
+
+    def test_sections(self):
+        sections = compare_sections(self.message("Welcome", "Ann"), self.message("Welcome!", "Bob"))
+        self.assertEqual([s["name"] for s in sections], ["Headers", "Text Body", "HTML Source"])
+        headers, text, html = (s["diff"] for s in sections)
+        self.assertEqual(
+            [(row[0], row[3], row[4]) for row in rows(headers)],
+            [
+                (KIND_EQUAL, "From: a@example.com", "From: a@example.com"),
+                (KIND_CHANGE, "Subject: Welcome", "Subject: Welcome!"),
+                (KIND_EQUAL, "Content-Type: multipart/alternative; boundary=\"b\"",
+                 "Content-Type: multipart/alternative; boundary=\"b\""),
+            ],
+        )
+        self.assertEqual(rows(text), [(KIND_CHANGE, 1, 1, "Hello Ann", "Hello Bob")])
+        self.assertEqual(rows(html), [(KIND_CHANGE, 1, 1, "<p>Hello Ann</p>", "<p>Hello Bob</p>")])
+
+    def test_same_message_is_identical_everywhere(self):
+        sections = compare_sections(self.message("Hi", "Ann"), self.message("Hi", "Ann"))
+        self.assertTrue(all(s["diff"].identical for s in sections))
+
+    def test_plain_text_message_has_no_html(self):
+        plain = email(b"Subject: Hi\r\n\r\nHello\r\n")
+        self.assertEqual(extract_html(plain.raw_message), "")
+        html = compare_sections(plain, self.message("Hi", "Ann"))[2]["diff"]
+        self.assertEqual(rows(html), [(KIND_INSERT, None, 1, "", "<p>Hello Ann</p>")])
+
+
+if __name__ == "__main__":
+    unittest.main()
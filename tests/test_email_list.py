@@ -0,0 +1,58 @@
+"""Listing emails reads neither their bodies nor their raw messages."""
+
+import os
+import unittest
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.models import Email
+
+from .helpers import TempDirTestCase
+
+RAW_MESSAGE = b"Subject: Report\r\n\r\n" + b"quarterly numbers\r\n" * 1000
+
+
+class EmailListTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.db = Database(os.path.join(self.directory, "smtp_proxy.db"))
+        self.repo = EmailRepository(self.db)
+        self.email_id = self.repo.create(
+            Email(
+                sender="a@example.com",
+                recipients=["b@example.com"],
+                subject="Report",
+                body="quarterly numbers",
+                raw_message=RAW_MESSAGE,
+                size_bytes=len(RAW_MESSAGE),
+            )
+        )
+        self.queries = []
+        self.db.conn.set_trace_callback(self.queries.append)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def assert_listed(self, emails: list[Email]):
+        self.assertEqual([email.id for email in emails], [self.email_id])
+        email = emails[0]
+        self.assertEqual(email.subject, "Report")
+        self.assertEqual(email.preview, "quarterly numbers")
+        self.assertEqual(email.size_bytes, len(RAW_MESSAGE))
+        self.assertEqual(email.raw_message, b"")
+        for query in self.queries:
+            self.assertNotRegex(query, r"SELECT (emails\.)?\*|raw_message|\bbody\b")
+
+    def test_page(self):
+        self.assert_listed(self.repo.get_page(10))
+
+    def test_search(self):
+        self.assert_listed(self.repo.search(sender="a@example.com", limit=10))
+        self.assert_listed(self.repo.search(text="quarterly", limit=10))
+
+    def test_single_email_has_its_raw_message(self):
+        self.assertEqual(self.repo.get_by_id(self.email_id).raw_message, RAW_MESSAGE)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,49 @@
+"""Signing and encryption are detected once, when an email is stored."""
+
+import os
+import unittest
+
+from smtp_proxy.crypto import SecurityReport
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.models import Email
+
+from .helpers import TempDirTestCase
+
+PGP_SIGNED = (
+    b'Content-Type: multipart/signed; protocol="application/pgp-signature"; boundary=b\r\n'
+    b"Subject: Signed\r\n\r\n--b--\r\n"
+)
+PLAIN = b"Subject: Plain\r\n\r\nHello\r\n"
+
+
+class EmailSecurityTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.db = Database(os.path.join(self.directory, "smtp_proxy.db"))
+        self.repo = EmailRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def store(self, raw_message: bytes) -> int:
+        return self.repo.create(
+            Email(sender="a@example.com", recipients=["b@example.com"], raw_message=raw_message)
+        )
+
+    def test_detected_when_stored(self):
+        signed, plain = self.store(PGP_SIGNED), self.store(PLAIN)
+        security = {email.id: email.security for email in self.repo.get_page(10, 0)}
+        self.assertEqual(security, {signed: "pgp:signed", plain: ""})
+        self.assertEqual(SecurityReport.from_summary(security[signed]).label, "PGP signed")
+        self.assertIsNone(SecurityReport.from_summary(security[plain]))
+
+    def test_backfill_detects_older_emails(self):
+        signed = self.store(PGP_SIGNED)
+        self.db.execute("UPDATE emails SET security = NULL")
+        self.assertEqual(self.repo.backfill_security(), 1)
+        self.assertEqual(self.repo.get_by_id(signed).security, "pgp:signed")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,155 @@
+"""New emails reach live email lists without a slow client holding anyone up."""
+
+import asyncio
+import json
+import threading
+import unittest
+from datetime import datetime
+
+from smtp_proxy.events import EmailEvent, EmailEvents
+from smtp_proxy.privacy import hash_subject
+from smtp_proxy.web.routes import email_event_stream
+
+from .helpers import SMTPClient, TempDirTestCase, build_application, make_config, running
+
+MESSAGE = b"From: a@example.com\r\nTo: b@example.com\r\nSubject: Quarterly report\r\n\r\nHi\r\n"
+
+
+def event(n: int) -> EmailEvent:
+    return EmailEvent(n, "a@example.com", f"Subject {n}", datetime(2026, 1, 1).isoformat())
+
+
+def parse(chunk: str) -> tuple[str, dict]:
+    """Return the event name and data of one server-sent event."""
+    fields = dict(line.split(": ", 1) for line in chunk.strip().split("\n"))
+    return fields["event"], json.loads(fields["data"])
+
+
+class EmailEventsTest(unittest.IsolatedAsyncioTestCase):
+    async def test_only_the_client_that_falls_behind_drops_events(self):
+        events = EmailEvents(queue_size=3)
+        slow, fast = events.subscribe(), events.subscribe()
+        received = []
+        for n in range(1, 6):
+            events.publish(event(n))
+            received.append((await fast.get()).id)
+
+        self.assertEqual(received, [1, 2, 3, 4, 5])
+        self.assertEqual(fast.take_dropped(), 0)
+        self.assertEqual([(await slow.get()).id for _ in range(3)], [1, 2, 3])
+        self.assertEqual(slow.take_dropped(), 2)
+        # The count restarts once taken
+        self.assertEqual(slow.take_dropped(), 0)
+        events.publish(event(6))
+        self.assertEqual((await slow.get()).id, 6)
+
+    async def test_publish_reaches_nobody_once_unsubscribed(self):
+        events = EmailEvents()
+        subscription = events.subscribe()
+        self.assertTrue(events.active)
+        events.unsubscribe(subscription)
+        self.assertFalse(events.active)
+        events.publish(event(1))
+        self.assertTrue(subscription.queue.empty())
+
+    async def test_close_ends_even_a_full_queue(self):
+        events = EmailEvents(queue_size=2)
+        subscription = events.subscribe()
+        for n in range(1, 4):
+            events.publish(event(n))
+        events.close()
+        self.assertFalse(events.active)
+        # Room is made for the end of the stream behind the queued events
+        self.assertEqual((await subscription.get()).id, 2)
+        self.assertIsNone(await subscription.get())
+        # Clients connecting during shutdown are ended straight away
+        self.assertIsNone(await events.subscribe().get())
+
+
+class EventStreamTest(unittest.IsolatedAsyncioTestCase):
+    async def test_stream_reports_what_a_slow_client_missed(self):
+        events = EmailEvents(queue_size=2)
+        stream = email_event_stream(events)
+        self.assertEqual(await anext(stream), "retry: 5000\n\n")
+        for n in range(1, 6):
+            events.publish(event(n))
+
+        first = await anext(stream)
+        self.assertTrue(first.startswith("id: 1\n"))
+        self.assertEqual(parse(first), ("email", event(1).to_dict()))
+        self.assertEqual(parse(await anext(stream)), ("dropped", {"count": 3}))
+        self.assertEqual(parse(await anext(stream))[1]["id"], 2)
+        await stream.aclose()
+        self.assertFalse(events.active)
+
+    async def test_streams_end_cleanly_on_close(self):
+        events = EmailEvents()
+        streams = [email_event_stream(events) for _ in range(3)]
+        for stream in streams:
+            await anext(stream)
+        readers = [asyncio.create_task(anext(stream)) for stream in streams]
+        await asyncio.sleep(0.05)
+        self.assertEqual(len(events._subscribers), 3)
+
+        events.close()
+        for reader in readers:
+            with self.assertRaises(StopAsyncIteration):
+                await asyncio.wait_for(reader, 1)
+        self.assertFalse(events.active)
+
+
+class SMTPEventsTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    async def receive(self, **privacy) -> tuple[EmailEvent, list[threading.Thread]]:
+        config = make_config(self.directory)
+        config.components = "smtp"
+        for name, value in privacy.items():
+            setattr(config.privacy, name, value)
+        application = build_application(config)
+        self.addCleanup(application.close)
+        email_repo = application.smtp_server.email_repo
+        threads = []
+        get_by_id = email_repo.get_by_id
+
+        def recording(email_id):
+            threads.append(threading.current_thread())
+            return get_by_id(email_id)
+
+        email_repo.get_by_id = recording
+        subscription = application.events.subscribe()
+        async with running(application.smtp_server) as server:
+            client = await SMTPClient.connect(server)
+            code, _ = await client.send("a@example.com", "b@example.com", MESSAGE)
+            self.assertEqual(code, 250)
+            await client.close()
+        return await asyncio.wait_for(subscription.get(), 1), threads
+
+    async def test_stored_email_is_announced_without_blocking_the_loop(self):
+        announced, threads = await self.receive()
+        self.assertEqual(announced.sender, "a@example.com")
+        self.assertEqual(announced.subject, "Quarterly report")
+        self.assertTrue(threads)
+        self.assertNotIn(threading.main_thread(), threads)
+
+    async def test_announced_subject_is_hashed_like_the_stored_one(self):
+        announced, _ = await self.receive(hash_subject=True)
+        self.assertEqual(announced.subject, hash_subject("Quarterly report"))
+
+    async def test_shutdown_ends_open_streams(self):
+        config = make_config(self.directory)
+        config.components = "smtp"
+        application = build_application(config)
+        stream = email_event_stream(application.events)
+        await anext(stream)
+        reader = asyncio.create_task(anext(stream))
+
+        shutdown = asyncio.Event()
+        run = asyncio.create_task(application.run(shutdown))
+        await asyncio.sleep(0.1)
+        shutdown.set()
+        await asyncio.wait_for(run, 10)
+        with self.assertRaises(StopAsyncIteration):
+            await asyncio.wait_for(reader, 1)
+
+
+if __name__ == "__main__":
+    unittest.main()
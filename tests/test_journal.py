@@ -0,0 +1,203 @@
+"""Every change to stored emails leaves a journal entry, written with the change itself."""
+
+import inspect
+import os
+import sqlite3
+import unittest
+from datetime import datetime, timedelta
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.database.journal_repository import JournalRepository
+from smtp_proxy.database.quota_repository import QuotaExceededError
+from smtp_proxy.models import Email
+
+from .helpers import TempDirTestCase
+
+RAW_MESSAGE = b"Subject: Order shipped\r\n\r\nSecret tracking number 1Z999\r\n"
+
+
+class JournalTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.db = Database(os.path.join(self.directory, "smtp_proxy.db"))
+        self.repo = EmailRepository(self.db)
+        self.journal = JournalRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def store(self, subject: str = "Order shipped", status: str = "received") -> int:
+        return self.repo.create(
+            Email(
+                sender="shop@example.com",
+                recipients=["buyer@example.com"],
+                subject=subject,
+                body="Secret tracking number 1Z999",
+                raw_message=RAW_MESSAGE,
+                size_bytes=len(RAW_MESSAGE),
+                status=status,
+            ),
+            actor="smtp:shop",
+        )
+
+    def entries(self) -> list[tuple]:
+        return [
+            (entry.action, entry.email_id, entry.actor, entry.old_status, entry.new_status)
+            for entry in reversed(self.journal.recent())
+        ]
+
+    def test_create(self):
+        email_id = self.store()
+        [entry] = self.journal.for_email(email_id)
+        self.assertEqual(entry.action, "receive")
+        self.assertEqual(entry.actor, "smtp:shop")
+        self.assertEqual(entry.new_status, "received")
+        self.assertEqual(
+            (entry.sender, entry.subject, entry.size_bytes),
+            ("shop@example.com", "Order shipped", len(RAW_MESSAGE)),
+        )
+        self.assertEqual(entry.received_at, self.repo.get_by_id(email_id).received_at)
+
+    def test_create_over_quota_journals_nothing(self):
+        self.repo.create(Email(sender="a@example.com"), quota=("shop", 1))
+        with self.assertRaises(QuotaExceededError):
+            self.repo.create(Email(sender="a@example.com"), quota=("shop", 1))
+        self.assertEqual([entry[0] for entry in self.entries()], ["receive"])
+
+    def test_update_status(self):
+        email_id = self.store()
+        self.assertTrue(self.repo.update_status(email_id, "read", actor="web:alice"))
+        # Setting the status it already has is not a change
+        self.assertTrue(self.repo.update_status(email_id, "read", actor="web:alice"))
+        self.assertEqual(
+            self.entries(),
+            [
+                ("receive", email_id, "smtp:shop", "", "received"),
+                ("status", email_id, "web:alice", "received", "read"),
+            ],
+        )
+
+    def test_update_status_all(self):
+        first, second = self.store(), self.store()
+        untouched = self.store(status="held")
+        self.assertEqual(self.repo.update_status_all("received", "read", actor="web:alice"), 2)
+        statuses = [entry for entry in self.entries() if entry[0] == "status"]
+        self.assertEqual(
+            sorted(statuses),
+            [
+                ("status", first, "web:alice", "received", "read"),
+                ("status", second, "web:alice", "received", "read"),
+            ],
+        )
+        self.assertEqual([e.action for e in self.journal.for_email(untouched)], ["receive"])
+
+    def test_delete(self):
+        email_id = self.store()
+        self.repo.update_status(email_id, "read")
+        self.assertTrue(self.repo.delete(email_id, actor="web:alice"))
+        entry = self.journal.for_email(email_id)[-1]
+        self.assertEqual(
+            (entry.action, entry.actor, entry.old_status), ("delete", "web:alice", "read")
+        )
+        # The tombstone keeps metadata only
+        self.assertEqual((entry.sender, entry.subject), ("shop@example.com", "Order shipped"))
+        self.assertEqual(entry.size_bytes, len(RAW_MESSAGE))
+        self.assert_no_content()
+
+    def test_delete_by_ids(self):
+        first, second, kept = self.store(), self.store(), self.store()
+        self.assertEqual(self.repo.delete_by_ids([first, second, 999], actor="web:alice"), 2)
+        deletions = sorted(entry[1] for entry in self.entries() if entry[0] == "delete")
+        self.assertEqual(deletions, [first, second])
+        self.assertEqual([e.action for e in self.journal.for_email(kept)], ["receive"])
+
+    def test_delete_all(self):
+        first, second = self.store(), self.store("Invoice")
+        self.assertEqual(self.repo.delete_all(actor="web:admin"), 2)
+        entries = self.journal.recent()
+        wipe = entries[0]
+        self.assertEqual(
+            (wipe.action, wipe.email_id, wipe.actor, wipe.count), ("wipe", None, "web:admin", 2)
+        )
+        self.assertEqual(
+            sorted((e.email_id, e.subject) for e in entries if e.action == "delete"),
+            [(first, "Order shipped"), (second, "Invoice")],
+        )
+        self.assert_no_content()
+
+    def test_record(self):
+        email_id = self.store()
+        self.journal.record(email_id, "release", "web:alice", "Sent to mx.example.com: 250 OK")
+        entry = self.journal.for_email(email_id)[-1]
+        self.assertEqual(
+            (entry.action, entry.old_status, entry.new_status), ("release", "received", "received")
+        )
+        self.assertEqual(entry.detail, "Sent to mx.example.com: 250 OK")
+
+    def test_failed_change_leaves_no_entry(self):
+        email_id = self.store()
+        self.db.execute(
+            "CREATE TRIGGER refuse_update BEFORE UPDATE ON emails "
+            "BEGIN SELECT RAISE(ABORT, 'refused'); END"
+        )
+        self.db.execute(
+            "CREATE TRIGGER refuse_delete BEFORE DELETE ON emails "
+            "BEGIN SELECT RAISE(ABORT, 'refused'); END"
+        )
+        for change in (
+            lambda: self.repo.update_status(email_id, "read"),
+            lambda: self.repo.update_status_all("received", "read"),
+            lambda: self.repo.delete(email_id),
+            lambda: self.repo.delete_all(),
+        ):
+            with self.assertRaises(sqlite3.IntegrityError):
+                change()
+        self.assertEqual([entry[0] for entry in self.entries()], ["receive"])
+
+    def test_as_of_rolls_back_later_changes(self):
+        deleted, changed = self.store("Gone"), self.store("Changed")
+        before = datetime.now()
+        self.repo.delete(deleted)
+        self.repo.update_status(changed, "read")
+        snapshot = {entry["id"]: entry for entry in self.journal.as_of(before)}
+        self.assertEqual(snapshot[deleted]["subject"], "Gone")
+        self.assertTrue(snapshot[deleted]["deleted"])
+        self.assertEqual(snapshot[changed]["status"], "received")
+        self.assertFalse(snapshot[changed]["deleted"])
+
+    def test_purge_keeps_entries_within_retention(self):
+        email_id = self.store()
+        self.repo.update_status(email_id, "read")
+        old = (datetime.now() - timedelta(days=10)).isoformat()
+        self.db.execute(
+            "UPDATE email_journal SET occurred_at = ? WHERE action = 'receive'", (old,)
+        )
+        self.assertEqual(self.journal.purge(0), 0)
+        self.assertEqual(self.journal.purge(30), 0)
+        self.assertEqual(self.journal.purge(7), 1)
+        self.assertEqual([e.action for e in self.journal.for_email(email_id)], ["status"])
+
+    def assert_no_content(self):
+        rows = self.db.fetchall("SELECT * FROM email_journal")
+        for row in rows:
+            for value in tuple(row):
+                self.assertNotIn("1Z999", str(value))
+
+    def test_every_journaled_method_is_covered(self):
+        # A new method writing to the journal needs its own test above
+        journaled = sorted(
+            name for name, method in inspect.getmembers(EmailRepository, inspect.isfunction)
+            if any(call in inspect.getsource(method) for call in ("journal_", "delete_by_ids("))
+        )
+        self.assertEqual(
+            journaled,
+            [
+                "create", "delete", "delete_all", "delete_by_ids", "update_status",
+                "update_status_all",
+            ],
+        )
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,180 @@
+"""Each deliverability check passes clean mail and explains what it flags."""
+
+import base64
+import unittest
+from unittest import mock
+
+from smtp_proxy import lint
+from smtp_proxy.extract import extract_content
+from smtp_proxy.models import Email
+
+HEADERS = (
+    "From: App <app@example.com>\r\n"
+    "To: user@example.org\r\n"
+    "Date: Thu, 15 Oct 2026 09:00:00 +0000\r\n"
+    "Message-ID: <1@example.com>\r\n"
+    "Subject: Welcome\r\n"
+)
+
+ALTERNATIVE = (
+    'MIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary="b"\r\n\r\n'
+    "--b\r\nContent-Type: text/plain\r\n\r\nHi\r\n"
+    "--b\r\nContent-Type: text/html\r\n\r\n<p>Hi</p>\r\n--b--\r\n"
+)
+
+
+def email(headers: str = HEADERS, body: str = "Content-Type: text/plain\r\n\r\nHi\r\n",
+          sender: str = "app@example.com", size_bytes: int = 0) -> Email:
+    raw = (headers + body).encode()
+    return Email(
+        sender=sender,
+        recipients=["user@example.org"],
+        subject=extract_content(raw).subject,
+        raw_message=raw,
+        size_bytes=size_bytes or len(raw),
+    )
+
+
+def replace(header: str, value: str | None) -> str:
+    """Return HEADERS with one header replaced, or dropped when value is None."""
+    lines = [line for line in HEADERS.split("\r\n") if line and not line.startswith(header + ":")]
+    if value is not None:
+        lines.append(f"{header}: {value}")
+    return "\r\n".join(lines) + "\r\n"
+
+
+def html_only(image_bytes: int) -> str:
+    image = base64.encodebytes(b"\0" * image_bytes).decode().replace("\n", "\r\n")
+    return (
+        'MIME-Version: 1.0\r\nContent-Type: multipart/related; boundary="b"\r\n\r\n'
+        "--b\r\nContent-Type: text/html\r\n\r\n<img src=\"cid:logo\">\r\n"
+        "--b\r\nContent-Type: image/png\r\nContent-Transfer-Encoding: base64\r\n"
+        f"Content-ID: <logo>\r\n\r\n{image}--b--\r\n"
+    )
+
+
+class CheckTest(unittest.TestCase):
+    def finding(self, name: str, message: Email) -> lint.Finding:
+        return next(f for f in lint.run_checks(message).findings if f.name == name)
+
+    def assert_passes(self, name: str, message: Email):
+        finding = self.finding(name, message)
+        self.assertTrue(finding.passed, finding.detail)
+        self.assertEqual(finding.detail, "")
+
+    def assert_fails(self, name: str, message: Email, detail: str):
+        finding = self.finding(name, message)
+        self.assertFalse(finding.passed)
+        self.assertIn(detail, finding.detail)
+
+    def test_clean_message_passes_everything(self):
+        report = lint.run_checks(email(body=ALTERNATIVE))
+        self.assertEqual(report.failures, [])
+        self.assertEqual(report.score, 100)
+
+    def test_message_id(self):
+        self.assert_passes("message_id", email())
+        self.assert_fails("message_id", email(replace("Message-ID", None)), "missing")
+        twice = HEADERS + "Message-ID: <2@example.com>\r\n"
+        self.assert_fails("message_id", email(twice), "appears 2 times")
+
+    def test_date(self):
+        self.assert_passes("date", email())
+        self.assert_fails("date", email(replace("Date", None)), "missing")
+        twice = HEADERS + "Date: Thu, 15 Oct 2026 10:00:00 +0000\r\n"
+        self.assert_fails("date", email(twice), "appears 2 times")
+
+    def test_text_alternative(self):
+        self.assert_passes("text_alternative", email())
+        self.assert_passes("text_alternative", email(body=ALTERNATIVE))
+        html = "Content-Type: text/html\r\n\r\n<p>Hi</p>\r\n"
+        self.assert_fails("text_alternative", email(body=html), "no text/plain alternative")
+
+    def test_inline_images(self):
+        self.assert_passes("inline_images", email(body=html_only(1024)))
+        self.assert_fails(
+            "inline_images",
+            email(body=html_only(lint.MAX_INLINE_IMAGE_BYTES + 1)),
+            f"embeds {lint.MAX_INLINE_IMAGE_BYTES + 1} bytes of images",
+        )
+
+    def test_subject_length(self):
+        limit = lint.MAX_SUBJECT_LENGTH
+        self.assert_passes("subject_length", email(replace("Subject", "x" * limit)))
+        self.assert_fails(
+            "subject_length", email(replace("Subject", "x" * (limit + 1))),
+            f"{limit + 1} characters",
+        )
+
+    def test_list_unsubscribe(self):
+        self.assert_passes("list_unsubscribe", email())
+        bulk = HEADERS + "Precedence: Bulk\r\n"
+        self.assert_fails("list_unsubscribe", email(bulk), "Precedence is 'bulk'")
+        unsubscribe = bulk + "List-Unsubscribe: <mailto:unsubscribe@example.com>\r\n"
+        self.assert_passes("list_unsubscribe", email(unsubscribe))
+
+    def test_from_domain(self):
+        self.assert_passes("from_domain", email())
+        self.assert_passes("from_domain", email(replace("From", "App <app@EXAMPLE.com.>")))
+        self.assert_fails(
+            "from_domain", email(sender="bounces@mailer.example.net"),
+            "From domain example.com differs from envelope domain mailer.example.net",
+        )
+        self.assert_fails("from_domain", email(replace("From", None)), "missing")
+        # A null reverse-path has no domain to compare
+        self.assert_passes("from_domain", email(sender=""))
+
+    def test_total_size(self):
+        self.assert_passes("total_size", email(size_bytes=lint.MAX_TOTAL_BYTES))
+        self.assert_fails(
+            "total_size", email(size_bytes=lint.MAX_TOTAL_BYTES + 1),
+            f"{lint.MAX_TOTAL_BYTES + 1} bytes",
+        )
+
+    def test_encoded_words(self):
+        self.assert_passes("encoded_words", email(replace("Subject", "=?utf-8?B?SMOpbGxv?=")))
+        self.assert_passes("encoded_words", email(replace("Subject", "=?utf-8?Q?H=C3=A9llo?=")))
+        self.assert_fails(
+            "encoded_words", email(replace("Subject", "=?utf-8?B?SMOpbGxv")), "malformed"
+        )
+        self.assert_fails(
+            "encoded_words", email(replace("Subject", "=?utf-8?B?SMO?=")), "undecodable"
+        )
+        self.assert_fails(
+            "encoded_words", email(replace("From", "=?no-such-charset?Q?x?= <app@example.com>")),
+            "From header has an undecodable",
+        )
+
+    def test_every_check_is_covered(self):
+        # A new check needs its own test above
+        self.assertEqual(
+            [registered.name for registered in lint.CHECKS],
+            [
+                "message_id", "date", "text_alternative", "inline_images", "subject_length",
+                "list_unsubscribe", "from_domain", "total_size", "encoded_words",
+            ],
+        )
+
+
+class ReportTest(unittest.TestCase):
+    def test_score_weighs_errors_double(self):
+        weights = [lint.SEVERITY_WEIGHTS[registered.severity] for registered in lint.CHECKS]
+        # A missing Date is an error, a missing text alternative a warning
+        message = email(replace("Date", None), "Content-Type: text/html\r\n\r\n<p>Hi</p>\r\n")
+        report = lint.run_checks(message)
+        self.assertEqual({f.name for f in report.failures}, {"date", "text_alternative"})
+        total = sum(weights)
+        self.assertEqual(report.score, round(100 * (total - 3) / total))
+
+    def test_check_that_raises_is_reported_as_failed(self):
+        func = mock.Mock(side_effect=KeyError("x"))
+        broken = lint.Check("broken", "Broken", lint.SEVERITY_WARNING, func)
+        with mock.patch.object(lint, "CHECKS", [broken]):
+            report = lint.run_checks(email())
+        [finding] = report.failures
+        self.assertEqual(finding.detail, "Check failed to run: 'x'")
+        self.assertEqual(report.score, 0)
+
+
+if __name__ == "__main__":
+    unittest.main()
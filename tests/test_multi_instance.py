@@ -0,0 +1,145 @@
+"""Instances sharing a database run each leased background job only once."""
+
+import asyncio
+import re
+import time
+import unittest
+from unittest import mock
+
+from smtp_proxy.database import AuditRepository, Database, JournalRepository, LeaseRepository
+from smtp_proxy.main import Application, run_journal_purge
+
+from .helpers import TempDirTestCase, make_config
+
+
+class LeaseTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        path = f"{self.directory}/smtp_proxy.db"
+        # One connection per instance, as separate processes would have
+        self.dbs = [Database(path), Database(path)]
+        self.first, self.second = (
+            LeaseRepository(db, holder) for db, holder in zip(self.dbs, ("first", "second"))
+        )
+
+    def tearDown(self):
+        for db in self.dbs:
+            db.close()
+        super().tearDown()
+
+    def test_one_holder_at_a_time(self):
+        self.assertTrue(self.first.acquire("job", 60))
+        self.assertFalse(self.second.acquire("job", 60))
+        # The holder renews its own lease
+        self.assertTrue(self.first.acquire("job", 60))
+        self.assertEqual(self.second.holder_of("job"), "first")
+        # Other jobs are leased separately
+        self.assertTrue(self.second.acquire("other", 60))
+
+    def test_expired_lease_is_taken_over(self):
+        self.assertTrue(self.first.acquire("job", 0.1))
+        time.sleep(0.2)
+        self.assertTrue(self.second.acquire("job", 60))
+        self.assertFalse(self.first.acquire("job", 60))
+
+    def test_release(self):
+        self.assertTrue(self.first.acquire("job", 60))
+        # Only the holder can release a lease
+        self.second.release("job")
+        self.assertEqual(self.first.holder_of("job"), "first")
+        self.first.release("job")
+        self.assertIsNone(self.first.holder_of("job"))
+        self.assertTrue(self.second.acquire("job", 60))
+
+
+class UDPCollector(asyncio.DatagramProtocol):
+    """Collects the seq of every syslog message received."""
+
+    def __init__(self):
+        self.seqs: list[int] = []
+
+    def datagram_received(self, data, addr):
+        self.seqs.append(int(re.search(rb' seq="(\d+)"', data).group(1)))
+
+
+class TwoInstancesTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    async def asyncSetUp(self):
+        self.transport, self.collector = await asyncio.get_running_loop().create_datagram_endpoint(
+            UDPCollector, local_addr=("127.0.0.1", 0)
+        )
+        self.addCleanup(self.transport.close)
+        self.applications = []
+        for instance_id in ("proxy-a", "proxy-b"):
+            config = make_config(self.directory)
+            config.instance_id = instance_id
+            config.components = "smtp"
+            config.siem.enabled = True
+            config.siem.host, config.siem.port = self.transport.get_extra_info("sockname")
+            self.applications.append(Application(config))
+
+    async def test_no_job_runs_twice(self):
+        purges = []
+        purge = JournalRepository.purge
+
+        def record_purge(journal_repo, retention_days):
+            purges.append(journal_repo)
+            return purge(journal_repo, retention_days)
+
+        for application in self.applications:
+            application.build()
+        audit_repo = AuditRepository(self.applications[0].db)
+        events = [audit_repo.record("test_event", n=n).id for n in range(250)]
+
+        shutdown = asyncio.Event()
+        with (
+            mock.patch("smtp_proxy.main.PURGE_INTERVAL_SECONDS", 0.05),
+            mock.patch.object(JournalRepository, "purge", autospec=True, side_effect=record_purge),
+        ):
+            runs = [
+                asyncio.create_task(application.run(shutdown))
+                for application in self.applications
+            ]
+            for _ in range(100):
+                if len(self.collector.seqs) >= len(events) and len(purges) >= 5:
+                    break
+                await asyncio.sleep(0.05)
+            shutdown.set()
+            await asyncio.wait_for(asyncio.gather(*runs), 10)
+
+        # Every event reached the collector exactly once, from one instance
+        self.assertEqual(sorted(self.collector.seqs), events)
+        self.assertGreaterEqual(len(purges), 5)
+        self.assertEqual(len({id(journal_repo) for journal_repo in purges}), 1)
+        shippers = [application.siem for application in self.applications]
+        self.assertEqual(sorted(shipper.shipped for shipper in shippers), [0, len(events)])
+
+
+class PurgeTakeoverTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    async def test_another_instance_takes_over_once_the_holder_stops(self):
+        path = f"{self.directory}/smtp_proxy.db"
+        dbs = [Database(path), Database(path)]
+        for db in dbs:
+            self.addCleanup(db.close)
+        journals = [mock.Mock(wraps=JournalRepository(db)) for db in dbs]
+        leases = [LeaseRepository(db, holder) for db, holder in zip(dbs, ("a", "b"))]
+
+        with (
+            mock.patch("smtp_proxy.main.PURGE_INTERVAL_SECONDS", 0.05),
+            mock.patch("smtp_proxy.main.PURGE_LEASE_SECONDS", 0.3),
+        ):
+            first = asyncio.create_task(run_journal_purge(journals[0], 30, leases[0]))
+            await asyncio.sleep(0.02)
+            second = asyncio.create_task(run_journal_purge(journals[1], 30, leases[1]))
+            await asyncio.sleep(0.2)
+            self.assertGreater(journals[0].purge.call_count, 0)
+            journals[1].purge.assert_not_called()
+
+            first.cancel()
+            await asyncio.sleep(0.6)
+            second.cancel()
+        self.assertGreater(journals[1].purge.call_count, 0)
+        self.assertEqual(leases[0].holder_of("journal_purge"), "b")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,119 @@
+"""Web passwords are rehashed to the configured bcrypt cost once, at sign-in."""
+
+import os
+import threading
+import unittest
+from unittest import mock
+
+from smtp_proxy.config import WebConfig
+from smtp_proxy.database import Database, UserRepository
+from smtp_proxy.passwords import build_passwords
+
+from .helpers import TempDirTestCase, make_config
+
+SIGN_INS = 8
+
+
+class BcryptRehashTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.path = os.path.join(self.directory, "smtp_proxy.db")
+        self.db = Database(self.path)
+        self.users(cost=4).create("alice", "secret")
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def users(self, cost: int, db: Database | None = None) -> UserRepository:
+        return UserRepository(db or self.db, build_passwords(WebConfig(bcrypt_cost=cost)))
+
+    def stored_hash(self) -> str:
+        return self.users(cost=4).get_by_username("alice").password_hash
+
+    def test_new_hashes_use_the_configured_cost(self):
+        self.assertTrue(self.stored_hash().startswith("$2b$04$"))
+        users = self.users(cost=5)
+        users.update_password(users.get_by_username("alice").id, "changed")
+        self.assertTrue(self.stored_hash().startswith("$2b$05$"))
+
+    def test_upgrade_happens_exactly_once(self):
+        users = self.users(cost=5)
+        with mock.patch.object(users, "rehash_password", wraps=users.rehash_password) as rehash:
+            for _ in range(3):
+                self.assertIsNotNone(users.authenticate("alice", "secret"))
+        rehash.assert_called_once()
+        upgraded = self.stored_hash()
+        self.assertTrue(upgraded.startswith("$2b$05$"))
+        self.assertTrue(users.verify_password(users.get_by_username("alice"), "secret"))
+
+        # A failed sign-in never rehashes, nor does one at the cost already stored
+        self.assertIsNone(self.users(cost=6).authenticate("alice", "wrong"))
+        self.assertIsNone(users.authenticate("alice", "wrong"))
+        self.assertEqual(self.stored_hash(), upgraded)
+
+    def test_lowering_the_cost_rehashes_too(self):
+        self.assertIsNotNone(self.users(cost=5).authenticate("alice", "secret"))
+        self.assertIsNotNone(self.users(cost=4).authenticate("alice", "secret"))
+        self.assertTrue(self.stored_hash().startswith("$2b$04$"))
+
+    def test_read_only_database_keeps_the_hash(self):
+        before = self.stored_hash()
+        self.db.read_only = True
+        self.assertIsNotNone(self.users(cost=5).authenticate("alice", "secret"))
+        self.db.read_only = False
+        self.assertEqual(self.stored_hash(), before)
+
+    def test_concurrent_sign_ins_upgrade_once(self):
+        # Hold every sign-in after it has verified the old hash, so all of
+        # them go on to replace it at the same time
+        ready = threading.Barrier(SIGN_INS, timeout=10)
+        results: list[tuple[str, bool]] = []
+        lock = threading.Lock()
+
+        def sign_in():
+            db = Database(self.path)
+            try:
+                users = self.users(cost=5, db=db)
+                rehash = users.rehash_password
+
+                def rehash_together(user_id, old_hash, password):
+                    ready.wait()
+                    replaced = rehash(user_id, old_hash, password)
+                    with lock:
+                        results.append((old_hash, replaced))
+                    return replaced
+
+                users.rehash_password = rehash_together
+                self.assertIsNotNone(users.authenticate("alice", "secret"))
+            finally:
+                db.close()
+
+        old_hash = self.stored_hash()
+        threads = [threading.Thread(target=sign_in) for _ in range(SIGN_INS)]
+        for thread in threads:
+            thread.start()
+        for thread in threads:
+            thread.join()
+
+        self.assertEqual(len(results), SIGN_INS)
+        self.assertTrue(all(checked == old_hash for checked, _ in results))
+        self.assertEqual(sum(replaced for _, replaced in results), 1)
+        users = self.users(cost=5)
+        self.assertTrue(self.stored_hash().startswith("$2b$05$"))
+        self.assertTrue(users.verify_password(users.get_by_username("alice"), "secret"))
+        # The winner's hash stands, so the next sign-in has nothing to do
+        with mock.patch.object(users, "rehash_password") as rehash:
+            users.authenticate("alice", "secret")
+        rehash.assert_not_called()
+
+    def test_cost_is_validated(self):
+        config = make_config(self.directory)
+        for cost in (3, 32):
+            config.web.bcrypt_cost = cost
+            with self.assertRaisesRegex(ValueError, "Web bcrypt_cost must be between 4 and 31"):
+                config.validate()
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,67 @@
+"""Content that privacy settings drop never reaches the database file."""
+
+import glob
+import unittest
+
+from .helpers import SMTPClient, TempDirTestCase, build_application, make_config, running
+
+MESSAGE = (
+    b"From: a@example.com\r\n"
+    b"To: b@example.com\r\n"
+    b"Subject: Quarterly report\r\n"
+    b"X-Internal-Ticket: header-marker-7f3a\r\n"
+    b"MIME-Version: 1.0\r\n"
+    b'Content-Type: multipart/mixed; boundary="b"\r\n'
+    b"\r\n"
+    b"--b\r\n"
+    b"Content-Type: text/plain\r\n"
+    b"\r\n"
+    b"body-marker-91c2\r\n"
+    b"--b\r\n"
+    b"Content-Type: text/plain\r\n"
+    b'Content-Disposition: attachment; filename="notes.txt"\r\n'
+    b"\r\n"
+    b"attachment-marker-4d8e\r\n"
+    b"--b--\r\n"
+)
+
+
+class RawStorageOffTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    async def receive(self, **privacy) -> bytes:
+        """Receive MESSAGE over SMTP, then return the bytes of every database file."""
+        config = make_config(self.directory)
+        config.components = "smtp"
+        for name, value in privacy.items():
+            setattr(config.privacy, name, value)
+        application = build_application(config)
+        try:
+            async with running(application.smtp_server) as server:
+                client = await SMTPClient.connect(server)
+                code, _ = await client.send("a@example.com", "b@example.com", MESSAGE)
+                self.assertEqual(code, 250)
+                await client.command("QUIT")
+                await client.close()
+        finally:
+            application.db.close()
+        # The database and its write-ahead log, if one is left
+        stored = b""
+        for path in glob.glob(f"{config.database.path}*"):
+            with open(path, "rb") as f:
+                stored += f.read()
+        self.assertIn(b"Quarterly report", stored)
+        return stored
+
+    async def test_raw_message_is_not_stored(self):
+        stored = await self.receive(store_raw=False)
+        self.assertIn(b"body-marker-91c2", stored)
+        self.assertNotIn(b"header-marker-7f3a", stored)
+        self.assertNotIn(b"attachment-marker-4d8e", stored)
+
+    async def test_neither_raw_message_nor_body_is_stored(self):
+        stored = await self.receive(store_raw=False, store_body=False)
+        for marker in (b"body-marker-91c2", b"header-marker-7f3a", b"attachment-marker-4d8e"):
+            self.assertNotIn(marker, stored)
+
+
+if __name__ == "__main__":
+    unittest.main()
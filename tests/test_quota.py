@@ -0,0 +1,65 @@
+"""Daily quotas count only the emails that were stored."""
+
+import os
+import sqlite3
+import unittest
+
+from smtp_proxy.database import Database, EmailRepository, QuotaRepository, RawMessageStore
+from smtp_proxy.database.quota_repository import QuotaExceededError
+from smtp_proxy.models import Email
+
+from .helpers import TempDirTestCase
+
+
+def message() -> Email:
+    return Email(
+        sender="a@example.com",
+        recipients=["b@example.com"],
+        raw_message=b"Subject: Hi\r\n\r\nHello\r\n",
+        auth_user="sender",
+    )
+
+
+class QuotaTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.db = Database(os.path.join(self.directory, "smtp_proxy.db"))
+        self.raw_store = RawMessageStore(os.path.join(self.directory, "storage"))
+        self.repo = EmailRepository(self.db, raw_store=self.raw_store, raw_files=True)
+        self.quotas = QuotaRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def test_counts_stored_emails_up_to_the_limit(self):
+        self.repo.create(message(), quota=("sender", 2))
+        self.repo.create(message(), quota=("sender", 2))
+        with self.assertRaises(QuotaExceededError):
+            self.repo.create(message(), quota=("sender", 2))
+        self.assertEqual(self.quotas.used("sender"), 2)
+        self.assertEqual(self.repo.count(), 2)
+        # The refused email's raw message file is shared with the stored ones
+        self.assertEqual(len(self.raw_store.files()), 1)
+
+    def test_refused_email_leaves_no_raw_message_file(self):
+        self.repo.create(message(), quota=("sender", 1))
+        files = self.raw_store.files()
+        refused = message()
+        refused.raw_message = b"Subject: Another\r\n\r\nHello\r\n"
+        with self.assertRaises(QuotaExceededError):
+            self.repo.create(refused, quota=("sender", 1))
+        self.assertEqual(self.raw_store.files(), files)
+
+    def test_failed_insert_uses_none_of_the_quota(self):
+        self.db.execute(
+            "CREATE TRIGGER refuse BEFORE INSERT ON emails "
+            "BEGIN SELECT RAISE(ABORT, 'disk on fire'); END"
+        )
+        with self.assertRaises(sqlite3.Error):
+            self.repo.create(message(), quota=("sender", 2))
+        self.assertEqual(self.quotas.used("sender"), 0)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,147 @@
+"""Read-only mode must serve the stored data without writing to it."""
+
+import re
+import unittest
+
+from fastapi.routing import APIRoute
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.database.audit_repository import AuditRepository
+from smtp_proxy.database.login_attempt_repository import LoginAttemptRepository
+from smtp_proxy.main import Application, StartupError
+from smtp_proxy.models import Email
+from smtp_proxy.web.app import MUTATING_METHODS, READ_ONLY_ALLOWED_PATHS
+
+from .helpers import TempDirTestCase, build_application, file_digest, make_config, request
+
+
+def store_email(path: str) -> int:
+    """Create the database at path holding one email, and return its ID."""
+    db = Database(path)
+    try:
+        return EmailRepository(db).create(
+            Email(
+                sender="alice@example.com",
+                recipients=["bob@example.com"],
+                subject="Hello",
+                body="Hi Bob",
+                raw_message=b"Subject: Hello\r\n\r\nHi Bob\r\n",
+            )
+        )
+    finally:
+        db.close()
+
+
+class ReadOnlyDatabaseTest(TempDirTestCase, unittest.TestCase):
+    def test_reads_without_writing(self):
+        config = make_config(self.directory)
+        email_id = store_email(config.database.path)
+        before = file_digest(config.database.path)
+
+        db = Database(config.database.path, read_only=True)
+        try:
+            self.assertEqual(EmailRepository(db).get_by_id(email_id).subject, "Hello")
+            self.assertTrue(db.probe())
+            self.assertIsNone(AuditRepository(db, "test").record("web.login", "failure", "x"))
+            attempts = LoginAttemptRepository(db)
+            self.assertIsNone(attempts.record_failure("admin", "127.0.0.1", 1, 5))
+            self.assertFalse(attempts.reset("admin"))
+        finally:
+            db.close()
+
+        self.assertEqual(file_digest(config.database.path), before)
+
+    def test_refuses_to_start_without_a_database(self):
+        config = make_config(self.directory)
+        config.read_only = True
+        with self.assertRaises(StartupError):
+            Application(config).check()
+
+
+class ReadOnlyStartupTest(TempDirTestCase, unittest.TestCase):
+    def test_runs_no_background_jobs(self):
+        config = make_config(self.directory)
+        config.components = "smtp"
+        config.database.replica_path = f"{self.directory}/replicas"
+        build_application(config).db.close()
+        before = file_digest(config.database.path)
+
+        config.read_only = True
+        application = build_application(config)
+        try:
+            self.assertFalse(application.runs_background_jobs)
+            self.assertIsNone(application.replicator)
+            self.assertIsNone(application.siem)
+        finally:
+            application.db.close()
+
+        self.assertEqual(file_digest(config.database.path), before)
+
+
+class ReadOnlyWebTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory, lockout_failures=2)
+        self.config.components = "web"
+        # Creates the admin user, which read-only mode cannot
+        build_application(self.config).db.close()
+        self.email_id = store_email(self.config.database.path)
+        self.before = file_digest(self.config.database.path)
+
+        self.config.read_only = True
+        self.application = build_application(self.config)
+        self.app = self.application.web_server.config.app
+
+    def tearDown(self):
+        self.application.db.close()
+        super().tearDown()
+
+    def sign_in(self) -> dict[str, str]:
+        response = request(
+            self.app, "POST", "/login",
+            form={"username": "admin", "password": self.config.admin.password},
+        )
+        self.assertEqual(response.status, 303)
+        return response.cookies()
+
+    def test_pages_still_render(self):
+        cookies = self.sign_in()
+        self.assertEqual(request(self.app, "GET", "/emails", cookies=cookies).status, 200)
+        response = request(self.app, "GET", f"/emails/{self.email_id}", cookies=cookies)
+        self.assertEqual(response.status, 200)
+        self.assertIn(b"Hello", response.body)
+        self.assertEqual(file_digest(self.config.database.path), self.before)
+
+    def test_sign_in_records_nothing(self):
+        # Enough failures to lock the account if they were recorded
+        for _ in range(self.config.web.lockout_failures + 1):
+            response = request(
+                self.app, "POST", "/login", form={"username": "admin", "password": "wrong"},
+            )
+            self.assertEqual(response.status, 401)
+        self.sign_in()
+        self.assertEqual(file_digest(self.config.database.path), self.before)
+
+    def test_mutating_routes_are_refused(self):
+        cookies = self.sign_in()
+        refused = 0
+        for route in self.app.routes:
+            if not isinstance(route, APIRoute) or route.path in READ_ONLY_ALLOWED_PATHS:
+                continue
+            path = re.sub(r"\{[^}]+\}", "1", route.path)
+            for method in sorted(route.methods & MUTATING_METHODS):
+                with self.subTest(method=method, path=path):
+                    response = request(self.app, method, path, form={}, cookies=cookies)
+                    self.assertEqual(response.status, 503)
+                    if path.startswith(("/api/", "/admin/")) or path.endswith(".json"):
+                        self.assertIn("application/json", response.header("content-type"))
+                    else:
+                        self.assertIn("text/html", response.header("content-type"))
+                    self.assertIn(b"read-only mode", response.body)
+                    refused += 1
+        self.assertGreater(refused, 0)
+        self.assertEqual(file_digest(self.config.database.path), self.before)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,206 @@
+"""Stored emails are relayed upstream and every attempt is recorded."""
+
+import asyncio
+import threading
+import unittest
+from unittest import mock
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.main import Application
+from smtp_proxy.models import Email
+from smtp_proxy.relay import (
+    CODE_CONNECT_FAILED,
+    CODE_CONNECTION_LOST,
+    CODE_TIMEOUT,
+    FAILED_STATUSES,
+    Relay,
+)
+from smtp_proxy.smtp.server import SMTPServer
+
+from .helpers import SMTPClient, TempDirTestCase, free_port, make_config, running
+
+MESSAGE = b"From: app@example.com\r\nSubject: Relay me\r\n\r\nBody\r\n"
+
+
+class StallingUpstream:
+    """Accepts connections and never answers, like a hung upstream.
+
+    With hang_up, each connection is closed as soon as it is accepted.
+    """
+
+    def __init__(self, hang_up: bool = False):
+        self.port = free_port()
+        self.hang_up = hang_up
+        self.writers: list[asyncio.StreamWriter] = []
+
+    async def __aenter__(self):
+        self.server = await asyncio.start_server(self._accept, "127.0.0.1", self.port)
+        return self
+
+    async def __aexit__(self, *exc):
+        self.server.close()
+        for writer in self.writers:
+            writer.close()
+        await self.server.wait_closed()
+
+    async def _accept(self, reader, writer):
+        self.writers.append(writer)
+        if self.hang_up:
+            writer.close()
+            return
+        await reader.read()
+
+
+class RelayTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def store(self) -> tuple[int, Email]:
+        email = Email(
+            sender="app@example.com",
+            recipients=["user@example.com"],
+            subject="Relay me",
+            raw_message=MESSAGE,
+        )
+        return self.email_repo.create(email), email
+
+    def relay_to(self, port: int) -> Relay:
+        upstream = self.config.smtp.upstream
+        upstream.host, upstream.port, upstream.timeout_seconds = "127.0.0.1", port, 1
+        return Relay(upstream, self.email_repo)
+
+    async def relay_once(self, port: int) -> int:
+        relay = self.relay_to(port)
+        email_id, email = self.store()
+        relay.submit(email_id, email)
+        await relay.drain(5)
+        return email_id
+
+    def assert_attempt(self, email_id: int, port: int, code: int):
+        self.assertEqual(self.email_repo.get_by_id(email_id).status, "relay_failed")
+        [attempt] = self.email_repo.get_delivery_attempts(email_id)
+        self.assertEqual(attempt.upstream, f"127.0.0.1:{port}")
+        self.assertEqual(attempt.smtp_code, code)
+        self.assertTrue(attempt.response)
+
+    async def test_refused_connection_is_recorded(self):
+        port = free_port()
+        self.assert_attempt(await self.relay_once(port), port, CODE_CONNECT_FAILED)
+
+    async def test_timeout_is_recorded(self):
+        async with StallingUpstream() as upstream:
+            email_id = await self.relay_once(upstream.port)
+        self.assert_attempt(email_id, upstream.port, CODE_TIMEOUT)
+        attempt = self.email_repo.get_delivery_attempts(email_id)[0]
+        # Recorded once the upstream's timeout_seconds ran out
+        self.assertGreaterEqual(attempt.duration_ms, 900)
+
+    async def test_lost_connection_is_recorded(self):
+        async with StallingUpstream(hang_up=True) as upstream:
+            email_id = await self.relay_once(upstream.port)
+        self.assert_attempt(email_id, upstream.port, CODE_CONNECTION_LOST)
+
+    async def test_outcome_is_written_off_the_event_loop(self):
+        threads = []
+        for name in ("add_delivery_attempt", "update_relay_routes", "update_status"):
+            method = getattr(self.email_repo, name)
+
+            def record(*args, method=method, **kwargs):
+                threads.append(threading.current_thread())
+                return method(*args, **kwargs)
+
+            setattr(self.email_repo, name, record)
+        email_id = await self.relay_once(free_port())
+        self.assertEqual(len(threads), 3)
+        self.assertNotIn(threading.main_thread(), threads)
+        self.assertEqual(self.email_repo.get_by_id(email_id).status, "relay_failed")
+
+    async def test_relay_finishing_before_the_deadline_is_kept(self):
+        upstream_config = make_config(self.directory)
+        upstream_config.database.path = f"{self.directory}/upstream.db"
+        upstream_db = Database(upstream_config.database.path)
+        self.addCleanup(upstream_db.close)
+        upstream = SMTPServer(upstream_config.smtp, EmailRepository(upstream_db))
+        async with running(upstream):
+            relay = self.relay_to(upstream_config.smtp.port)
+            email_id, email = self.store()
+            relay.submit(email_id, email)
+            await relay.drain(5)
+        self.assertEqual(self.email_repo.get_by_id(email_id).status, "relayed")
+        self.assertEqual(EmailRepository(upstream_db).count(), 1)
+
+    async def test_relay_still_running_at_the_deadline_is_marked_failed(self):
+        async with StallingUpstream() as upstream:
+            relay = self.relay_to(upstream.port)
+            email_id, email = self.store()
+            relay.submit(email_id, email)
+            await asyncio.sleep(0.1)
+            await relay.drain(0.1)
+            self.assertFalse(relay._tasks)
+
+        self.assertEqual(self.email_repo.get_by_id(email_id).status, "relay_failed")
+        [attempt] = self.email_repo.get_delivery_attempts(email_id)
+        self.assertEqual(attempt.upstream, f"127.0.0.1:{upstream.port}")
+        self.assertEqual(attempt.smtp_code, CODE_CONNECTION_LOST)
+        self.assertEqual(attempt.response, "Interrupted by shutdown")
+        # Listed under failed deliveries, ready for a retry
+        failed = self.email_repo.get_by_status(FAILED_STATUSES, 10, 0)
+        self.assertEqual([e.id for e in failed], [email_id])
+
+    async def test_status_set_by_a_rule_is_kept(self):
+        async with StallingUpstream() as upstream:
+            relay = self.relay_to(upstream.port)
+            email_id, email = self.store()
+            email.status = "read"
+            self.email_repo.update_status(email_id, "read")
+            relay.submit(email_id, email)
+            await asyncio.sleep(0.1)
+            await relay.drain(0.1)
+        self.assertEqual(self.email_repo.get_by_id(email_id).status, "read")
+        self.assertEqual(len(self.email_repo.get_delivery_attempts(email_id)), 1)
+
+
+class ApplicationShutdownTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    async def test_shutdown_marks_unfinished_relays_failed(self):
+        config = make_config(self.directory)
+        config.components = "smtp"
+        async with StallingUpstream() as upstream:
+            config.smtp.relay.enabled = True
+            config.smtp.upstream.host = "127.0.0.1"
+            config.smtp.upstream.port = upstream.port
+            config.smtp.upstream.timeout_seconds = 1
+            application = Application(config)
+            application.build()
+
+            shutdown = asyncio.Event()
+            run = asyncio.create_task(application.run(shutdown))
+            for _ in range(100):
+                try:
+                    client = await SMTPClient.connect(application.smtp_server)
+                    break
+                except OSError:
+                    await asyncio.sleep(0.02)
+            code, _ = await client.send("app@example.com", "user@example.com", MESSAGE)
+            self.assertEqual(code, 250)
+            await client.command("QUIT")
+            await client.close()
+
+            with mock.patch("smtp_proxy.main.RELAY_DRAIN_SECONDS", 0.2):
+                shutdown.set()
+                await asyncio.wait_for(run, 10)
+
+        db = Database(config.database.path)
+        self.addCleanup(db.close)
+        [email] = EmailRepository(db).get_by_status(FAILED_STATUSES, 10, 0)
+        self.assertEqual(email.status, "relay_failed")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,91 @@
+"""A replica restored after the primary dies holds every email it had acknowledged."""
+
+import os
+from pathlib import Path
+import signal
+import sqlite3
+import subprocess
+import sys
+import textwrap
+import unittest
+
+from smtp_proxy.database.replica import check_integrity, restore_replica
+
+from .helpers import TempDirTestCase
+
+# Stores emails as fast as it can, taking a snapshot after each, and
+# reports both on stdout; it only stops when killed
+PRIMARY = textwrap.dedent("""
+    import itertools, sys
+    from smtp_proxy.database import Database, EmailRepository
+    from smtp_proxy.database.replica import Replicator
+    from smtp_proxy.models import Email
+
+    db = Database(sys.argv[1])
+    repo = EmailRepository(db)
+    replicator = Replicator(db, sys.argv[2], keep=2)
+    for i in itertools.count():
+        email_id = repo.create(Email(
+            sender="a@example.com",
+            recipients=["b@example.com"],
+            subject=f"Message {i}",
+            raw_message=b"Subject: Message\\r\\n\\r\\n" + b"x" * 20000,
+        ))
+        print("stored", email_id, flush=True)
+        replicator.replicate()
+        print("replicated", email_id, flush=True)
+""")
+
+SNAPSHOTS_BEFORE_KILL = 20
+
+
+class ReplicaRestoreTest(TempDirTestCase, unittest.TestCase):
+    def test_restore_after_primary_is_killed(self):
+        primary = os.path.join(self.directory, "primary.db")
+        replicas = os.path.join(self.directory, "replicas")
+        root = str(Path(__file__).resolve().parent.parent)
+        env = dict(os.environ)
+        env["PYTHONPATH"] = os.pathsep.join(filter(None, [root, env.get("PYTHONPATH")]))
+        process = subprocess.Popen(
+            [sys.executable, "-c", PRIMARY, primary, replicas],
+            stdout=subprocess.PIPE,
+            env=env,
+            text=True,
+        )
+        stored, replicated = set(), set()
+        try:
+            for line in process.stdout:
+                event, email_id = line.split()
+                (stored if event == "stored" else replicated).add(int(email_id))
+                if len(replicated) == SNAPSHOTS_BEFORE_KILL:
+                    # Kill it while it goes on writing
+                    process.send_signal(signal.SIGKILL)
+                    break
+        finally:
+            process.kill()
+            process.wait(10)
+            process.stdout.close()
+        self.assertEqual(len(replicated), SNAPSHOTS_BEFORE_KILL)
+
+        # The primary itself survives the kill with every stored email
+        self.assertEqual(check_integrity(Path(primary)), "ok")
+        self.assertLessEqual(stored, self.email_ids(primary))
+
+        target = os.path.join(self.directory, "restored.db")
+        _, count = restore_replica(replicas, target)
+        self.assertEqual(check_integrity(Path(target)), "ok")
+        restored = self.email_ids(target)
+        self.assertEqual(count, len(restored))
+        self.assertLessEqual(replicated, restored)
+
+    @staticmethod
+    def email_ids(path: str) -> set[int]:
+        conn = sqlite3.connect(path)
+        try:
+            return {row[0] for row in conn.execute("SELECT id FROM emails")}
+        finally:
+            conn.close()
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,181 @@
+"""Web requests get a timeout and body limit per route, without cutting off streams."""
+
+import asyncio
+import unittest
+from types import SimpleNamespace
+from unittest import mock
+
+from smtp_proxy.events import EmailEvents
+from smtp_proxy.web import routes
+from smtp_proxy.web.limits import LOGIN_MAX_BODY_BYTES, RequestLimitsMiddleware, extending_deadline
+
+from .helpers import request
+
+TIMEOUT = 0.2
+CHUNK = b"x" * 1024
+
+
+class ErrorResponse:
+    """Answers with a WebError's status and message, as render_error would."""
+
+    def __init__(self, error):
+        self.error = error
+
+    async def __call__(self, scope, receive, send):
+        await send({"type": "http.response.start", "status": self.error.status_code,
+                    "headers": []})
+        await send({"type": "http.response.body", "body": str(self.error).encode()})
+
+
+def limited(app, **limits) -> RequestLimitsMiddleware:
+    options = {"timeout_seconds": TIMEOUT, "max_body_bytes": 1000, "max_upload_bytes": 5000}
+    return RequestLimitsMiddleware(
+        app, **{**options, **limits}, on_error=lambda scope, error: ErrorResponse(error)
+    )
+
+
+def handler_request(scope) -> SimpleNamespace:
+    """Stand in for the Request a route handler gets, whose state is the scope's."""
+    return SimpleNamespace(state=SimpleNamespace(**scope["state"]))
+
+
+async def start(send, status: int = 200):
+    await send({"type": "http.response.start", "status": status, "headers": []})
+
+
+async def end(send):
+    await send({"type": "http.response.body", "body": b"", "more_body": False})
+
+
+def slow(seconds: float):
+    async def app(scope, receive, send):
+        await asyncio.sleep(seconds)
+        await start(send)
+        await end(send)
+    return app
+
+
+def export(chunks: int, delay: float, extend: bool = True):
+    """An export that takes delay to produce each chunk, like a large mbox download."""
+    async def app(scope, receive, send):
+        produced = (CHUNK for _ in range(chunks))
+        if extend:
+            produced = extending_deadline(handler_request(scope), produced, TIMEOUT)
+        await start(send)
+        for chunk in produced:
+            await asyncio.sleep(delay)
+            await send({"type": "http.response.body", "body": chunk, "more_body": True})
+        await end(send)
+    return app
+
+
+def event_stream(duration: float):
+    """Serve the live email stream, closing the broadcaster after duration."""
+    async def app(scope, receive, send):
+        events = EmailEvents()
+        asyncio.get_running_loop().call_later(duration, events.close)
+        await start(send)
+        async for chunk in routes.email_event_stream(events):
+            await send({"type": "http.response.body", "body": chunk.encode(), "more_body": True})
+        await end(send)
+    return app
+
+
+def echo_body():
+    async def app(scope, receive, send):
+        body = b""
+        while True:
+            message = await receive()
+            body += message.get("body", b"")
+            if not message.get("more_body"):
+                break
+        await start(send)
+        await send({"type": "http.response.body", "body": str(len(body)).encode()})
+    return app
+
+
+class TimeoutTest(unittest.TestCase):
+    def test_quick_request(self):
+        self.assertEqual(request(limited(slow(0)), "GET", "/emails").status, 200)
+
+    def test_slow_request_gets_503(self):
+        response = request(limited(slow(TIMEOUT * 3)), "GET", "/emails")
+        self.assertEqual(response.status, 503)
+        self.assertIn(f"{TIMEOUT:g}s", response.body.decode())
+
+    def test_zero_disables_the_timeout(self):
+        app = limited(slow(TIMEOUT * 2), timeout_seconds=0)
+        self.assertEqual(request(app, "GET", "/emails").status, 200)
+
+    def test_export_longer_than_the_timeout_completes(self):
+        # 20 chunks at a quarter of the timeout each take five times the timeout
+        response = request(limited(export(20, TIMEOUT / 4)), "GET", "/emails/export.mbox")
+        self.assertEqual(response.status, 200)
+        self.assertEqual(response.body, CHUNK * 20)
+
+    def test_export_without_progress_is_cut_off(self):
+        response = request(
+            limited(export(20, TIMEOUT / 4, extend=False)), "GET", "/emails/export.mbox"
+        )
+        self.assertEqual(response.status, 200)
+        self.assertLess(len(response.body), len(CHUNK * 20))
+        # A stalled export is cut off even while extending
+        response = request(limited(export(3, TIMEOUT * 2)), "GET", "/emails/export.mbox")
+        self.assertLess(len(response.body), len(CHUNK * 3))
+
+    def test_event_stream_stays_open_far_past_the_timeout(self):
+        with mock.patch.object(routes, "EVENT_KEEPALIVE_SECONDS", TIMEOUT / 4):
+            response = request(limited(event_stream(TIMEOUT * 10)), "GET", "/events")
+            chunks = response.body.decode().split("\n\n")
+            self.assertEqual(chunks[0], f"retry: {routes.EVENT_RETRY_MS}")
+            # The stream ran to the end, sending keepalives all the way
+            self.assertGreaterEqual(chunks.count(": keepalive"), 20)
+
+            # The same stream elsewhere would have been cut off
+            response = request(limited(event_stream(TIMEOUT * 10)), "GET", "/emails/stream")
+            self.assertLess(response.body.decode().count(": keepalive"), 10)
+
+
+class BodyLimitTest(unittest.TestCase):
+    def post(self, path: str, size: int, chunked: bool = False):
+        app = limited(echo_body())
+        if not chunked:
+            return request(app, "POST", path, form={"data": "x" * size})
+        # Without Content-Length the body is counted as it arrives
+        return asyncio.run(self._chunked(app, path, size))
+
+    async def _chunked(self, app, path: str, size: int):
+        scope = {"type": "http", "path": path, "headers": [], "method": "POST"}
+        messages = [
+            {"type": "http.request", "body": b"x" * 100, "more_body": True}
+            for _ in range(size // 100)
+        ] + [{"type": "http.request", "body": b"", "more_body": False}]
+        sent = []
+
+        async def receive():
+            return messages.pop(0) if messages else {"type": "http.disconnect"}
+
+        async def send(message):
+            sent.append(message)
+
+        await app(scope, receive, send)
+        return SimpleNamespace(status=sent[0]["status"])
+
+    def test_default_limit(self):
+        self.assertEqual(self.post("/emails/delete", 900).status, 200)
+        response = self.post("/emails/delete", 1000)
+        self.assertEqual(response.status, 413)
+        self.assertIn("larger than 1000 bytes", response.body.decode())
+        self.assertEqual(self.post("/emails/delete", 1500, chunked=True).status, 413)
+        self.assertEqual(self.post("/emails/delete", 900, chunked=True).status, 200)
+
+    def test_login_and_upload_limits(self):
+        self.assertEqual(self.post("/login", 4000).status, 200)
+        self.assertEqual(self.post("/login", LOGIN_MAX_BODY_BYTES).status, 413)
+        self.assertEqual(self.post("/admin/import-settings", 4000).status, 200)
+        self.assertEqual(self.post("/admin/import-settings", 6000).status, 413)
+        self.assertEqual(self.post("/admin/import-settings", 6000, chunked=True).status, 413)
+
+
+if __name__ == "__main__":
+    unittest.main()
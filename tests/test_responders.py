@@ -0,0 +1,201 @@
+"""Configured test recipients answer with well-formed bounces and auto-replies."""
+
+import asyncio
+import time
+import unittest
+from email import message_from_bytes
+from email.message import EmailMessage
+from email.policy import default as email_policy
+
+from smtp_proxy.config import ResponderConfig
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.models import Email
+from smtp_proxy.responders import ResponderEngine, is_automatic
+from smtp_proxy.smtp.server import SMTPServer
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+MESSAGE_ID = "<order-42@app.example.com>"
+BODY = "Secret body that is never returned"
+
+HARD_BOUNCE = ResponderConfig(
+    name="gone", recipient_pattern=r"^bounce@test\.example$", action="hard_bounce"
+)
+SOFT_BOUNCE = ResponderConfig(
+    name="full", recipient_pattern=r"^full@test\.example$", action="soft_bounce",
+    status="4.2.2", message="Mailbox full",
+)
+OUT_OF_OFFICE = ResponderConfig(
+    name="away", recipient_pattern=r"^away@test\.example$", action="out_of_office",
+    delay_seconds=1, message="Back on Monday.\n",
+)
+ACCEPT = ResponderConfig(name="sink", recipient_pattern=r"@sink\.example$", action="accept")
+
+
+def message(*headers: str) -> bytes:
+    lines = [
+        "From: app@example.com",
+        "To: customer@test.example",
+        "Subject: Your order",
+        f"Message-ID: {MESSAGE_ID}",
+        *headers,
+        "",
+        BODY,
+    ]
+    return "\r\n".join(lines).encode()
+
+
+def parse(email: Email) -> EmailMessage:
+    return message_from_bytes(email.raw_message, policy=email_policy)
+
+
+class ResponderTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    async def deliver(
+        self, responders: list[ResponderConfig], *messages: tuple[str, str, bytes]
+    ) -> list[Email]:
+        """Send each (sender, recipient, message), then return the responses generated."""
+        engine = ResponderEngine(responders, self.email_repo, self.config.smtp.domain)
+        server = SMTPServer(self.config.smtp, self.email_repo, responders=engine)
+        async with running(server):
+            client = await SMTPClient.connect(server)
+            for sender, recipient, raw in messages:
+                code, _ = await client.send(sender, recipient, raw)
+                self.assertEqual(code, 250)
+            await client.close()
+            while engine._tasks:
+                await asyncio.gather(*engine._tasks)
+        emails = sorted(self.email_repo.get_all(), key=lambda email: email.id)
+        # The messages themselves are stored as usual
+        self.assertEqual(
+            len([e for e in emails if not e.auth_user.startswith("responder:")]), len(messages)
+        )
+        return [e for e in emails if e.auth_user.startswith("responder:")]
+
+    def assert_threaded(self, response: EmailMessage):
+        self.assertEqual(response["In-Reply-To"], MESSAGE_ID)
+        self.assertEqual(response["References"], MESSAGE_ID)
+        self.assertEqual(response["Auto-Submitted"], "auto-replied")
+        self.assertEqual(response["To"], "app@example.com")
+
+    def delivery_status(self, dsn: EmailMessage) -> list[dict[str, str]]:
+        """Return the per-message block and each per-recipient block of a DSN."""
+        self.assertEqual(dsn.get_content_type(), "multipart/report")
+        self.assertEqual(dsn.get_param("report-type"), "delivery-status")
+        parts = dsn.get_payload()
+        self.assertEqual(
+            [part.get_content_type() for part in parts],
+            ["text/plain", "message/delivery-status", "text/rfc822-headers"],
+        )
+        return [dict(block.items()) for block in parts[1].get_payload()]
+
+    async def test_hard_bounce(self):
+        [bounce] = await self.deliver(
+            [HARD_BOUNCE], ("app@example.com", "bounce@test.example", message())
+        )
+        # Bounces have the null reverse-path, so they cannot bounce in turn
+        self.assertEqual((bounce.sender, bounce.recipients), ("", ["app@example.com"]))
+        self.assertEqual(bounce.auth_user, "responder:gone")
+
+        dsn = parse(bounce)
+        self.assert_threaded(dsn)
+        self.assertEqual(dsn["Subject"], "Undelivered Mail Returned to Sender")
+        self.assertEqual(
+            dsn["From"], f"Mail Delivery System <MAILER-DAEMON@{self.config.smtp.domain}>"
+        )
+        per_message, per_recipient = self.delivery_status(dsn)
+        self.assertEqual(per_message["Reporting-MTA"], f"dns; {self.config.smtp.domain}")
+        self.assertIn("Arrival-Date", per_message)
+        self.assertEqual(
+            per_recipient,
+            {
+                "Final-Recipient": "rfc822; bounce@test.example",
+                "Action": "failed",
+                "Status": "5.1.1",
+                "Diagnostic-Code": "smtp; 550 5.1.1 Mailbox unavailable",
+            },
+        )
+
+        text, _, headers = dsn.get_payload()
+        self.assertIn("could not be delivered to bounce@test.example", text.get_content())
+        # The original's headers come back, but never its body
+        returned = headers.get_content()
+        self.assertIn(f"Message-ID: {MESSAGE_ID}", returned)
+        self.assertNotIn(BODY, bounce.raw_message.decode())
+
+    async def test_soft_bounce(self):
+        [bounce] = await self.deliver(
+            [SOFT_BOUNCE], ("app@example.com", "full@test.example", message())
+        )
+        dsn = parse(bounce)
+        self.assert_threaded(dsn)
+        self.assertEqual(dsn["Subject"], "Delayed Mail (still being retried)")
+        _, per_recipient = self.delivery_status(dsn)
+        self.assertEqual(per_recipient["Action"], "delayed")
+        self.assertEqual(per_recipient["Status"], "4.2.2")
+        self.assertEqual(per_recipient["Diagnostic-Code"], "smtp; 451 4.2.2 Mailbox full")
+
+    async def test_out_of_office_after_its_delay(self):
+        started_at = time.monotonic()
+        [reply] = await self.deliver(
+            [OUT_OF_OFFICE], ("app@example.com", "away@test.example", message())
+        )
+        self.assertGreaterEqual(time.monotonic() - started_at, OUT_OF_OFFICE.delay_seconds)
+        self.assertEqual(
+            (reply.sender, reply.recipients), ("away@test.example", ["app@example.com"])
+        )
+        response = parse(reply)
+        self.assert_threaded(response)
+        self.assertEqual(response["From"], "away@test.example")
+        self.assertEqual(response["Subject"], "Out of Office: Your order")
+        self.assertEqual(response.get_content().strip(), "Back on Monday.")
+
+    async def test_accept_and_unmatched_recipients_get_nothing(self):
+        responses = await self.deliver(
+            [ACCEPT, HARD_BOUNCE],
+            ("app@example.com", "anyone@sink.example", message()),
+            ("app@example.com", "someone@test.example", message()),
+        )
+        self.assertEqual(responses, [])
+
+    async def test_automatic_messages_are_never_answered(self):
+        responses = await self.deliver(
+            [HARD_BOUNCE, OUT_OF_OFFICE],
+            ("", "bounce@test.example", message()),
+            ("app@example.com", "bounce@test.example", message("Auto-Submitted: auto-replied")),
+            ("app@example.com", "away@test.example", message("Precedence: bulk")),
+            ("app@example.com", "away@test.example", message("List-Id: <news.example.com>")),
+        )
+        self.assertEqual(responses, [])
+
+    async def test_responses_are_automatic_themselves(self):
+        # Two proxies answering each other's bounces and replies would loop forever
+        responses = await self.deliver(
+            [HARD_BOUNCE, OUT_OF_OFFICE],
+            ("app@example.com", "bounce@test.example", message()),
+            ("app@example.com", "away@test.example", message()),
+        )
+        self.assertEqual(len(responses), 2)
+        self.assertTrue(all(is_automatic(response) for response in responses))
+
+    async def test_rate_cap(self):
+        capped = ResponderConfig(
+            name="gone", recipient_pattern=r"^bounce@", action="hard_bounce", max_per_minute=2
+        )
+        responses = await self.deliver(
+            [capped], *[("app@example.com", "bounce@test.example", message())] * 4
+        )
+        self.assertEqual(len(responses), 2)
+
+
+if __name__ == "__main__":
+    unittest.main()
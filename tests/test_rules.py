@@ -0,0 +1,210 @@
+"""Rules label, route, notify and reject received mail."""
+
+import json
+import threading
+import unittest
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+from smtp_proxy import rules
+from smtp_proxy.database import Database, EmailRepository, RuleRepository
+from smtp_proxy.models import Email, Rule
+from smtp_proxy.notify import RuleNotifier
+from smtp_proxy.privacy import hash_subject
+from smtp_proxy.smtp.server import SMTPServer
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+MESSAGE = b"From: app@example.com\r\nSubject: Invoice 1043\r\n\r\nTotal due\r\n"
+
+
+def rule(action: str, value: str, **conditions) -> Rule:
+    return Rule(name=f"{action} {value}".strip(), action=action, action_value=value, **conditions)
+
+
+class ValidationTest(unittest.TestCase):
+    def assert_valid(self, action: str, value: str):
+        self.assertEqual(rules.validate_rule(rule(action, value)), [], value)
+
+    def assert_invalid(self, action: str, value: str, problem: str):
+        self.assertIn(problem, " ".join(rules.validate_rule(rule(action, value))), value)
+
+    def test_reject_message_is_one_line_of_printable_ascii(self):
+        for value in ("", "Go away", "5.7.1 Sender not allowed here"):
+            self.assert_valid("reject", value)
+        for value in ("Go away\r\n250 OK", "Go away\n", "tab\there", "Refusé"):
+            self.assert_invalid("reject", value, "one line of printable ASCII")
+
+    def test_labels_and_mailboxes(self):
+        for action in ("add_label", "route_to_mailbox"):
+            for value in ("billing", "team.qa-1", "A_B"):
+                self.assert_valid(action, value)
+            for value in ("", "two words", "a,b", "-leading", "x" * 65):
+                self.assert_invalid(action, value, "up to 64 letters")
+
+    def test_notification_url(self):
+        for value in ("https://hooks.example.com/T0/B0/x", "http://127.0.0.1:8080/notify"):
+            self.assert_valid("notify", value)
+        for value in ("", "hooks.example.com/x", "ftp://example.com/x", "https://"):
+            self.assert_invalid("notify", value, "http or https URL")
+
+    def test_legacy_multi_line_reject_message_gets_the_default(self):
+        default = "Message rejected by policy"
+        self.assertEqual(rules.reject_message(rule("reject", "No\r\n250 OK")), default)
+        self.assertEqual(rules.reject_message(rule("reject", "")), default)
+        self.assertEqual(rules.reject_message(rule("reject", "Go away")), "Go away")
+
+
+class EvaluateTest(unittest.TestCase):
+    def email(self) -> Email:
+        return Email(sender="app@example.com", recipients=["ap@billing.test"], subject="Invoice")
+
+    def test_actions_apply_in_order(self):
+        email = self.email()
+        outcome = rules.evaluate(
+            [
+                rule("add_label", "billing", recipient_pattern=r"@billing\.test$"),
+                rule("add_label", "finance"),
+                rule("add_label", "billing"),
+                rule("route_to_mailbox", "inbox"),
+                rule("route_to_mailbox", "accounts"),
+                rule("set_status", "read"),
+                rule("notify", "https://hooks.example.com/billing"),
+                rule("add_label", "skipped", sender_pattern="^nobody@"),
+            ],
+            email,
+        )
+        self.assertEqual(email.labels, ["billing", "finance"])
+        self.assertEqual(email.mailbox, "accounts")
+        self.assertEqual(email.status, "read")
+        self.assertEqual(
+            [r.action_value for r in outcome.notify], ["https://hooks.example.com/billing"]
+        )
+        self.assertEqual(len(outcome.matched), 7)
+        self.assertIsNone(outcome.reject)
+
+    def test_reject_stops_evaluation(self):
+        email = self.email()
+        outcome = rules.evaluate(
+            [rule("add_label", "first"), rule("reject", "No"), rule("add_label", "after")], email
+        )
+        self.assertEqual(outcome.reject.action_value, "No")
+        self.assertEqual(email.labels, ["first"])
+
+
+class NotificationReceiver(ThreadingHTTPServer):
+    """Collects the JSON bodies posted to it."""
+
+    def __init__(self):
+        self.bodies: list[dict] = []
+        self.received = threading.Event()
+        receiver = self
+
+        class Handler(BaseHTTPRequestHandler):
+            def do_POST(self):
+                length = int(self.headers["Content-Length"])
+                receiver.bodies.append(json.loads(self.rfile.read(length)))
+                self.send_response(200)
+                self.end_headers()
+                receiver.received.set()
+
+            def log_message(self, *args):
+                pass
+
+        super().__init__(("127.0.0.1", 0), Handler)
+        threading.Thread(target=self.serve_forever, daemon=True).start()
+
+    @property
+    def url(self) -> str:
+        return f"http://127.0.0.1:{self.server_address[1]}/notify"
+
+    def close(self):
+        self.shutdown()
+        self.server_close()
+
+
+class SMTPRulesTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+        self.rule_repo = RuleRepository(self.db)
+        self.receiver = NotificationReceiver()
+
+    def tearDown(self):
+        self.receiver.close()
+        self.db.close()
+        super().tearDown()
+
+    async def send(self, notifier: RuleNotifier | None = None, message: bytes = MESSAGE):
+        server = SMTPServer(
+            self.config.smtp, self.email_repo, rule_repo=self.rule_repo, notifier=notifier
+        )
+        async with running(server):
+            client = await SMTPClient.connect(server)
+            reply = await client.send("app@example.com", "ap@billing.test", message)
+            # The session must still be in step with the client
+            noop = await client.command("NOOP")
+            await client.close()
+            if notifier:
+                await notifier.drain(5)
+        self.assertEqual(noop[0], 250)
+        return reply
+
+    async def test_labels_and_mailbox_are_stored_and_filterable(self):
+        self.rule_repo.create(rule("add_label", "billing", recipient_pattern="@billing"))
+        self.rule_repo.create(rule("add_label", "invoices", subject_pattern="^invoice"))
+        self.rule_repo.create(rule("route_to_mailbox", "accounts"))
+        self.assertEqual((await self.send())[0], 250)
+
+        email = self.email_repo.get_recent(1)[0]
+        self.assertEqual(email.labels, ["billing", "invoices"])
+        self.assertEqual(email.mailbox, "accounts")
+        self.assertEqual([e.id for e in self.email_repo.search(label="invoices")], [email.id])
+        self.assertEqual([e.id for e in self.email_repo.search(mailbox="accounts")], [email.id])
+        self.assertEqual(self.email_repo.search(label="bill"), [])
+        self.assertEqual(self.email_repo.search(mailbox="inbox"), [])
+        self.assertEqual(self.email_repo.labels(), ["billing", "invoices"])
+        self.assertEqual(self.email_repo.mailboxes(), ["accounts"])
+
+    async def test_notify_posts_once_stored(self):
+        self.rule_repo.create(rule("notify", self.receiver.url, subject_pattern="invoice"))
+        self.rule_repo.create(rule("add_label", "billing"))
+        self.assertEqual((await self.send(RuleNotifier()))[0], 250)
+
+        email = self.email_repo.get_recent(1)[0]
+        self.assertTrue(self.receiver.received.wait(5))
+        [body] = self.receiver.bodies
+        self.assertEqual(body["rule"], f"notify {self.receiver.url}")
+        self.assertIn(f"email {email.id} from app@example.com: Invoice 1043", body["text"])
+        self.assertEqual(body["email"]["id"], email.id)
+        self.assertEqual(body["email"]["recipients"], ["ap@billing.test"])
+        self.assertEqual(body["email"]["subject"], "Invoice 1043")
+        # Rules after the notify rule have applied by the time it is sent
+        self.assertEqual(body["email"]["labels"], ["billing"])
+
+    async def test_notification_hashes_subject_like_storage(self):
+        self.rule_repo.create(rule("notify", self.receiver.url))
+        await self.send(RuleNotifier(hash_subjects=True))
+        self.assertTrue(self.receiver.received.wait(5))
+        self.assertEqual(self.receiver.bodies[0]["email"]["subject"], hash_subject("Invoice 1043"))
+        self.assertNotIn("Invoice", self.receiver.bodies[0]["text"])
+
+    async def test_failing_endpoint_does_not_fail_the_client(self):
+        self.rule_repo.create(rule("notify", "http://127.0.0.1:1/unreachable"))
+        self.assertEqual((await self.send(RuleNotifier(timeout_seconds=1)))[0], 250)
+        self.assertEqual(self.email_repo.count(), 1)
+
+    async def test_reject_reply_is_one_line(self):
+        self.rule_repo.create(rule("reject", "Not from this sender"))
+        self.assertEqual(await self.send(), (550, ["Not from this sender"]))
+        self.assertEqual(self.email_repo.count(), 0)
+
+    async def test_stored_multi_line_reject_message_cannot_inject_replies(self):
+        # Saved before messages were validated, or written straight to the database
+        self.rule_repo.create(rule("reject", "Denied\r\n250 OK: Message accepted"))
+        self.assertEqual(await self.send(), (550, ["Message rejected by policy"]))
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,139 @@
+"""The selftest command submits a message end to end and reports each stage."""
+
+import argparse
+import asyncio
+import contextlib
+import io
+import os
+import sqlite3
+import unittest
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.main import run_selftest_command, run_standalone_selftest
+from smtp_proxy.models import Email
+from smtp_proxy.selftest import FAIL, PASS, SKIP, SelfTest
+from smtp_proxy.smtp.server import SMTPServer
+
+from .helpers import TempDirTestCase, file_digest, make_config, running
+
+
+def statuses(results) -> dict[str, str]:
+    return {result.stage: result.status for result in results}
+
+
+ALL_PASSED = dict(submit=PASS, store=PASS, fidelity=PASS, relay=SKIP, cleanup=PASS)
+
+
+class SelfTestTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    async def run_selftest(self, **options):
+        server = SMTPServer(self.config.smtp, self.email_repo)
+        async with running(server):
+            selftest = SelfTest(
+                self.config,
+                self.config.smtp.host,
+                self.config.smtp.port,
+                self.config.database.path,
+                timeout_seconds=5,
+                **options,
+            )
+            return await asyncio.to_thread(selftest.run)
+
+    async def test_all_stages_pass_and_clean_up(self):
+        results = await self.run_selftest()
+        self.assertEqual(statuses(results), ALL_PASSED, results)
+        self.assertEqual(self.email_repo.count(), 0)
+
+    async def test_skipped_stages(self):
+        results = await self.run_selftest(skip=("cleanup",))
+        self.assertEqual(statuses(results), dict(ALL_PASSED, cleanup=SKIP))
+        self.assertEqual(self.email_repo.count(), 1)
+
+        results = await self.run_selftest(skip=("submit",))
+        # Without a submitted message nothing can be looked up or checked
+        self.assertEqual(
+            statuses(results),
+            dict(submit=SKIP, store=SKIP, fidelity=SKIP, relay=SKIP, cleanup=SKIP),
+        )
+
+    async def test_authenticates_as_the_configured_user(self):
+        self.config.smtp.auth.required = True
+        results = await self.run_selftest()
+        self.assertEqual(statuses(results), ALL_PASSED, results)
+
+    async def test_submit_fails_without_a_plaintext_password(self):
+        self.config.smtp.auth.required = True
+        self.config.smtp.auth.password = ""
+        self.config.smtp.auth.password_hash = "$2b$12$" + "x" * 53
+        results = await self.run_selftest()
+        self.assertEqual(statuses(results)["submit"], FAIL)
+        self.assertEqual(statuses(results)["store"], SKIP)
+
+
+class StandaloneSelfTestTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.path = self.config.database.path
+
+    def run_command(self, standalone: bool = True) -> str:
+        args = argparse.Namespace(
+            standalone=standalone,
+            host=None,
+            port=None,
+            username=None,
+            password=None,
+            sender=None,
+            recipient=None,
+            timeout=5.0,
+            skip=[],
+        )
+        output = io.StringIO()
+        with contextlib.redirect_stdout(output):
+            run_selftest_command(args, self.config)
+        return output.getvalue()
+
+    def test_real_database_is_neither_written_nor_migrated(self):
+        db = Database(self.path)
+        EmailRepository(db).create(Email(sender="a@example.com", recipients=["b@example.com"]))
+        # Stands in for a database from before the latest column was added
+        db.execute("ALTER TABLE emails DROP COLUMN security")
+        db.close()
+        digest = file_digest(self.path)
+
+        results = asyncio.run(run_standalone_selftest(self.config, dict(timeout_seconds=5)))
+        self.assertEqual(statuses(results), ALL_PASSED, results)
+
+        self.assertEqual(file_digest(self.path), digest)
+        conn = sqlite3.connect(self.path)
+        try:
+            columns = {row[1] for row in conn.execute("PRAGMA table_info(emails)")}
+            self.assertNotIn("security", columns)
+            self.assertEqual(conn.execute("SELECT COUNT(*) FROM emails").fetchone()[0], 1)
+        finally:
+            conn.close()
+
+    def test_missing_database_is_not_created(self):
+        self.assertIn("Self-test passed", self.run_command())
+        self.assertFalse(os.path.exists(self.path))
+
+    def test_failure_exits_non_zero(self):
+        self.config.smtp.auth.required = True
+        self.config.smtp.auth.password = ""
+        self.config.smtp.auth.password_hash = "$2b$12$" + "x" * 53
+        with self.assertRaises(SystemExit) as raised:
+            self.run_command()
+        self.assertEqual(raised.exception.code, 1)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,194 @@
+"""A settings bundle exported from one database reproduces its rules on another."""
+
+import argparse
+import json
+import os
+import unittest
+from dataclasses import replace
+
+from smtp_proxy import rules, settings
+from smtp_proxy.database import Database, RuleRepository
+from smtp_proxy.main import run_settings_command
+from smtp_proxy.models import Email, Rule
+
+from .helpers import TempDirTestCase, make_config
+
+RULES = [
+    Rule(name="drop-spam", priority=1, subject_pattern=r"(?i)viagra", action="reject",
+         action_value="5.7.1 Not here"),
+    Rule(name="billing", priority=10, recipient_pattern=r"@billing\.test$",
+         action="add_label", action_value="billing"),
+    Rule(name="large", priority=20, min_size_bytes=1000, action="add_label", action_value="big"),
+    Rule(name="qa-box", priority=30, auth_user="qa", action="route_to_mailbox",
+         action_value="qa"),
+    Rule(name="alerts", priority=40, sender_pattern=r"^alerts@", action="notify",
+         action_value="https://hooks.example.com/alerts"),
+    Rule(name="archive", priority=50, sender_pattern=r"@archive\.test$", action="set_status",
+         action_value="archived"),
+    Rule(name="off", priority=60, enabled=False, action="reject"),
+]
+
+SAMPLES = [
+    Email(sender="app@example.com", recipients=["ap@billing.test"], subject="Invoice"),
+    Email(sender="app@example.com", recipients=["x@example.com"], subject="Buy VIAGRA"),
+    Email(sender="alerts@example.com", recipients=["ap@billing.test"], size_bytes=5000),
+    Email(sender="a@archive.test", recipients=["x@example.com"], auth_user="qa"),
+    Email(sender="nobody@example.com", recipients=["x@example.com"], subject="Hello"),
+]
+
+
+def outcomes(rule_repo: RuleRepository) -> list[tuple]:
+    """Evaluate the enabled rules against each sample and summarise what they did."""
+    summary = []
+    for sample in SAMPLES:
+        email = replace(sample, labels=[])
+        outcome = rules.evaluate(rule_repo.get_enabled(), email)
+        summary.append((
+            [rule.name for rule in outcome.matched],
+            outcome.reject.name if outcome.reject else None,
+            [rule.action_value for rule in outcome.notify],
+            email.status,
+            email.labels,
+            email.mailbox,
+        ))
+    return summary
+
+
+def rules_only(bundle: dict) -> dict:
+    return {key: value for key, value in bundle.items() if key != "exported_at"}
+
+
+class SettingsRoundTripTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.source_db = Database(os.path.join(self.directory, "source.db"))
+        self.target_db = Database(os.path.join(self.directory, "target.db"))
+        self.source = RuleRepository(self.source_db)
+        self.target = RuleRepository(self.target_db)
+        for rule in RULES:
+            self.source.create(replace(rule))
+
+    def tearDown(self):
+        self.source_db.close()
+        self.target_db.close()
+        super().tearDown()
+
+    def bundle(self) -> dict:
+        # Through JSON, as the bundle travels between instances as a file
+        return json.loads(json.dumps(settings.export_settings(self.source)))
+
+    def test_round_trip_reproduces_behaviour(self):
+        bundle = self.bundle()
+        self.assertEqual(bundle["version"], settings.SETTINGS_VERSION)
+
+        plan = settings.plan_import(bundle, self.target)
+        self.assertEqual(plan.errors, [])
+        self.assertEqual(sorted(r.name for r in plan.create), sorted(r.name for r in RULES))
+        settings.apply_import(plan, self.target)
+
+        self.assertEqual(
+            rules_only(settings.export_settings(self.target)), rules_only(bundle)
+        )
+        self.assertEqual(outcomes(self.target), outcomes(self.source))
+        # The samples do exercise every action
+        self.assertEqual(
+            outcomes(self.source),
+            [
+                (["billing"], None, [], "received", ["billing"], ""),
+                (["drop-spam"], "drop-spam", [], "received", [], ""),
+                (
+                    ["billing", "large", "alerts"], None,
+                    ["https://hooks.example.com/alerts"], "received", ["billing", "big"], "",
+                ),
+                (["qa-box", "archive"], None, [], "archived", [], "qa"),
+                ([], None, [], "received", [], ""),
+            ],
+        )
+
+    def test_importing_again_changes_nothing(self):
+        settings.apply_import(settings.plan_import(self.bundle(), self.target), self.target)
+        plan = settings.plan_import(self.bundle(), self.target)
+        self.assertEqual(plan.to_dict()["unchanged"], [rule.name for rule in self.source.get_all()])
+        self.assertEqual((plan.create, plan.update, plan.delete), ([], [], []))
+
+    def test_existing_rules_are_matched_by_name(self):
+        kept_id = self.target.create(Rule(name="billing", action="add_label", action_value="old"))
+        self.target.create(Rule(name="local-only", action="add_label", action_value="mine"))
+
+        plan = settings.plan_import(self.bundle(), self.target)
+        self.assertEqual(plan.to_dict()["update"], ["billing"])
+        self.assertEqual(plan.delete, [])
+        settings.apply_import(plan, self.target)
+        billing = self.target.get_by_id(kept_id)
+        self.assertEqual(billing.action_value, "billing")
+        self.assertIn("local-only", [rule.name for rule in self.target.get_all()])
+
+        plan = settings.plan_import(self.bundle(), self.target, prune=True)
+        self.assertEqual(plan.to_dict()["delete"], ["local-only"])
+        settings.apply_import(plan, self.target)
+        self.assertEqual(outcomes(self.target), outcomes(self.source))
+        self.assertEqual(
+            rules_only(settings.export_settings(self.target)), rules_only(self.bundle())
+        )
+
+    def test_invalid_bundles_are_refused(self):
+        plan = settings.plan_import({"version": 99, "rules": []}, self.target)
+        self.assertIn("Unsupported settings bundle version", plan.errors[0])
+
+        bundle = self.bundle()
+        bundle["rules"][0]["priority"] = "high"
+        bundle["rules"][1]["action"] = "explode"
+        bundle["rules"].append(dict(bundle["rules"][2]))
+        plan = settings.plan_import(bundle, self.target)
+        self.assertEqual(len(plan.errors), 3, plan.errors)
+        with self.assertRaises(ValueError):
+            settings.apply_import(plan, self.target)
+        self.assertEqual(self.target.get_all(), [])
+
+
+class SettingsCommandTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.source = make_config(os.path.join(self.directory, "source"))
+        self.target = make_config(os.path.join(self.directory, "target"))
+        self.file = os.path.join(self.directory, "settings.json")
+        db = Database(self.source.database.path)
+        for rule in RULES:
+            RuleRepository(db).create(replace(rule))
+        db.close()
+
+    def target_rules(self) -> list[str]:
+        db = Database(self.target.database.path)
+        try:
+            return [rule.name for rule in RuleRepository(db).get_all()]
+        finally:
+            db.close()
+
+    def run_import(self, dry_run: bool = False, prune: bool = False):
+        args = argparse.Namespace(
+            settings_command="import", file=self.file, dry_run=dry_run, prune=prune
+        )
+        run_settings_command(args, self.target)
+
+    def test_export_then_import(self):
+        run_settings_command(
+            argparse.Namespace(settings_command="export", file=self.file), self.source
+        )
+        with open(self.file) as f:
+            self.assertEqual(len(json.load(f)["rules"]), len(RULES))
+
+        self.run_import(dry_run=True)
+        self.assertEqual(self.target_rules(), [])
+        self.run_import()
+        self.assertEqual(sorted(self.target_rules()), sorted(rule.name for rule in RULES))
+
+    def test_unreadable_bundle_exits(self):
+        with open(self.file, "w") as f:
+            f.write("{not json")
+        with self.assertRaises(SystemExit):
+            self.run_import()
+        self.assertEqual(self.target_rules(), [])
+
+
+if __name__ == "__main__":
+    unittest.main()
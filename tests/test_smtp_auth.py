@@ -0,0 +1,150 @@
+"""SMTP AUTH against configured credentials, SMTP users from the web UI and web users."""
+
+import base64
+import hashlib
+import hmac
+import unittest
+
+import bcrypt
+
+from smtp_proxy.config import SMTPCredential
+from smtp_proxy.database import (
+    Database,
+    EmailRepository,
+    SMTPCredentialRepository,
+    UserRepository,
+)
+from smtp_proxy.passwords import build_passwords
+from smtp_proxy.smtp.server import SMTPServer
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+
+async def plain(client: SMTPClient, username: str, password: str) -> int:
+    """Authenticate with PLAIN and return the reply code."""
+    token = base64.b64encode(f"\0{username}\0{password}".encode()).decode()
+    code, _ = await client.command(f"AUTH PLAIN {token}")
+    return code
+
+
+async def login(client: SMTPClient, username: str, password: str) -> int:
+    """Authenticate with LOGIN and return the final reply code."""
+    for line in ("AUTH LOGIN", base64.b64encode(username.encode()).decode()):
+        code, _ = await client.command(line)
+        if code != 334:
+            return code
+    code, _ = await client.command(base64.b64encode(password.encode()).decode())
+    return code
+
+
+async def cram_md5(client: SMTPClient, username: str, password: str) -> int:
+    """Authenticate with CRAM-MD5 and return the final reply code."""
+    code, lines = await client.command("AUTH CRAM-MD5")
+    if code != 334:
+        return code
+    challenge = base64.b64decode(lines[0])
+    digest = hmac.new(password.encode(), challenge, hashlib.md5).hexdigest()
+    code, _ = await client.command(base64.b64encode(f"{username} {digest}".encode()).decode())
+    return code
+
+
+class AuthTestCase(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.config.smtp.auth.required = True
+        self.db = Database(self.config.database.path)
+        self.credential_repo = SMTPCredentialRepository(self.db)
+        self.user_repo = UserRepository(self.db, build_passwords(self.config.web))
+        self.user_repo.create("alice", "web-password", role="viewer")
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def server(self) -> SMTPServer:
+        return SMTPServer(
+            self.config.smtp,
+            EmailRepository(self.db),
+            credential_repo=self.credential_repo,
+            user_repo=self.user_repo,
+        )
+
+    async def check(self, username: str, password: str) -> list[int]:
+        """Authenticate with PLAIN and with LOGIN, returning both reply codes."""
+        async with running(self.server()) as server:
+            codes = []
+            for mechanism in (plain, login):
+                client = await SMTPClient.connect(server)
+                codes.append(await mechanism(client, username, password))
+                await client.close()
+            return codes
+
+
+class PasswordAuthTest(AuthTestCase):
+    """PLAIN and LOGIN in both modes: configured credentials, or web users."""
+
+    async def test_configured_credentials(self):
+        self.assertEqual(await self.check("mailuser", "mailpass"), [235, 235])
+        self.assertEqual(await self.check("mailuser", "wrong"), [535, 535])
+        self.assertEqual(await self.check("alice", "web-password"), [535, 535])
+
+    async def test_web_users(self):
+        self.config.smtp.auth.use_web_users = True
+        self.assertEqual(await self.check("alice", "web-password"), [235, 235])
+        self.assertEqual(await self.check("alice", "wrong"), [535, 535])
+        # Replaced by the web users, not checked alongside them
+        self.assertEqual(await self.check("mailuser", "mailpass"), [535, 535])
+
+    async def test_web_ui_smtp_user_takes_precedence_over_configured_one(self):
+        _, password = self.credential_repo.create("mailuser")
+        self.assertEqual(await self.check("mailuser", password), [235, 235])
+        self.assertEqual(await self.check("mailuser", "mailpass"), [535, 535])
+
+    async def test_web_ui_smtp_user_takes_precedence_over_web_user(self):
+        self.config.smtp.auth.use_web_users = True
+        user_id, password = self.credential_repo.create("alice")
+        self.assertEqual(await self.check("alice", password), [235, 235])
+        self.assertEqual(await self.check("alice", "web-password"), [535, 535])
+
+        # Disabling it does not hand the name back to the web user
+        self.credential_repo.set_disabled(user_id, True)
+        self.assertEqual(await self.check("alice", password), [535, 535])
+        self.assertEqual(await self.check("alice", "web-password"), [535, 535])
+
+
+class CramMD5Test(AuthTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config.smtp.auth.mechanisms = ["PLAIN", "CRAM-MD5"]
+
+    async def test_configured_plaintext_user(self):
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server, greet=False)
+            _, lines = await client.command("EHLO client.example.com")
+            self.assertIn("AUTH PLAIN CRAM-MD5", lines)
+            self.assertEqual(await cram_md5(client, "mailuser", "mailpass"), 235)
+            await client.close()
+
+    async def test_not_offered_without_plaintext_passwords(self):
+        hashed = bcrypt.hashpw(b"mailpass", bcrypt.gensalt(4)).decode()
+        self.config.smtp.auth.username = ""
+        self.config.smtp.auth.users = [SMTPCredential("mailuser", password_hash=hashed)]
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server, greet=False)
+            _, lines = await client.command("EHLO client.example.com")
+            self.assertIn("AUTH PLAIN", lines)
+            self.assertEqual(await cram_md5(client, "mailuser", "mailpass"), 504)
+            await client.close()
+
+    async def test_web_ui_user_takes_precedence(self):
+        # Same name as the configured user, whose password must no longer work
+        self.credential_repo.create("mailuser")
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            self.assertEqual(await cram_md5(client, "mailuser", "mailpass"), 535)
+            await client.close()
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,319 @@
+"""SMTP sessions follow the protocol on hand-crafted byte streams."""
+
+import asyncio
+import time
+import unittest
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.smtp.server import SMTPServer
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+ENVELOPE = b"EHLO client.example.com\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\n"
+
+
+class ProtocolTestCase(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def server(self) -> SMTPServer:
+        return SMTPServer(self.config.smtp, self.email_repo)
+
+    async def open(self, server: SMTPServer) -> SMTPClient:
+        """Connect without reading the banner."""
+        return SMTPClient(
+            *await asyncio.open_connection(server.config.host, server.config.port)
+        )
+
+    async def replies(self, client: SMTPClient, count: int) -> list[int]:
+        return [(await client.reply())[0] for _ in range(count)]
+
+    def stored(self) -> list:
+        return list(reversed(self.email_repo.get_recent(10)))
+
+
+class EarlyTalkerTest(ProtocolTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config.smtp.early_talker_wait_ms = 200
+
+    async def talk_early(self, server: SMTPServer) -> SMTPClient:
+        client = await self.open(server)
+        client.writer.write(b"EHLO client.example.com\r\n")
+        await client.writer.drain()
+        return client
+
+    async def test_early_command_is_flagged_and_still_answered(self):
+        self.config.smtp.early_talker_action = "log"
+        async with running(self.server()) as server:
+            client = await self.talk_early(server)
+            # The byte read to spot the early talker is not lost from EHLO
+            self.assertEqual(await self.replies(client, 2), [220, 250])
+            code, _ = await client.send("a@example.com", "b@example.com", b"Subject: Hi\r\n")
+            self.assertEqual(code, 250)
+            await client.close()
+        [email] = self.stored()
+        self.assertEqual(email.anomalies, "data sent before greeting")
+
+    async def test_early_talker_is_spotted_as_soon_as_it_talks(self):
+        self.config.smtp.early_talker_action = "log"
+        self.config.smtp.early_talker_wait_ms = 5000
+        async with running(self.server()) as server:
+            started_at = time.perf_counter()
+            client = await self.talk_early(server)
+            self.assertEqual(await self.replies(client, 2), [220, 250])
+            self.assertLess(time.perf_counter() - started_at, 1)
+            await client.close()
+
+    async def test_single_early_byte_is_kept(self):
+        self.config.smtp.early_talker_action = "log"
+        async with running(self.server()) as server:
+            client = await self.open(server)
+            client.writer.write(b"N")
+            await asyncio.sleep(0.4)
+            self.assertEqual((await client.reply())[0], 220)
+            # The N sent before the banner starts this NOOP
+            self.assertEqual(await client.command("OOP"), (250, ["OK"]))
+            await client.close()
+
+    async def test_patient_client_is_not_flagged(self):
+        self.config.smtp.early_talker_action = "reject"
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            code, _ = await client.send("a@example.com", "b@example.com", b"Subject: Hi\r\n")
+            self.assertEqual(code, 250)
+            await client.close()
+        self.assertEqual(self.stored()[0].anomalies, "")
+
+    async def test_reject(self):
+        self.config.smtp.early_talker_action = "reject"
+        async with running(self.server()) as server:
+            client = await self.talk_early(server)
+            self.assertEqual((await client.reply())[0], 554)
+            self.assertEqual(await asyncio.wait_for(client.reader.read(), 5), b"")
+            await client.close()
+
+    async def test_delay(self):
+        self.config.smtp.early_talker_action = "delay"
+        self.config.smtp.early_talker_delay_seconds = 1
+        async with running(self.server()) as server:
+            started_at = time.perf_counter()
+            client = await self.talk_early(server)
+            self.assertEqual(await self.replies(client, 2), [220, 250])
+            self.assertGreaterEqual(time.perf_counter() - started_at, 1)
+            await client.close()
+
+    async def test_off_answers_pipelined_commands_without_waiting(self):
+        self.config.smtp.early_talker_wait_ms = 5000
+        async with running(self.server()) as server:
+            started_at = time.perf_counter()
+            client = await self.talk_early(server)
+            self.assertEqual(await self.replies(client, 2), [220, 250])
+            self.assertLess(time.perf_counter() - started_at, 1)
+            await client.close()
+
+    async def test_client_gone_before_the_banner(self):
+        self.config.smtp.early_talker_action = "reject"
+        async with running(self.server()) as server:
+            client = await self.open(server)
+            client.writer.close()
+            await asyncio.sleep(0.4)
+            # The server is unaffected
+            client = await SMTPClient.connect(server)
+            await client.close()
+
+
+class TransactionTest(ProtocolTestCase):
+    async def commands(self, client: SMTPClient, *lines: str) -> list[int]:
+        return [(await client.command(line))[0] for line in lines]
+
+    async def finish(self, client: SMTPClient, message: bytes = b"Subject: Hi\r\n") -> int:
+        client.writer.write(message + b"\r\n.\r\n")
+        await client.writer.drain()
+        return (await client.reply())[0]
+
+    async def test_rset_forgets_sender_and_recipients(self):
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            codes = await self.commands(
+                client, "MAIL FROM:<a@example.com>", "RCPT TO:<x@example.com>", "RSET",
+                "RCPT TO:<y@example.com>", "DATA",
+            )
+            self.assertEqual(codes, [250, 250, 250, 503, 503])
+            codes = await self.commands(
+                client, "MAIL FROM:<b@example.com>", "RCPT TO:<y@example.com>", "DATA"
+            )
+            self.assertEqual(codes, [250, 250, 354])
+            self.assertEqual(await self.finish(client), 250)
+            await client.close()
+        [email] = self.stored()
+        self.assertEqual((email.sender, email.recipients), ("b@example.com", ["y@example.com"]))
+
+    async def test_rset_outside_a_transaction(self):
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server, greet=False)
+            self.assertEqual(await self.commands(client, "RSET", "RSET", "NOOP"), [250, 250, 250])
+            await client.close()
+
+    async def test_rset_keeps_authentication(self):
+        self.config.smtp.auth.required = True
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            codes = await self.commands(
+                client, "AUTH PLAIN AG1haWx1c2VyAG1haWxwYXNz", "RSET",
+                "MAIL FROM:<a@example.com>", "RCPT TO:<x@example.com>", "DATA",
+            )
+            self.assertEqual(codes, [235, 250, 250, 250, 354])
+            self.assertEqual(await self.finish(client), 250)
+            await client.close()
+        self.assertEqual(self.stored()[0].auth_user, "mailuser")
+
+    async def test_second_mail_starts_a_new_transaction(self):
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            codes = await self.commands(
+                client, "MAIL FROM:<a@example.com>", "RCPT TO:<x@example.com>",
+                "MAIL FROM:<b@example.com>", "RCPT TO:<y@example.com>", "DATA",
+            )
+            self.assertEqual(codes, [250, 250, 250, 250, 354])
+            self.assertEqual(await self.finish(client), 250)
+            await client.close()
+        [email] = self.stored()
+        # Recipients given for the first sender are not carried over
+        self.assertEqual((email.sender, email.recipients), ("b@example.com", ["y@example.com"]))
+
+    async def test_second_mail_can_be_refused(self):
+        self.config.smtp.duplicate_mail = "reject"
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            codes = await self.commands(
+                client, "MAIL FROM:<a@example.com>", "RCPT TO:<x@example.com>",
+                "MAIL FROM:<b@example.com>", "RCPT TO:<y@example.com>", "DATA",
+            )
+            self.assertEqual(codes, [250, 250, 503, 250, 354])
+            self.assertEqual(await self.finish(client), 250)
+            await client.close()
+        [email] = self.stored()
+        # The refused MAIL left the transaction in progress untouched
+        self.assertEqual(email.sender, "a@example.com")
+        self.assertEqual(email.recipients, ["x@example.com", "y@example.com"])
+
+    async def test_greeting_again_aborts_the_transaction(self):
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            codes = await self.commands(
+                client, "MAIL FROM:<a@example.com>", "RCPT TO:<x@example.com>",
+                "EHLO client.example.com", "DATA",
+            )
+            self.assertEqual(codes, [250, 250, 250, 503])
+            await client.close()
+
+    async def test_data_needs_a_sender_and_recipients(self):
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            self.assertEqual(await self.commands(client, "DATA"), [503])
+            codes = await self.commands(client, "MAIL FROM:<a@example.com>", "DATA")
+            self.assertEqual(codes, [250, 554])
+            # The session is still in step, so the transaction can go on
+            codes = await self.commands(client, "NOOP", "RCPT TO:<x@example.com>", "DATA")
+            self.assertEqual(codes, [250, 250, 354])
+            self.assertEqual(await self.finish(client), 250)
+            await client.close()
+        self.assertEqual(len(self.stored()), 1)
+
+    async def test_refused_recipients_do_not_count(self):
+        self.config.smtp.max_recipients = 1
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            codes = await self.commands(
+                client, "MAIL FROM:<a@example.com>", "RCPT TO:<x@example.com>",
+                "RCPT TO:<y@example.com>", "DATA",
+            )
+            self.assertEqual(codes, [250, 250, 452, 354])
+            self.assertEqual(await self.finish(client), 250)
+            await client.close()
+        self.assertEqual(self.stored()[0].recipients, ["x@example.com"])
+
+    async def test_transaction_ends_with_the_message(self):
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            code, _ = await client.send("a@example.com", "x@example.com", b"Subject: Hi\r\n")
+            self.assertEqual(code, 250)
+            codes = await self.commands(client, "RCPT TO:<y@example.com>", "DATA")
+            self.assertEqual(codes, [503, 503])
+            await client.close()
+
+
+class SmugglingTest(ProtocolTestCase):
+    # A second message hidden behind a dot line that some servers read as end of data
+    SMUGGLED = (
+        b"Subject: First\r\n\r\nHello\r\n"
+        b"\n.\n"
+        b"MAIL FROM:<admin@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\n"
+        b"Subject: Smuggled\r\n\r\nGotcha\r\n"
+        b"\r\n.\r\n"
+    )
+
+    async def send_raw(self, data: bytes, replies: int) -> list[int]:
+        async with running(self.server()) as server:
+            client = await self.open(server)
+            client.writer.write(ENVELOPE + b"DATA\r\n")
+            self.assertEqual(await self.replies(client, 5), [220, 250, 250, 250, 354])
+            client.writer.write(data)
+            codes = await self.replies(client, replies)
+            # Still in step with the client
+            self.assertEqual(await client.command("NOOP"), (250, ["OK"]))
+            await client.close()
+        return codes
+
+    async def test_normalize_keeps_bare_lf_dot_as_content(self):
+        self.assertEqual(await self.send_raw(self.SMUGGLED, 1), [250])
+        [email] = self.stored()
+        self.assertEqual(email.subject, "First")
+        self.assertIn(b"\r\n.\r\nMAIL FROM:<admin@example.com>", email.raw_message)
+        self.assertIn(b"Gotcha", email.raw_message)
+        self.assertEqual(email.anomalies, "end-of-data without CRLF.CRLF")
+
+    async def test_reject_refuses_the_message(self):
+        self.config.smtp.smuggling_protection = "reject"
+        self.assertEqual(await self.send_raw(self.SMUGGLED, 1), [554])
+        self.assertEqual(self.stored(), [])
+
+    async def test_off_ends_data_on_bare_lf_dot(self):
+        self.config.smtp.smuggling_protection = "off"
+        codes = await self.send_raw(self.SMUGGLED, 5)
+        self.assertEqual(codes, [250, 250, 250, 354, 250])
+        self.assertEqual([e.subject for e in self.stored()], ["First", "Smuggled"])
+
+    async def test_other_improper_endings(self):
+        self.config.smtp.smuggling_protection = "reject"
+        for ending in (b"Hello\r\n.\n", b"Hello\n.\r\n", b"Hello\n\r\n.\n"):
+            with self.subTest(ending=ending):
+                # The dot line was taken as content, so the message needs a proper end
+                codes = await self.send_raw(b"Subject: x\r\n\r\n" + ending + b"\r\n.\r\n", 1)
+                self.assertEqual(codes, [554])
+        self.assertEqual(self.stored(), [])
+
+    async def test_lone_cr_does_not_end_a_line(self):
+        self.config.smtp.smuggling_protection = "reject"
+        data = b"Subject: x\r\n\r\nHello\r.\r\nMore\r\n.\r\n"
+        self.assertEqual(await self.send_raw(data, 1), [250])
+        # Line endings are normalized for storage, but only after framing
+        self.assertIn(b"Hello\r\n.\r\nMore", self.stored()[0].raw_message)
+
+    async def test_proper_ending_after_bare_lf_content(self):
+        self.config.smtp.smuggling_protection = "reject"
+        data = b"Subject: x\r\n\r\nline one\nline two\r\n.\r\n"
+        self.assertEqual(await self.send_raw(data, 1), [250])
+        self.assertEqual(self.stored()[0].anomalies, "")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,101 @@
+"""Idle and slow SMTP sessions are closed on time, without disturbing others."""
+
+import asyncio
+import time
+import unittest
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.smtp.server import SMTPServer
+from smtp_proxy.smtp.session import REAPED_IDLE, REAPED_SLOW_DATA
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+# Leeway for the event loop on a busy machine
+SLACK_SECONDS = 1.5
+
+
+class ReapingTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        smtp = self.config.smtp
+        smtp.idle_timeout_seconds = 1
+        smtp.read_timeout_seconds = 2
+        smtp.min_data_rate_bytes_per_second = 1000
+        smtp.data_rate_grace_seconds = 1
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+        self.server = SMTPServer(smtp, self.email_repo)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    async def assert_closed(self, client: SMTPClient, reply: str) -> float:
+        """Check the server closes the session with a 421; return when it did."""
+        code, lines = await client.reply()
+        closed_at = time.monotonic()
+        self.assertEqual(code, 421)
+        self.assertIn(reply, lines[0])
+        self.assertEqual(await asyncio.wait_for(client.reader.read(), 5), b"")
+        await client.close()
+        return closed_at
+
+    async def test_idle_client(self):
+        async with running(self.server) as server:
+            client = await SMTPClient.connect(server)
+            started = time.monotonic()
+            elapsed = await self.assert_closed(client, "Idle timeout") - started
+        self.assertGreaterEqual(elapsed, self.config.smtp.idle_timeout_seconds)
+        self.assertLess(elapsed, self.config.smtp.idle_timeout_seconds + SLACK_SECONDS)
+        self.assertEqual(server.reaped[REAPED_IDLE], 1)
+
+    async def trickle(self, client: SMTPClient) -> None:
+        """Send message data far below the minimum rate until the server hangs up."""
+        while not client.reader.at_eof() and not client.writer.is_closing():
+            client.writer.write(b"slow\r\n")
+            try:
+                await client.writer.drain()
+            except ConnectionError:
+                return
+            await asyncio.sleep(0.2)
+
+    async def pipelined(self, server: SMTPServer) -> list[int]:
+        """Send a whole transaction in one write, as a pipelining client does."""
+        client = await SMTPClient.connect(server)
+        client.writer.write(
+            b"MAIL FROM:<a@example.com>\r\n"
+            b"RCPT TO:<b@example.com>\r\n"
+            b"DATA\r\n"
+            b"Subject: Quick\r\n\r\nHello\r\n.\r\n"
+            b"QUIT\r\n"
+        )
+        await client.writer.drain()
+        codes = [(await client.reply())[0] for _ in range(5)]
+        await client.close()
+        return codes
+
+    async def test_slow_data_does_not_disturb_pipelined_clients(self):
+        async with running(self.server) as server:
+            slow = await SMTPClient.connect(server)
+            for line in ("MAIL FROM:<a@example.com>", "RCPT TO:<b@example.com>", "DATA"):
+                await slow.command(line)
+            started = time.monotonic()
+            trickling = asyncio.create_task(self.trickle(slow))
+            closing = asyncio.create_task(self.assert_closed(slow, "Transfer rate too low"))
+
+            # Other clients are served in full while the slow one is reaped
+            for _ in range(3):
+                self.assertEqual(await self.pipelined(server), [250, 250, 354, 250, 221])
+                await asyncio.sleep(0.3)
+
+            elapsed = await closing - started
+            await trickling
+        self.assertGreater(elapsed, self.config.smtp.data_rate_grace_seconds)
+        self.assertLess(elapsed, self.config.smtp.data_rate_grace_seconds + SLACK_SECONDS)
+        self.assertEqual(server.reaped[REAPED_SLOW_DATA], 1)
+        self.assertEqual(self.email_repo.count(), 3)
+
+
+if __name__ == "__main__":
+    unittest.main()
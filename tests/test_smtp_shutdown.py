@@ -0,0 +1,93 @@
+"""New SMTP clients are told to come back while the server drains."""
+
+import asyncio
+import os
+import unittest
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.smtp.server import SMTPServer
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+
+class ShutdownTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.db = Database(self.config.database.path)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    async def test_new_client_gets_421_while_draining(self):
+        self.config.smtp.shutdown_message = "Down for maintenance, back at 10:00"
+        self.config.smtp.shutdown_drain_seconds = 3
+        server = SMTPServer(self.config.smtp, EmailRepository(self.db))
+        async with running(server):
+            active = await SMTPClient.connect(server)
+            shutdown = asyncio.create_task(server.shutdown())
+            await asyncio.sleep(0.2)
+
+            reader, writer = await asyncio.open_connection(
+                self.config.smtp.host, self.config.smtp.port
+            )
+            line = await asyncio.wait_for(reader.readline(), 5)
+            self.assertEqual(line, b"421 localhost Down for maintenance, back at 10:00\r\n")
+            self.assertEqual(await asyncio.wait_for(reader.read(), 5), b"")
+            writer.close()
+
+            # The session that was already open may still finish its mail
+            code, _ = await active.send("a@example.com", "b@example.com", b"Subject: Hi\r\n")
+            self.assertEqual(code, 250)
+            self.assertEqual((await active.command("QUIT"))[0], 221)
+            await active.close()
+            await asyncio.wait_for(shutdown, 5)
+        self.assertEqual(EmailRepository(self.db).count(), 1)
+
+    async def read_greeting(self) -> bytes:
+        reader, writer = await asyncio.open_connection(
+            self.config.smtp.host, self.config.smtp.port
+        )
+        try:
+            return await asyncio.wait_for(reader.readline(), 5)
+        finally:
+            writer.close()
+
+    async def test_idle_server_answers_421_for_the_whole_drain_period(self):
+        self.config.smtp.shutdown_drain_seconds = 2
+        server = SMTPServer(self.config.smtp, EmailRepository(self.db))
+        async with running(server):
+            loop = asyncio.get_running_loop()
+            started_at = loop.time()
+            shutdown = asyncio.create_task(server.shutdown())
+            for delay in (0.2, 1.0, 1.7):
+                await asyncio.sleep(started_at + delay - loop.time())
+                self.assertFalse(shutdown.done())
+                line = await self.read_greeting()
+                self.assertTrue(line.startswith(b"421 localhost "), (delay, line))
+            await asyncio.wait_for(shutdown, 5)
+            self.assertGreaterEqual(loop.time() - started_at, 2)
+
+        with self.assertRaises(OSError):
+            await self.read_greeting()
+
+    async def test_idle_server_stops_at_once_without_announcing(self):
+        self.config.smtp.announce_shutdown = False
+        self.config.smtp.shutdown_drain_seconds = 10
+        server = SMTPServer(self.config.smtp, EmailRepository(self.db))
+        async with running(server):
+            await asyncio.wait_for(server.shutdown(), 1)
+            with self.assertRaises(OSError):
+                await self.read_greeting()
+
+    def test_message_must_be_one_line(self):
+        for message in ("", "Closing\r\n250 OK", "Fermé pour maintenance"):
+            with self.subTest(message=message):
+                self.config.smtp.shutdown_message = message
+                with self.assertRaisesRegex(ValueError, "shutdown message"):
+                    self.config.validate()
+
+
+if __name__ == "__main__":
+    unittest.main()
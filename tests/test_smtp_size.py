@@ -0,0 +1,70 @@
+"""Oversized messages are refused without being held in memory."""
+
+import asyncio
+import tracemalloc
+import unittest
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.smtp.server import SMTPServer
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+MAX_MESSAGE_BYTES = 256 * 1024
+STREAMED_BYTES = 32 * 1024 * 1024
+# Well above max_message_bytes and the reader's buffer, well below what was sent
+MEMORY_BOUND = 4 * 1024 * 1024
+
+
+class OversizedMessageTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        config = make_config(self.directory)
+        config.smtp.max_message_bytes = MAX_MESSAGE_BYTES
+        self.db = Database(config.database.path)
+        self.email_repo = EmailRepository(self.db)
+        self.server = SMTPServer(config.smtp, self.email_repo)
+
+    async def asyncSetUp(self):
+        # Debug mode checks every callback, far too slowly for megabytes of lines
+        asyncio.get_running_loop().set_debug(False)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    async def stream(self, chunk: bytes) -> tuple[int, list[str], int]:
+        """Send STREAMED_BYTES of chunk as one message; return the reply and peak memory."""
+        async with running(self.server) as server:
+            client = await SMTPClient.connect(server)
+            for line in ("MAIL FROM:<a@example.com>", "RCPT TO:<b@example.com>", "DATA"):
+                await client.command(line)
+            tracemalloc.start()
+            try:
+                for _ in range(STREAMED_BYTES // len(chunk)):
+                    client.writer.write(chunk)
+                    await client.writer.drain()
+                client.writer.write(b"\r\n.\r\n")
+                code, lines = await client.reply()
+                _, peak = tracemalloc.get_traced_memory()
+            finally:
+                tracemalloc.stop()
+            # The session is still in step with the client
+            self.assertEqual((await client.command("NOOP"))[0], 250)
+            await client.close()
+        return code, lines, peak
+
+    async def test_many_lines(self):
+        code, lines, peak = await self.stream(b"x" * 998 + b"\r\n")
+        self.assertEqual((code, lines[0][:5]), (552, "5.3.4"))
+        self.assertLess(peak, MEMORY_BOUND)
+        self.assertEqual(self.email_repo.count(), 0)
+
+    async def test_one_endless_line(self):
+        code, lines, peak = await self.stream(b"x" * 65536)
+        self.assertEqual((code, lines[0][:5]), (552, "5.3.4"))
+        self.assertLess(peak, MEMORY_BOUND)
+        self.assertEqual(self.email_repo.count(), 0)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,88 @@
+"""Each received email records how long each step of its SMTP transaction took."""
+
+import asyncio
+import time
+import unittest
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.smtp.server import SMTPServer
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+MESSAGE = b"From: app@example.com\r\nSubject: Timed\r\n\r\nBody\r\n"
+FIELDS = ["connect_to_mail_ms", "data_transfer_ms", "mail_to_data_ms", "store_ms"]
+PAUSE = 0.2
+
+
+class TimingTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def timings(self) -> list[dict]:
+        return [email.timing for email in sorted(self.email_repo.get_all(), key=lambda e: e.id)]
+
+    async def test_fields_are_populated_and_add_up(self):
+        async with running(SMTPServer(self.config.smtp, self.email_repo)) as server:
+            started_at = time.perf_counter()
+            client = await SMTPClient.connect(server)
+            await asyncio.sleep(PAUSE)
+            code, _ = await client.command("MAIL FROM:<app@example.com>")
+            self.assertEqual(code, 250)
+            await client.command("RCPT TO:<user@example.com>")
+            await asyncio.sleep(PAUSE)
+            code, _ = await client.command("DATA")
+            self.assertEqual(code, 354)
+            client.writer.write(MESSAGE)
+            await asyncio.sleep(PAUSE)
+            client.writer.write(b".\r\n")
+            code, _ = await client.reply()
+            self.assertEqual(code, 250)
+            elapsed_ms = (time.perf_counter() - started_at) * 1000
+            await client.close()
+
+        [timing] = self.timings()
+        self.assertEqual(sorted(timing), FIELDS)
+        for name in FIELDS:
+            self.assertIsInstance(timing[name], float, name)
+            self.assertGreaterEqual(timing[name], 0, name)
+        # Each pause lands in its own step
+        for name in ("connect_to_mail_ms", "mail_to_data_ms", "data_transfer_ms"):
+            self.assertGreaterEqual(timing[name], PAUSE * 1000 * 0.9, name)
+        # The steps follow one another, so together they fit in the session
+        self.assertLessEqual(sum(timing.values()), elapsed_ms)
+
+    async def test_later_messages_are_timed_from_the_end_of_the_previous_one(self):
+        async with running(SMTPServer(self.config.smtp, self.email_repo)) as server:
+            client = await SMTPClient.connect(server)
+            await asyncio.sleep(PAUSE)
+            for _ in range(3):
+                code, _ = await client.send("app@example.com", "user@example.com", MESSAGE)
+                self.assertEqual(code, 250)
+            # An abandoned transaction ends the wait, and a repeated MAIL
+            # keeps timing from where the one it replaces started
+            await client.command("MAIL FROM:<app@example.com>")
+            await client.command("RSET")
+            await asyncio.sleep(PAUSE)
+            await client.command("MAIL FROM:<first@example.com>")
+            code, _ = await client.send("app@example.com", "user@example.com", MESSAGE)
+            self.assertEqual(code, 250)
+            await client.close()
+
+        waits = [timing["connect_to_mail_ms"] for timing in self.timings()]
+        self.assertEqual(len(waits), 4)
+        self.assertGreaterEqual(waits[0], PAUSE * 1000 * 0.9)
+        # Pipelined messages do not carry the first one's wait with them
+        self.assertLess(max(waits[1:3]), PAUSE * 1000 / 2)
+        self.assertGreaterEqual(waits[3], PAUSE * 1000 * 0.9)
+        self.assertLess(waits[3], waits[0] + PAUSE * 1000)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,223 @@
+"""STARTTLS policy is enforced at MAIL, and the TLS each client used is reported."""
+
+import os
+import shutil
+import ssl
+import subprocess
+import tempfile
+import unittest
+from datetime import datetime, timedelta
+from types import SimpleNamespace
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.database.audit_repository import AuditRepository
+from smtp_proxy.models import Email
+from smtp_proxy.smtp.server import SMTPServer
+from smtp_proxy.web.routes import build_tls_report
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+MESSAGE = b"From: app@example.com\r\nSubject: Over TLS\r\n\r\nBody\r\n"
+
+# AUTH PLAIN for the default mailuser/mailpass credential
+PLAIN_TOKEN = "AG1haWx1c2VyAG1haWxwYXNz"
+
+
+def client_context(maximum: ssl.TLSVersion | None = None) -> ssl.SSLContext:
+    """Return a client context that trusts the test's self-signed certificate."""
+    context = ssl.create_default_context()
+    context.check_hostname = False
+    context.verify_mode = ssl.CERT_NONE
+    if maximum:
+        context.maximum_version = maximum
+    return context
+
+
+@unittest.skipUnless(shutil.which("openssl"), "openssl is needed to make a certificate")
+class STARTTLSPolicyTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    @classmethod
+    def setUpClass(cls):
+        cls._certs = tempfile.TemporaryDirectory()
+        cls.cert_file = os.path.join(cls._certs.name, "server.crt")
+        cls.key_file = os.path.join(cls._certs.name, "server.key")
+        subprocess.run(
+            ["openssl", "req", "-x509", "-newkey", "ec", "-pkeyopt",
+             "ec_paramgen_curve:prime256v1", "-nodes", "-days", "1", "-subj", "/CN=localhost",
+             "-keyout", cls.key_file, "-out", cls.cert_file],
+            check=True, capture_output=True,
+        )
+
+    @classmethod
+    def tearDownClass(cls):
+        cls._certs.cleanup()
+
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        tls = self.config.smtp.tls
+        tls.enabled, tls.cert_file, tls.key_file = True, self.cert_file, self.key_file
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+        self.audit_repo = AuditRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def server(self) -> SMTPServer:
+        return SMTPServer(self.config.smtp, self.email_repo, audit_repo=self.audit_repo)
+
+    async def starttls(self, client: SMTPClient, context: ssl.SSLContext | None = None):
+        code, _ = await client.command("STARTTLS")
+        self.assertEqual(code, 220)
+        await client.writer.start_tls(context or client_context())
+        code, lines = await client.command("EHLO client.example.com")
+        self.assertEqual(code, 250)
+        return lines
+
+    async def test_mail_before_starttls_is_refused(self):
+        self.config.smtp.tls.require = "all"
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            code, lines = await client.command("MAIL FROM:<app@example.com>")
+            self.assertEqual((code, lines), (530, ["5.7.0 Must issue a STARTTLS command first"]))
+            # Nothing of the transaction was accepted, so RCPT has no sender to follow
+            code, _ = await client.command("RCPT TO:<user@example.com>")
+            self.assertEqual(code, 503)
+
+            await self.starttls(client)
+            code, _ = await client.send("app@example.com", "user@example.com", MESSAGE)
+            self.assertEqual(code, 250)
+            await client.close()
+
+        [email] = self.email_repo.get_all()
+        self.assertTrue(email.tls_version.startswith("TLSv1."))
+        self.assertTrue(email.tls_cipher)
+        [event] = self.audit_repo.recent()
+        self.assertEqual((event.event, event.outcome), ("smtp.tls_required", "failure"))
+        self.assertEqual((event.source, event.data), ("127.0.0.1", {"require": "all"}))
+
+    async def test_authenticating_is_not_enough_when_all_sessions_need_tls(self):
+        self.config.smtp.tls.require = "all"
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            code, _ = await client.command(f"AUTH PLAIN {PLAIN_TOKEN}")
+            self.assertEqual(code, 235)
+            code, _ = await client.command("MAIL FROM:<app@example.com>")
+            self.assertEqual(code, 530)
+            await client.close()
+
+    async def test_unauthenticated_sessions_only(self):
+        self.config.smtp.tls.require = "unauthenticated"
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            code, _ = await client.command("MAIL FROM:<app@example.com>")
+            self.assertEqual(code, 530)
+            code, _ = await client.command(f"AUTH PLAIN {PLAIN_TOKEN}")
+            self.assertEqual(code, 235)
+            code, _ = await client.send("app@example.com", "user@example.com", MESSAGE)
+            self.assertEqual(code, 250)
+            await client.close()
+
+        [email] = self.email_repo.get_all()
+        self.assertEqual((email.auth_user, email.tls_version), ("mailuser", ""))
+
+    async def test_off_accepts_plaintext(self):
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            code, _ = await client.send("app@example.com", "user@example.com", MESSAGE)
+            self.assertEqual(code, 250)
+            await client.close()
+        self.assertEqual(self.email_repo.get_all()[0].tls_version, "")
+        self.assertEqual(self.audit_repo.recent(), [])
+
+    async def test_starttls_only_once(self):
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            code, lines = await client.command("EHLO client.example.com")
+            self.assertIn("STARTTLS", lines)
+            lines = await self.starttls(client)
+            self.assertNotIn("STARTTLS", lines)
+            code, lines = await client.command("STARTTLS")
+            self.assertEqual((code, lines), (503, ["5.5.1 TLS already active"]))
+            await client.close()
+
+    async def test_min_version(self):
+        self.config.smtp.tls.min_version = "1.3"
+        async with running(self.server()) as server:
+            client = await SMTPClient.connect(server)
+            code, _ = await client.command("STARTTLS")
+            self.assertEqual(code, 220)
+            with self.assertRaises((ssl.SSLError, ConnectionError)):
+                await client.writer.start_tls(client_context(maximum=ssl.TLSVersion.TLSv1_2))
+            await client.close()
+
+            client = await SMTPClient.connect(server)
+            await self.starttls(client)
+            code, _ = await client.send("app@example.com", "user@example.com", MESSAGE)
+            self.assertEqual(code, 250)
+            await client.close()
+        [email] = self.email_repo.get_all()
+        self.assertEqual(email.tls_version, "TLSv1.3")
+
+
+class TLSReportTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.db = Database(os.path.join(self.directory, "smtp_proxy.db"))
+        self.email_repo = EmailRepository(self.db)
+        self.request = SimpleNamespace(
+            app=SimpleNamespace(state=SimpleNamespace(email_repo=self.email_repo))
+        )
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def receive(self, auth_user: str, client_ip: str, version: str | None, cipher: str = "",
+                hours_ago: int = 0):
+        self.email_repo.create(Email(
+            sender="app@example.com",
+            auth_user=auth_user,
+            client_ip=client_ip,
+            tls_version=version,
+            tls_cipher=cipher,
+            received_at=datetime.now() - timedelta(hours=hours_ago),
+        ))
+
+    def test_clients_are_grouped_and_the_insecure_come_first(self):
+        modern = ("TLSv1.3", "TLS_AES_256_GCM_SHA384")
+        for _ in range(5):
+            self.receive("billing", "10.0.0.1", *modern)
+        self.receive("legacy", "10.0.0.2", *modern)
+        self.receive("legacy", "10.0.0.2", "TLSv1", "ECDHE-RSA-AES128-SHA")
+        self.receive("legacy", "10.0.0.2", "TLSv1", "ECDHE-RSA-AES128-SHA")
+        self.receive("", "10.0.0.3", "")
+        self.receive("", "10.0.0.3", *modern)
+        # Received before TLS details were recorded, or outside the window
+        self.receive("", "10.0.0.4", None)
+        self.receive("", "10.0.0.5", "", hours_ago=48)
+
+        report = build_tls_report(self.request, 24)
+        self.assertEqual(
+            [(c.auth_user, c.client_ip, c.messages, c.plaintext, c.deprecated) for c in report],
+            [
+                ("", "10.0.0.3", 2, 1, 0),
+                ("legacy", "10.0.0.2", 3, 0, 2),
+                ("billing", "10.0.0.1", 5, 0, 0),
+            ],
+        )
+        self.assertEqual(
+            report[1].connections,
+            [
+                {"version": "TLSv1", "cipher": "ECDHE-RSA-AES128-SHA", "messages": 2},
+                {"version": "TLSv1.3", "cipher": "TLS_AES_256_GCM_SHA384", "messages": 1},
+            ],
+        )
+        # A wider window takes in the older plaintext client too
+        wider = build_tls_report(self.request, 72)
+        self.assertEqual([c.client_ip for c in wider[:2]], ["10.0.0.3", "10.0.0.5"])
+
+
+if __name__ == "__main__":
+    unittest.main()
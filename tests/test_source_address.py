@@ -0,0 +1,163 @@
+"""Upstream SMTP connections are made from the configured source address."""
+
+import asyncio
+import unittest
+from unittest import mock
+
+from smtp_proxy import relay as relay_module
+from smtp_proxy.config import RelayRoute, UpstreamConfig
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.main import Application, StartupError
+from smtp_proxy.models import Email
+from smtp_proxy.relay import CODE_CONNECT_FAILED, Relay, RelayError, deliver, local_address_error
+from smtp_proxy.smtp.server import SMTPServer
+
+from .helpers import TempDirTestCase, make_config, running
+
+MESSAGE = b"From: app@example.com\r\nSubject: Where from\r\n\r\nBody\r\n"
+
+# From the documentation range, so never on an interface. The sources used
+# below are all loopback, as Linux answers on the whole of 127.0.0.0/8.
+UNASSIGNED = "192.0.2.1"
+
+
+class SourceAddressTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+
+        # The local listener stores what it receives, with the client address it saw
+        self.upstream_config = make_config(self.directory)
+        self.upstream_config.database.path = f"{self.directory}/upstream.db"
+        self.upstream_db = Database(self.upstream_config.database.path)
+        self.upstream_repo = EmailRepository(self.upstream_db)
+
+    def tearDown(self):
+        self.upstream_db.close()
+        self.db.close()
+        super().tearDown()
+
+    def upstream(self, host: str = "127.0.0.1", **options) -> UpstreamConfig:
+        return UpstreamConfig(
+            host=host, port=self.upstream_config.smtp.port, timeout_seconds=2, **options
+        )
+
+    def sources(self) -> list[tuple[str, list[str]]]:
+        return [(email.client_ip, email.recipients) for email in self.upstream_repo.get_all()]
+
+    async def deliver(self, upstream: UpstreamConfig, local_address: str = "") -> tuple[int, str]:
+        return await asyncio.to_thread(
+            deliver, upstream, "app@example.com", ["user@example.com"], MESSAGE,
+            local_address=local_address,
+        )
+
+    async def test_default_source_is_left_to_the_os(self):
+        async with running(SMTPServer(self.upstream_config.smtp, self.upstream_repo)):
+            code, _ = await self.deliver(self.upstream())
+        self.assertEqual(code, 250)
+        self.assertEqual(self.sources(), [("127.0.0.1", ["user@example.com"])])
+
+    async def test_relay_source_and_upstream_override(self):
+        async with running(SMTPServer(self.upstream_config.smtp, self.upstream_repo)):
+            await self.deliver(self.upstream(), local_address="127.0.0.2")
+            await self.deliver(self.upstream(local_address="127.0.0.3"), local_address="127.0.0.2")
+        self.assertEqual(sorted(ip for ip, _ in self.sources()), ["127.0.0.2", "127.0.0.3"])
+
+    async def test_routes_override_the_relay_source(self):
+        routes = [
+            RelayRoute(host="127.0.0.1", port=self.upstream_config.smtp.port,
+                       domain="pinned.example", local_address="127.0.0.3"),
+            RelayRoute(host="127.0.0.1", port=self.upstream_config.smtp.port,
+                       domain="shared.example"),
+        ]
+        relay = Relay(UpstreamConfig(), self.email_repo, routes, local_address="127.0.0.2")
+        email = Email(
+            sender="app@example.com",
+            recipients=["a@pinned.example", "b@shared.example"],
+            raw_message=MESSAGE,
+        )
+        email_id = self.email_repo.create(email)
+        with mock.patch.object(relay_module.logger, "info") as info:
+            async with running(SMTPServer(self.upstream_config.smtp, self.upstream_repo)):
+                relay.submit(email_id, email)
+                await relay.drain(5)
+
+        self.assertEqual(self.email_repo.get_by_id(email_id).status, "relayed")
+        self.assertEqual(
+            sorted(self.sources()),
+            [("127.0.0.2", ["b@shared.example"]), ("127.0.0.3", ["a@pinned.example"])],
+        )
+        # Each delivery's log line names the source it was made from
+        lines = sorted(call.args[0] for call in info.call_args_list)
+        self.assertEqual(len(lines), 2)
+        self.assertTrue(lines[0].endswith("via route pinned.example from 127.0.0.3"))
+        self.assertTrue(lines[1].endswith("via route shared.example from 127.0.0.2"))
+
+    async def test_ipv6_source(self):
+        self.upstream_config.smtp.host = "::1"
+        async with running(SMTPServer(self.upstream_config.smtp, self.upstream_repo)):
+            code, _ = await self.deliver(self.upstream("::1", local_address="::1"))
+        self.assertEqual(code, 250)
+        self.assertEqual([ip for ip, _ in self.sources()], ["::1"])
+
+    async def test_pinned_family_does_not_fall_back_to_the_other(self):
+        self.upstream_config.smtp.host = "::1"
+        async with running(SMTPServer(self.upstream_config.smtp, self.upstream_repo)):
+            with self.assertRaises(RelayError) as raised:
+                await self.deliver(self.upstream("::1"), local_address="127.0.0.2")
+            self.assertEqual(raised.exception.code, CODE_CONNECT_FAILED)
+            self.assertIn("has no IPv4 address", raised.exception.response)
+
+            with self.assertRaises(RelayError) as raised:
+                await self.deliver(self.upstream("127.0.0.1", local_address="::1"))
+            self.assertIn("has no IPv6 address", raised.exception.response)
+        self.assertEqual(self.sources(), [])
+
+
+class SourceAddressCheckTest(TempDirTestCase, unittest.TestCase):
+    def test_local_address_error(self):
+        self.assertIsNone(local_address_error("127.0.0.2"))
+        self.assertIsNone(local_address_error("::1"))
+        self.assertIn("is not assigned to a local interface", local_address_error(UNASSIGNED))
+        self.assertEqual(local_address_error("eth0"), "'eth0' is not an IP address")
+
+    def test_startup_refuses_an_unassigned_address(self):
+        for place in ("relay", "upstream", "route"):
+            config = make_config(self.directory)
+            if place == "relay":
+                config.smtp.relay.local_address = UNASSIGNED
+            elif place == "upstream":
+                config.smtp.upstream.local_address = UNASSIGNED
+            else:
+                config.smtp.relay.routes = [
+                    RelayRoute(host="mx.example.org", domain="example.org",
+                               local_address=UNASSIGNED)
+                ]
+            with self.subTest(place=place):
+                with self.assertRaisesRegex(
+                    StartupError, f"Cannot connect to upstream SMTP servers from {UNASSIGNED}"
+                ):
+                    Application(config).check()
+
+        config = make_config(self.directory)
+        config.smtp.relay.local_address = "127.0.0.2"
+        Application(config).check()
+
+    def test_config_rejects_values_that_are_not_addresses(self):
+        config = make_config(self.directory)
+        config.smtp.relay.local_address = "eth0"
+        config.smtp.relay.routes = [
+            RelayRoute(host="mx.example.org", domain="example.org", local_address="10.0.0")
+        ]
+        with self.assertRaises(ValueError) as raised:
+            config.validate()
+        self.assertIn("SMTP relay local_address must be an IP address: 'eth0'",
+                      str(raised.exception))
+        self.assertIn("SMTP relay route example.org local_address must be an IP address",
+                      str(raised.exception))
+
+
+if __name__ == "__main__":
+    unittest.main()
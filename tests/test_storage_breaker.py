@@ -0,0 +1,222 @@
+"""Storage errors open the breaker, SMTP answers with 4xx and recovery closes it again."""
+
+import asyncio
+import os
+import sqlite3
+import stat
+import unittest
+
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.database.health import (
+    STORAGE_DISK_FULL,
+    STORAGE_IO,
+    STORAGE_LOCKED,
+    STORAGE_READ_ONLY,
+    StorageBreaker,
+    classify_storage_error,
+)
+from smtp_proxy.main import run_storage_probe
+from smtp_proxy.smtp.server import SMTPServer
+from smtp_proxy.smtp.session import storage_error_reply
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+DISK_FULL = sqlite3.OperationalError("database or disk is full")
+LOCKED = sqlite3.OperationalError("database is locked")
+
+
+class ClassifyTest(unittest.TestCase):
+    def test_storage_errors(self):
+        cases = [
+            ("database or disk is full", STORAGE_DISK_FULL),
+            ("database is locked", STORAGE_LOCKED),
+            ("database table is locked: emails", STORAGE_LOCKED),
+            ("attempt to write a readonly database", STORAGE_READ_ONLY),
+            ("disk I/O error", STORAGE_IO),
+            ("unable to open database file", STORAGE_IO),
+        ]
+        for message, kind in cases:
+            self.assertEqual(classify_storage_error(sqlite3.OperationalError(message)), kind)
+
+    def test_other_errors_are_not_storage_problems(self):
+        self.assertIsNone(classify_storage_error(sqlite3.OperationalError("no such table: x")))
+        self.assertIsNone(classify_storage_error(sqlite3.IntegrityError("UNIQUE constraint")))
+        self.assertIsNone(classify_storage_error(OSError("database or disk is full")))
+
+    def test_smtp_replies(self):
+        self.assertEqual(storage_error_reply(DISK_FULL), "452 4.3.1 Insufficient system storage")
+        self.assertTrue(storage_error_reply(LOCKED).startswith("451 4.3.0 "))
+
+
+class StorageBreakerTest(unittest.TestCase):
+    def setUp(self):
+        self.breaker = StorageBreaker()
+
+    def test_starts_closed(self):
+        self.assertFalse(self.breaker.is_open)
+        self.assertEqual(self.breaker.stats(), {"state": "closed", "kind": None, "error": ""})
+
+    def test_storage_error_opens(self):
+        self.breaker.record_failure(DISK_FULL)
+        self.assertTrue(self.breaker.is_open)
+        self.assertEqual(
+            self.breaker.stats(),
+            {"state": "open", "kind": STORAGE_DISK_FULL, "error": "database or disk is full"},
+        )
+
+    def test_other_errors_leave_it_closed(self):
+        self.breaker.record_failure(sqlite3.OperationalError("no such column: x"))
+        self.assertFalse(self.breaker.is_open)
+
+    def test_later_failures_update_the_kind_but_not_the_start(self):
+        self.breaker.record_failure(DISK_FULL)
+        opened_at = self.breaker.opened_at
+        self.breaker.record_failure(LOCKED)
+        self.assertEqual(self.breaker.kind, STORAGE_LOCKED)
+        self.assertEqual(self.breaker.opened_at, opened_at)
+        # A non-storage error while open changes nothing
+        self.breaker.record_failure(sqlite3.OperationalError("no such table: x"))
+        self.assertEqual(self.breaker.kind, STORAGE_LOCKED)
+
+    def test_success_closes(self):
+        self.breaker.record_failure(LOCKED)
+        self.breaker.record_success()
+        self.assertFalse(self.breaker.is_open)
+        self.assertEqual(self.breaker.stats(), {"state": "closed", "kind": None, "error": ""})
+        self.breaker.record_success()
+        self.assertFalse(self.breaker.is_open)
+
+
+class FlakyConnection:
+    """Wraps a connection so its statements fail with error while it is set."""
+
+    def __init__(self, conn: sqlite3.Connection):
+        self.conn = conn
+        self.error: Exception | None = None
+
+    def execute(self, *args):
+        if self.error:
+            raise self.error
+        return self.conn.execute(*args)
+
+    def executemany(self, *args):
+        if self.error:
+            raise self.error
+        return self.conn.executemany(*args)
+
+    def __getattr__(self, name):
+        return getattr(self.conn, name)
+
+
+class DatabaseBreakerTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.db = Database(os.path.join(self.directory, "smtp_proxy.db"))
+        self.conn = FlakyConnection(self.db.conn)
+        self.db.conn = self.conn
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def test_failed_write_opens_and_next_write_closes(self):
+        self.conn.error = DISK_FULL
+        with self.assertRaises(sqlite3.OperationalError):
+            self.db.execute("INSERT INTO health_probe (checked_at) VALUES ('x')")
+        self.assertEqual(self.db.breaker.kind, STORAGE_DISK_FULL)
+        with self.assertRaises(sqlite3.OperationalError):
+            self.db.executemany("INSERT INTO health_probe (checked_at) VALUES (?)", [("x",)])
+        self.assertTrue(self.db.breaker.is_open)
+
+        self.conn.error = None
+        self.db.execute("INSERT INTO health_probe (checked_at) VALUES ('x')")
+        self.assertFalse(self.db.breaker.is_open)
+
+    def test_failed_read_opens(self):
+        self.conn.error = sqlite3.OperationalError("disk I/O error")
+        with self.assertRaises(sqlite3.OperationalError):
+            self.db.fetchall("SELECT * FROM emails")
+        self.assertEqual(self.db.breaker.kind, STORAGE_IO)
+
+    def test_bad_query_does_not_open(self):
+        with self.assertRaises(sqlite3.OperationalError):
+            self.db.execute("INSERT INTO no_such_table VALUES (1)")
+        self.assertFalse(self.db.breaker.is_open)
+
+    def test_probe(self):
+        self.conn.error = LOCKED
+        self.assertFalse(self.db.probe())
+        self.assertTrue(self.db.breaker.is_open)
+        self.conn.error = None
+        self.assertTrue(self.db.probe())
+        self.assertFalse(self.db.breaker.is_open)
+
+
+class StorageOutageTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+        self.server = SMTPServer(self.config.smtp, self.email_repo)
+
+    def tearDown(self):
+        os.chmod(self.directory, stat.S_IRWXU)
+        self.db.close()
+        super().tearDown()
+
+    async def send(self) -> tuple[int, list[str]]:
+        client = await SMTPClient.connect(self.server)
+        try:
+            return await client.send("a@example.com", "b@example.com", b"Subject: Hi\r\n\r\nHi")
+        finally:
+            await client.close()
+
+    async def test_simulated_outage(self):
+        async with running(self.server):
+            conn = FlakyConnection(self.db.conn)
+            self.db.conn = conn
+            conn.error = DISK_FULL
+            code, lines = await self.send()
+            self.assertEqual((code, lines), (452, ["4.3.1 Insufficient system storage"]))
+            # New transactions are turned away up front until storage is back
+            code, lines = await self.send()
+            self.assertEqual(code, 451)
+            self.assertIn("4.3.0", lines[0])
+
+            conn.error = None
+            self.assertTrue(self.db.probe())
+            self.assertEqual((await self.send())[0], 250)
+        self.assertEqual(self.email_repo.count(), 1)
+
+    @unittest.skipIf(os.geteuid() == 0, "root writes regardless of directory permissions")
+    async def test_directory_made_read_only_and_back(self):
+        async with running(self.server):
+            self.assertEqual((await self.send())[0], 250)
+
+            # SQLite needs to create a rollback journal next to the database
+            os.chmod(self.directory, stat.S_IRUSR | stat.S_IXUSR)
+            code, lines = await self.send()
+            self.assertEqual(code, 451)
+            self.assertTrue(lines[0].startswith("4.3.0 "), lines)
+            self.assertTrue(self.db.breaker.is_open)
+            self.assertFalse(self.db.probe())
+            self.assertEqual((await self.send())[0], 451)
+
+            os.chmod(self.directory, stat.S_IRWXU)
+            probe = asyncio.create_task(run_storage_probe(self.db, 1))
+            try:
+                for _ in range(50):
+                    if not self.db.breaker.is_open:
+                        break
+                    await asyncio.sleep(0.1)
+            finally:
+                probe.cancel()
+            self.assertFalse(self.db.breaker.is_open)
+            self.assertEqual((await self.send())[0], 250)
+        self.assertEqual(self.email_repo.count(), 2)
+        self.assertEqual(self.db.fetchone("PRAGMA integrity_check")[0], "ok")
+
+
+if __name__ == "__main__":
+    unittest.main()
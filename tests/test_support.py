@@ -0,0 +1,143 @@
+"""Support bundles carry diagnostics but never secrets or email content."""
+
+import dataclasses
+import io
+import json
+import unittest
+import zipfile
+
+from smtp_proxy import support
+from smtp_proxy.config import RelayRoute, SMTPCredential
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.database.api_token_repository import ApiTokenRepository
+from smtp_proxy.database.smtp_credential_repository import SMTPCredentialRepository
+from smtp_proxy.database.user_repository import UserRepository
+from smtp_proxy.models import Email
+
+from .helpers import TempDirTestCase, make_config
+
+EMAIL_BODY = "Body marker 7f3a9c, never leave the database"
+EMAIL_SUBJECT = "Subject marker 51be02"
+
+
+def plant_secrets(config, prefix: str = "s") -> list[str]:
+    """Give every secret-looking string field of a config a distinct value, returning them."""
+    planted = []
+    for index, field in enumerate(dataclasses.fields(config)):
+        value = getattr(config, field.name)
+        if dataclasses.is_dataclass(value):
+            planted += plant_secrets(value, f"{prefix}{index}-")
+        elif isinstance(value, list):
+            for position, item in enumerate(value):
+                if dataclasses.is_dataclass(item):
+                    planted += plant_secrets(item, f"{prefix}{index}.{position}-")
+        elif isinstance(value, str) and support.SECRET_FIELD.search(field.name):
+            secret = f"planted-{prefix}{index}-{field.name}-secret"
+            setattr(config, field.name, secret)
+            planted.append(secret)
+    return planted
+
+
+def secret_fields(data, key: str = "") -> list[tuple[str, object]]:
+    """Find every secret-looking key in JSON data with its value."""
+    if isinstance(data, dict):
+        return [found for k, v in data.items() for found in secret_fields(v, k)]
+    if isinstance(data, list):
+        return [found for item in data for found in secret_fields(item, key)]
+    return [(key, data)] if key and support.SECRET_FIELD.search(key) else []
+
+
+class SupportBundleTest(TempDirTestCase, unittest.TestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.config.smtp.auth.users = [SMTPCredential(username="app", password="")]
+        self.config.smtp.relay.routes = [
+            RelayRoute(host="smtp.sendgrid.net", domain="example.org")
+        ]
+        self.secrets = plant_secrets(self.config)
+        self.db = Database(self.config.database.path)
+
+        EmailRepository(self.db).create(
+            Email(sender="a@example.com", subject=EMAIL_SUBJECT, body=EMAIL_BODY,
+                  raw_message=f"Subject: {EMAIL_SUBJECT}\r\n\r\n{EMAIL_BODY}\r\n".encode())
+        )
+        UserRepository(self.db).create("alice", "alice-web-password")
+        _, token = ApiTokenRepository(self.db).create("ci")
+        _, smtp_password = SMTPCredentialRepository(self.db).create("mailer")
+        self.secrets += ["alice-web-password", token, smtp_password]
+        # Stored hashes are as good as secrets to an attacker with time
+        for query in (
+            "SELECT password_hash FROM users",
+            "SELECT token_hash FROM api_tokens",
+            "SELECT password_hash FROM smtp_credentials",
+        ):
+            self.secrets += [row[0] for row in self.db.fetchall(query)]
+
+        session_secret = self.config.web.session_secret
+        upstream_password = self.config.smtp.upstream.password
+        self.log_lines = [
+            "2026-10-15 09:00:00 - smtp_proxy - INFO - Server started",
+            f"2026-10-15 09:00:01 - smtp_proxy - DEBUG - Session secret is {session_secret}",
+            "2026-10-15 09:00:02 - smtp_proxy - INFO - GET /login?user=a&password=hunter2xyz",
+            "2026-10-15 09:00:03 - smtp_proxy - INFO - Retrying with token=tok_abcdef123456",
+            f"2026-10-15 09:00:04 - smtp_proxy - WARNING - Rejected: auth {upstream_password}",
+        ]
+        self.secrets += ["hunter2xyz", "tok_abcdef123456"]
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def bundle(self, sections=support.SECTIONS) -> dict[str, str]:
+        out = io.BytesIO()
+        support.SupportBundle(
+            self.config, self.db, self.log_lines, runtime={"storage": {"state": "closed"}}
+        ).write(out, sections)
+        with zipfile.ZipFile(out) as bundle:
+            return {name: bundle.read(name).decode() for name in bundle.namelist()}
+
+    def test_no_secret_or_email_content_appears_anywhere(self):
+        self.assertGreater(len(self.secrets), 15)
+        files = self.bundle()
+        self.assertEqual(
+            sorted(files),
+            sorted(["manifest.json", "config.json", "schema.json", "logs.txt", "integrity.txt",
+                    "tables.json", "version.json", "runtime.json", "rejections.txt"]),
+        )
+        for name, content in files.items():
+            for secret in self.secrets:
+                self.assertNotIn(secret, content, f"{secret} leaked into {name}")
+            for marker in (EMAIL_BODY, EMAIL_SUBJECT, "7f3a9c", "51be02"):
+                self.assertNotIn(marker, content, f"Email content leaked into {name}")
+
+    def test_every_secret_config_field_is_redacted(self):
+        config = json.loads(self.bundle(["config"])["config.json"])
+        found = secret_fields(config)
+        self.assertGreater(len(found), 10)
+        for key, value in found:
+            self.assertIn(value, (support.REDACTED, "", None, False), key)
+        # Everything else is kept, so the bundle stays useful
+        self.assertEqual(config["smtp"]["port"], self.config.smtp.port)
+        self.assertEqual(config["smtp"]["relay"]["routes"][0]["domain"], "example.org")
+
+    def test_logs_keep_their_shape(self):
+        logs = self.bundle(["logs"])["logs.txt"].splitlines()
+        self.assertEqual(logs[0], self.log_lines[0])
+        self.assertTrue(logs[1].endswith(f"Session secret is {support.REDACTED}"))
+        self.assertIn(f"password={support.REDACTED}", logs[2])
+        self.assertIn(f"token={support.REDACTED}", logs[3])
+
+    def test_sections_are_optional(self):
+        files = self.bundle(["tables", "integrity"])
+        self.assertEqual(sorted(files), ["integrity.txt", "manifest.json", "tables.json"])
+        self.assertEqual(files["integrity.txt"], "ok\n")
+        self.assertEqual(json.loads(files["tables.json"])["emails"]["rows"], 1)
+        manifest = json.loads(files["manifest.json"])
+        self.assertEqual(manifest["sections"], ["integrity", "tables"])
+        # Rejections name senders and recipients, so they are opt-in
+        self.assertNotIn("rejections", support.DEFAULT_SECTIONS)
+
+
+if __name__ == "__main__":
+    unittest.main()
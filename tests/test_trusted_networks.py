@@ -0,0 +1,137 @@
+"""Clients from trusted networks may send without SMTP AUTH, and no others."""
+
+import socket
+import unittest
+
+from smtp_proxy.config import TrustedNetwork
+from smtp_proxy.database import Database, EmailRepository
+from smtp_proxy.smtp.server import SMTPServer
+from smtp_proxy.smtp.session import trusted_network_name
+
+from .helpers import SMTPClient, TempDirTestCase, make_config, running
+
+
+def ipv6_available() -> bool:
+    try:
+        with socket.socket(socket.AF_INET6) as sock:
+            sock.bind(("::1", 0))
+        return True
+    except OSError:
+        return False
+
+
+class TrustedNetworkNameTest(unittest.TestCase):
+    def assert_matches(self, network: str, inside: list[str], outside: list[str]):
+        networks = [TrustedNetwork(network, "office")]
+        for ip in inside:
+            self.assertEqual(trusted_network_name(ip, networks), "office", f"{ip} in {network}")
+        for ip in outside:
+            self.assertIsNone(trusted_network_name(ip, networks), f"{ip} not in {network}")
+
+    def test_ipv4_boundaries(self):
+        self.assert_matches(
+            "10.0.0.0/8",
+            ["10.0.0.0", "10.0.0.1", "10.255.255.255"],
+            ["9.255.255.255", "11.0.0.0", "110.0.0.1"],
+        )
+        self.assert_matches(
+            "192.168.1.0/24", ["192.168.1.0", "192.168.1.255"], ["192.168.0.255", "192.168.2.0"]
+        )
+        self.assert_matches(
+            "172.16.0.0/12", ["172.16.0.0", "172.31.255.255"], ["172.15.255.255", "172.32.0.0"]
+        )
+
+    def test_single_ipv4_host(self):
+        for network in ("203.0.113.7/32", "203.0.113.7"):
+            self.assert_matches(network, ["203.0.113.7"], ["203.0.113.6", "203.0.113.8"])
+
+    def test_host_bits_are_ignored(self):
+        self.assert_matches("192.168.1.77/24", ["192.168.1.0", "192.168.1.255"], ["192.168.2.1"])
+
+    def test_ipv6_boundaries(self):
+        self.assert_matches(
+            "fd00::/8",
+            ["fd00::", "fd12:3456::1", "fdff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"],
+            ["fcff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "fe00::", "::1"],
+        )
+        self.assert_matches(
+            "2001:db8:abcd::/48",
+            ["2001:db8:abcd::", "2001:db8:abcd:ffff:ffff:ffff:ffff:ffff"],
+            ["2001:db8:abcc:ffff:ffff:ffff:ffff:ffff", "2001:db8:abce::"],
+        )
+
+    def test_single_ipv6_host(self):
+        for network in ("2001:db8::1/128", "2001:db8::1"):
+            self.assert_matches(network, ["2001:db8::1", "2001:DB8:0:0:0:0:0:1"], ["2001:db8::2"])
+
+    def test_ipv4_mapped_clients_match_ipv4_networks(self):
+        self.assert_matches("10.0.0.0/8", ["::ffff:10.1.2.3"], ["::ffff:11.1.2.3"])
+
+    def test_families_do_not_cross(self):
+        # The whole IPv6 space does not take in IPv4 clients, nor the other way round
+        self.assert_matches("::/0", ["::1", "2001:db8::1"], ["10.0.0.1", "::ffff:10.0.0.1"])
+        self.assert_matches("0.0.0.0/0", ["10.0.0.1", "::ffff:10.0.0.1"], ["::1", "fd00::1"])
+
+    def test_first_matching_network_names_the_client(self):
+        networks = [TrustedNetwork("10.1.0.0/16", "lab"), TrustedNetwork("10.0.0.0/8")]
+        self.assertEqual(trusted_network_name("10.1.2.3", networks), "lab")
+        # Unnamed networks are named after themselves
+        self.assertEqual(trusted_network_name("10.2.0.1", networks), "10.0.0.0/8")
+
+    def test_unknown_client(self):
+        networks = [TrustedNetwork("0.0.0.0/0")]
+        for client_ip in ("unknown", "", "10.0.0.1%eth0"):
+            self.assertIsNone(trusted_network_name(client_ip, networks))
+        self.assertIsNone(trusted_network_name("10.0.0.1", []))
+
+
+class TrustedClientTest(TempDirTestCase, unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        super().setUp()
+        self.config = make_config(self.directory)
+        self.config.smtp.auth.required = True
+        self.db = Database(self.config.database.path)
+        self.email_repo = EmailRepository(self.db)
+
+    def tearDown(self):
+        self.db.close()
+        super().tearDown()
+
+    def test_invalid_network_is_refused_by_config(self):
+        self.config.smtp.trusted_networks = [TrustedNetwork("10.0.0.0/33"), TrustedNetwork("lan")]
+        with self.assertRaisesRegex(ValueError, r"Invalid SMTP trusted network: 10\.0\.0\.0/33"):
+            self.config.validate()
+
+    async def send(self, *networks: TrustedNetwork) -> int:
+        self.config.smtp.trusted_networks = list(networks)
+        server = SMTPServer(self.config.smtp, self.email_repo)
+        async with running(server):
+            client = await SMTPClient.connect(server)
+            code, _ = await client.send("a@example.com", "b@example.com", b"Subject: Hi\r\n")
+            await client.close()
+        return code
+
+    async def test_trusted_ipv4_client_sends_without_auth(self):
+        self.assertEqual(await self.send(TrustedNetwork("127.0.0.1/32", "loopback")), 250)
+        self.assertEqual(self.email_repo.get_recent(1)[0].auth_user, "ip:loopback")
+
+    async def test_client_just_outside_needs_auth(self):
+        code = await self.send(TrustedNetwork("127.0.0.2/32"), TrustedNetwork("127.0.0.0/32"))
+        self.assertEqual(code, 530)
+        self.assertEqual(self.email_repo.count(), 0)
+
+    @unittest.skipUnless(ipv6_available(), "IPv6 loopback not available")
+    async def test_trusted_ipv6_client_sends_without_auth(self):
+        self.config.smtp.host = "::1"
+        self.assertEqual(await self.send(TrustedNetwork("::1/128", "loopback6")), 250)
+        self.assertEqual(self.email_repo.get_recent(1)[0].auth_user, "ip:loopback6")
+
+    @unittest.skipUnless(ipv6_available(), "IPv6 loopback not available")
+    async def test_ipv6_client_outside_needs_auth(self):
+        self.config.smtp.host = "::1"
+        code = await self.send(TrustedNetwork("::2/128"), TrustedNetwork("127.0.0.1"))
+        self.assertEqual(code, 530)
+
+
+if __name__ == "__main__":
+    unittest.main()